@@ -0,0 +1,145 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var exportBranch string
+var exportFrom string
+var exportOutput string
+var importName string
+
+func NewCmdExport(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [<dot>] [--branch=<branch>] [--from=<commit>] -o <file.dmx>",
+		Short: `Export a branch of a dot, and its commits, to an archive file`,
+		Long: `Writes the commits on a branch of <dot> (by default, the current dot and
+branch) to an archive file, which can be imported into any cluster with
+'dm import'. Uncommitted changes aren't exported.
+
+With '--from', only the commits after <commit> are exported, and the archive
+can only be imported on top of a dot which already has <commit>.
+
+Example: to give a colleague the master branch of 'postgres', and later just
+what's new since then:
+
+    dm export postgres -o postgres.dmx
+    dm export postgres --from <last commit exported> -o postgres-new.dmx
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if exportOutput == "" {
+					return fmt.Errorf("Please specify a file to export to with -o.")
+				}
+				if len(args) > 1 {
+					return fmt.Errorf("Too many arguments specified.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				volumeName, branchName := "", exportBranch
+				if len(args) == 1 {
+					volumeName = args[0]
+					if branchName == "" {
+						branchName = remotes.DEFAULT_BRANCH
+					}
+				} else {
+					volumeName, err = dm.StrictCurrentVolume()
+					if err != nil {
+						return err
+					}
+					if volumeName == "" {
+						return fmt.Errorf(
+							"No current dot. Try 'dm list' and " +
+								"'dm switch' to switch to a dot.",
+						)
+					}
+					if branchName == "" {
+						branchName, err = dm.CurrentBranch(volumeName)
+						if err != nil {
+							return err
+						}
+					}
+				}
+
+				if exportOutput == "-" {
+					return dm.ExportArchive(volumeName, branchName, exportFrom, out)
+				}
+				file, err := os.Create(exportOutput)
+				if err != nil {
+					return err
+				}
+				err = dm.ExportArchive(volumeName, branchName, exportFrom, file)
+				if err == nil {
+					err = file.Close()
+				} else {
+					file.Close()
+				}
+				if err != nil {
+					// don't leave half an archive lying around
+					os.Remove(exportOutput)
+					return err
+				}
+				fmt.Fprintf(out, "Exported %s (%s) to %s\n", volumeName, branchName, exportOutput)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&exportBranch, "branch", "", "",
+		"Branch to export, by default the current one")
+	cmd.Flags().StringVarP(&exportFrom, "from", "", "",
+		"Only export the commits after this one")
+	cmd.Flags().StringVarP(&exportOutput, "output", "o", "",
+		"File to write the archive to, or '-' for stdout")
+	return cmd
+}
+
+func NewCmdImport(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file.dmx> [--name=<dot>]",
+		Short: `Import a dot from an archive file made by 'dm export'`,
+		Long: `Recreates the branch and commits in an archive on the current remote, as
+the dot they were exported from or as '--name'. If the dot already exists, the
+archive's commits are added to it, so archives exported with '--from' can be
+imported on top of earlier ones.
+
+Example:
+
+    dm import postgres.dmx --name postgres-copy
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one archive file to import.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				var archive io.Reader = os.Stdin
+				if args[0] != "-" {
+					file, err := os.Open(args[0])
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+					archive = file
+				}
+				transferId, err := dm.ImportArchive(archive, importName)
+				if err != nil {
+					return err
+				}
+				return dm.PollTransfer(transferId, out)
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&importName, "name", "", "",
+		"Name to import the dot as, by default the name it was exported as")
+	return cmd
+}
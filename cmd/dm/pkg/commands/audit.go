@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var auditUser string
+var auditMethod string
+var auditDot string
+var auditSince string
+var auditLimit int
+var auditJson bool
+
+func NewCmdAudit(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit [--user=<user>] [--method=<method>] [--dot=<dot>] [--since=<when>] [-n <count>] [--json]",
+		Short: "Show who changed what on the current remote",
+		Long: `Show the latest entries in the audit log, newest first. Every API call which
+changes something (e.g. Commit, Rollback, Delete) and every replication
+request is recorded with who made it, whether they used a password, an API key
+or an API token, where it came from, its arguments (without secrets), how it
+went and how long it took.
+
+For example, to find out who reset a dot:
+
+    dm audit --dot=admin/apples --method=Rollback
+
+The log is kept on each node, and only covers the node the remote points at
+unless the cluster was started with AUDIT_LOG_ETCD=true, which keeps it in
+etcd too. Only the admin user can read it.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("'dm audit' doesn't take arguments, see --help for its options.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				filter := remotes.AuditFilter{
+					User: auditUser, Method: auditMethod, Limit: auditLimit,
+				}
+				if auditDot != "" {
+					namespace, name, err := remotes.ParseNamespacedVolume(auditDot)
+					if err != nil {
+						return err
+					}
+					filter.Dot = namespace + "/" + name
+				}
+				if auditSince != "" {
+					filter.Since, err = parseSince(auditSince)
+					if err != nil {
+						return err
+					}
+				}
+				entries, err := dm.AuditLog(filter)
+				if err != nil {
+					return err
+				}
+				if auditJson {
+					encoder := json.NewEncoder(out)
+					for _, entry := range entries {
+						err = encoder.Encode(entry)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "TIME\tUSER\tAUTH\tFROM\tMETHOD\tDOT\tRESULT\tDURATION\n")
+				for _, entry := range entries {
+					user := entry.User
+					if user == "" {
+						user = entry.UserId
+					}
+					auth := "api-key"
+					if entry.PasswordAuthenticated {
+						auth = "password"
+					} else if entry.Token != "" {
+						auth = "token:" + entry.Token
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.2fs\n",
+						entry.Time.Local().Format("2006-01-02 15:04:05"), user, auth, entry.SourceIP,
+						strings.TrimPrefix(entry.Method, "DotmeshRPC."), entry.Dot, entry.Result,
+						entry.DurationSeconds)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&auditUser, "user", "", "", "Only show what this user did")
+	cmd.Flags().StringVarP(&auditMethod, "method", "", "", "Only show calls of this method, e.g. Rollback")
+	cmd.Flags().StringVarP(&auditDot, "dot", "", "", "Only show what was done to this dot")
+	cmd.Flags().StringVarP(&auditSince, "since", "", "",
+		"Only show entries since a time (RFC 3339) or a duration ago, e.g. '24h'")
+	cmd.Flags().IntVarP(&auditLimit, "limit", "n", 100, "How many entries to show at most")
+	cmd.Flags().BoolVar(&auditJson, "json", false, "Print entries as JSON, with their arguments")
+	return cmd
+}
+
+// A time, or how long ago.
+func parseSince(s string) (time.Time, error) {
+	if ago, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time '%s', try something like '24h' or '2006-01-02T15:04:05Z'", s)
+	}
+	return t, nil
+}
@@ -10,6 +10,9 @@ import (
 )
 
 var cloneLocalVolume string
+var cloneCodec string
+var cloneLimit string
+var cloneCommit string
 
 func NewCmdClone(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
@@ -40,10 +43,16 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 				if err != nil {
 					return err
 				}
+				opts, err := transferOptions(cloneCodec, cloneLimit)
+				if err != nil {
+					return err
+				}
+				opts.TargetCommit = cloneCommit
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					cloneLocalVolume, branchName,
 					filesystemName, branchName,
+					opts,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
@@ -65,6 +74,16 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 
 	cmd.PersistentFlags().StringVarP(&cloneLocalVolume, "local-name", "", "",
 		"Local dot name to create")
+	cmd.PersistentFlags().StringVarP(&cloneCodec, "codec", "", "",
+		"Compress replication streams with 'zstd' (optionally with a level, "+
+			"e.g. 'zstd:6'), 'lz4', 'gzip' or 'none' (for data which is already "+
+			"compressed). By default the servers choose.")
+	cmd.PersistentFlags().StringVarP(&cloneLimit, "limit", "", "",
+		"Limit replication to this many bytes per second, e.g. '512K' or "+
+			"'10M'. By default the servers' REPLICATION_BANDWIDTH_LIMIT applies.")
+	cmd.PersistentFlags().StringVarP(&cloneCommit, "commit", "", "",
+		"Only fetch commits up to this one, a commit id or a tag. By default "+
+			"everything up to the latest commit is fetched.")
 
 	return cmd
 }
@@ -66,6 +66,7 @@ var (
 	dockerApiVersion   string
 	usePoolDir         string
 	usePoolName        string
+	storageBackend     string
 	discoveryUrl       string
 )
 
@@ -75,6 +76,17 @@ var (
 var inheritedEnvironment = []string{
 	"FILESYSTEM_METADATA_TIMEOUT",
 	"EXTRA_HOST_COMMANDS",
+	"REPLICATION_CODECS",
+	"REPLICATION_BANDWIDTH_LIMIT",
+	"AUDIT_LOG_PATH",
+	"AUDIT_LOG_ETCD",
+	"DOTMESH_TLS",
+	"DOTMESH_TLS_CERT",
+	"DOTMESH_TLS_KEY",
+	"DOTMESH_TLS_CA",
+	"DOTMESH_OIDC_ISSUER",
+	"DOTMESH_OIDC_CLIENT_ID",
+	"DOTMESH_OIDC_GROUPS",
 }
 
 var timings map[string]float64
@@ -123,6 +135,7 @@ another.`,
 	cmd.AddCommand(NewCmdClusterJoin(os.Stdout))
 	cmd.AddCommand(NewCmdClusterReset(os.Stdout))
 	cmd.AddCommand(NewCmdClusterUpgrade(os.Stdout))
+	cmd.AddCommand(NewCmdClusterSchedule(os.Stdout))
 	cmd.PersistentFlags().StringVar(
 		&traceAddr, "trace", "",
 		"Hostname for Zipkin host to enable distributed tracing",
@@ -162,6 +175,12 @@ another.`,
 		&usePoolName, "use-pool-name",
 		"", "name of pool to import or create; useful for testing",
 	)
+	cmd.PersistentFlags().StringVar(
+		&storageBackend, "storage-backend",
+		"zfs", "where to store dots: 'zfs', 'btrfs' for hosts whose "+
+			"/var/lib/dotmesh is on btrfs, or 'directory' for hosts which "+
+			"can't load ZFS (no copy-on-write, so commits use more disk)",
+	)
 	cmd.PersistentFlags().StringVar(
 		&discoveryUrl, "discovery-url",
 		"https://discovery.dotmesh.io", "URL of discovery service. "+
@@ -563,6 +582,7 @@ func startDotmeshContainer(pkiPath string) error {
 		// Allow tests to specify which pool to create and where.
 		"-e", fmt.Sprintf("USE_POOL_NAME=%s", usePoolName),
 		"-e", fmt.Sprintf("USE_POOL_DIR=%s", usePoolDir),
+		"-e", fmt.Sprintf("STORAGE_BACKEND=%s", storageBackend),
 		// In case the docker daemon is older than the bundled docker client in
 		// the dotmesh-server image, at least allow the user to instruct it to
 		// fall back to an older API version.
@@ -785,7 +805,18 @@ func clusterCommonSetup(clusterUrl, adminPassword, adminKey, pkiPath, clusterSec
 	if err != nil {
 		return err
 	}
-	err = config.AddRemote("local", "admin", getHostFromEnv(), adminKey)
+	// our server uses the cluster's certificate unless it's been given
+	// another one
+	useTLS := os.Getenv("DOTMESH_TLS") != "off"
+	caCert := ""
+	if useTLS && os.Getenv("DOTMESH_TLS_CERT") == "" {
+		caCertBytes, err := ioutil.ReadFile(filepath.Join(pkiPath, "ca.pem"))
+		if err != nil {
+			return err
+		}
+		caCert = string(caCertBytes)
+	}
+	err = config.AddRemote("local", "admin", getHostFromEnv(), adminKey, useTLS, caCert)
 	if err != nil {
 		return err
 	}
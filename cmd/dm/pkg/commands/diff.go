@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var diffStat bool
+var diffNameOnly bool
+var diffSubdot string
+
+func NewCmdDiff(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [<ref>] [<ref>] [--stat|--name-only] [--subdot=<subdot>]",
+		Short: "Show the files changed between commits, or since a commit",
+		Long: `Show the files which were added, removed, modified or renamed in the
+current branch between two commits, or between one commit (HEAD if none is
+given) and the current state of the dot. A <ref> is a commit id, a tag, or
+HEAD followed by a '^' for each commit back from the latest, and may be a
+commit from before the branch was made.
+
+Files are compared by size and modification time, not their contents. Paths
+start with the subdot the file is in ('__default__' for the one used by plain
+dot names), unless '--subdot' picks one.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if diffStat && diffNameOnly {
+					return fmt.Errorf("Please specify at most one of --stat and --name-only.")
+				}
+				if len(args) > 2 {
+					return fmt.Errorf("Please specify at most two refs.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				dot, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				branch, err := dm.CurrentBranch(dot)
+				if err != nil {
+					return err
+				}
+				from, to := "HEAD", ""
+				if len(args) > 0 {
+					from = args[0]
+				}
+				if len(args) > 1 {
+					to = args[1]
+				}
+				diff, err := dm.Diff(dot, branch, from, to, diffSubdot)
+				if err != nil {
+					return err
+				}
+				switch {
+				case diffNameOnly:
+					for _, change := range diff.Changes {
+						fmt.Fprintln(out, change.Path)
+					}
+				case diffStat:
+					printDiffStat(out, diff.Changes)
+				default:
+					printDiff(out, diff.Changes)
+				}
+				if diff.Truncated {
+					fmt.Fprintf(out, "(only the first %d changes are shown)\n", len(diff.Changes))
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&diffStat, "stat", "", false,
+		"Show how the size of each file changed, and a summary")
+	cmd.Flags().BoolVarP(&diffNameOnly, "name-only", "", false,
+		"Only show the paths of the files which changed")
+	cmd.Flags().StringVarP(&diffSubdot, "subdot", "", "",
+		"Only show changes in this subdot")
+	return cmd
+}
+
+func printDiff(out io.Writer, changes []remotes.FileChange) {
+	w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	for _, change := range changes {
+		switch change.Change {
+		case "added":
+			fmt.Fprintf(w, "added\t%s\t%s\n", change.Path, prettyPrintSize(change.Size))
+		case "removed":
+			fmt.Fprintf(w, "removed\t%s\t%s\n", change.Path, prettyPrintSize(change.OldSize))
+		case "renamed":
+			fmt.Fprintf(w, "renamed\t%s -> %s\t%s\n",
+				change.OldPath, change.Path, prettyPrintSize(change.Size))
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s -> %s\n", change.Change, change.Path,
+				prettyPrintSize(change.OldSize), prettyPrintSize(change.Size))
+		}
+	}
+	w.Flush()
+}
+
+func printDiffStat(out io.Writer, changes []remotes.FileChange) {
+	w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	counts := map[string]int{}
+	var delta int64
+	for _, change := range changes {
+		counts[change.Change]++
+		delta += change.Size - change.OldSize
+		path := change.Path
+		if change.OldPath != "" {
+			path = change.OldPath + " -> " + change.Path
+		}
+		fmt.Fprintf(w, " %s\t| %s\n", path, signedSize(change.Size-change.OldSize))
+	}
+	w.Flush()
+	fmt.Fprintf(out, " %d files changed (%d added, %d removed, %d modified, %d renamed), %s in total\n",
+		len(changes), counts["added"], counts["removed"], counts["modified"],
+		counts["renamed"], signedSize(delta),
+	)
+}
+
+func signedSize(size int64) string {
+	switch {
+	case size > 0:
+		return "+" + prettyPrintSize(size)
+	case size < 0:
+		return "-" + prettyPrintSize(-size)
+	default:
+		return "0"
+	}
+}
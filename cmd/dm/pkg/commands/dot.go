@@ -83,6 +83,15 @@ change the default remote dot for <dot> on <remote>.
 
 Run 'dm dot show [<dot>]' to show information about the dot.
 
+Run 'dm dot policy set [<dot>] --commit-every=<interval> ...' to commit
+automatically and expire old automatic commits.
+
+Run 'dm dot hook add [<dot>[.<subdot>]] --pre|--post ...' to run a command in
+the dot's containers (or signal them, or call a webhook) around each commit.
+
+Run 'dm dot share [<dot>] <user> --role=reader|writer|maintainer' to let
+another user work on the dot, and 'dm dot unshare [<dot>] <user>' to stop.
+
 Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
 is used.`,
 	}
@@ -90,6 +99,10 @@ is used.`,
 	cmd.AddCommand(NewCmdDotSetUpstream(os.Stdout))
 	cmd.AddCommand(NewCmdDotShow(os.Stdout))
 	cmd.AddCommand(NewCmdDotDelete(os.Stdout))
+	cmd.AddCommand(NewCmdDotPolicy(os.Stdout))
+	cmd.AddCommand(NewCmdDotHook(os.Stdout))
+	cmd.AddCommand(NewCmdDotShare(os.Stdout))
+	cmd.AddCommand(NewCmdDotUnshare(os.Stdout))
 
 	return cmd
 }
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var filesCommit string
+var filesSubdot string
+var lsLong bool
+var catTar bool
+
+const filesHelp = `Paths start from the root of the dot, so begin with the subdot a file is
+in ('__default__' for the one used by plain dot names), unless '--subdot'
+picks one. '--commit' takes a commit id, a tag, or HEAD followed by a '^' for
+each commit back from the latest, and defaults to the latest commit on the
+current branch. Symlinks aren't followed.`
+
+func NewCmdLs(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls [<path>] [--commit=<ref>] [--subdot=<subdot>] [-l]",
+		Short: "List the files in a commit of the current dot",
+		Long: `List the files in a directory as it was in a commit of the current
+branch, without rolling back to it.
+
+` + filesHelp,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one path.")
+				}
+				dm, dot, branch, err := filesDot()
+				if err != nil {
+					return err
+				}
+				p := ""
+				if len(args) == 1 {
+					p = args[0]
+				}
+				files, err := dm.ListFiles(dot, branch, filesCommit, path.Join(filesSubdot, p))
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				for _, file := range files {
+					name := file.Name
+					switch file.Type {
+					case "dir":
+						name += "/"
+					case "symlink":
+						name += " -> " + file.LinkTarget
+					}
+					if lsLong {
+						fmt.Fprintf(w, "%s\t%d\t%s\t%s\n",
+							file.Mode, file.Size, file.ModTime.Format("2006-01-02 15:04"), name)
+					} else {
+						fmt.Fprintln(w, name)
+					}
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&filesCommit, "commit", "", "HEAD", "The commit to list the files in")
+	cmd.Flags().StringVarP(&filesSubdot, "subdot", "", "", "List the files in this subdot")
+	cmd.Flags().BoolVarP(&lsLong, "long", "l", false, "Show modes, sizes and modification times")
+	return cmd
+}
+
+func NewCmdCat(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cat <path> [--commit=<ref>] [--subdot=<subdot>] [--tar]",
+		Short: "Print a file from a commit of the current dot",
+		Long: `Write the contents of a file as it was in a commit of the current branch
+to stdout, without rolling back to it. With '--tar', write a tar of it, or
+of everything in it if it's a directory, instead.
+
+Example: to get the whole of the default subdot as it was in the commit
+before the latest:
+
+    dm cat __default__ --commit=HEAD^ --tar > backup.tar
+
+` + filesHelp,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one path.")
+				}
+				dm, dot, branch, err := filesDot()
+				if err != nil {
+					return err
+				}
+				return dm.ReadFile(dot, branch, filesCommit, path.Join(filesSubdot, args[0]), catTar, out)
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&filesCommit, "commit", "", "HEAD", "The commit to read the file from")
+	cmd.Flags().StringVarP(&filesSubdot, "subdot", "", "", "Read the file from this subdot")
+	cmd.Flags().BoolVarP(&catTar, "tar", "", false, "Write a tar of the file or directory")
+	return cmd
+}
+
+func filesDot() (*remotes.DotmeshAPI, string, string, error) {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	dot, err := dm.StrictCurrentVolume()
+	if err != nil {
+		return nil, "", "", err
+	}
+	branch, err := dm.CurrentBranch(dot)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return dm, dot, branch, nil
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var hookPre bool
+var hookPost bool
+var hookExec string
+var hookSignal string
+var hookWebhook string
+var hookTimeout string
+var hookOnFailure string
+
+func NewCmdDotHook(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hook",
+		Short: "Manage the hooks run when a dot is committed",
+		Long: `Add, list or clear hooks which run before ('--pre') and after ('--post') a
+dot is committed, so that e.g. a database can be told to flush its files to
+disk and hold off writing while the commit's snapshot is taken.
+
+A hook runs a command in each of the running containers using the dot (or
+just those using <subdot>), sends them a signal, or POSTs to a webhook. If a
+pre hook fails, the commit fails (after running the post hooks); if a post
+hook fails, the commit goes ahead. '--on-failure' changes that. What the hooks
+did is shown in 'dm log'.
+
+Example: to checkpoint Postgres before committing:
+
+    dm dot hook add postgres --pre --exec='psql -U postgres -c CHECKPOINT'
+
+Only the admin user can add or clear hooks. Where '[<dot>]' is omitted, the
+current dot (selected by 'dm switch') is used.`,
+	}
+	cmd.AddCommand(NewCmdDotHookAdd(out))
+	cmd.AddCommand(NewCmdDotHookList(out))
+	cmd.AddCommand(NewCmdDotHookClear(out))
+	return cmd
+}
+
+func NewCmdDotHookAdd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add [<dot>[.<subdot>]] --pre|--post --exec=<command>|--signal=<signal>|--webhook=<url> [--timeout=<duration>] [--on-failure=abort|proceed]",
+		Short: "Add a hook to run when a dot is committed",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if hookPre == hookPost {
+					return fmt.Errorf("Please specify one of --pre and --post.")
+				}
+				subdot := ""
+				if len(args) == 1 && strings.Contains(args[0], ".") {
+					shrapnel := strings.SplitN(args[0], ".", 2)
+					args = []string{shrapnel[0]}
+					subdot = shrapnel[1]
+				}
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				hook := remotes.CommitHook{
+					When:      "post",
+					Subdot:    subdot,
+					Exec:      hookExec,
+					Signal:    hookSignal,
+					Webhook:   hookWebhook,
+					Timeout:   hookTimeout,
+					OnFailure: hookOnFailure,
+				}
+				if hookPre {
+					hook.When = "pre"
+				}
+				hooks, err := dm.GetCommitHooks(dot)
+				if err != nil {
+					return err
+				}
+				return dm.SetCommitHooks(dot, append(hooks, hook))
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&hookPre, "pre", "", false, "Run the hook before the commit")
+	cmd.Flags().BoolVarP(&hookPost, "post", "", false, "Run the hook after the commit")
+	cmd.Flags().StringVarP(&hookExec, "exec", "", "",
+		"Command to run (with sh -c) in each container using the dot")
+	cmd.Flags().StringVarP(&hookSignal, "signal", "", "",
+		"Signal to send to each container using the dot, e.g. 'SIGUSR1'")
+	cmd.Flags().StringVarP(&hookWebhook, "webhook", "", "",
+		"URL to POST details of the commit to")
+	cmd.Flags().StringVarP(&hookTimeout, "timeout", "", "",
+		"How long to wait for the hook, e.g. '30s' (default 1m)")
+	cmd.Flags().StringVarP(&hookOnFailure, "on-failure", "", "",
+		"'abort' or 'proceed' with the commit if the hook fails")
+	return cmd
+}
+
+func NewCmdDotHookList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [<dot>]",
+		Short: "List the hooks run when a dot is committed",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				hooks, err := dm.GetCommitHooks(dot)
+				if err != nil {
+					return err
+				}
+				if len(hooks) == 0 {
+					fmt.Fprintf(out, "%s has no hooks.\n", dot)
+					return nil
+				}
+				for _, hook := range hooks {
+					target := dot
+					if hook.Subdot != "" {
+						target += "." + hook.Subdot
+					}
+					var action string
+					switch {
+					case hook.Exec != "":
+						action = fmt.Sprintf("exec %q", hook.Exec)
+					case hook.Signal != "":
+						action = "signal " + hook.Signal
+					default:
+						action = "webhook " + hook.Webhook
+					}
+					fmt.Fprintf(out, "%s\t%s\t%s", hook.When, target, action)
+					if hook.Timeout != "" {
+						fmt.Fprintf(out, "\ttimeout %s", hook.Timeout)
+					}
+					if hook.OnFailure != "" {
+						fmt.Fprintf(out, "\ton failure %s", hook.OnFailure)
+					}
+					fmt.Fprintf(out, "\n")
+				}
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdDotHookClear(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "clear [<dot>]",
+		Short: "Remove all of a dot's hooks",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				return dm.SetCommitHooks(dot, []remotes.CommitHook{})
+			})
+		},
+	}
+	return cmd
+}
@@ -57,14 +57,26 @@ func Initialise() {
 	MainCmd.AddCommand(NewCmdSwitch(os.Stdout))
 	MainCmd.AddCommand(NewCmdCommit(os.Stdout))
 	MainCmd.AddCommand(NewCmdLog(os.Stdout))
+	MainCmd.AddCommand(NewCmdTag(os.Stdout))
+	MainCmd.AddCommand(NewCmdDiff(os.Stdout))
+	MainCmd.AddCommand(NewCmdLs(os.Stdout))
+	MainCmd.AddCommand(NewCmdCat(os.Stdout))
 	MainCmd.AddCommand(NewCmdBranch(os.Stdout))
 	MainCmd.AddCommand(NewCmdCheckout(os.Stdout))
 	MainCmd.AddCommand(NewCmdReset(os.Stdout))
 	MainCmd.AddCommand(NewCmdClone(os.Stdout))
 	MainCmd.AddCommand(NewCmdPull(os.Stdout))
 	MainCmd.AddCommand(NewCmdPush(os.Stdout))
+	MainCmd.AddCommand(NewCmdCancel(os.Stdout))
+	MainCmd.AddCommand(NewCmdExport(os.Stdout))
+	MainCmd.AddCommand(NewCmdImport(os.Stdout))
 	MainCmd.AddCommand(NewCmdDebug(os.Stdout))
 	MainCmd.AddCommand(NewCmdDot(os.Stdout))
+	MainCmd.AddCommand(NewCmdWatch(os.Stdout))
+	MainCmd.AddCommand(NewCmdWebhook(os.Stdout))
+	MainCmd.AddCommand(NewCmdAudit(os.Stdout))
+	MainCmd.AddCommand(NewCmdToken(os.Stdout))
+	MainCmd.AddCommand(NewCmdOrg(os.Stdout))
 	MainCmd.AddCommand(NewCmdVersion(os.Stdout))
 
 	MainCmd.PersistentFlags().StringVarP(
@@ -106,6 +118,13 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 						} else {
 							current = "  "
 						}
+						if s3 := remotes[k].S3; s3 != nil {
+							fmt.Fprintf(
+								out, "%s%s\ts3://%s/%s (%s)\n",
+								current, k, s3.Bucket, s3.Prefix, s3.Endpoint,
+							)
+							continue
+						}
 						fmt.Fprintf(
 							out, "%s%s\t%s@%s\n",
 							current, k, remotes[k].User, remotes[k].Hostname,
@@ -120,10 +139,30 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 			})
 		},
 	}
-	cmd.AddCommand(&cobra.Command{
-		Use:   "add <remote-name> <user@cluster-hostname>",
+	var s3Endpoint, s3Region string
+	var oidcLogin, insecureHttp bool
+	var caCertFile string
+	addCmd := &cobra.Command{
+		Use:   "add <remote-name> <user@cluster-hostname> | <remote-name> <cluster-hostname> --oidc | <remote-name> s3://<bucket>[/<prefix>] [--endpoint=<url>]",
 		Short: "Add a remote",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#add-a-new-remote-dm-remote-add-name-user-hostname",
+		Long: `Add a remote cluster, or an S3 bucket to push dots to and pull them from.
+
+For an S3 bucket, the access key and secret key are read from
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or asked for. --endpoint points
+at anything else which speaks the S3 API, e.g. http://localhost:9000 for MinIO.
+
+With --oidc, log in with the OpenID Connect provider the cluster is configured
+to use instead of giving a user and API key: you'll be told where to go to log
+in, and your user is made the first time you do.
+
+Clusters are talked to over HTTPS. If a cluster's certificate isn't signed by
+one of the usual CAs, e.g. it's one 'dm cluster init' made, the CA it presents
+is trusted and its fingerprint is shown, unless --ca-cert says which CA to
+trust. --insecure-http talks to clusters which don't speak HTTPS yet without
+checking; while clusters are moving to HTTPS, that's also what happens (with a
+warning) when they don't, unless DOTMESH_TLS=on.
+
+Online help: https://docs.dotmesh.com/references/cli/#add-a-new-remote-dm-remote-add-name-user-hostname`,
 
 		Run: func(cmd *cobra.Command, args []string) {
 			runHandlingError(func() error {
@@ -133,21 +172,45 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 					)
 				}
 				remote := args[0]
+				if strings.HasPrefix(args[1], "s3://") {
+					return addS3Remote(out, remote, args[1], s3Endpoint, s3Region)
+				}
+				var user, hostname, apiKey string
 				shrapnel := strings.SplitN(args[1], "@", 2)
-				if len(shrapnel) != 2 {
+				if oidcLogin {
+					// the provider says who the user is
+					hostname = shrapnel[len(shrapnel)-1]
+				} else if len(shrapnel) != 2 {
 					return fmt.Errorf(
 						"Please specify user@cluster-hostname, got %s", shrapnel,
 					)
+				} else {
+					user = shrapnel[0]
+					hostname = shrapnel[1]
+					// allow this to be used be a script
+					apiKey = os.Getenv("DOTMESH_PASSWORD")
 				}
-				user := shrapnel[0]
-				hostname := shrapnel[1]
 				dm, err := remotes.NewDotmeshAPI(configPath)
 				if err != nil {
 					return err
 				}
-				// allow this to be used be a script
-				apiKey := os.Getenv("DOTMESH_PASSWORD")
-				if apiKey == "" {
+				client := &remotes.JsonRpcClient{
+					Hostname: hostname,
+					TLS:      !insecureHttp,
+				}
+				if !insecureHttp {
+					client.TLS, client.CACert, err = remotes.ProbeTLS(hostname, caCertFile, out)
+					if err != nil {
+						return err
+					}
+				}
+				if oidcLogin {
+					user, apiKey, err = remotes.OidcLogin(client, out)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Logged in as %s.\n", user)
+				} else if apiKey == "" {
 					fmt.Printf("API key: ")
 					enteredApiKey, err := gopass.GetPasswd()
 					fmt.Printf("\n")
@@ -156,17 +219,16 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 					}
 					apiKey = string(enteredApiKey)
 				}
-				client := &remotes.JsonRpcClient{
-					User:     user,
-					Hostname: hostname,
-					ApiKey:   apiKey,
-				}
+				client.User = user
+				client.ApiKey = apiKey
 				var result bool
 				err = client.CallRemote(context.Background(), "DotmeshRPC.Ping", nil, &result)
 				if err != nil {
 					return err
 				}
-				err = dm.Configuration.AddRemote(remote, user, hostname, string(apiKey))
+				err = dm.Configuration.AddRemote(
+					remote, user, hostname, string(apiKey), client.TLS, client.CACert,
+				)
 				if err != nil {
 					return err
 				}
@@ -182,7 +244,18 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 				return nil
 			})
 		},
-	})
+	}
+	addCmd.Flags().StringVarP(&s3Endpoint, "endpoint", "", "https://s3.amazonaws.com",
+		"S3 endpoint URL, for s3:// remotes")
+	addCmd.Flags().StringVarP(&s3Region, "region", "", "us-east-1",
+		"S3 region, for s3:// remotes")
+	addCmd.Flags().BoolVarP(&oidcLogin, "oidc", "", false,
+		"Log in with the cluster's OpenID Connect provider")
+	addCmd.Flags().StringVarP(&caCertFile, "ca-cert", "", "",
+		"A PEM file with the CA certificate to check the cluster's certificate with")
+	addCmd.Flags().BoolVarP(&insecureHttp, "insecure-http", "", false,
+		"Talk to the cluster with plain HTTP, which sends your API key and data unencrypted")
+	cmd.AddCommand(addCmd)
 	cmd.AddCommand(&cobra.Command{
 		Use:   "rm <remote>",
 		Short: "Remove a remote",
@@ -226,6 +299,49 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 	return cmd
 }
 
+func addS3Remote(out io.Writer, remote, url, endpoint, region string) error {
+	shrapnel := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if shrapnel[0] == "" {
+		return fmt.Errorf("Please specify s3://<bucket>[/<prefix>], got %s", url)
+	}
+	s3 := remotes.S3Remote{
+		Endpoint:  endpoint,
+		Region:    region,
+		Bucket:    shrapnel[0],
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if len(shrapnel) == 2 {
+		s3.Prefix = strings.Trim(shrapnel[1], "/")
+	}
+	if s3.AccessKey == "" {
+		fmt.Printf("Access key: ")
+		_, err := fmt.Scanln(&s3.AccessKey)
+		if err != nil {
+			return err
+		}
+	}
+	if s3.SecretKey == "" {
+		fmt.Printf("Secret key: ")
+		secretKey, err := gopass.GetPasswd()
+		fmt.Printf("\n")
+		if err != nil {
+			return err
+		}
+		s3.SecretKey = string(secretKey)
+	}
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+	err = dm.Configuration.AddS3Remote(remote, s3)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Remote added.")
+	return nil
+}
+
 func NewCmdCheckout(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "checkout",
@@ -540,11 +656,26 @@ func NewCmdLog(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				tags, err := dm.Tags(activeVolume)
+				if err != nil {
+					return err
+				}
+				tagsOf := map[string][]string{}
+				for _, tag := range tags {
+					tagsOf[tag.Commit] = append(tagsOf[tag.Commit], tag.Name)
+				}
 				for _, commit := range commits {
-					fmt.Fprintf(out, "commit %s\n", commit.Id)
+					if names, ok := tagsOf[commit.Id]; ok {
+						fmt.Fprintf(out, "commit %s (tag: %s)\n", commit.Id, strings.Join(names, ", "))
+					} else {
+						fmt.Fprintf(out, "commit %s\n", commit.Id)
+					}
 					fmt.Fprintf(out, "Author: %s\n", (*commit.Metadata)["author"])
 					fmt.Fprintf(out, "Date: %s\n\n", (*commit.Metadata)["timestamp"])
 					fmt.Fprintf(out, "    %s\n\n", (*commit.Metadata)["message"])
+					if hooks := (*commit.Metadata)["hooks"]; hooks != "" {
+						fmt.Fprintf(out, "Hooks:\n    %s\n\n", strings.Replace(hooks, "\n", "\n    ", -1))
+					}
 				}
 				return nil
 			}()
@@ -580,13 +711,19 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				protected, err := dm.BranchProtections(v)
+				if err != nil {
+					return err
+				}
 				for _, branch := range bs {
+					line := "  " + branch
 					if branch == b {
-						branch = "* " + branch
-					} else {
-						branch = "  " + branch
+						line = "* " + branch
+					}
+					if protection, ok := protected[branch]; ok {
+						line += " (protected: " + protection.String() + ")"
 					}
-					fmt.Fprintf(out, "%s\n", branch)
+					fmt.Fprintf(out, "%s\n", line)
 				}
 				return nil
 			}()
@@ -596,6 +733,8 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 			}
 		},
 	}
+	cmd.AddCommand(NewCmdBranchProtect(out))
+	cmd.AddCommand(NewCmdBranchUnprotect(out))
 	return cmd
 }
 
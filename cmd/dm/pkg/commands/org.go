@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var orgMemberRole string
+
+func NewCmdOrg(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "org",
+		Short: "Manage organizations, namespaces which belong to a team",
+		Long: `Create organizations and manage their members. An organization is a namespace
+like a user's, e.g. 'acme/website', but its dots belong to the whole team.
+Each member has a role, which applies to all of the organization's dots:
+
+    reader  can see and pull them
+    writer  can also change them, e.g. push, tag and set policies
+    admin   can also administer them and the namespace, e.g. create dots,
+            delete them and manage webhooks
+    owner   can also manage the organization's members
+
+Whoever creates an organization is its first owner.`,
+	}
+	cmd.AddCommand(NewCmdOrgCreate(out))
+	cmd.AddCommand(NewCmdOrgList(out))
+	cmd.AddCommand(NewCmdOrgAddMember(out))
+	cmd.AddCommand(NewCmdOrgRemoveMember(out))
+	return cmd
+}
+
+func NewCmdOrgCreate(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an organization",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the organization's name.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				org, err := dm.CreateOrganization(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Created organization %s\n", org.Name)
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdOrgList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the organizations you're a member of, and their members",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				orgs, err := dm.Organizations()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "ORGANIZATION\tMEMBER\tROLE\n")
+				for _, org := range orgs {
+					for _, member := range org.Members {
+						user := member.User
+						if user == "" {
+							user = member.UserId
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\n", org.Name, user, member.Role)
+					}
+				}
+				return w.Flush()
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdOrgAddMember(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add-member <organization> <user> [--role=reader|writer|admin|owner]",
+		Short: "Add a user to an organization, or change their role in it",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("Please specify the organization and the user to add.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				_, err = dm.AddOrganizationMember(args[0], args[1], orgMemberRole)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s is now %s of %s\n", args[1], withArticle(orgMemberRole), args[0])
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&orgMemberRole, "role", "", "writer",
+		"The user's role: reader, writer, admin or owner")
+	return cmd
+}
+
+func NewCmdOrgRemoveMember(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove-member <organization> <user>",
+		Short: "Remove a user from an organization",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("Please specify the organization and the user to remove.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				_, err = dm.RemoveOrganizationMember(args[0], args[1])
+				return err
+			})
+		},
+	}
+	return cmd
+}
+
+func withArticle(role string) string {
+	if role == "owner" || role == "admin" {
+		return "an " + role
+	}
+	return "a " + role
+}
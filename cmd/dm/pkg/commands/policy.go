@@ -0,0 +1,173 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var policyCommitEvery string
+var policyKeepHourly int
+var policyKeepDaily int
+var policyKeepWeekly int
+
+func NewCmdDotPolicy(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Manage a dot's automatic commits",
+		Long: `Show, set or clear the policy for committing a dot automatically, and for
+how long to keep those commits. A policy applies to all of the dot's branches.
+Automatic commits are only made when something has changed, and commits made
+with 'dm commit' are never expired.
+
+Example: to commit every 15 minutes and keep the latest automatic commit from
+each of the last 24 hours, 7 days and 4 weeks:
+
+    dm dot policy set postgres --commit-every=15m --keep-hourly=24 \
+        --keep-daily=7 --keep-weekly=4
+
+Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
+is used.`,
+	}
+	cmd.AddCommand(NewCmdDotPolicySet(out))
+	cmd.AddCommand(NewCmdDotPolicyShow(out))
+	cmd.AddCommand(NewCmdDotPolicyClear(out))
+	return cmd
+}
+
+func NewCmdDotPolicySet(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set [<dot>] [--commit-every=<interval>] [--keep-hourly=<n>] [--keep-daily=<n>] [--keep-weekly=<n>]",
+		Short: "Set a dot's policy, replacing any it already has",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				policy := remotes.SnapshotPolicy{
+					CommitEvery: policyCommitEvery,
+					KeepHourly:  policyKeepHourly,
+					KeepDaily:   policyKeepDaily,
+					KeepWeekly:  policyKeepWeekly,
+				}
+				if policy == (remotes.SnapshotPolicy{}) {
+					return fmt.Errorf(
+						"Please specify at least one of --commit-every, --keep-hourly, " +
+							"--keep-daily and --keep-weekly, or use 'dm dot policy clear'.",
+					)
+				}
+				err = dm.SetPolicy(dot, policy)
+				if err != nil {
+					return err
+				}
+				return printPolicy(out, dot, policy)
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&policyCommitEvery, "commit-every", "", "",
+		"Commit automatically this often, e.g. '15m' or '1h'")
+	cmd.Flags().IntVarP(&policyKeepHourly, "keep-hourly", "", 0,
+		"Keep an automatic commit from each of this many recent hours")
+	cmd.Flags().IntVarP(&policyKeepDaily, "keep-daily", "", 0,
+		"Keep an automatic commit from each of this many recent days")
+	cmd.Flags().IntVarP(&policyKeepWeekly, "keep-weekly", "", 0,
+		"Keep an automatic commit from each of this many recent weeks")
+	return cmd
+}
+
+func NewCmdDotPolicyShow(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show [<dot>]",
+		Short: "Show a dot's policy",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				policy, err := dm.GetPolicy(dot)
+				if err != nil {
+					return err
+				}
+				return printPolicy(out, dot, policy)
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdDotPolicyClear(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "clear [<dot>]",
+		Short: "Stop committing a dot automatically, keeping the commits already made",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, err := policyDot(args)
+				if err != nil {
+					return err
+				}
+				return dm.SetPolicy(dot, remotes.SnapshotPolicy{})
+			})
+		},
+	}
+	return cmd
+}
+
+func policyDot(args []string) (*remotes.DotmeshAPI, string, error) {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+	switch len(args) {
+	case 0:
+		dot, err := dm.CurrentVolume()
+		if err != nil {
+			return nil, "", err
+		}
+		if dot == "" {
+			return nil, "", fmt.Errorf(
+				"No current dot. Try 'dm list' and 'dm switch' to switch to a dot.",
+			)
+		}
+		return dm, dot, nil
+	case 1:
+		return dm, args[0], nil
+	default:
+		return nil, "", fmt.Errorf("Too many arguments specified.")
+	}
+}
+
+func printPolicy(out io.Writer, dot string, policy remotes.SnapshotPolicy) error {
+	if policy == (remotes.SnapshotPolicy{}) {
+		fmt.Fprintf(out, "%s has no policy.\n", dot)
+		return nil
+	}
+	if policy.CommitEvery != "" {
+		fmt.Fprintf(out, "%s is committed every %s.\n", dot, policy.CommitEvery)
+	} else {
+		fmt.Fprintf(out, "%s isn't committed automatically.\n", dot)
+	}
+	keep := []string{}
+	for _, k := range []struct {
+		n    int
+		unit string
+	}{
+		{policy.KeepHourly, "hourly"},
+		{policy.KeepDaily, "daily"},
+		{policy.KeepWeekly, "weekly"},
+	} {
+		if k.n > 0 {
+			keep = append(keep, fmt.Sprintf("%d %s", k.n, k.unit))
+		}
+	}
+	if len(keep) == 0 {
+		fmt.Fprintf(out, "Automatic commits are kept forever.\n")
+	} else {
+		fmt.Fprintf(out, "Keeping %s automatic commits.\n", strings.Join(keep, ", "))
+	}
+	return nil
+}
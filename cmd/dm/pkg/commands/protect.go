@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var protection remotes.BranchProtection
+
+func NewCmdBranchProtect(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "protect [<branch>] [--no-rollback] [--no-diverged-push] [--no-delete] [--owner-only-commit]",
+		Short: "Protect a branch of the current dot",
+		Long: `Protect <branch> (the current branch if it's not given) of the current dot
+from changes which would lose commits, replacing any protection it already
+has. Only the dot's owner can protect branches. With no flags, all of these
+apply:
+
+  --no-rollback        the branch can't be reset, and policies don't
+                       expire its automatic commits
+  --no-diverged-push   pushes and pulls into the branch must fast-forward it
+  --no-delete          the dot can't be deleted
+  --owner-only-commit  only the dot's owner can commit to the branch
+
+Example: to stop anyone resetting master or deleting the dot, but still let
+collaborators commit:
+
+    dm branch protect master --no-rollback --no-diverged-push --no-delete`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, branch, err := protectedBranch(args)
+				if err != nil {
+					return err
+				}
+				p := protection
+				if p == (remotes.BranchProtection{}) {
+					p = remotes.BranchProtection{
+						NoRollback: true, NoDivergedPush: true, NoDelete: true, OwnerOnlyCommit: true,
+					}
+				}
+				err = dm.SetBranchProtection(dot, branch, p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Protected %s (%s)\n", branch, p)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&protection.NoRollback, "no-rollback", "", false,
+		"Don't allow the branch to be reset")
+	cmd.Flags().BoolVarP(&protection.NoDivergedPush, "no-diverged-push", "", false,
+		"Only allow pushes and pulls which fast-forward the branch")
+	cmd.Flags().BoolVarP(&protection.NoDelete, "no-delete", "", false,
+		"Don't allow the dot to be deleted")
+	cmd.Flags().BoolVarP(&protection.OwnerOnlyCommit, "owner-only-commit", "", false,
+		"Only allow the dot's owner to commit to the branch")
+	return cmd
+}
+
+func NewCmdBranchUnprotect(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "unprotect [<branch>]",
+		Short: "Remove the protection from a branch of the current dot",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, branch, err := protectedBranch(args)
+				if err != nil {
+					return err
+				}
+				err = dm.SetBranchProtection(dot, branch, remotes.BranchProtection{})
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Unprotected %s\n", branch)
+				return nil
+			})
+		},
+	}
+}
+
+// The current dot, and the branch named in args or the current one.
+func protectedBranch(args []string) (*remotes.DotmeshAPI, string, string, error) {
+	if len(args) > 1 {
+		return nil, "", "", fmt.Errorf("Please specify at most one branch.")
+	}
+	dm, dot, branch, err := filesDot()
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(args) == 1 {
+		branch = args[0]
+	}
+	return dm, dot, branch, nil
+}
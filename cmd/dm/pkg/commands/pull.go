@@ -10,6 +10,9 @@ import (
 )
 
 var pullRemoteVolume string
+var pullCodec string
+var pullLimit string
+var pullCommit string
 
 func NewCmdPull(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
@@ -44,10 +47,16 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 				if err != nil {
 					return err
 				}
+				opts, err := transferOptions(pullCodec, pullLimit)
+				if err != nil {
+					return err
+				}
+				opts.TargetCommit = pullCommit
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					filesystemName, branchName,
 					pullRemoteVolume, branchName,
+					opts,
 				)
 				if err != nil {
 					return err
@@ -67,6 +76,16 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 
 	cmd.PersistentFlags().StringVarP(&pullRemoteVolume, "remote-name", "", "",
 		"Remote dot name to pull from")
+	cmd.PersistentFlags().StringVarP(&pullCodec, "codec", "", "",
+		"Compress replication streams with 'zstd' (optionally with a level, "+
+			"e.g. 'zstd:6'), 'lz4', 'gzip' or 'none' (for data which is already "+
+			"compressed). By default the servers choose.")
+	cmd.PersistentFlags().StringVarP(&pullLimit, "limit", "", "",
+		"Limit replication to this many bytes per second, e.g. '512K' or "+
+			"'10M'. By default the servers' REPLICATION_BANDWIDTH_LIMIT applies.")
+	cmd.PersistentFlags().StringVarP(&pullCommit, "commit", "", "",
+		"Only fetch commits up to this one, a commit id or a tag. By default "+
+			"everything up to the latest commit is fetched.")
 
 	return cmd
 }
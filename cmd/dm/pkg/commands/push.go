@@ -10,6 +10,9 @@ import (
 )
 
 var pushRemoteVolume string
+var pushCodec string
+var pushLimit string
+var pushCommit string
 
 func NewCmdPush(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
@@ -43,8 +46,14 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 				if err != nil {
 					return err
 				}
+				opts, err := transferOptions(pushCodec, pushLimit)
+				if err != nil {
+					return err
+				}
+				opts.TargetCommit = pushCommit
 				transferId, err := dm.RequestTransfer(
 					"push", peer, filesystemName, branchName, pushRemoteVolume, "",
+					opts,
 				)
 				if err != nil {
 					return err
@@ -63,5 +72,15 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 	}
 	cmd.PersistentFlags().StringVarP(&pushRemoteVolume, "remote-name", "", "",
 		"Remote dot name to push to, including remote namespace e.g. alice/apples")
+	cmd.PersistentFlags().StringVarP(&pushCodec, "codec", "", "",
+		"Compress replication streams with 'zstd' (optionally with a level, "+
+			"e.g. 'zstd:6'), 'lz4', 'gzip' or 'none' (for data which is already "+
+			"compressed). By default the servers choose.")
+	cmd.PersistentFlags().StringVarP(&pushLimit, "limit", "", "",
+		"Limit replication to this many bytes per second, e.g. '512K' or "+
+			"'10M'. By default the servers' REPLICATION_BANDWIDTH_LIMIT applies.")
+	cmd.PersistentFlags().StringVarP(&pushCommit, "commit", "", "",
+		"Only send commits up to this one, a commit id or a tag. By default "+
+			"everything up to the latest commit is sent.")
 	return cmd
 }
@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var clearSchedule bool
+
+func NewCmdClusterSchedule(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule [<window>...] [--clear]",
+		Short: "Show or set when push, pull and clone may transfer data",
+		Long: `Show or set the cluster-wide replication schedule.
+
+Each <window> is a range of times of day in UTC, e.g. '22:00-06:00'. Transfers
+started outside all of the windows are queued until one opens, and can be
+cancelled with 'dm cancel' in the meantime. With no arguments, show the
+current schedule. '--clear' lets transfers run at any time again.
+
+Example: to only replicate overnight:
+
+    dm cluster schedule 22:00-06:00`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := clusterSchedule(cmd, args, out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&clearSchedule, "clear", "", false,
+		"remove the schedule, so transfers can run at any time.",
+	)
+	return cmd
+}
+
+func NewCmdCancel(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <transfer-id>",
+		Short: "Cancel a push, pull or clone which is queued waiting for the replication schedule",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the id of the transfer to cancel.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				err = dm.CancelTransfer(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Cancelled %s.\n", args[0])
+				return nil
+			}()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func clusterSchedule(cmd *cobra.Command, args []string, out io.Writer) error {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+	if clearSchedule {
+		if len(args) > 0 {
+			return fmt.Errorf("Please specify either windows or --clear, not both.")
+		}
+		return dm.SetReplicationSchedule(remotes.ReplicationSchedule{})
+	}
+	if len(args) > 0 {
+		return dm.SetReplicationSchedule(remotes.ReplicationSchedule{Windows: args})
+	}
+	schedule, err := dm.GetReplicationSchedule()
+	if err != nil {
+		return err
+	}
+	if len(schedule.Windows) == 0 {
+		fmt.Fprintf(out, "No replication schedule, transfers can run at any time.\n")
+		return nil
+	}
+	fmt.Fprintf(out, "Transfers run during %s UTC.\n", strings.Join(schedule.Windows, ", "))
+	return nil
+}
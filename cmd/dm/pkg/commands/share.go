@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+var shareRole string
+
+func NewCmdDotShare(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "share [<dot>] <user> [--role=reader|writer|maintainer]",
+		Short: "Let another user work on a dot, or change what they can do with it",
+		Long: `Share a dot with another user, as one of:
+
+    reader      can see and pull it
+    writer      can also commit, branch and push to it
+    maintainer  can also reset it with 'dm reset'
+
+Only the dot's owner can share it.
+
+Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
+is used.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) < 1 {
+					return fmt.Errorf("Please specify the user to share the dot with.")
+				}
+				user := args[len(args)-1]
+				dm, dot, err := policyDot(args[:len(args)-1])
+				if err != nil {
+					return err
+				}
+				err = dm.ShareDot(dot, user, shareRole)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s is now %s of %s\n", user, withArticle(shareRole), dot)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&shareRole, "role", "", "writer",
+		"What the user can do: reader, writer or maintainer")
+	return cmd
+}
+
+func NewCmdDotUnshare(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "unshare [<dot>] <user>",
+		Short: "Stop sharing a dot with a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) < 1 {
+					return fmt.Errorf("Please specify the user to stop sharing the dot with.")
+				}
+				user := args[len(args)-1]
+				dm, dot, err := policyDot(args[:len(args)-1])
+				if err != nil {
+					return err
+				}
+				return dm.UnshareDot(dot, user)
+			})
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var tagList bool
+var tagDelete bool
+
+func NewCmdTag(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tag [<name> [<commit>]] [-l] [-d <name>]",
+		Short: "Name commits of the current dot",
+		Long: `Tag a commit of the current branch with <name>, which can then be used
+anywhere a commit id can, e.g. 'dm reset --hard <name>' or
+'dm push <remote> --commit=<name>'. <commit> is a commit id, HEAD followed by a
+'^' for each commit back from the latest, or another tag, and defaults to the
+latest commit.
+
+Tags belong to the whole dot rather than a branch, and are pushed and pulled
+along with the commits they name. They can't be moved, only deleted (by the
+dot's owner), and tagged commits can't be reset past or removed by a policy.
+
+With no arguments, or '-l', list the dot's tags. '-d <name>' deletes a tag.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, dot, branch, err := filesDot()
+				if err != nil {
+					return err
+				}
+				if tagDelete {
+					if len(args) != 1 {
+						return fmt.Errorf("Please specify one tag to delete.")
+					}
+					err = dm.DeleteTag(dot, args[0])
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Deleted tag %s\n", args[0])
+					return nil
+				}
+				if tagList || len(args) == 0 {
+					if len(args) > 0 {
+						return fmt.Errorf("'-l' doesn't take any arguments.")
+					}
+					tags, err := dm.Tags(dot)
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+					for _, tag := range tags {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+							tag.Name, tag.Commit, tag.Author, tag.Created.Local().Format("2006-01-02 15:04"))
+					}
+					return w.Flush()
+				}
+				if len(args) > 2 {
+					return fmt.Errorf("Please specify a tag name and at most one commit.")
+				}
+				commit := ""
+				if len(args) == 2 {
+					commit = args[1]
+				}
+				tag, err := dm.CreateTag(dot, branch, args[0], commit)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Tagged %s as %s\n", tag.Commit, tag.Name)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&tagList, "list", "l", false, "List the dot's tags")
+	cmd.Flags().BoolVarP(&tagDelete, "delete", "d", false, "Delete the named tag")
+	return cmd
+}
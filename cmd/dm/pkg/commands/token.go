@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var tokenScope string
+var tokenDots []string
+var tokenNamespaces []string
+var tokenExpires string
+
+func NewCmdToken(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage API tokens for the current remote's user",
+		Long: `Create, list and revoke API tokens, which can be used instead of your API key
+(e.g. by a CI job) but only allow some things:
+
+    read   anything which doesn't change anything, including pulling
+    push   the same as read, except pulling, plus pushing to the dots and
+           namespaces given with --dot and --namespace
+    admin  anything your API key allows
+
+A token can also expire. Use it in place of your API key, e.g.:
+
+    DOTMESH_PASSWORD=<token> dm remote add ci <user>@<hostname>
+
+Tokens can't change your password or API key, show your API key, or manage
+tokens, so these commands need the remote to use your API key.`,
+	}
+	cmd.AddCommand(NewCmdTokenCreate(out))
+	cmd.AddCommand(NewCmdTokenList(out))
+	cmd.AddCommand(NewCmdTokenRevoke(out))
+	return cmd
+}
+
+func NewCmdTokenCreate(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "create <name> [--scope=read|push|admin] [--dot=<dot>...] " +
+			"[--namespace=<namespace>...] [--expires=<duration>]",
+		Short: "Create an API token",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please give the token a name.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				dots := []string{}
+				for _, dot := range tokenDots {
+					namespace, name, err := remotes.ParseNamespacedVolume(dot)
+					if err != nil {
+						return err
+					}
+					dots = append(dots, namespace+"/"+name)
+				}
+				var expires time.Time
+				if tokenExpires != "" {
+					lifetime, err := time.ParseDuration(tokenExpires)
+					if err != nil {
+						return fmt.Errorf("Invalid --expires '%s', try something like '720h'", tokenExpires)
+					}
+					expires = time.Now().Add(lifetime)
+				}
+				token, secret, err := dm.CreateApiToken(args[0], tokenScope, dots, tokenNamespaces, expires)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Created %s token %s (%s)\n", token.Scope, token.Name, token.Id)
+				fmt.Fprintf(out, "It's %s (this won't be shown again)\n", secret)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&tokenScope, "scope", "", "read", "What the token allows: read, push or admin")
+	cmd.Flags().StringSliceVarP(&tokenDots, "dot", "", []string{},
+		"A dot a push token can push to (may be repeated)")
+	cmd.Flags().StringSliceVarP(&tokenNamespaces, "namespace", "", []string{},
+		"A namespace a push token can push to any dot in (may be repeated)")
+	cmd.Flags().StringVarP(&tokenExpires, "expires", "", "",
+		"How long until the token expires, e.g. '720h' (default: never)")
+	return cmd
+}
+
+func NewCmdTokenList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List your API tokens",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				tokens, err := dm.ApiTokens()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "NAME\tID\tSCOPE\tPUSH TO\tEXPIRES\tLAST USED\n")
+				for _, token := range tokens {
+					expires := "never"
+					if !token.Expires.IsZero() {
+						expires = token.Expires.Local().Format("2006-01-02 15:04")
+						if token.Expires.Before(time.Now()) {
+							expires += " (expired)"
+						}
+					}
+					lastUsed := "never"
+					if !token.LastUsed.IsZero() {
+						lastUsed = token.LastUsed.Local().Format("2006-01-02 15:04")
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", token.Name, token.Id, token.Scope,
+						strings.Join(append(append([]string{}, token.Dots...), token.Namespaces...), ","),
+						expires, lastUsed)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdTokenRevoke(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke <name-or-id>",
+		Short: "Revoke an API token, so that it can't be used any more",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name or id of the token to revoke.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				return dm.RevokeApiToken(args[0])
+			})
+		},
+	}
+	return cmd
+}
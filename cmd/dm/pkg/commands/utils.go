@@ -5,6 +5,8 @@ import (
 	"encoding/base32"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
 )
@@ -24,6 +26,47 @@ func prettyPrintSize(size int64) string {
 	return s
 }
 
+// "10M" => 10485760 bytes per second. Accepts an optional K, M or G suffix
+// (powers of 1024), and an optional "/s".
+func parseBandwidth(s string) (int64, error) {
+	spec := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	spec = strings.TrimSuffix(strings.TrimSuffix(spec, "IB"), "B")
+	multiplier := int64(1)
+	if len(spec) > 0 {
+		switch spec[len(spec)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			spec = spec[:len(spec)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(spec, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf(
+			"Invalid bandwidth limit '%s', try something like '512K' or '10M'", s,
+		)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// options for push, pull and clone from their --codec and --limit flags
+func transferOptions(codec, limit string) (remotes.TransferOptions, error) {
+	opts := remotes.TransferOptions{Codec: codec}
+	if limit != "" {
+		bandwidthLimit, err := parseBandwidth(limit)
+		if err != nil {
+			return opts, err
+		}
+		opts.BandwidthLimit = bandwidthLimit
+	}
+	return opts, nil
+}
+
 func resolveTransferArgs(args []string) (returnPeer string, returnFilesystemName string, returnBranchName string, returnError error) {
 
 	// Use:   "{push,pull,clone} <remote>",
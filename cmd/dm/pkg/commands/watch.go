@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var watchJson bool
+
+func NewCmdWatch(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch [<dot>] [--json]",
+		Short: "Show changes to dots as they happen",
+		Long: `Print commits, new branches, state changes, master moves, transfer progress
+and deletions of all the dots you can see on the current remote, or just of
+<dot>, as they happen, until interrupted.
+
+State changes and receive progress are those of the node the remote points
+at; everything else is cluster-wide. '--json' prints each event as a line of
+JSON instead.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one dot.")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				filter := remotes.EventFilter{}
+				if len(args) == 1 {
+					filter.Volume = args[0]
+				}
+				var writeErr error
+				err = dm.StreamEvents(context.Background(), filter, func(e remotes.StreamEvent) bool {
+					if watchJson {
+						writeErr = json.NewEncoder(out).Encode(e)
+					} else {
+						_, writeErr = fmt.Fprintln(out, describeEvent(e))
+					}
+					return writeErr == nil
+				})
+				if err != nil {
+					return err
+				}
+				return writeErr
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&watchJson, "json", false, "Print events as JSON")
+	return cmd
+}
+
+func describeEvent(e remotes.StreamEvent) string {
+	dot := e.FilesystemId
+	if e.Name != "" {
+		dot = fmt.Sprintf("%s/%s", e.Namespace, e.Name)
+		if e.Branch != "" {
+			dot += "@" + e.Branch
+		}
+	}
+	what := ""
+	switch e.Type {
+	case "commit":
+		message := ""
+		if e.Commit.Metadata != nil {
+			message = (*e.Commit.Metadata)["message"]
+		}
+		what = fmt.Sprintf("%s %q", e.Commit.Id, message)
+	case "branch":
+		what = "created"
+	case "transition":
+		what = "-> " + e.State
+	case "master":
+		what = "now on " + e.Server
+	case "receive-progress":
+		what = fmt.Sprintf("%.2fMiB received", float64(e.Bytes)/(1024*1024))
+	case "transfer":
+		t := e.Transfer
+		what = fmt.Sprintf(
+			"%s %s %s (%d/%d), %.2f/%.2fMiB",
+			t.Direction, e.TransferId, t.Status, t.Index, t.Total,
+			float64(t.Sent)/(1024*1024), float64(t.Size)/(1024*1024),
+		)
+		if t.Message != "" {
+			what += ": " + t.Message
+		}
+	case "delete":
+		what = "deleted"
+	}
+	return fmt.Sprintf("%s %-16s %s %s", e.Time.Local().Format("15:04:05"), e.Type, dot, what)
+}
@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var webhookNamespace string
+var webhookEventTypes []string
+var webhookSecret string
+
+func NewCmdWebhook(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Manage webhooks told about changes to dots in a namespace",
+		Long: `Add, list and remove webhooks, which are POSTed JSON describing things that
+happen to the dots in a namespace:
+
+    commit           a commit was made
+    push-received    a push into a branch finished
+    branch-created   a branch was made
+    deleted          a dot was deleted
+    transfer-failed  a push or pull from the cluster failed
+
+Each request has the event in its X-Dotmesh-Event header, and is signed with
+the webhook's secret: the X-Dotmesh-Signature header is "sha256=" followed by
+the hex HMAC-SHA256 of the body, keyed on the secret. Failed deliveries are
+retried a few times with backoff; 'dm webhook deliveries' shows how they went.
+
+Webhooks belong to the namespace of the current remote's user unless
+'--namespace' says otherwise, and only the namespace's administrator can
+manage them.`,
+	}
+	cmd.PersistentFlags().StringVarP(&webhookNamespace, "namespace", "", "",
+		"Namespace of the webhooks (default: the current remote's user)")
+	cmd.AddCommand(NewCmdWebhookAdd(out))
+	cmd.AddCommand(NewCmdWebhookList(out))
+	cmd.AddCommand(NewCmdWebhookRemove(out))
+	cmd.AddCommand(NewCmdWebhookDeliveries(out))
+	return cmd
+}
+
+func webhookApi() (*remotes.DotmeshAPI, string, error) {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+	namespace := webhookNamespace
+	if namespace == "" {
+		namespace = dm.CurrentUser()
+	}
+	return dm, namespace, nil
+}
+
+func NewCmdWebhookAdd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <url> [--event=<event>...] [--secret=<secret>]",
+		Short: "Add a webhook",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the webhook's URL.")
+				}
+				dm, namespace, err := webhookApi()
+				if err != nil {
+					return err
+				}
+				webhook, err := dm.AddWebhook(remotes.Webhook{
+					Namespace: namespace,
+					URL:       args[0],
+					Secret:    webhookSecret,
+					Events:    webhookEventTypes,
+				})
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Added webhook %s\n", webhook.Id)
+				if webhookSecret == "" {
+					fmt.Fprintf(out, "Its secret is %s (this won't be shown again)\n", webhook.Secret)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringSliceVarP(&webhookEventTypes, "event", "", []string{},
+		"Only deliver this event (may be repeated, default: all of them)")
+	cmd.Flags().StringVarP(&webhookSecret, "secret", "", "",
+		"Secret to sign deliveries with (default: a random one)")
+	return cmd
+}
+
+func NewCmdWebhookList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the namespace's webhooks",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, namespace, err := webhookApi()
+				if err != nil {
+					return err
+				}
+				webhooks, err := dm.Webhooks(namespace)
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "ID\tURL\tEVENTS\n")
+				for _, webhook := range webhooks {
+					events := "all"
+					if len(webhook.Events) > 0 {
+						events = strings.Join(webhook.Events, ",")
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", webhook.Id, webhook.URL, events)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdWebhookRemove(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove <id>",
+		Short: "Remove a webhook",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the id of the webhook to remove.")
+				}
+				dm, namespace, err := webhookApi()
+				if err != nil {
+					return err
+				}
+				return dm.RemoveWebhook(namespace, args[0])
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdWebhookDeliveries(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deliveries [<id>]",
+		Short: "Show recent deliveries to the namespace's webhooks, or to one of them",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one webhook.")
+				}
+				webhookId := ""
+				if len(args) == 1 {
+					webhookId = args[0]
+				}
+				dm, namespace, err := webhookApi()
+				if err != nil {
+					return err
+				}
+				deliveries, err := dm.WebhookDeliveries(namespace, webhookId)
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "TIME\tEVENT\tURL\tSTATUS\tATTEMPTS\tRESPONSE\n")
+				for _, d := range deliveries {
+					response := ""
+					if d.ResponseCode != 0 {
+						response = fmt.Sprintf("%d", d.ResponseCode)
+					}
+					if d.Error != "" {
+						response = strings.TrimSpace(response + " " + d.Error)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+						d.Created.Local().Format("2006-01-02 15:04:05"), d.Event, d.URL,
+						d.Status, d.Attempts, response)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	return cmd
+}
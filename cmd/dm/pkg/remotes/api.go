@@ -1,10 +1,16 @@
 package remotes
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -302,6 +308,455 @@ func (dm *DotmeshAPI) DeleteVolume(volumeName string) error {
 	return nil
 }
 
+// Cluster-wide schedule of when transfers may run, e.g. {"Windows":
+// ["22:00-06:00"]} (UTC). No windows means any time.
+type ReplicationSchedule struct {
+	Windows []string
+}
+
+func (dm *DotmeshAPI) GetReplicationSchedule() (ReplicationSchedule, error) {
+	var schedule ReplicationSchedule
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.GetReplicationSchedule", struct{}{}, &schedule,
+	)
+	return schedule, err
+}
+
+func (dm *DotmeshAPI) SetReplicationSchedule(schedule ReplicationSchedule) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.SetReplicationSchedule", schedule, &result,
+	)
+}
+
+// Cancel a transfer which is queued waiting for the replication schedule.
+func (dm *DotmeshAPI) CancelTransfer(transferId string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.CancelTransfer", transferId, &result,
+	)
+}
+
+// A dot's policy of committing automatically every CommitEvery (e.g. "15m")
+// and of keeping the latest automatic commit from each of the last KeepHourly
+// hours, KeepDaily days and KeepWeekly weeks.
+type SnapshotPolicy struct {
+	CommitEvery string
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+}
+
+func (dm *DotmeshAPI) GetPolicy(volumeName string) (SnapshotPolicy, error) {
+	var policy SnapshotPolicy
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return policy, err
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.GetPolicy",
+		VolumeName{Namespace: namespace, Name: name}, &policy,
+	)
+	return policy, err
+}
+
+func (dm *DotmeshAPI) SetPolicy(volumeName string, policy SnapshotPolicy) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.SetPolicy", struct {
+			Namespace, Name string
+			Policy          SnapshotPolicy
+		}{namespace, name, policy}, &result,
+	)
+}
+
+// Run before ("pre") or after ("post") a dot is committed, in the containers
+// using it (or just its Subdot), see 'dm dot hook'.
+type CommitHook struct {
+	When      string
+	Subdot    string
+	Exec      string
+	Signal    string
+	Webhook   string
+	Timeout   string
+	OnFailure string
+}
+
+func (dm *DotmeshAPI) GetCommitHooks(volumeName string) ([]CommitHook, error) {
+	hooks := []CommitHook{}
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return hooks, err
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.GetCommitHooks",
+		VolumeName{Namespace: namespace, Name: name}, &hooks,
+	)
+	return hooks, err
+}
+
+func (dm *DotmeshAPI) SetCommitHooks(volumeName string, hooks []CommitHook) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.SetCommitHooks", struct {
+			Namespace, Name string
+			Hooks           []CommitHook
+		}{namespace, name, hooks}, &result,
+	)
+}
+
+// A record of something done to the cluster, see 'dm audit'.
+type AuditEntry struct {
+	Time                  time.Time
+	Node                  string
+	UserId                string
+	User                  string
+	PasswordAuthenticated bool
+	Token                 string
+	SourceIP              string
+	Method                string
+	Dot                   string
+	Args                  json.RawMessage
+	Result                string
+	DurationSeconds       float64
+}
+
+type AuditFilter struct {
+	User   string
+	Method string
+	Dot    string
+	Since  time.Time
+	Limit  int
+}
+
+// The latest audit log entries matching filter, newest first.
+func (dm *DotmeshAPI) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := dm.client.CallRemote(context.Background(), "DotmeshRPC.AuditLog", filter, &entries)
+	return entries, err
+}
+
+// A subscription to events in a namespace, see 'dm webhook'.
+type Webhook struct {
+	Id        string
+	Namespace string
+	URL       string
+	// only set when adding a webhook
+	Secret  string
+	Events  []string
+	Created time.Time
+}
+
+type WebhookDelivery struct {
+	Id           string
+	WebhookId    string
+	Event        string
+	URL          string
+	Status       string // "pending", "delivered" or "failed"
+	Attempts     int
+	ResponseCode int
+	Error        string
+	Created      time.Time
+	Updated      time.Time
+}
+
+// The user the current remote is used as, whose namespace is the default.
+func (dm *DotmeshAPI) CurrentUser() string {
+	if dm.client == nil {
+		return ""
+	}
+	return dm.client.User
+}
+
+func (dm *DotmeshAPI) Webhooks(namespace string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := dm.client.CallRemote(context.Background(), "DotmeshRPC.Webhooks", namespace, &webhooks)
+	return webhooks, err
+}
+
+// Add a webhook, returning it with its id and secret.
+func (dm *DotmeshAPI) AddWebhook(webhook Webhook) (Webhook, error) {
+	var result Webhook
+	err := dm.client.CallRemote(context.Background(), "DotmeshRPC.AddWebhook", webhook, &result)
+	return result, err
+}
+
+func (dm *DotmeshAPI) RemoveWebhook(namespace, id string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveWebhook", struct{ Namespace, Id string }{namespace, id}, &result,
+	)
+}
+
+// Recent deliveries to a namespace's webhooks, or to one of them if
+// webhookId isn't "", newest first.
+func (dm *DotmeshAPI) WebhookDeliveries(namespace, webhookId string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.WebhookDeliveries",
+		struct{ Namespace, WebhookId string }{namespace, webhookId}, &deliveries,
+	)
+	return deliveries, err
+}
+
+// A named, scoped credential which can be used instead of the API key, see
+// 'dm token'.
+type ApiToken struct {
+	Id         string
+	Name       string
+	Scope      string // "read", "push" or "admin"
+	Dots       []string
+	Namespaces []string
+	Created    time.Time
+	Expires    time.Time // zero if it doesn't
+	LastUsed   time.Time // zero if it hasn't been
+}
+
+func (dm *DotmeshAPI) ApiTokens() ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	err := dm.client.CallRemote(context.Background(), "DotmeshRPC.ApiTokens", struct{}{}, &tokens)
+	return tokens, err
+}
+
+// Make a token, returning it and the secret to use it with.
+func (dm *DotmeshAPI) CreateApiToken(
+	name, scope string, dots, namespaces []string, expires time.Time,
+) (ApiToken, string, error) {
+	var result struct {
+		Token  ApiToken
+		Secret string
+	}
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.CreateApiToken", struct {
+			Name, Scope      string
+			Dots, Namespaces []string
+			Expires          time.Time
+		}{name, scope, dots, namespaces, expires}, &result,
+	)
+	return result.Token, result.Secret, err
+}
+
+// Revoke a token, by id or name.
+func (dm *DotmeshAPI) RevokeApiToken(id string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RevokeApiToken", struct{ Id string }{id}, &result,
+	)
+}
+
+// A namespace which belongs to a team, see 'dm org'.
+type Organization struct {
+	Name    string
+	Members []OrganizationMember
+	Created time.Time
+}
+
+type OrganizationMember struct {
+	UserId string
+	User   string
+	Role   string // "reader", "writer", "admin" or "owner"
+}
+
+func (dm *DotmeshAPI) CreateOrganization(name string) (Organization, error) {
+	var result Organization
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.CreateOrganization", struct{ Name string }{name}, &result,
+	)
+	return result, err
+}
+
+// The organizations the current remote's user is a member of.
+func (dm *DotmeshAPI) Organizations() ([]Organization, error) {
+	orgs := []Organization{}
+	err := dm.client.CallRemote(context.Background(), "DotmeshRPC.Organizations", struct{}{}, &orgs)
+	return orgs, err
+}
+
+// Add a user to an organization, or change their role in it.
+func (dm *DotmeshAPI) AddOrganizationMember(org, user, role string) (Organization, error) {
+	var result Organization
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.AddOrganizationMember",
+		struct{ Organization, User, Role string }{org, user, role}, &result,
+	)
+	return result, err
+}
+
+func (dm *DotmeshAPI) RemoveOrganizationMember(org, user string) (Organization, error) {
+	var result Organization
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveOrganizationMember",
+		struct{ Organization, User string }{org, user}, &result,
+	)
+	return result, err
+}
+
+// Let another user work on a dot, as a "reader", "writer" or "maintainer",
+// or change what they can do with it.
+func (dm *DotmeshAPI) ShareDot(volumeName, user, role string) error {
+	masterBranchId, err := dm.masterBranchId(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.AddCollaborator",
+		struct{ MasterBranchID, Collaborator, Role string }{masterBranchId, user, role}, &result,
+	)
+}
+
+func (dm *DotmeshAPI) UnshareDot(volumeName, user string) error {
+	masterBranchId, err := dm.masterBranchId(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveCollaborator",
+		struct{ MasterBranchID, Collaborator string }{masterBranchId, user}, &result,
+	)
+}
+
+func (dm *DotmeshAPI) masterBranchId(volumeName string) (string, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Lookup",
+		struct{ Namespace, Name, Branch string }{namespace, name, ""}, &id,
+	)
+	return id, err
+}
+
+// One file which differs between two commits, see 'dm diff'.
+type FileChange struct {
+	Change  string // "added", "removed", "modified" or "renamed"
+	Path    string
+	OldPath string // if it was renamed
+	Size    int64
+	OldSize int64
+}
+
+type DiffResult struct {
+	Changes []FileChange
+	// only some of the changes were sent
+	Truncated bool
+}
+
+// What changed in branchName of volumeName between the commits from and to
+// (commit ids or HEAD^...), or between from and the working state if to is
+// "". subdot limits it to one subdot.
+func (dm *DotmeshAPI) Diff(volumeName, branchName, from, to, subdot string) (DiffResult, error) {
+	var result DiffResult
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	from, err = dm.findCommit(from, volumeName, branchName)
+	if err != nil {
+		return result, err
+	}
+	if to != "" {
+		to, err = dm.findCommit(to, volumeName, branchName)
+		if err != nil {
+			return result, err
+		}
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Diff", map[string]string{
+			"Namespace":      namespace,
+			"Name":           name,
+			"Branch":         deMasterify(branchName),
+			"FromSnapshotId": from,
+			"ToSnapshotId":   to,
+			"Subdot":         subdot,
+		}, &result,
+	)
+	return result, err
+}
+
+// An entry in a listing of the files in a commit, see 'dm ls'.
+type DotFile struct {
+	Name       string
+	Type       string // "file", "dir", "symlink" or "other"
+	Size       int64
+	Mode       string
+	ModTime    time.Time
+	LinkTarget string
+}
+
+// List the files at path (relative to the root of the dot, so starting with
+// a subdot) in commit (a commit id or HEAD^...) of branchName of volumeName.
+func (dm *DotmeshAPI) ListFiles(volumeName, branchName, commit, path string) ([]DotFile, error) {
+	files := []DotFile{}
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return files, err
+	}
+	commit, err = dm.findCommit(commit, volumeName, branchName)
+	if err != nil {
+		return files, err
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.ListFiles", map[string]string{
+			"Namespace":  namespace,
+			"Name":       name,
+			"Branch":     deMasterify(branchName),
+			"SnapshotId": commit,
+			"Path":       path,
+		}, &files,
+	)
+	return files, err
+}
+
+// Write the file at path in commit of branchName of volumeName to w, or a tar
+// of it if asTar is set. Directories can only be read as tars.
+func (dm *DotmeshAPI) ReadFile(volumeName, branchName, commit, path string, asTar bool, w io.Writer) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	commit, err = dm.findCommit(commit, volumeName, branchName)
+	if err != nil {
+		return err
+	}
+	query := url.Values{
+		"branch": {deMasterify(branchName)},
+		"commit": {commit},
+		"path":   {path},
+		"tar":    {strconv.FormatBool(asTar)},
+	}
+	req, err := dm.client.NewRequest(
+		"GET", fmt.Sprintf("/files/%s/%s?%s", namespace, name, query.Encode()), nil,
+	)
+	if err != nil {
+		return err
+	}
+	resp, err := dm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return archiveResponseError(resp)
+	}
+	if !asTar && resp.Header.Get("Content-Type") == "application/x-tar" {
+		return fmt.Errorf("%s is a directory, use --tar to get a tar of it", path)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
 func (dm *DotmeshAPI) SwitchVolume(volumeName string) error {
 	return dm.setCurrentVolume(volumeName)
 }
@@ -327,6 +782,61 @@ func (dm *DotmeshAPI) AllBranches(volumeName string) ([]string, error) {
 	return branches, err
 }
 
+type BranchProtection struct {
+	NoRollback      bool
+	NoDivergedPush  bool
+	NoDelete        bool
+	OwnerOnlyCommit bool
+}
+
+func (p BranchProtection) String() string {
+	rules := []string{}
+	if p.NoRollback {
+		rules = append(rules, "no-rollback")
+	}
+	if p.NoDivergedPush {
+		rules = append(rules, "no-diverged-push")
+	}
+	if p.NoDelete {
+		rules = append(rules, "no-delete")
+	}
+	if p.OwnerOnlyCommit {
+		rules = append(rules, "owner-only-commit")
+	}
+	return strings.Join(rules, ",")
+}
+
+// How volumeName's branches are protected, by branch name. Unprotected
+// branches are left out.
+func (dm *DotmeshAPI) BranchProtections(volumeName string) (map[string]BranchProtection, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var protected map[string]BranchProtection
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.GetBranchProtections", VolumeName{namespace, name}, &protected,
+	)
+	return protected, err
+}
+
+// Protect a branch, or unprotect it if protection is empty.
+func (dm *DotmeshAPI) SetBranchProtection(volumeName, branchName string, protection BranchProtection) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.SetBranchProtection", map[string]interface{}{
+			"Namespace":  namespace,
+			"Name":       name,
+			"Branch":     deMasterify(branchName),
+			"Protection": protection,
+		}, &result,
+	)
+}
+
 func (dm *DotmeshAPI) AllVolumes() ([]DotmeshVolume, error) {
 	filesystems := map[string]map[string]DotmeshVolume{}
 	result := []DotmeshVolume{}
@@ -445,9 +955,77 @@ func (dm *DotmeshAPI) findCommit(ref, volumeName, branchName string) (string, er
 			return "", fmt.Errorf("Commits don't go back that far")
 		}
 		return cs[i].Id, nil
-	} else {
-		return ref, nil
 	}
+	tags, err := dm.Tags(volumeName)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag.Name == ref {
+			return tag.Commit, nil
+		}
+	}
+	return ref, nil
+}
+
+type Tag struct {
+	Name    string
+	Commit  string
+	Author  string
+	Created time.Time
+}
+
+func (dm *DotmeshAPI) Tags(volumeName string) ([]Tag, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var tags []Tag
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Tags", VolumeName{namespace, name}, &tags,
+	)
+	return tags, err
+}
+
+// Tag commit (a commit id, HEAD^... or another tag) of branchName, or its
+// latest commit if commit is "".
+func (dm *DotmeshAPI) CreateTag(volumeName, branchName, tag, commit string) (Tag, error) {
+	var result Tag
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	if commit != "" {
+		commit, err = dm.findCommit(commit, volumeName, branchName)
+		if err != nil {
+			return result, err
+		}
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Tag", map[string]string{
+			"Namespace": namespace,
+			"Name":      name,
+			"Branch":    deMasterify(branchName),
+			"Tag":       tag,
+			"Commit":    commit,
+		}, &result,
+	)
+	return result, err
+}
+
+func (dm *DotmeshAPI) DeleteTag(volumeName, tag string) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.DeleteTag", map[string]string{
+			"Namespace": namespace,
+			"Name":      name,
+			"Tag":       tag,
+		}, &result,
+	)
 }
 
 func (dm *DotmeshAPI) ResetCurrentVolume(commit string) error {
@@ -550,6 +1128,106 @@ type TransferPollResult struct {
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Set if the current segment picked up where an interrupted transfer
+	// left off, in which case Size and Sent don't include BytesSkipped.
+	Resumed      bool
+	BytesSkipped int64
+
+	// How the current segment's stream is compressed
+	Codec            string
+	CompressedStream bool // blocks sent as they're compressed on disk
+
+	// bytes per second the current segment is limited to, 0 if unlimited
+	BandwidthLimit int64
+}
+
+// An event from the server's stream of things happening to dots, see
+// StreamEvents.
+type StreamEvent struct {
+	// one of "commit", "branch", "transition", "master", "transfer",
+	// "receive-progress" or "delete"
+	Type         string
+	Time         time.Time
+	FilesystemId string
+	Namespace    string
+	Name         string
+	Branch       string
+	State        string
+	Server       string
+	Commit       *snapshot
+	Bytes        int64
+	TransferId   string
+	Transfer     *TransferPollResult
+}
+
+// Which events to stream, all of them the user can see if it's empty.
+type EventFilter struct {
+	// a dot, e.g. "admin/apples" or just "apples"
+	Volume     string
+	TransferId string
+}
+
+// Stream events from the server, calling handle with each one until it
+// returns false, ctx is cancelled or the server goes away.
+func (dm *DotmeshAPI) StreamEvents(
+	ctx context.Context, filter EventFilter, handle func(StreamEvent) bool,
+) error {
+	query := url.Values{}
+	if filter.Volume != "" {
+		namespace, name, err := ParseNamespacedVolume(filter.Volume)
+		if err != nil {
+			return err
+		}
+		query.Set("namespace", namespace)
+		query.Set("name", name)
+	}
+	if filter.TransferId != "" {
+		query.Set("transfer", filter.TransferId)
+	}
+	req, err := dm.client.NewRequest("GET", "/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dm.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return archiveResponseError(resp)
+	}
+	// server-sent events: "data: <json>" lines, ended by a blank line, and
+	// ": comments" to keep the connection alive
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	data := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		}
+		if line != "" || data == "" {
+			continue
+		}
+		e := StreamEvent{}
+		err = json.Unmarshal([]byte(data), &e)
+		data = ""
+		if err != nil {
+			return fmt.Errorf("Unable to read event: %s", err)
+		}
+		if !handle(e) {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("The server closed the event stream")
 }
 
 func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer) error {
@@ -558,18 +1236,89 @@ func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer) error {
 
 	var bar *pb.ProgressBar
 	started := false
+	// segments we've already said were resumed, or how they're compressed
+	reportedResume := map[int]bool{}
+	reportedCodec := map[int]bool{}
+	reportedQueued := false
+
+	// Follow the transfer's progress on the event stream, still asking for it
+	// now and then in case an event was missed, or every second if the
+	// server can't stream events (e.g. it's an older version).
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan TransferPollResult)
+	streamFailed := make(chan struct{})
+	go func() {
+		err := dm.StreamEvents(ctx, EventFilter{TransferId: transferId}, func(e StreamEvent) bool {
+			if e.Transfer == nil {
+				return true
+			}
+			select {
+			case updates <- *e.Transfer:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err != nil {
+			close(streamFailed)
+		}
+	}()
+	streaming := true
+	wait := time.Second
 
 	for {
-		time.Sleep(time.Second)
 		result := &TransferPollResult{}
-		err := dm.client.CallRemote(
-			context.Background(), "DotmeshRPC.GetTransfer", transferId, result,
-		)
-		if err != nil {
-			if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
-				out.Write([]byte(fmt.Sprintf("Got error, trying again: %s\n", err)))
+		select {
+		case update := <-updates:
+			*result = update
+		case <-streamFailed:
+			streaming = false
+			streamFailed = nil
+			continue
+		case <-time.After(wait):
+			err := dm.client.CallRemote(
+				context.Background(), "DotmeshRPC.GetTransfer", transferId, result,
+			)
+			if err != nil {
+				if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
+					out.Write([]byte(fmt.Sprintf("Got error, trying again: %s\n", err)))
+				}
+			}
+			if streaming {
+				wait = 5 * time.Second
+			} else {
+				wait = time.Second
 			}
 		}
+		if result.Status == "queued" && !reportedQueued {
+			out.Write([]byte(fmt.Sprintf("Queued, %s\n", result.Message)))
+			out.Write([]byte(fmt.Sprintf("To cancel it, run 'dm cancel %s'\n", transferId)))
+			reportedQueued = true
+		}
+		if result.Codec != "" && !reportedCodec[result.Index] {
+			compressedBlocks := ""
+			if result.CompressedStream {
+				compressedBlocks = ", sending blocks compressed as they are on disk"
+			}
+			limit := ""
+			if result.BandwidthLimit > 0 {
+				limit = fmt.Sprintf(
+					", limited to %.2fMiB/s", float64(result.BandwidthLimit)/(1024*1024),
+				)
+			}
+			out.Write([]byte(fmt.Sprintf(
+				"Compressing with %s%s%s\n", result.Codec, compressedBlocks, limit,
+			)))
+			reportedCodec[result.Index] = true
+		}
+		if result.Resumed && !reportedResume[result.Index] {
+			out.Write([]byte(fmt.Sprintf(
+				"Resuming interrupted transfer, skipping %.2fMiB already sent\n",
+				float64(result.BytesSkipped)/(1024*1024),
+			)))
+			reportedResume[result.Index] = true
+		}
 		if result.Size > 0 {
 			if !started {
 				bar = pb.New64(result.Size)
@@ -655,6 +1404,8 @@ type TransferRequest struct {
 	Peer             string
 	User             string
 	ApiKey           string
+	PeerTLS          bool
+	PeerCACert       string
 	Direction        string
 	LocalNamespace   string
 	LocalName        string
@@ -663,6 +1414,23 @@ type TransferRequest struct {
 	RemoteName       string
 	RemoteBranchName string
 	TargetCommit     string
+	Codec            string
+	BandwidthLimit   int64
+	S3               *S3Remote
+}
+
+// Optional settings for a transfer.
+type TransferOptions struct {
+	// what to compress replication streams with: "zstd" (optionally with a
+	// level, e.g. "zstd:6"), "lz4", "gzip" or "none". "" leaves it up to the
+	// servers.
+	Codec string
+	// bytes per second to limit replication streams to, 0 leaves it up to
+	// the servers.
+	BandwidthLimit int64
+	// the last commit to send, a commit id or a tag of the sending dot. ""
+	// sends up to the latest.
+	TargetCommit string
 }
 
 // attempt to get the latest commits in filesystemId (which may be a branch)
@@ -674,6 +1442,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 	direction, peer,
 	localFilesystemName, localBranchName,
 	remoteFilesystemName, remoteBranchName string,
+	opts TransferOptions,
 ) (string, error) {
 	connectionInitiator := dm.Configuration.CurrentRemote
 
@@ -732,6 +1501,13 @@ func (dm *DotmeshAPI) RequestTransfer(
 	// Guess defaults for the remote filesystem
 	var remoteNamespace, remoteVolume string
 
+	// dots go in the user's namespace on a cluster, and keep their own
+	// namespace in an S3 bucket
+	defaultNamespace := remote.User
+	if remote.S3 != nil {
+		defaultNamespace = localNamespace
+	}
+
 	if remoteFilesystemName == "" {
 		// No remote specified. Do we already have a default configured?
 		defaultRemoteNamespace, defaultRemoteVolume, ok := dm.Configuration.DefaultRemoteVolumeFor(peer, localNamespace, localVolume)
@@ -743,12 +1519,12 @@ func (dm *DotmeshAPI) RequestTransfer(
 			// If not, default to the un-namespaced local filesystem name.
 			// This causes it to default into the user's own namespace
 			// when we parse the name, too.
-			remoteNamespace = remote.User
+			remoteNamespace = defaultNamespace
 			remoteVolume = localVolume
 		}
 	} else {
 		// Default namespace for remote volume is the username on this remote
-		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(remoteFilesystemName, remote.User)
+		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(remoteFilesystemName, defaultNamespace)
 		if err != nil {
 			return "", err
 		}
@@ -798,6 +1574,8 @@ func (dm *DotmeshAPI) RequestTransfer(
 			Peer:             remote.Hostname,
 			User:             remote.User,
 			ApiKey:           remote.ApiKey,
+			PeerTLS:          remote.TLS,
+			PeerCACert:       remote.CACert,
 			Direction:        direction,
 			LocalNamespace:   localNamespace,
 			LocalName:        localVolume,
@@ -805,8 +1583,10 @@ func (dm *DotmeshAPI) RequestTransfer(
 			RemoteNamespace:  remoteNamespace,
 			RemoteName:       remoteVolume,
 			RemoteBranchName: deMasterify(remoteBranchName),
-			// TODO add TargetSnapshot here, to support specifying "push to a given
-			// snapshot" rather than just "push all snapshots up to the latest"
+			Codec:            opts.Codec,
+			BandwidthLimit:   opts.BandwidthLimit,
+			TargetCommit:     opts.TargetCommit,
+			S3:               remote.S3,
 		}, &transferId)
 	if err != nil {
 		return "", err
@@ -814,6 +1594,93 @@ func (dm *DotmeshAPI) RequestTransfer(
 	return transferId, nil
 }
 
+// The trailer the server sets on an export once it's written everything, to
+// "complete" if the archive is whole.
+const ARCHIVE_STATUS_TRAILER = "Dotmesh-Archive-Status"
+
+// export branchName of volumeName to w as an archive, of only the commits
+// after from (a commit id or HEAD^...) if it's given.
+func (dm *DotmeshAPI) ExportArchive(volumeName, branchName, from string, w io.Writer) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		from, err = dm.findCommit(from, volumeName, branchName)
+		if err != nil {
+			return err
+		}
+	}
+	query := url.Values{"branch": {deMasterify(branchName)}, "from": {from}}
+	req, err := dm.client.NewRequest(
+		"GET", fmt.Sprintf("/export/%s/%s?%s", namespace, name, query.Encode()), nil,
+	)
+	if err != nil {
+		return err
+	}
+	resp, err := dm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return archiveResponseError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	// only known once the body's been read
+	status := resp.Trailer.Get(ARCHIVE_STATUS_TRAILER)
+	if status != "complete" {
+		if status == "" {
+			status = "it ended early"
+		}
+		return fmt.Errorf("Export of %s failed: %s", volumeName, status)
+	}
+	return nil
+}
+
+// send an archive to the current remote, to be imported as volumeName (or
+// as whatever it was exported as, if that's ""). Returns the id of the
+// transfer which applies it.
+func (dm *DotmeshAPI) ImportArchive(r io.Reader, volumeName string) (string, error) {
+	path := "/import"
+	if volumeName != "" {
+		namespace, name, err := ParseNamespacedVolume(volumeName)
+		if err != nil {
+			return "", err
+		}
+		path += "?" + url.Values{"namespace": {namespace}, "name": {name}}.Encode()
+	}
+	req, err := dm.client.NewRequest("POST", path, r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := dm.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", archiveResponseError(resp)
+	}
+	transferId, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(transferId)), nil
+}
+
+func archiveResponseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("Permission denied. Please check that your API key is still valid.")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+}
+
 // FIXME: Put this in a shared library, as it duplicates the copy in
 // dotmesh-server/pkg/main/utils.go (now with a few differences)
 
@@ -0,0 +1,159 @@
+package remotes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Log in to a cluster with the OpenID Connect provider it's configured to use,
+// with the device code flow: tell the person where to go and what code to
+// enter there, wait for them to do it, then swap the ID token the provider
+// gives us for their user name and API key on the cluster.
+func OidcLogin(cluster *JsonRpcClient, out io.Writer) (string, string, error) {
+	config := struct{ Issuer, ClientId string }{}
+	err := clusterJson(cluster, "GET", "/oidc", nil, &config)
+	if err != nil {
+		return "", "", err
+	}
+
+	discovery := struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+		TokenEndpoint               string `json:"token_endpoint"`
+	}{}
+	err = getJson(strings.TrimSuffix(config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return "", "", err
+	}
+	if discovery.DeviceAuthorizationEndpoint == "" {
+		return "", "", fmt.Errorf("%s doesn't support logging in with a device code", config.Issuer)
+	}
+
+	device := struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationUri         string `json:"verification_uri"`
+		VerificationUriComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{}
+	err = postForm(discovery.DeviceAuthorizationEndpoint, url.Values{
+		"client_id": {config.ClientId},
+		"scope":     {"openid profile email groups"},
+	}, &device)
+	if err != nil {
+		return "", "", err
+	}
+	if device.VerificationUriComplete != "" {
+		fmt.Fprintf(out, "To log in, go to %s\n", device.VerificationUriComplete)
+		fmt.Fprintf(out, "and check the code is %s\n", device.UserCode)
+	} else {
+		fmt.Fprintf(out, "To log in, go to %s\n", device.VerificationUri)
+		fmt.Fprintf(out, "and enter the code %s\n", device.UserCode)
+	}
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	if device.ExpiresIn == 0 {
+		deadline = time.Now().Add(10 * time.Minute)
+	}
+	var idToken string
+	for idToken == "" {
+		if time.Now().After(deadline) {
+			return "", "", fmt.Errorf("Timed out waiting for you to log in, please try again")
+		}
+		time.Sleep(interval)
+		token := struct {
+			IdToken string `json:"id_token"`
+			Error   string `json:"error"`
+		}{}
+		err = postForm(discovery.TokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+			"client_id":   {config.ClientId},
+		}, &token)
+		if err != nil && token.Error == "" {
+			return "", "", err
+		}
+		switch token.Error {
+		case "":
+			if token.IdToken == "" {
+				return "", "", fmt.Errorf("%s didn't give us an ID token", config.Issuer)
+			}
+			idToken = token.IdToken
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", "", fmt.Errorf("Couldn't log in: %s", token.Error)
+		}
+	}
+
+	login := struct{ User, ApiKey string }{}
+	body, err := json.Marshal(struct{ IdToken string }{idToken})
+	if err != nil {
+		return "", "", err
+	}
+	err = clusterJson(cluster, "POST", "/oidc/login", bytes.NewBuffer(body), &login)
+	if err != nil {
+		return "", "", err
+	}
+	return login.User, login.ApiKey, nil
+}
+
+func clusterJson(cluster *JsonRpcClient, method, path string, body io.Reader, result interface{}) error {
+	req, err := cluster.NewRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := cluster.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func getJson(endpoint string, result interface{}) error {
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Decodes the response into result even if it's an error, which is how OAuth
+// endpoints say what's wrong.
+func postForm(endpoint string, form url.Values, result interface{}) error {
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got %s from %s", resp.Status, endpoint)
+	}
+	return err
+}
+
+func responseError(resp *http.Response) error {
+	message := make([]byte, 1024)
+	n, _ := io.ReadFull(resp.Body, message)
+	return fmt.Errorf("Got %s from %s: %s", resp.Status, resp.Request.URL, strings.TrimSpace(string(message[:n])))
+}
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -46,6 +47,23 @@ type Remote struct {
 	CurrentVolume        string
 	CurrentBranches      map[string]string
 	DefaultRemoteVolumes map[string]map[string]VolumeName
+	// whether the cluster speaks HTTPS (remotes added before it could don't
+	// use it), and the CA its certificate is pinned to, "" for the usual ones
+	TLS    bool   `json:",omitempty"`
+	CACert string `json:",omitempty"`
+	// set for remotes which are S3 buckets rather than clusters
+	S3 *S3Remote
+}
+
+// An S3 bucket (or anything which speaks the S3 API) which dots can be pushed
+// to and pulled from.
+type S3Remote struct {
+	Endpoint  string // e.g. "https://s3.amazonaws.com" or "http://localhost:9000"
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
 }
 
 type Configuration struct {
@@ -123,10 +141,16 @@ func (c *Configuration) GetCurrentRemote() string {
 func (c *Configuration) SetCurrentRemote(remote string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	_, ok := c.Remotes[remote]
+	r, ok := c.Remotes[remote]
 	if !ok {
 		return fmt.Errorf("No such remote '%s'", remote)
 	}
+	if r.S3 != nil {
+		return fmt.Errorf(
+			"'%s' is an S3 remote, you can push to and pull from it but not switch to it",
+			remote,
+		)
+	}
 	c.CurrentRemote = remote
 	return c.save()
 }
@@ -263,7 +287,7 @@ func (c *Configuration) SetCurrentBranchForVolume(volume, branch string) error {
 	return c.save()
 }
 
-func (c *Configuration) AddRemote(remote, user, hostname, apiKey string) error {
+func (c *Configuration) AddRemote(remote, user, hostname, apiKey string, tls bool, caCert string) error {
 	_, ok := c.Remotes[remote]
 	if ok {
 		return fmt.Errorf("Remote exists '%s'", remote)
@@ -272,7 +296,18 @@ func (c *Configuration) AddRemote(remote, user, hostname, apiKey string) error {
 		User:     user,
 		Hostname: hostname,
 		ApiKey:   apiKey,
+		TLS:      tls,
+		CACert:   caCert,
+	}
+	return c.save()
+}
+
+func (c *Configuration) AddS3Remote(remote string, s3 S3Remote) error {
+	_, ok := c.Remotes[remote]
+	if ok {
+		return fmt.Errorf("Remote exists '%s'", remote)
 	}
+	c.Remotes[remote] = &Remote{S3: &s3}
 	return c.save()
 }
 
@@ -299,6 +334,8 @@ func (c *Configuration) ClusterFromRemote(remote string) (*JsonRpcClient, error)
 		User:     remoteCreds.User,
 		Hostname: remoteCreds.Hostname,
 		ApiKey:   remoteCreds.ApiKey,
+		TLS:      remoteCreds.TLS,
+		CACert:   remoteCreds.CACert,
 	}, nil
 }
 
@@ -310,24 +347,14 @@ type JsonRpcClient struct {
 	User     string
 	Hostname string
 	ApiKey   string
+	TLS      bool
+	CACert   string
 }
 
-// call a method with string args, and attempt to decode it into result
-func (j *JsonRpcClient) CallRemote(
-	ctx context.Context, method string, args interface{}, result interface{},
-) error {
-	// create new span using span found in context as parent (if none is found,
-	// our span becomes the trace root).
-	span, ctx := opentracing.StartSpanFromContext(ctx, method)
-	span.LogFields(
-		opentracinglog.String("type", "cli-rpc"),
-		opentracinglog.String("method", method),
-		opentracinglog.String("args", fmt.Sprintf("%v", args)),
-	)
-	defer span.Finish()
-
+// an authenticated request for path (e.g. "/rpc") on the cluster
+func (j *JsonRpcClient) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
 	if j == nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"No remote cluster specified. List remotes with 'dm remote -v'. " +
 				"Choose one with 'dm remote switch' or create one with 'dm remote " +
 				"add'. Try 'dm cluster init' if you don't have a cluster yet.",
@@ -337,17 +364,42 @@ func (j *JsonRpcClient) CallRemote(
 	scheme := "http"
 	port := "6969"
 
+	if j.TLS {
+		scheme = "https"
+	}
 	if j.Hostname == "saas.dotmesh.io" || j.Hostname == "dothub.com" {
 		scheme = "https"
 		port = "443"
 	}
 
-	url := fmt.Sprintf("%s://%s:%s/rpc", scheme, j.Hostname, port)
+	url := fmt.Sprintf("%s://%s:%s%s", scheme, j.Hostname, port, path)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(j.User, j.ApiKey)
+	return req, nil
+}
+
+// call a method with string args, and attempt to decode it into result
+func (j *JsonRpcClient) CallRemote(
+	ctx context.Context, method string, args interface{}, result interface{},
+) error {
+	// create new span using span found in context as parent (if none is found,
+	// our span becomes the trace root).
+	span, ctx := opentracing.StartSpanFromContext(ctx, method)
+	span.LogFields(
+		opentracinglog.String("type", "cli-rpc"),
+		opentracinglog.String("method", method),
+		opentracinglog.String("args", fmt.Sprintf("%v", args)),
+	)
+	defer span.Finish()
+
 	message, err := json2.EncodeClientRequest(method, args)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(message))
+	req, err := j.NewRequest("POST", "/rpc", bytes.NewBuffer(message))
 	if err != nil {
 		return err
 	}
@@ -357,10 +409,8 @@ func (j *JsonRpcClient) CallRemote(
 	req = middleware.ToHTTPRequest(tracer)(req.WithContext(ctx))
 
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(j.User, j.ApiKey)
-	client := new(http.Client)
 
-	resp, err := client.Do(req)
+	resp, err := j.Do(req)
 	if err != nil {
 		return err
 	}
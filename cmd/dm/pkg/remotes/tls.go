@@ -0,0 +1,145 @@
+package remotes
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Do a request made with NewRequest, checking the cluster's certificate
+// against its pinned CA if it has one.
+func (j *JsonRpcClient) Do(req *http.Request) (*http.Response, error) {
+	if j.CACert == "" {
+		return http.DefaultClient.Do(req)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(j.CACert)) {
+		return nil, fmt.Errorf("Invalid CA certificate for %s, try adding the remote again", j.Hostname)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			// the names in a cluster's certificate often aren't the ones
+			// it's known by, but nobody else has its CA's key
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verifyIssuer(roots),
+		},
+	}}
+	return client.Do(req)
+}
+
+func verifyIssuer(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs, err := parseCertificates(rawCerts)
+		if err != nil {
+			return err
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates(certs)})
+		return err
+	}
+}
+
+func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("No certificate presented")
+	}
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func intermediates(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// Work out how to talk to a cluster securely, returning whether it speaks
+// HTTPS and the CA certificate to pin ("" if its certificate is signed by one
+// of the usual CAs). caCertFile pins a CA we've been given. Otherwise, like
+// ssh, we trust the CA the cluster presents the first time, and say what it
+// was so that it can be checked.
+//
+// While clusters are moving to HTTPS, ones which don't speak it yet are
+// talked to with plain HTTP, with a warning, unless DOTMESH_TLS=on.
+func ProbeTLS(hostname, caCertFile string, out io.Writer) (bool, string, error) {
+	if caCertFile != "" {
+		caCert, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return false, "", err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+			return false, "", fmt.Errorf("No certificates in %s", caCertFile)
+		}
+		return true, string(caCert), nil
+	}
+	if hostname == "saas.dotmesh.io" || hostname == "dothub.com" {
+		return true, "", nil
+	}
+	conn, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: 30 * time.Second}, "tcp", net.JoinHostPort(hostname, "6969"),
+		&tls.Config{InsecureSkipVerify: true},
+	)
+	if err != nil {
+		if _, ok := err.(tls.RecordHeaderError); ok {
+			if os.Getenv("DOTMESH_TLS") == "on" {
+				return false, "", fmt.Errorf(
+					"%s doesn't speak HTTPS, it may have an older dotmesh or DOTMESH_TLS=off. "+
+						"Use --insecure-http to talk to it anyway, but your API key and data "+
+						"will be sent unencrypted.", hostname,
+				)
+			}
+			fmt.Fprintf(out,
+				"Warning: %s doesn't speak HTTPS, so your API key and data will be sent to it "+
+					"unencrypted. Once it does, remove the remote and add it again.\n", hostname,
+			)
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	_, err = certs[0].Verify(x509.VerifyOptions{DNSName: hostname, Intermediates: intermediates(certs)})
+	if err == nil {
+		return true, "", nil
+	}
+	ca := certs[len(certs)-1]
+	if !ca.IsCA {
+		return false, "", fmt.Errorf(
+			"%s's certificate isn't signed by a CA we know (%s), use --ca-cert to say which it is",
+			hostname, err,
+		)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err = certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates(certs)})
+	if err != nil {
+		return false, "", fmt.Errorf("%s's certificate isn't signed by the CA it presents: %s", hostname, err)
+	}
+	fingerprint := sha256.Sum256(ca.Raw)
+	hex := []string{}
+	for _, b := range fingerprint {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+	fmt.Fprintf(out, "Trusting %s's CA '%s', with SHA-256 fingerprint\n%s\n",
+		hostname, ca.Subject.CommonName, strings.Join(hex, ":"))
+	fmt.Fprintf(out, "If that's not what you expected, remove the remote and add it with --ca-cert.\n")
+	return true, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})), nil
+}
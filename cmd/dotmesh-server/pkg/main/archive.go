@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Dots can be exported to, and imported from, archive files (.dmx) which can
+// be handed around without a second cluster. An archive is:
+//
+//   DOTMESH-ARCHIVE 1\n
+//   <ArchiveHeader as JSON>\n
+//   <section>...
+//
+// with a section per filesystem (branch) in the header, in the same order,
+// each holding the replication stream from the section's From to its last
+// snapshot. A section is the stream, compressed with the header's codec, in
+// chunks which are each a 4 byte big-endian length followed by that many
+// bytes. A zero length chunk ends the stream, and is followed by the hex
+// SHA-256 of the stream before compression.
+//
+// An archive exported --from a commit only has the commits after it, and
+// can be imported on top of a dot which has that commit.
+//
+// Importing spools the archive to a temporary file and then pulls from it,
+// as if it was a remote.
+
+const ARCHIVE_MAGIC = "DOTMESH-ARCHIVE 1\n"
+
+// Set on the response to an export once it's finished, "complete" if it all
+// made it into the archive, otherwise what went wrong.
+const ARCHIVE_STATUS_TRAILER = "Dotmesh-Archive-Status"
+const ARCHIVE_COMPLETE = "complete"
+
+type ArchiveHeader struct {
+	// the storage backend the streams came from, they can only be received
+	// by the same kind
+	Backend    string
+	Codec      string
+	Namespace  string
+	Name       string
+	BranchName string
+	// the path to the exported branch, which the sections are a (possibly
+	// incremental) part of
+	Path     PathToTopLevelFilesystem
+	Sections []ArchiveSection
+	Created  time.Time
+}
+
+type ArchiveSection struct {
+	FilesystemId string
+	// START_SNAPSHOT, a snapshot of FilesystemId, or a clone's fully
+	// qualified origin snapshot
+	From string
+	// the snapshots in the stream, with their metadata
+	Snapshots []*snapshot
+	// estimated size of the stream before compression, for progress
+	Size int64
+}
+
+// Writes each Write as a chunk. Close ends the section.
+type archiveChunkWriter struct {
+	w io.Writer
+}
+
+func (c archiveChunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err := binary.Write(c.w, binary.BigEndian, uint32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+func (c archiveChunkWriter) Close() error {
+	return binary.Write(c.w, binary.BigEndian, uint32(0))
+}
+
+// Reads a section's chunks as one stream, up to the zero length chunk.
+type archiveChunkReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (c *archiveChunkReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		err := binary.Read(c.r, binary.BigEndian, &c.remaining)
+		if err != nil {
+			return 0, fmt.Errorf("Archive is truncated: %s", err)
+		}
+		if c.remaining == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint32(n)
+	if err == io.EOF {
+		err = fmt.Errorf("Archive is truncated")
+	}
+	return n, err
+}
+
+// Read the checksum which follows a section's chunks.
+func readArchiveChecksum(r io.Reader) (string, error) {
+	checksum := make([]byte, 64)
+	_, err := io.ReadFull(r, checksum)
+	if err != nil {
+		return "", fmt.Errorf("Archive is truncated: %s", err)
+	}
+	return string(checksum), nil
+}
+
+func readArchiveHeader(r *bufio.Reader) (ArchiveHeader, error) {
+	header := ArchiveHeader{}
+	magic, err := r.ReadString('\n')
+	if err != nil || magic != ARCHIVE_MAGIC {
+		return header, fmt.Errorf("Not a dotmesh archive, or from a newer version of dotmesh")
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return header, fmt.Errorf("Can't read archive header: %s", err)
+	}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return header, fmt.Errorf("Can't read archive header: %s", err)
+	}
+	return header, nil
+}
+
+func writeArchiveHeader(w io.Writer, header ArchiveHeader) error {
+	serialized, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(ARCHIVE_MAGIC))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(serialized, '\n'))
+	return err
+}
+
+// The sections to export to get branchName of name onto a cluster which
+// already has commit from (or nothing, if from is ""). They follow the path
+// the way applyPath does.
+func (s *InMemoryState) archiveSections(
+	path PathToTopLevelFilesystem, from string,
+) ([]ArchiveSection, error) {
+	type step struct {
+		origin       Origin
+		filesystemId string
+		toSnapshotId string
+	}
+	steps := []step{}
+	for i := 0; i <= len(path.Clones); i++ {
+		st := step{filesystemId: path.TopLevelFilesystemId}
+		if i > 0 {
+			clone := path.Clones[i-1].Clone
+			st.origin = clone.Origin
+			st.filesystemId = clone.FilesystemId
+		}
+		if i < len(path.Clones) {
+			st.toSnapshotId = path.Clones[i].Clone.Origin.SnapshotId
+		}
+		steps = append(steps, st)
+	}
+
+	sections := []ArchiveSection{}
+	foundFrom := from == ""
+	for _, st := range steps {
+		snaps, err := s.snapshotsForCurrentMaster(st.filesystemId)
+		if err != nil {
+			return nil, err
+		}
+		restricted, err := restrictSnapshots(pointers(snaps), st.toSnapshotId)
+		if err != nil {
+			return nil, err
+		}
+		section := ArchiveSection{
+			FilesystemId: st.filesystemId,
+			From:         START_SNAPSHOT,
+			Snapshots:    restricted,
+		}
+		if st.origin.FilesystemId != "" {
+			section.From = fmt.Sprintf("%s@%s", st.origin.FilesystemId, st.origin.SnapshotId)
+		}
+		if !foundFrom {
+			for i, snap := range restricted {
+				if snap.Id == from {
+					foundFrom = true
+					section.From = from
+					section.Snapshots = restricted[i+1:]
+				}
+			}
+			if !foundFrom {
+				// the receiver already has all of this filesystem
+				continue
+			}
+		}
+		if len(section.Snapshots) > 0 {
+			sections = append(sections, section)
+		}
+	}
+	if !foundFrom {
+		return nil, fmt.Errorf("Commit %s isn't on the branch being exported", from)
+	}
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("There are no commits after %s to export", from)
+	}
+	return sections, nil
+}
+
+// GET /export/{namespace}/{name}?branch=<branch>&from=<commit> => an archive
+type ArchiveExporter struct {
+	state *InMemoryState
+}
+
+func (s *InMemoryState) NewArchiveExporter() http.Handler {
+	return ArchiveExporter{state: s}
+}
+
+func (a ArchiveExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := VolumeName{vars["namespace"], vars["name"]}
+	branchName := r.URL.Query().Get("branch")
+	if branchName == DEFAULT_BRANCH {
+		branchName = ""
+	}
+	from := r.URL.Query().Get("from")
+
+	fail := func(status int, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("[ArchiveExporter] %s", msg)
+		w.WriteHeader(status)
+		w.Write([]byte(msg + "\n"))
+	}
+
+	err := requireValidVolumeName(name)
+	if err != nil {
+		fail(http.StatusBadRequest, "%s", err)
+		return
+	}
+	tlf, err := a.state.registry.LookupFilesystem(name)
+	if err != nil {
+		fail(http.StatusNotFound, "Can't find %s: %s", name, err)
+		return
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		fail(http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if !authorized {
+		fail(http.StatusForbidden, "You don't have access to %s", name)
+		return
+	}
+	path, err := a.state.registry.deducePathToTopLevelFilesystem(name, branchName)
+	if err != nil {
+		fail(http.StatusNotFound, "Can't find %s: %s", name, err)
+		return
+	}
+	sections, err := a.state.archiveSections(path, from)
+	if err != nil {
+		fail(http.StatusBadRequest, "Can't export %s: %s", name, err)
+		return
+	}
+	for i, section := range sections {
+		if a.state.masterFor(section.FilesystemId) != a.state.myNodeId {
+			fail(
+				http.StatusNotFound,
+				"Host not master for %s (%s), export it from the node which is",
+				name, section.FilesystemId,
+			)
+			return
+		}
+		sections[i].Size, err = a.state.storage.PredictSize(
+			"", section.From, section.FilesystemId,
+			section.Snapshots[len(section.Snapshots)-1].Id, false,
+		)
+		if err != nil {
+			fail(http.StatusInternalServerError, "Can't predict size of %s: %s", name, err)
+			return
+		}
+	}
+	header := ArchiveHeader{
+		Backend:    a.state.storage.Name(),
+		Codec:      chooseCodec(codecPreferences(r.URL.Query().Get("codec")), localCodecs()),
+		Namespace:  name.Namespace,
+		Name:       name.Name,
+		BranchName: branchName,
+		Path:       path,
+		Sections:   sections,
+		Created:    time.Now().UTC(),
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", ARCHIVE_STATUS_TRAILER)
+	err = a.writeArchive(w, header)
+	if err != nil {
+		log.Printf("[ArchiveExporter] Exporting %s failed: %s", name, err)
+		w.Header().Set(ARCHIVE_STATUS_TRAILER, err.Error())
+		return
+	}
+	w.Header().Set(ARCHIVE_STATUS_TRAILER, ARCHIVE_COMPLETE)
+}
+
+func (a ArchiveExporter) writeArchive(w io.Writer, header ArchiveHeader) error {
+	err := writeArchiveHeader(w, header)
+	if err != nil {
+		return err
+	}
+	for _, section := range header.Sections {
+		toSnapshotId := section.Snapshots[len(section.Snapshots)-1].Id
+		pipeReader, pipeWriter := io.Pipe()
+		finished := make(chan bool)
+		checksum := newStreamChecksum()
+		go pipe(
+			pipeReader, fmt.Sprintf("send stream for %s", section.FilesystemId),
+			archiveChunkWriter{w}, "archive section",
+			finished,
+			make(chan *Event),
+			func(e *Event, c chan *Event) {},
+			func(bytes int64, t int64) {},
+			"compress", header.Codec, 0, checksum,
+		)
+		err = a.state.storage.Send(
+			"", section.From, section.FilesystemId, toSnapshotId, false, pipeWriter,
+		)
+		pipeWriter.Close()
+		<-finished
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(checksumString(checksum)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// POST /import?namespace=<namespace>&name=<name> with an archive => the id of
+// a transfer which applies it, which can be polled like any other.
+type ArchiveImporter struct {
+	state *InMemoryState
+}
+
+func (s *InMemoryState) NewArchiveImporter() http.Handler {
+	return ArchiveImporter{state: s}
+}
+
+func (a ArchiveImporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("[ArchiveImporter] %s", msg)
+		w.WriteHeader(status)
+		w.Write([]byte(msg + "\n"))
+	}
+
+	body := bufio.NewReader(r.Body)
+	header, err := readArchiveHeader(body)
+	if err != nil {
+		fail(http.StatusBadRequest, "%s", err)
+		return
+	}
+	if header.Backend != a.state.storage.Name() {
+		fail(
+			http.StatusBadRequest,
+			"Archive is of %s storage, it can't be imported into %s storage",
+			header.Backend, a.state.storage.Name(),
+		)
+		return
+	}
+	name := VolumeName{header.Namespace, header.Name}
+	if r.URL.Query().Get("name") != "" {
+		name = VolumeName{r.URL.Query().Get("namespace"), r.URL.Query().Get("name")}
+	}
+	err = requireValidVolumeName(name)
+	if err != nil {
+		fail(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	// the whole archive is kept until the transfer which applies it has
+	// finished with it
+	err = os.MkdirAll(archiveSpoolDir(), 0700)
+	if err != nil {
+		fail(http.StatusInternalServerError, "Can't spool archive: %s", err)
+		return
+	}
+	spool, err := ioutil.TempFile(archiveSpoolDir(), "dotmesh-import-")
+	if err != nil {
+		fail(http.StatusInternalServerError, "Can't spool archive: %s", err)
+		return
+	}
+	err = writeArchiveHeader(spool, header)
+	if err == nil {
+		_, err = io.Copy(spool, body)
+	}
+	spool.Close()
+	if err != nil {
+		os.Remove(spool.Name())
+		fail(http.StatusBadRequest, "Can't spool archive: %s", err)
+		return
+	}
+
+	transferId, err := a.startImport(r, name, header, spool.Name())
+	if err != nil {
+		os.Remove(spool.Name())
+		fail(http.StatusBadRequest, "Can't import into %s: %s", name, err)
+		return
+	}
+	w.Write([]byte(transferId))
+}
+
+func (a ArchiveImporter) startImport(
+	r *http.Request, name VolumeName, header ArchiveHeader, archive string,
+) (string, error) {
+	d := NewDotmeshRPC(a.state)
+	path := header.Path
+	path.TopLevelFilesystemName = name
+	filesystemId := path.TopLevelFilesystemId
+	if len(path.Clones) > 0 {
+		filesystemId = path.Clones[len(path.Clones)-1].Clone.FilesystemId
+	}
+
+	tlf, err := a.state.registry.LookupFilesystem(name)
+	if err == nil {
+		err = requireAuthorized(tlf.Authorize, r, tlf, "import into")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	localFilesystemId := a.state.registry.Exists(name, header.BranchName)
+	if localFilesystemId == "" {
+		err := d.registerFilesystemBecomeMaster(
+			r.Context(), name.Namespace, name.Name, header.BranchName, filesystemId, path,
+		)
+		if err != nil {
+			return "", err
+		}
+	} else if localFilesystemId != filesystemId {
+		return "", fmt.Errorf(
+			"Cannot reconcile filesystems with different ids, archive=%s, local=%s",
+			filesystemId, localFilesystemId,
+		)
+	} else {
+		if a.state.masterFor(filesystemId) != a.state.myNodeId {
+			return "", fmt.Errorf(
+				"Host not master for %s, import it on the node which is", name,
+			)
+		}
+		dirtyBytes, cs, err := d.localDirtyBytesAndContainers(r.Context(), filesystemId)
+		if err != nil {
+			return "", err
+		}
+		err = refuseBusyTransferTarget(dirtyBytes, cs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var transferId string
+	err = d.startTransfer(filesystemId, &TransferRequest{
+		Direction:        "pull",
+		LocalNamespace:   name.Namespace,
+		LocalName:        name.Name,
+		LocalBranchName:  header.BranchName,
+		RemoteNamespace:  header.Namespace,
+		RemoteName:       header.Name,
+		RemoteBranchName: header.BranchName,
+		Archive:          archive,
+	}, &transferId)
+	return transferId, err
+}
+
+func openArchive(archive string) (*os.File, *bufio.Reader, ArchiveHeader, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, ArchiveHeader{}, err
+	}
+	reader := bufio.NewReader(file)
+	header, err := readArchiveHeader(reader)
+	if err != nil {
+		file.Close()
+		return nil, nil, header, err
+	}
+	return file, reader, header, nil
+}
+
+// A transferFn which applies the section of the archive being imported for
+// toFilesystemId, if there is one.
+func (f *fsMachine) archivePull(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	transferRequestId string, pollResult *TransferPollResult,
+	client *JsonRpcClient, transferRequest *TransferRequest,
+) (*Event, stateFn) {
+	file, reader, header, err := openArchive(transferRequest.Archive)
+	if err != nil {
+		return &Event{
+			Name: "failed-opening-archive", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	defer file.Close()
+
+	fsMachine, err := f.state.maybeFilesystem(toFilesystemId)
+	if err != nil {
+		return &Event{
+			Name: "archive-pull-cant-find-filesystem-id",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	fsMachine.snapshotsLock.Lock()
+	localSnaps := fsMachine.filesystem.snapshots
+	fsMachine.snapshotsLock.Unlock()
+
+	// skip the sections before ours
+	var section *ArchiveSection
+	for i := range header.Sections {
+		if header.Sections[i].FilesystemId == toFilesystemId {
+			section = &header.Sections[i]
+			break
+		}
+		_, err = io.Copy(ioutil.Discard, &archiveChunkReader{r: reader})
+		if err == nil {
+			_, err = readArchiveChecksum(reader)
+		}
+		if err != nil {
+			return &Event{
+				Name: "failed-reading-archive", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+	}
+
+	local := map[string]bool{}
+	for _, snap := range localSnaps {
+		local[snap.Id] = true
+	}
+	if section == nil {
+		// an incremental archive which starts after this filesystem, which
+		// we need to have already
+		if len(localSnaps) == 0 {
+			return &Event{
+				Name: "archive-needs-earlier-commits",
+				Args: &EventArgs{"err": fmt.Errorf(
+					"The archive is incremental, and %s doesn't have the commits it's based on",
+					toFilesystemId,
+				)},
+			}, backoffState
+		}
+		return &Event{Name: "peer-up-to-date"}, backoffState
+	}
+	latest := section.Snapshots[len(section.Snapshots)-1]
+	if local[latest.Id] {
+		pollResult.Status = "finished"
+		pollResult.Message = "already up-to-date, nothing to do"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		return &Event{Name: "peer-up-to-date"}, backoffState
+	}
+	if len(localSnaps) > 0 && localSnaps[len(localSnaps)-1].Id != section.From {
+		return &Event{
+			Name: "archive-doesnt-apply",
+			Args: &EventArgs{"err": fmt.Errorf(
+				"The archive's commits for %s follow %s, but the latest commit here is %s",
+				toFilesystemId, section.From, localSnaps[len(localSnaps)-1].Id,
+			)},
+		}, backoffState
+	}
+	if len(localSnaps) == 0 && (section.From != START_SNAPSHOT && !strings.Contains(section.From, "@")) {
+		return &Event{
+			Name: "archive-needs-earlier-commits",
+			Args: &EventArgs{"err": fmt.Errorf(
+				"The archive is incremental from %s, which %s doesn't have",
+				section.From, toFilesystemId,
+			)},
+		}, backoffState
+	}
+
+	pollResult.FilesystemId = toFilesystemId
+	pollResult.StartingCommit = section.From
+	pollResult.TargetCommit = latest.Id
+	pollResult.Codec = header.Codec
+	pollResult.Size = section.Size
+	pollResult.Sent = 0
+	pollResult.Status = "pulling"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	err = validateCodec(header.Codec)
+	if err == nil {
+		codecName, _ := splitCodec(header.Codec)
+		if !containsString(localCodecs(), codecName) {
+			err = fmt.Errorf("Codec %s isn't supported here", header.Codec)
+		}
+	}
+	if err != nil {
+		return &Event{
+			Name: "unsupported-codec-in-archive", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	finished := make(chan bool)
+	checksum := newStreamChecksum()
+	startTime := time.Now().UnixNano()
+	chunks := &archiveChunkReader{r: reader}
+	go pipe(
+		chunks, fmt.Sprintf("archive section for %s", toFilesystemId),
+		pipeWriter, "receive stream",
+		finished,
+		f.innerRequests,
+		func(e *Event, c chan *Event) { c <- e },
+		func(bytes int64, t int64) {
+			pollResult.Sent = bytes
+			pollResult.NanosecondsElapsed = time.Now().UnixNano() - startTime
+			err := updatePollResult(transferRequestId, *pollResult)
+			if err != nil {
+				log.Printf("Error updating poll result: %s", err)
+			}
+		},
+		"decompress", header.Codec, 0, checksum,
+	)
+	err = receiveWithoutResume(f.state.storage, toFilesystemId, pipeReader)
+	pipeReader.Close()
+	<-finished
+	if err == nil {
+		// the decompressor may stop short of the end of the section
+		_, err = io.Copy(ioutil.Discard, chunks)
+	}
+	if err != nil {
+		return &Event{
+			Name: "failed-receiving-archive",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	expected, err := readArchiveChecksum(reader)
+	if err == nil && expected != checksumString(checksum) {
+		err = &ChecksumMismatch{Expected: expected, Actual: checksumString(checksum)}
+	}
+	if err != nil {
+		args := EventArgs{"err": err, "filesystemId": toFilesystemId}
+		rollbackErr := rollbackReceive(f.state.storage, toFilesystemId, section.From)
+		if rollbackErr != nil {
+			args["rollbackErr"] = rollbackErr
+		}
+		return &Event{Name: "checksum-mismatch-in-archive", Args: &args}, backoffState
+	}
+	err = applyPrelude(f.state.storage, Prelude{SnapshotProperties: section.Snapshots}, toFilesystemId)
+	if err != nil {
+		return &Event{
+			Name: "failed-applying-prelude",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+
+	pollResult.Status = "finished"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "error-updating-poll-result", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{Name: "finished-pull"}, discoveringState
+}
+
+// The path to the branch an archive being imported is of.
+func archivePathToTopLevelFilesystem(transferRequest TransferRequest) (PathToTopLevelFilesystem, error) {
+	file, _, header, err := openArchive(transferRequest.Archive)
+	if err != nil {
+		return PathToTopLevelFilesystem{}, err
+	}
+	file.Close()
+	path := header.Path
+	path.TopLevelFilesystemName = VolumeName{
+		transferRequest.LocalNamespace, transferRequest.LocalName,
+	}
+	return path, nil
+}
+
+// Where archives being imported are spooled to.
+func archiveSpoolDir() string {
+	return filepath.Join(os.TempDir(), "dotmesh-imports")
+}
+
+func removeImportedArchive(transferRequest TransferRequest) {
+	if transferRequest.Archive == "" {
+		return
+	}
+	// only ever remove what we spooled
+	if filepath.Dir(filepath.Clean(transferRequest.Archive)) != archiveSpoolDir() {
+		log.Printf("[removeImportedArchive] Not removing %s, it isn't in %s", transferRequest.Archive, archiveSpoolDir())
+		return
+	}
+	err := os.Remove(transferRequest.Archive)
+	if err != nil {
+		log.Printf("[removeImportedArchive] %s", err)
+	}
+}
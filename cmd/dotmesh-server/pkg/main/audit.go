@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+	rpc "github.com/gorilla/rpc/v2"
+	"golang.org/x/net/context"
+)
+
+// The audit log records who did what: every RPC which changes something, and
+// every request to the replication endpoints, with who made it, how they
+// authenticated, where from, the arguments (with secrets redacted), how it
+// went and how long it took. It's appended to a local file (AUDIT_LOG_PATH),
+// rotated when it gets big, and also to etcd if AUDIT_LOG_ETCD is set, so
+// that the whole cluster's log can be seen from any node. The admin user can
+// read it with 'dm audit'.
+type AuditEntry struct {
+	Time                  time.Time
+	Node                  string
+	UserId                string
+	User                  string `json:",omitempty"`
+	PasswordAuthenticated bool
+	// the name of the API token used, if one was
+	Token    string `json:",omitempty"`
+	SourceIP string
+	// e.g. "DotmeshRPC.Rollback", or the name of an HTTP endpoint such as
+	// "zfs-receiver"
+	Method string
+	// the dot acted on, if it's clear from the arguments
+	Dot  string          `json:",omitempty"`
+	Args json.RawMessage `json:",omitempty"`
+	// "ok", or what went wrong
+	Result          string
+	DurationSeconds float64
+}
+
+// Which entries 'dm audit' wants, newest first.
+type AuditFilter struct {
+	// a user name or id
+	User   string
+	Method string
+	// e.g. "admin/apples"
+	Dot   string
+	Since time.Time
+	// DEFAULT_AUDIT_LIMIT if 0
+	Limit int
+}
+
+const DEFAULT_AUDIT_LOG_PATH = "/var/lib/dotmesh/audit.log"
+
+// the log is rotated when it reaches this size, keeping this many old ones
+// (audit.log.1 being the newest)
+const AUDIT_LOG_MAX_BYTES = 10 * 1024 * 1024
+const AUDIT_LOG_KEEP = 5
+
+// how long entries are kept in etcd
+const AUDIT_ETCD_TTL = 30 * 24 * time.Hour
+
+const DEFAULT_AUDIT_LIMIT = 100
+
+// arguments bigger than this are summarized rather than recorded
+const MAX_AUDIT_ARGS = 4096
+
+// RPCs which change something, and so are audited
+var auditedRPCs = map[string]bool{
+	"Procure": true, "ResetApiKey": true, "UpdatePassword": true, "RegisterNewUser": true,
+	"UpdateUserPaymentDetails": true, "Create": true, "SwitchContainers": true, "Commit": true,
+	"Rollback": true, "Branch": true, "RegisterFilesystem": true, "RegisterTransfer": true,
+	"Transfer": true, "AddCollaborator": true, "SetReplicationSchedule": true, "SetPolicy": true,
+	"SetCommitHooks": true, "AddWebhook": true, "RemoveWebhook": true, "Tag": true,
+	"DeleteTag": true, "ReplicateTags": true, "SetBranchProtection": true, "Delete": true,
+	"SetDebugFlag": true, "CreateApiToken": true, "RevokeApiToken": true, "CreateOrganization": true,
+	"AddOrganizationMember": true, "RemoveOrganizationMember": true, "RemoveCollaborator": true,
+	"CancelTransfer": true,
+}
+
+type auditLog struct {
+	nodeId string
+	path   string
+	toEtcd bool
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAuditLog(nodeId string) *auditLog {
+	path := os.Getenv("AUDIT_LOG_PATH")
+	if path == "" {
+		path = DEFAULT_AUDIT_LOG_PATH
+	}
+	toEtcd := os.Getenv("AUDIT_LOG_ETCD")
+	return &auditLog{
+		nodeId: nodeId,
+		path:   path,
+		toEtcd: toEtcd != "" && toEtcd != "0" && toEtcd != "false",
+	}
+}
+
+func (a *auditLog) record(entry AuditEntry) {
+	entry.Node = a.nodeId
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[auditLog] Unable to serialize %+v: %s", entry, err)
+		return
+	}
+	err = a.append(append(serialized, '\n'))
+	if err != nil {
+		log.Printf("[auditLog] Unable to write to %s: %s", a.path, err)
+	}
+	if a.toEtcd {
+		go func() {
+			kapi, err := getEtcdKeysApi()
+			if err == nil {
+				_, err = kapi.CreateInOrder(
+					context.Background(), fmt.Sprintf("%s/audit", ETCD_PREFIX), string(serialized),
+					&client.CreateInOrderOptions{TTL: AUDIT_ETCD_TTL},
+				)
+			}
+			if err != nil {
+				log.Printf("[auditLog] Unable to record entry in etcd: %s", err)
+			}
+		}()
+	}
+}
+
+func (a *auditLog) append(line []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil && a.size+int64(len(line)) > AUDIT_LOG_MAX_BYTES {
+		a.file.Close()
+		a.file = nil
+		for i := AUDIT_LOG_KEEP - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		err := os.Rename(a.path, a.path+".1")
+		if err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		err := os.MkdirAll(filepath.Dir(a.path), 0700)
+		if err != nil {
+			return err
+		}
+		a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := a.file.Stat()
+		if err != nil {
+			return err
+		}
+		a.size = info.Size()
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.User == "" || f.User == entry.User || f.User == entry.UserId) &&
+		(f.Method == "" || f.Method == entry.Method || "DotmeshRPC."+f.Method == entry.Method) &&
+		(f.Dot == "" || f.Dot == entry.Dot) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since))
+}
+
+// The latest entries matching filter, newest first. They come from etcd if
+// entries are being stored there, so that they cover the whole cluster, or
+// else from this node's files.
+func (a *auditLog) query(filter AuditFilter) ([]AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_AUDIT_LIMIT
+	}
+	// oldest first
+	lines := [][]byte{}
+	if a.toEtcd {
+		kapi, err := getEtcdKeysApi()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := kapi.Get(
+			context.Background(), fmt.Sprintf("%s/audit", ETCD_PREFIX),
+			&client.GetOptions{Recursive: true, Sort: true},
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			for _, node := range resp.Node.Nodes {
+				lines = append(lines, []byte(node.Value))
+			}
+		}
+	} else {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		paths := []string{}
+		for i := AUDIT_LOG_KEEP; i > 0; i-- {
+			paths = append(paths, fmt.Sprintf("%s.%d", a.path, i))
+		}
+		for _, path := range append(paths, a.path) {
+			f, err := os.Open(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				lines = append(lines, append([]byte{}, scanner.Bytes()...))
+			}
+			f.Close()
+		}
+	}
+	entries := []AuditEntry{}
+	for i := len(lines) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := AuditEntry{}
+		if json.Unmarshal(lines[i], &entry) != nil {
+			continue
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Replace the values of anything which looks like a secret, e.g. passwords,
+// API keys and S3 secret keys, the way safeArgs does for transfers.
+func redactSecrets(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, inner := range value {
+			lower := strings.ToLower(key)
+			if strings.Contains(lower, "password") || strings.Contains(lower, "apikey") ||
+				strings.Contains(lower, "secret") || strings.Contains(lower, "token") {
+				value[key] = "<redacted>"
+			} else {
+				value[key] = redactSecrets(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range value {
+			value[i] = redactSecrets(inner)
+		}
+	}
+	return v
+}
+
+// The decoded arguments of an RPC, nil if there aren't any.
+func rpcArgs(params json.RawMessage) interface{} {
+	var args interface{}
+	if len(params) == 0 || json.Unmarshal(params, &args) != nil {
+		return nil
+	}
+	// gorilla's json codec sends a one element array of params
+	if list, ok := args.([]interface{}); ok && len(list) == 1 {
+		args = list[0]
+	}
+	return args
+}
+
+// The redacted arguments of an RPC, and the dot they're about if they say.
+func auditArgs(params json.RawMessage) (json.RawMessage, string) {
+	args := rpcArgs(params)
+	if args == nil {
+		return nil, ""
+	}
+	args = redactSecrets(args)
+	dot := ""
+	if fields, ok := args.(map[string]interface{}); ok {
+		for _, prefix := range []string{"", "Local"} {
+			namespace, _ := fields[prefix+"Namespace"].(string)
+			name, _ := fields[prefix+"Name"].(string)
+			if namespace != "" && name != "" {
+				dot = namespace + "/" + name
+				break
+			}
+		}
+	}
+	serialized, err := json.Marshal(args)
+	if err != nil {
+		return nil, dot
+	}
+	if len(serialized) > MAX_AUDIT_ARGS {
+		serialized, _ = json.Marshal(fmt.Sprintf("<%d bytes of arguments>", len(serialized)))
+	}
+	return serialized, dot
+}
+
+// Who's making an authenticated request, from where.
+func auditEntryFor(r *http.Request) AuditEntry {
+	entry := AuditEntry{Time: time.Now().UTC(), SourceIP: r.RemoteAddr}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.SourceIP = host
+	}
+	entry.UserId, _ = r.Context().Value("authenticated-user-id").(string)
+	entry.PasswordAuthenticated, _ = r.Context().Value("password-authenticated").(bool)
+	if token, _ := r.Context().Value("api-token").(*ApiToken); token != nil {
+		entry.Token = token.Name
+	}
+	if user, err := GetUserById(entry.UserId); err == nil {
+		entry.User = user.Name
+	}
+	return entry
+}
+
+// keeps the status of a response, and the start of its body if asked to
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	keepBody    bool
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.keepBody && w.body.Len() < 64*1024 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Audit the RPCs in auditedRPCs. Like timeRPCs, this peeks in the request's
+// body for the method, and in the response's for how it went.
+func (a *auditLog) auditRPCs(server *rpc.Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readAndRestoreBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := struct {
+			Method string
+			Params json.RawMessage
+		}{}
+		json.Unmarshal(body, &request)
+		pieces := strings.SplitN(request.Method, ".", 2)
+		if len(pieces) != 2 || !server.HasMethod(request.Method) || !auditedRPCs[pieces[1]] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		entry := auditEntryFor(r)
+		entry.Method = request.Method
+		entry.Args, entry.Dot = auditArgs(request.Params)
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK, keepBody: true}
+		handler.ServeHTTP(recorder, r)
+		entry.DurationSeconds = time.Since(entry.Time).Seconds()
+		entry.Result = rpcResult(recorder)
+		a.record(entry)
+	})
+}
+
+func rpcResult(recorder *auditResponseWriter) string {
+	if recorder.status < 200 || recorder.status >= 300 {
+		return fmt.Sprintf("HTTP status %d", recorder.status)
+	}
+	response := struct {
+		Error json.RawMessage
+	}{}
+	err := json.Unmarshal(recorder.body.Bytes(), &response)
+	if err != nil {
+		return "unreadable response"
+	}
+	if len(response.Error) == 0 || string(response.Error) == "null" {
+		return "ok"
+	}
+	// json2 errors are objects with a message
+	rpcErr := struct{ Message string }{}
+	if json.Unmarshal(response.Error, &rpcErr) == nil && rpcErr.Message != "" {
+		return rpcErr.Message
+	}
+	return string(response.Error)
+}
+
+// Audit every request to an HTTP endpoint, e.g. the replication ones, as
+// method.
+func (a *auditLog) auditHTTP(method string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntryFor(r)
+		entry.Method = method
+		entry.Args, _ = json.Marshal(map[string]string{
+			"Method": r.Method, "Path": r.URL.Path, "Query": r.URL.RawQuery,
+		})
+		vars, query := mux.Vars(r), r.URL.Query()
+		if vars["namespace"] != "" {
+			entry.Dot = vars["namespace"] + "/" + vars["name"]
+		} else if query.Get("namespace") != "" {
+			entry.Dot = query.Get("namespace") + "/" + query.Get("name")
+		}
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		entry.DurationSeconds = time.Since(entry.Time).Seconds()
+		entry.Result = "ok"
+		if recorder.status < 200 || recorder.status >= 300 {
+			entry.Result = fmt.Sprintf("HTTP status %d", recorder.status)
+		}
+		a.record(entry)
+	})
+}
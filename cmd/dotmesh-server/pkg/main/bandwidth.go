@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Bandwidth limits for replication between clusters, in bytes per second.
+// A transfer can ask for a limit (TransferRequest.BandwidthLimit), otherwise
+// the server's REPLICATION_BANDWIDTH_LIMIT (e.g. "10M") applies. The
+// initiator tells the peer its limit in BANDWIDTH_LIMIT_HEADER, and the peer
+// applies that or its own default, whichever is lower.
+//
+// Replication between the nodes of a cluster isn't limited.
+
+const BANDWIDTH_LIMIT_HEADER = "Dotmesh-Bandwidth-Limit"
+
+// "10M" => 10485760. Accepts a number of bytes with an optional K, M or G
+// suffix (powers of 1024), and an optional "/s".
+func parseBandwidth(s string) (int64, error) {
+	spec := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	spec = strings.TrimSuffix(strings.TrimSuffix(spec, "IB"), "B")
+	multiplier := int64(1)
+	if len(spec) > 0 {
+		switch spec[len(spec)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			spec = spec[:len(spec)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(spec, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf(
+			"Invalid bandwidth limit '%s', try something like '512K' or '10M'", s,
+		)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func defaultBandwidthLimit() int64 {
+	setting := os.Getenv("REPLICATION_BANDWIDTH_LIMIT")
+	if setting == "" {
+		return 0
+	}
+	limit, err := parseBandwidth(setting)
+	if err != nil {
+		log.Printf("[defaultBandwidthLimit] Ignoring REPLICATION_BANDWIDTH_LIMIT: %s", err)
+		return 0
+	}
+	return limit
+}
+
+// the lower of two limits, where 0 means unlimited
+func lowerBandwidthLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// The limit for a transfer we're initiating.
+func transferBandwidthLimit(transferRequest *TransferRequest) int64 {
+	if transferRequest.BandwidthLimit > 0 {
+		return transferRequest.BandwidthLimit
+	}
+	return defaultBandwidthLimit()
+}
+
+func formatBandwidth(limit int64) string {
+	return fmt.Sprintf("%.2fMiB/s", float64(limit)/(1024*1024))
+}
+
+// Tell the peer what limit we're transferring at.
+func requestBandwidthLimit(limit int64, req *http.Request) {
+	if limit > 0 {
+		req.Header.Set(BANDWIDTH_LIMIT_HEADER, fmt.Sprintf("%d", limit))
+	}
+}
+
+// The limit for serving a replication request, given the limit the initiator
+// asked for and our own default (which doesn't apply within the cluster).
+func (s *InMemoryState) servingBandwidthLimit(r *http.Request) int64 {
+	var requested int64
+	if header := r.Header.Get(BANDWIDTH_LIMIT_HEADER); header != "" {
+		limit, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			log.Printf("[servingBandwidthLimit] Ignoring bad %s header: %s", BANDWIDTH_LIMIT_HEADER, err)
+		} else {
+			requested = limit
+		}
+	}
+	if s.fromClusterNode(r) {
+		return requested
+	}
+	return lowerBandwidthLimit(requested, defaultBandwidthLimit())
+}
+
+// whether a request came from one of the nodes in this cluster
+func (s *InMemoryState) fromClusterNode(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	s.serverAddressesCacheLock.Lock()
+	defer s.serverAddressesCacheLock.Unlock()
+	for _, addresses := range *s.serverAddressesCache {
+		if containsString(strings.Split(addresses, ","), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps the average rate of whatever's counted by wait below limit bytes per
+// second.
+type rateLimiter struct {
+	limit int64
+	start time.Time
+	bytes int64
+}
+
+func newRateLimiter(limit int64) *rateLimiter {
+	return &rateLimiter{limit: limit, start: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.bytes += int64(n)
+	due := time.Duration(float64(l.bytes) / float64(l.limit) * float64(time.Second))
+	if ahead := due - time.Since(l.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	t.limiter.wait(len(p))
+	return t.w.Write(p)
+}
+
+// Cluster-wide replication schedule, e.g. {"Windows": ["22:00-06:00"]}.
+// Transfers started outside all of the windows are queued until one opens.
+// Times are UTC so that all the nodes agree.
+type ReplicationSchedule struct {
+	Windows []string
+}
+
+type replicationWindow struct {
+	start, end time.Duration // since midnight
+}
+
+// "22:00-06:00" => 22h, 6h
+func parseReplicationWindow(s string) (replicationWindow, error) {
+	invalid := fmt.Errorf("Invalid replication window '%s', try something like '22:00-06:00'", s)
+	shrapnel := strings.Split(strings.TrimSpace(s), "-")
+	if len(shrapnel) != 2 {
+		return replicationWindow{}, invalid
+	}
+	times := []time.Duration{}
+	for _, hhmm := range shrapnel {
+		t, err := time.Parse("15:04", strings.TrimSpace(hhmm))
+		if err != nil {
+			return replicationWindow{}, invalid
+		}
+		times = append(times, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	if times[0] == times[1] {
+		return replicationWindow{}, fmt.Errorf("Replication window '%s' is empty", s)
+	}
+	return replicationWindow{start: times[0], end: times[1]}, nil
+}
+
+func (s ReplicationSchedule) validate() error {
+	for _, w := range s.Windows {
+		_, err := parseReplicationWindow(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How long until one of the windows is open at now, 0 if one already is (or
+// there aren't any).
+func (s ReplicationSchedule) untilOpen(now time.Time) time.Duration {
+	if len(s.Windows) == 0 {
+		return 0
+	}
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	sinceMidnight := now.Sub(midnight)
+	var soonest time.Duration = -1
+	for _, spec := range s.Windows {
+		w, err := parseReplicationWindow(spec)
+		if err != nil {
+			log.Printf("[untilOpen] ignoring %s", err)
+			continue
+		}
+		var open bool
+		if w.start < w.end {
+			open = sinceMidnight >= w.start && sinceMidnight < w.end
+		} else {
+			// wraps around midnight
+			open = sinceMidnight >= w.start || sinceMidnight < w.end
+		}
+		if open {
+			return 0
+		}
+		wait := w.start - sinceMidnight
+		if wait < 0 {
+			wait += 24 * time.Hour
+		}
+		if soonest == -1 || wait < soonest {
+			soonest = wait
+		}
+	}
+	if soonest == -1 {
+		return 0
+	}
+	return soonest
+}
+
+func replicationScheduleKey() string {
+	return fmt.Sprintf("%s/replication/schedule", ETCD_PREFIX)
+}
+
+func getReplicationSchedule() (ReplicationSchedule, error) {
+	schedule := ReplicationSchedule{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return schedule, err
+	}
+	resp, err := kapi.Get(context.Background(), replicationScheduleKey(), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return schedule, nil
+		}
+		return schedule, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &schedule)
+	return schedule, err
+}
+
+func setReplicationSchedule(schedule ReplicationSchedule) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	if len(schedule.Windows) == 0 {
+		_, err = kapi.Delete(context.Background(), replicationScheduleKey(), nil)
+		if err != nil && client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	serialized, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(context.Background(), replicationScheduleKey(), string(serialized), nil)
+	return err
+}
+
+// How often a queued transfer checks the schedule, and whether it's been
+// cancelled.
+const QUEUED_TRANSFER_CHECK_INTERVAL = 10 * time.Second
+
+func queuedMessage(schedule ReplicationSchedule, wait time.Duration) string {
+	return fmt.Sprintf(
+		"waiting for replication window %s UTC, opens in %s",
+		strings.Join(schedule.Windows, ", "), wait.Round(time.Minute),
+	)
+}
+
+// Hold a transfer until the replication schedule allows it to run, reporting
+// it as queued in the meantime, then hand it to the filesystem's state
+// machine. That way the dot carries on working while it waits. The schedule
+// is checked again as it waits, so changing it takes effect for transfers
+// which are already queued, and CancelTransfer stops it.
+func (s *InMemoryState) queueTransfer(
+	filesystemId, transferRequestId string, transferRequest TransferRequest, e *Event,
+) error {
+	schedule, err := getReplicationSchedule()
+	if err != nil {
+		return err
+	}
+	pollResult := TransferPollResultFromTransferRequest(
+		transferRequestId, transferRequest, s.myNodeId, 1, 1, "queued",
+	)
+	pollResult.Message = queuedMessage(schedule, schedule.untilOpen(time.Now()))
+	err = updatePollResult(transferRequestId, pollResult)
+	if err != nil {
+		return err
+	}
+	log.Printf("[queueTransfer] %s: %s", transferRequestId, pollResult.Message)
+
+	go func() {
+		for {
+			time.Sleep(QUEUED_TRANSFER_CHECK_INTERVAL)
+			if s.queuedTransferCancelled(transferRequestId) {
+				log.Printf("[queueTransfer] %s: cancelled", transferRequestId)
+				removeImportedArchive(transferRequest)
+				return
+			}
+			schedule, err := getReplicationSchedule()
+			if err != nil {
+				log.Printf("[queueTransfer] %s: can't check schedule, trying again: %s", transferRequestId, err)
+				continue
+			}
+			wait := schedule.untilOpen(time.Now())
+			if wait == 0 {
+				break
+			}
+			message := queuedMessage(schedule, wait)
+			if message != pollResult.Message {
+				pollResult.Message = message
+				err = updatePollResult(transferRequestId, pollResult)
+				if err != nil {
+					log.Printf("[queueTransfer] %s: can't update poll result: %s", transferRequestId, err)
+				}
+			}
+		}
+		log.Printf("[queueTransfer] %s: window open, starting", transferRequestId)
+		err := s.dispatchTransfer(filesystemId, transferRequestId, transferRequest, e)
+		if err != nil {
+			pollResult.Status = "error"
+			pollResult.Message = fmt.Sprintf("Couldn't start transfer: %s", err)
+			updatePollResult(transferRequestId, pollResult)
+			removeImportedArchive(transferRequest)
+		}
+	}()
+	return nil
+}
+
+// Whether CancelTransfer has been called for a queued transfer, which leaves
+// it in the error state.
+func (s *InMemoryState) queuedTransferCancelled(transferRequestId string) bool {
+	s.interclusterTransfersLock.Lock()
+	defer s.interclusterTransfersLock.Unlock()
+	transfer, ok := (*s.interclusterTransfers)[transferRequestId]
+	// it won't be there until etcd tells us about it
+	return ok && transfer.Status != "queued"
+}
+
+// Make the master of a (possibly nonexisting) filesystem start pulling or
+// pushing it, updating status as it goes in a new pollable "transfers" object
+// in etcd.
+func (s *InMemoryState) dispatchTransfer(
+	filesystemId, transferRequestId string, transferRequest TransferRequest, e *Event,
+) error {
+	responseChan, _, err := s.globalFsRequestWithId(filesystemId, transferRequestId, e)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// asynchronously throw away the response, transfers can be polled via
+		// their own entries in etcd
+		e := <-responseChan
+		log.Printf("finished transfer of %+v, %+v", safeArgs(transferRequest), e)
+	}()
+	return nil
+}
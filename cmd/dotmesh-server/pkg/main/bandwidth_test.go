@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected int64
+		ok       bool
+	}{
+		{"1000", 1000, true},
+		{"512K", 512 * 1024, true},
+		{"10M", 10 * 1024 * 1024, true},
+		{"10m/s", 10 * 1024 * 1024, true},
+		{"10MB/s", 10 * 1024 * 1024, true},
+		{"10MiB", 10 * 1024 * 1024, true},
+		{"1.5G", 3 * 512 * 1024 * 1024, true},
+		{" 2K ", 2048, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"-1M", 0, false},
+		{"fast", 0, false},
+	} {
+		limit, err := parseBandwidth(test.spec)
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error %s", test.spec, err)
+			continue
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: expected an error, got %d", test.spec, limit)
+			continue
+		}
+		if limit != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.spec, test.expected, limit)
+		}
+	}
+}
+
+func TestUntilOpen(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", "2018-03-01 "+hhmm)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	for _, test := range []struct {
+		windows  []string
+		now      string
+		expected time.Duration
+	}{
+		{nil, "12:00", 0},
+		{[]string{"09:00-17:00"}, "12:00", 0},
+		{[]string{"09:00-17:00"}, "09:00", 0},
+		{[]string{"09:00-17:00"}, "17:00", 16 * time.Hour},
+		{[]string{"09:00-17:00"}, "08:30", 30 * time.Minute},
+		// wrapping around midnight
+		{[]string{"22:00-06:00"}, "23:00", 0},
+		{[]string{"22:00-06:00"}, "01:00", 0},
+		{[]string{"22:00-06:00"}, "12:00", 10 * time.Hour},
+		// the soonest of several
+		{[]string{"22:00-06:00", "13:00-14:00"}, "12:00", time.Hour},
+		// invalid windows are ignored
+		{[]string{"whenever", "13:00-14:00"}, "12:00", time.Hour},
+		{[]string{"whenever"}, "12:00", 0},
+	} {
+		wait := ReplicationSchedule{Windows: test.windows}.untilOpen(at(test.now))
+		if wait != test.expected {
+			t.Errorf("%v at %s: expected %s, got %s", test.windows, test.now, test.expected, wait)
+		}
+	}
+	// times are UTC, whatever zone now is in
+	noon := at("12:00").In(time.FixedZone("UTC+5", 5*60*60))
+	wait := ReplicationSchedule{Windows: []string{"12:00-13:00"}}.untilOpen(noon)
+	if wait != 0 {
+		t.Errorf("Expected the window to be open at noon UTC, got %s", wait)
+	}
+}
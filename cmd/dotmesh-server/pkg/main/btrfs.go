@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A storage backend for hosts whose root filesystem is btrfs. It uses the same
+// on-disk layout and sidecar as the directory backend (which it embeds for
+// discovery, mounting and metadata), except that the data directory is a
+// subvolume and each commit is a read-only snapshot of it:
+//
+//	<root>/<POOL>/dmfs/<filesystemId>/data                writable subvolume
+//	<root>/<POOL>/dmfs/<filesystemId>/snapshots/<id>      read-only snapshots
+//	<root>/<POOL>/dmfs/<filesystemId>/dotmesh.json        sidecar
+//
+// Clones are writable snapshots of their origin snapshot. Replication streams
+// are a line of JSON (the same header the directory backend sends) followed
+// by one `btrfs send` stream per snapshot, each incremental from the one
+// before, which `btrfs receive` is happy to read back to back.
+//
+// If quotas are enabled on the btrfs filesystem (`btrfs quota enable`), qgroup
+// accounting is used for dirty and used bytes. Otherwise they're estimated by
+// walking the trees, like the directory backend does.
+type BtrfsBackend struct {
+	*DirectoryBackend
+}
+
+func NewBtrfsBackend(root string) *BtrfsBackend {
+	return &BtrfsBackend{NewDirectoryBackend(root)}
+}
+
+func (b *BtrfsBackend) Name() string {
+	return "btrfs"
+}
+
+func btrfs(args ...string) ([]byte, error) {
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf(
+			"%v while running btrfs %s: %s", err, strings.Join(args, " "), out,
+		)
+	}
+	return out, nil
+}
+
+func (b *BtrfsBackend) isMounted(filesystemId string) bool {
+	code, err := returnCode("mountpoint", mnt(filesystemId))
+	return err == nil && code == 0
+}
+
+// delete the subvolume at path, if there is one
+func deleteSubvolume(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := btrfs("subvolume", "delete", path)
+	return err
+}
+
+// replace the data subvolume with a writable snapshot of snapshotId. the data
+// subvolume is bind mounted, so it has to be unmounted while that happens.
+func (b *BtrfsBackend) replaceData(filesystemId, snapshotId string) error {
+	mounted := b.isMounted(filesystemId)
+	if mounted {
+		err := b.Unmount(filesystemId)
+		if err != nil {
+			return err
+		}
+	}
+	err := deleteSubvolume(b.dataDir(filesystemId))
+	if err != nil {
+		return err
+	}
+	_, err = btrfs(
+		"subvolume", "snapshot",
+		b.snapshotDir(filesystemId, snapshotId), b.dataDir(filesystemId),
+	)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return b.Mount(filesystemId)
+	}
+	return nil
+}
+
+func (b *BtrfsBackend) Create(filesystemId string) error {
+	if _, err := os.Stat(b.sidecarPath(filesystemId)); err == nil {
+		return fmt.Errorf("Filesystem %s already exists", filesystemId)
+	}
+	err := os.MkdirAll(filepath.Join(b.fsDir(filesystemId), "snapshots"), 0755)
+	if err != nil {
+		return err
+	}
+	_, err = btrfs("subvolume", "create", b.dataDir(filesystemId))
+	if err != nil {
+		return err
+	}
+	return writeSidecarFile(b.sidecarPath(filesystemId), &directorySidecar{})
+}
+
+func (b *BtrfsBackend) Destroy(filesystemId string) error {
+	if b.isMounted(filesystemId) {
+		err := b.Unmount(filesystemId)
+		if err != nil {
+			return err
+		}
+	}
+	b.sizeCacheLock.Lock()
+	delete(b.sizeCache, filesystemId)
+	b.sizeCacheLock.Unlock()
+	err := os.Remove(b.sidecarPath(filesystemId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	snapshotsDir := filepath.Join(b.fsDir(filesystemId), "snapshots")
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		err := deleteSubvolume(filepath.Join(snapshotsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	err = deleteSubvolume(b.dataDir(filesystemId))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(b.fsDir(filesystemId))
+}
+
+func (b *BtrfsBackend) Snapshot(filesystemId, snapshotId string, meta metadata) error {
+	sidecar, err := b.readSidecar(filesystemId)
+	if err != nil {
+		return err
+	}
+	if sidecar.indexOf(snapshotId) != -1 {
+		return fmt.Errorf("Snapshot %s@%s already exists", filesystemId, snapshotId)
+	}
+	_, err = btrfs(
+		"subvolume", "snapshot", "-r",
+		b.dataDir(filesystemId), b.snapshotDir(filesystemId, snapshotId),
+	)
+	if err != nil {
+		return err
+	}
+	err = b.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		s.Snapshots = append(s.Snapshots, directorySnapshot{
+			Id: snapshotId, Properties: propertiesFromMetadata(meta),
+		})
+		return nil
+	})
+	if err != nil {
+		// don't leave a snapshot lying around which nothing knows about
+		deleteSubvolume(b.snapshotDir(filesystemId, snapshotId))
+		return err
+	}
+	return nil
+}
+
+func (b *BtrfsBackend) Rollback(filesystemId, snapshotId string) error {
+	var discard []directorySnapshot
+	err := b.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		i := s.indexOf(snapshotId)
+		if i == -1 {
+			return fmt.Errorf("No such snapshot %s@%s", filesystemId, snapshotId)
+		}
+		discard = s.Snapshots[i+1:]
+		s.Snapshots = s.Snapshots[:i+1]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, snap := range discard {
+		err := deleteSubvolume(b.snapshotDir(filesystemId, snap.Id))
+		if err != nil {
+			return err
+		}
+	}
+	return b.replaceData(filesystemId, snapshotId)
+}
+
+func (b *BtrfsBackend) DestroySnapshot(filesystemId, snapshotId string) error {
+	err := b.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		i := s.indexOf(snapshotId)
+		if i == -1 {
+			return fmt.Errorf("No such snapshot %s@%s", filesystemId, snapshotId)
+		}
+		s.Snapshots = append(s.Snapshots[:i], s.Snapshots[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteSubvolume(b.snapshotDir(filesystemId, snapshotId))
+}
+
+func (b *BtrfsBackend) Clone(filesystemId, snapshotId, newFilesystemId string) error {
+	if _, err := os.Stat(b.sidecarPath(newFilesystemId)); err == nil {
+		return fmt.Errorf("Filesystem %s already exists", newFilesystemId)
+	}
+	err := os.MkdirAll(filepath.Join(b.fsDir(newFilesystemId), "snapshots"), 0755)
+	if err != nil {
+		return err
+	}
+	_, err = btrfs(
+		"subvolume", "snapshot",
+		b.snapshotDir(filesystemId, snapshotId), b.dataDir(newFilesystemId),
+	)
+	if err != nil {
+		os.RemoveAll(b.fsDir(newFilesystemId))
+		return err
+	}
+	return writeSidecarFile(b.sidecarPath(newFilesystemId), &directorySidecar{
+		Origin: Origin{FilesystemId: filesystemId, SnapshotId: snapshotId},
+	})
+}
+
+// subvolume id of the subvolume at path, as used in qgroup ids
+func subvolumeId(path string) (string, error) {
+	out, err := btrfs("inspect-internal", "rootid", path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+type qgroupUsage struct {
+	referenced int64
+	exclusive  int64
+}
+
+// level 0 qgroup usage on the btrfs filesystem containing path, keyed on
+// subvolume id. fails if quotas aren't enabled.
+func qgroups(path string) (map[string]qgroupUsage, error) {
+	out, err := btrfs("qgroup", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	usage := map[string]qgroupUsage{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		referenced, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse qgroup line %q: %s", line, err)
+		}
+		exclusive, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse qgroup line %q: %s", line, err)
+		}
+		usage[fields[0][len("0/"):]] = qgroupUsage{referenced, exclusive}
+	}
+	return usage, nil
+}
+
+func (b *BtrfsBackend) SizeInfo(filesystemId, latestSnap string) (int64, int64, error) {
+	dirtyBytes, sizeBytes, err := b.qgroupSizeInfo(filesystemId, latestSnap)
+	if err == nil {
+		return dirtyBytes, sizeBytes, nil
+	}
+	// no quotas, so estimate it the slow way. snapshots are separate
+	// subvolumes, so their inode numbers can't be compared with the data's
+	// and only the live data counts towards the size. snapshots are
+	// read-only, so the latest one's files only need finding once.
+	b.sizeCacheLock.Lock()
+	cache, ok := b.sizeCache[filesystemId]
+	b.sizeCacheLock.Unlock()
+	if !ok || cache.latestId != latestSnap {
+		cache = &directorySizeCache{latestId: latestSnap, latestFiles: map[string]os.FileInfo{}}
+		if latestSnap != "" {
+			cache.latestFiles, err = regularFiles(b.snapshotDir(filesystemId, latestSnap))
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		b.sizeCacheLock.Lock()
+		b.sizeCache[filesystemId] = cache
+		b.sizeCacheLock.Unlock()
+	}
+	sizeBytes, dirtyBytes, err = workingStateSize(b.dataDir(filesystemId), cache.latestFiles)
+	if err != nil {
+		return 0, 0, err
+	}
+	return dirtyBytes, sizeBytes, nil
+}
+
+func (b *BtrfsBackend) qgroupSizeInfo(filesystemId, latestSnap string) (int64, int64, error) {
+	usage, err := qgroups(b.fsDir(filesystemId))
+	if err != nil {
+		return 0, 0, err
+	}
+	dataId, err := subvolumeId(b.dataDir(filesystemId))
+	if err != nil {
+		return 0, 0, err
+	}
+	data, ok := usage[dataId]
+	if !ok {
+		return 0, 0, fmt.Errorf("No qgroup for %s", b.dataDir(filesystemId))
+	}
+	// anything the data subvolume doesn't share with a snapshot has been
+	// written since the last one
+	dirtyBytes := data.exclusive
+	if latestSnap == "" {
+		dirtyBytes = data.referenced
+	}
+	sizeBytes := data.referenced
+	sidecar, err := b.readSidecar(filesystemId)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, snap := range sidecar.Snapshots {
+		snapId, err := subvolumeId(b.snapshotDir(filesystemId, snap.Id))
+		if err != nil {
+			return 0, 0, err
+		}
+		sizeBytes += usage[snapId].exclusive
+	}
+	return dirtyBytes, sizeBytes, nil
+}
+
+// the snapshot directory each snapshot in header should be sent relative to
+// ("" for a full send)
+func (b *BtrfsBackend) sendParents(header *directoryStreamHeader, toFilesystemId string) []string {
+	parents := []string{}
+	previous := ""
+	if header.BaseSnapshotId != "" {
+		previous = b.snapshotDir(header.BaseFilesystemId, header.BaseSnapshotId)
+	}
+	for _, snap := range header.Snapshots {
+		parents = append(parents, previous)
+		previous = b.snapshotDir(toFilesystemId, snap.Id)
+	}
+	return parents
+}
+
+func (b *BtrfsBackend) PredictSize(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+) (int64, error) {
+	header, err := b.streamHeader(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return 0, err
+	}
+	// btrfs send has no dry run, so estimate from the files which changed
+	// between each pair of snapshots
+	var size int64
+	for i, parent := range b.sendParents(header, toFilesystemId) {
+		dir := b.snapshotDir(toFilesystemId, header.Snapshots[i].Id)
+		var delta int64
+		if parent == "" {
+			delta, err = treeSize(dir)
+		} else {
+			delta, err = treeDelta(dir, parent)
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += delta
+	}
+	return size, nil
+}
+
+func (b *BtrfsBackend) Send(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+	stream io.Writer,
+) error {
+	header, err := b.streamHeader(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return err
+	}
+	// json.Encoder terminates it with a newline, which Receive looks for
+	err = json.NewEncoder(stream).Encode(header)
+	if err != nil {
+		return err
+	}
+	for i, parent := range b.sendParents(header, toFilesystemId) {
+		args := []string{"send"}
+		if parent != "" {
+			args = append(args, "-p", parent)
+		}
+		args = append(args, b.snapshotDir(toFilesystemId, header.Snapshots[i].Id))
+		cmd := exec.Command("btrfs", args...)
+		errBuffer := bytes.Buffer{}
+		cmd.Stdout = stream
+		cmd.Stderr = io.MultiWriter(getLogfile("btrfs-send-errors"), &errBuffer)
+		log.Printf("[BtrfsBackend:Send] running btrfs %s", strings.Join(args, " "))
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf(
+				"%v while running btrfs %s: %s", err, strings.Join(args, " "), errBuffer.String(),
+			)
+		}
+	}
+	return nil
+}
+
+func (b *BtrfsBackend) Receive(filesystemId string, stream io.Reader) error {
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("Unable to read stream header for %s: %s", filesystemId, err)
+	}
+	header := &directoryStreamHeader{}
+	err = json.Unmarshal(line, header)
+	if err != nil {
+		return fmt.Errorf("Unable to parse stream header for %s: %s", filesystemId, err)
+	}
+
+	sidecar, err := b.readSidecar(filesystemId)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = b.checkStreamHeader(filesystemId, sidecar, header)
+	if err != nil {
+		return err
+	}
+	origin := Origin{}
+	if header.BaseSnapshotId == "" || header.BaseFilesystemId != filesystemId {
+		if exists {
+			return fmt.Errorf(
+				"Destination %s exists, can't receive a non-incremental stream into it",
+				filesystemId,
+			)
+		}
+		if header.BaseSnapshotId != "" {
+			origin = Origin{
+				FilesystemId: header.BaseFilesystemId, SnapshotId: header.BaseSnapshotId,
+			}
+		}
+		err = os.MkdirAll(filepath.Join(b.fsDir(filesystemId), "snapshots"), 0755)
+		if err != nil {
+			return err
+		}
+	} else {
+		if !exists {
+			return fmt.Errorf(
+				"Destination %s does not exist, can't receive an incremental stream into it",
+				filesystemId,
+			)
+		}
+		if len(sidecar.Snapshots) == 0 ||
+			sidecar.Snapshots[len(sidecar.Snapshots)-1].Id != header.BaseSnapshotId {
+			return fmt.Errorf(
+				"Most recent snapshot of %s does not match incremental source %s",
+				filesystemId, header.BaseSnapshotId,
+			)
+		}
+		// the data subvolume gets replaced with the latest snapshot at the
+		// end, so refuse to throw away uncommitted changes
+		changed, err := treeChanged(
+			b.dataDir(filesystemId), b.snapshotDir(filesystemId, header.BaseSnapshotId),
+		)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return fmt.Errorf(
+				"Destination %s has been modified since most recent snapshot %s",
+				filesystemId, header.BaseSnapshotId,
+			)
+		}
+	}
+	cleanup := func() {
+		for _, snap := range header.Snapshots {
+			deleteSubvolume(b.snapshotDir(filesystemId, snap.Id))
+		}
+		if !exists {
+			os.RemoveAll(b.fsDir(filesystemId))
+		}
+	}
+
+	// received subvolumes are named after the ones they were sent from,
+	// i.e. the snapshot ids
+	cmd := exec.Command("btrfs", "receive", filepath.Join(b.fsDir(filesystemId), "snapshots"))
+	errBuffer := bytes.Buffer{}
+	cmd.Stdin = reader
+	cmd.Stderr = io.MultiWriter(getLogfile("btrfs-recv-errors"), &errBuffer)
+	err = cmd.Run()
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("%v while running btrfs receive: %s", err, errBuffer.String())
+	}
+
+	if exists {
+		err = b.updateSidecar(filesystemId, func(s *directorySidecar) error {
+			s.Snapshots = append(s.Snapshots, header.Snapshots...)
+			return nil
+		})
+	} else {
+		err = writeSidecarFile(b.sidecarPath(filesystemId), &directorySidecar{
+			Origin: origin, Snapshots: header.Snapshots,
+		})
+	}
+	if err != nil {
+		cleanup()
+		return err
+	}
+	if len(header.Snapshots) == 0 {
+		if !exists {
+			// nothing to make the data out of, so start empty
+			_, err = btrfs("subvolume", "create", b.dataDir(filesystemId))
+		}
+		return err
+	}
+	// like zfs recv, leave the filesystem looking like the latest snapshot
+	return b.replaceData(filesystemId, header.Snapshots[len(header.Snapshots)-1].Id)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBtrfsSendParents(t *testing.T) {
+	b := NewBtrfsBackend("/var/lib/dotmesh")
+	snapshots := []directorySnapshot{{Id: "one"}, {Id: "two"}, {Id: "three"}}
+
+	// a full stream: the first snapshot is sent whole, the rest relative to
+	// the one before
+	parents := b.sendParents(&directoryStreamHeader{Snapshots: snapshots}, "fs")
+	expected := []string{"", b.snapshotDir("fs", "one"), b.snapshotDir("fs", "two")}
+	if fmt.Sprintf("%q", parents) != fmt.Sprintf("%q", expected) {
+		t.Errorf("Expected %q, got %q", expected, parents)
+	}
+
+	// a clone's stream starts from its origin's snapshot
+	parents = b.sendParents(&directoryStreamHeader{
+		BaseFilesystemId: "origin", BaseSnapshotId: "base", Snapshots: snapshots[:2],
+	}, "clone")
+	expected = []string{b.snapshotDir("origin", "base"), b.snapshotDir("clone", "one")}
+	if fmt.Sprintf("%q", parents) != fmt.Sprintf("%q", expected) {
+		t.Errorf("Expected %q, got %q", expected, parents)
+	}
+}
+
+// a btrfs backend whose filesystem "fs" has the snapshot "one" and data
+// matching it, laid out with plain directories, which is all that receiving
+// and sizing look at before running btrfs
+func newTestBtrfsBackend(t *testing.T) (*BtrfsBackend, func()) {
+	root, err := ioutil.TempDir("", "dotmesh-btrfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBtrfsBackend(root)
+	modified := time.Now().Add(-time.Hour)
+	for _, dir := range []string{b.dataDir("fs"), b.snapshotDir("fs", "one")} {
+		committed := filepath.Join(dir, "committed")
+		err = os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(committed, []byte("1"), 0644)
+		}
+		if err == nil {
+			err = os.Chtimes(committed, modified, modified)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writeSidecarFile(b.sidecarPath("fs"), &directorySidecar{
+		Snapshots: []directorySnapshot{{Id: "one"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, func() { os.RemoveAll(root) }
+}
+
+func TestBtrfsReceiveRefusesUncommittedChanges(t *testing.T) {
+	b, cleanup := newTestBtrfsBackend(t)
+	defer cleanup()
+
+	uncommitted := filepath.Join(b.dataDir("fs"), "uncommitted")
+	err := ioutil.WriteFile(uncommitted, []byte("precious"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := json.Marshal(directoryStreamHeader{
+		BaseFilesystemId: "fs", BaseSnapshotId: "one",
+		Snapshots: []directorySnapshot{{Id: "two"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Receive("fs", bytes.NewBuffer(append(header, '\n')))
+	if err == nil || !strings.Contains(err.Error(), "modified since") {
+		t.Errorf("Expected receiving over uncommitted changes to fail, got %v", err)
+	}
+	if _, err := os.Stat(uncommitted); err != nil {
+		t.Errorf("Uncommitted changes were lost: %s", err)
+	}
+}
+
+func TestBtrfsSizeInfoWithoutQuotas(t *testing.T) {
+	b, cleanup := newTestBtrfsBackend(t)
+	defer cleanup()
+
+	dirty, size, err := b.SizeInfo("fs", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty != 0 {
+		t.Errorf("Expected no dirty bytes, got %d", dirty)
+	}
+	// the latest snapshot's files are cached, but the data isn't
+	err = ioutil.WriteFile(filepath.Join(b.dataDir("fs"), "new"), []byte("22"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty, newSize, err := b.SizeInfo("fs", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty != 2 || newSize != size+2 {
+		t.Errorf("Expected 2 dirty bytes of %d, got %d of %d", size+2, dirty, newSize)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The sender of a replication stream sends the SHA-256 of everything it sent
+// (the prelude and the stream, before compression) in an HTTP trailer, so the
+// receiver can check that what it received is what was sent before it
+// applies the prelude or tells anyone about the new snapshots. If it doesn't
+// match, the received snapshots are rolled back.
+//
+// Senders which predate this don't declare the trailer, and aren't checked.
+//
+// A stream which stops short is still a valid stream of what was sent, so if
+// sending fails partway through, the sender puts CHECKSUM_FAILED in the
+// trailer instead, and the receiver rolls back as if it didn't match.
+
+const CHECKSUM_TRAILER = "Dotmesh-Stream-Sha256"
+const CHECKSUM_FAILED = "failed"
+
+// The status a receiver responds to a POST with if the stream didn't match
+// its checksum.
+const CHECKSUM_MISMATCH_STATUS = http.StatusUnprocessableEntity
+
+type ChecksumMismatch struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatch) Error() string {
+	return fmt.Sprintf(
+		"replication stream checksum mismatch: sender sent %s, received %s",
+		e.Expected, e.Actual,
+	)
+}
+
+func newStreamChecksum() hash.Hash {
+	return sha256.New()
+}
+
+func checksumString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// A request body which sets the checksum trailer on req once everything has
+// been written to it, just before it's closed.
+type checksummedBody struct {
+	io.WriteCloser
+	checksum hash.Hash
+	req      *http.Request
+	failed   int32
+}
+
+func newChecksummedBody(w io.WriteCloser, checksum hash.Hash, req *http.Request) *checksummedBody {
+	if req.Trailer == nil {
+		req.Trailer = http.Header{}
+	}
+	// declaring it up front tells the receiver to expect it
+	req.Trailer[CHECKSUM_TRAILER] = nil
+	return &checksummedBody{WriteCloser: w, checksum: checksum, req: req}
+}
+
+// Say that sending failed, so what's been written so far mustn't be used.
+func (b *checksummedBody) Fail() {
+	atomic.StoreInt32(&b.failed, 1)
+}
+
+func (b *checksummedBody) Close() error {
+	if atomic.LoadInt32(&b.failed) != 0 {
+		b.req.Trailer.Set(CHECKSUM_TRAILER, CHECKSUM_FAILED)
+	} else {
+		b.req.Trailer.Set(CHECKSUM_TRAILER, checksumString(b.checksum))
+	}
+	return b.WriteCloser.Close()
+}
+
+// Check the checksum the sender put in trailer (a request or response's
+// Trailer, once its body has been read) against what we received.
+func verifyChecksum(trailer http.Header, checksum hash.Hash) error {
+	if _, declared := trailer[CHECKSUM_TRAILER]; !declared {
+		log.Printf("[verifyChecksum] Sender didn't send a checksum, not verifying")
+		return nil
+	}
+	expected := strings.ToLower(trailer.Get(CHECKSUM_TRAILER))
+	if expected == CHECKSUM_FAILED {
+		return fmt.Errorf("The sender failed partway through the replication stream")
+	}
+	actual := checksumString(checksum)
+	if expected != actual {
+		if expected == "" {
+			expected = "nothing"
+		}
+		return &ChecksumMismatch{Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// Undo receiving a stream from fromSnap (a snapshot id, START_SNAPSHOT or a
+// fully qualified origin snapshot) into filesystemId.
+func rollbackReceive(storage StorageBackend, filesystemId, fromSnap string) error {
+	log.Printf("[rollbackReceive] Rolling %s back to %s", filesystemId, fromSnap)
+	if fromSnap == START_SNAPSHOT || strings.Contains(fromSnap, "@") {
+		// the whole filesystem came from the stream
+		return storage.Destroy(filesystemId)
+	}
+	return storage.Rollback(filesystemId, fromSnap)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func checksumOf(data string) string {
+	h := newStreamChecksum()
+	h.Write([]byte(data))
+	return checksumString(h)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	received := newStreamChecksum()
+	received.Write([]byte("stream"))
+
+	for _, test := range []struct {
+		name    string
+		trailer http.Header
+		ok      bool
+	}{
+		{"matching", http.Header{CHECKSUM_TRAILER: {checksumOf("stream")}}, true},
+		{"upper case", http.Header{CHECKSUM_TRAILER: {strings.ToUpper(checksumOf("stream"))}}, true},
+		{"not matching", http.Header{CHECKSUM_TRAILER: {checksumOf("something else")}}, false},
+		{"declared but not sent", http.Header{CHECKSUM_TRAILER: nil}, false},
+		{"sender failed", http.Header{CHECKSUM_TRAILER: {CHECKSUM_FAILED}}, false},
+		{"older sender", http.Header{}, true},
+	} {
+		err := verifyChecksum(test.trailer, received)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestChecksummedBody(t *testing.T) {
+	for _, failed := range []bool{false, true} {
+		req, err := http.NewRequest("POST", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksum := newStreamChecksum()
+		body := newChecksummedBody(nopWriteCloser{&bytes.Buffer{}}, checksum, req)
+		if _, declared := req.Trailer[CHECKSUM_TRAILER]; !declared {
+			t.Errorf("Trailer wasn't declared")
+		}
+		checksum.Write([]byte("stream"))
+		body.Write([]byte("stream"))
+		if failed {
+			body.Fail()
+		}
+		body.Close()
+
+		err = verifyChecksum(req.Trailer, checksum)
+		if failed && err == nil {
+			t.Errorf("A failed send verified")
+		}
+		if !failed && err != nil {
+			t.Errorf("A complete send didn't verify: %s", err)
+		}
+	}
+}
+
+// a StorageBackend which records how a receive is undone
+type rollbackStorage struct {
+	StorageBackend
+	calls []string
+}
+
+func (s *rollbackStorage) Destroy(filesystemId string) error {
+	s.calls = append(s.calls, "destroy "+filesystemId)
+	return nil
+}
+
+func (s *rollbackStorage) Rollback(filesystemId, snapshotId string) error {
+	s.calls = append(s.calls, "rollback "+filesystemId+" to "+snapshotId)
+	return nil
+}
+
+func TestRollbackReceive(t *testing.T) {
+	for _, test := range []struct {
+		fromSnap string
+		expected string
+	}{
+		{"snap", "[rollback fs to snap]"},
+		// the whole filesystem came from the stream
+		{START_SNAPSHOT, "[destroy fs]"},
+		{"origin@snap", "[destroy fs]"},
+	} {
+		storage := &rollbackStorage{}
+		err := rollbackReceive(storage, "fs", test.fromSnap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls := fmt.Sprintf("%v", storage.calls); calls != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.fromSnap, test.expected, calls)
+		}
+	}
+}
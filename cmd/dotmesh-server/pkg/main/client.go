@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"golang.org/x/net/context"
 
@@ -19,6 +22,10 @@ type JsonRpcClient struct {
 	User     string
 	Hostname string
 	ApiKey   string
+	// whether the other cluster speaks HTTPS, and the CA to check its
+	// certificate with ("" for the usual ones)
+	TLS    bool
+	CACert string
 }
 
 func NewJsonRpcClient(user, hostname, apiKey string) *JsonRpcClient {
@@ -42,8 +49,7 @@ func (j *JsonRpcClient) CallRemote(
 	span.SetTag("rpcArgs", fmt.Sprintf("%v", args))
 	defer span.Finish()
 
-	// RPCs are always between clusters, so "external"
-	url := fmt.Sprintf("%s/rpc", deduceUrl(j.Hostname, "external"))
+	url := fmt.Sprintf("%s/rpc", j.baseUrl())
 	message, err := json2.EncodeClientRequest(method, args)
 	if err != nil {
 		return err
@@ -59,7 +65,10 @@ func (j *JsonRpcClient) CallRemote(
 
 	req.Header.Set("Content-Type", "application/json")
 	req.SetBasicAuth(j.User, j.ApiKey)
-	client := new(http.Client)
+	client, err := j.httpClient()
+	if err != nil {
+		return err
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -85,3 +94,35 @@ func (j *JsonRpcClient) CallRemote(
 	}
 	return nil
 }
+
+// e.g. "https://192.168.1.12:6969"
+func (j *JsonRpcClient) baseUrl() string {
+	// RPCs are always between clusters, so "external"
+	url := deduceUrl(j.Hostname, "external")
+	if j.TLS && strings.HasPrefix(url, "http:") {
+		url = "https:" + strings.TrimPrefix(url, "http:")
+	}
+	return url
+}
+
+func (j *JsonRpcClient) httpClient() (*http.Client, error) {
+	if j.CACert == "" {
+		return new(http.Client), nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(j.CACert)) {
+		return nil, fmt.Errorf("Invalid CA certificate for %s", j.Hostname)
+	}
+	return httpClientWithTLS(&tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyIssuer(roots),
+	}), nil
+}
+
+// For the cluster a transfer is to or from.
+func (t TransferRequest) peerClient() *JsonRpcClient {
+	client := NewJsonRpcClient(t.User, t.Peer, t.ApiKey)
+	client.TLS = t.PeerTLS
+	client.CACert = t.PeerCACert
+	return client
+}
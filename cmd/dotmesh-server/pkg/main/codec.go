@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pierrec/lz4"
+)
+
+// Compression codecs for replication streams. Whoever starts a transfer says
+// which codecs it would like, in order of preference, and the first one that
+// both ends support is used:
+//
+//   - for a GET (pull), the receiver lists its preferences in
+//     ACCEPT_CODECS_HEADER, and the sender says which one it picked in
+//     CODEC_HEADER on the response.
+//   - for a POST (push), the sender asks the receiver which codecs it supports
+//     with the ReplicationCapabilities RPC, and says which one it picked in
+//     CODEC_HEADER on the request.
+//
+// Peers which don't know about any of this just use gzip.
+//
+// Codecs are "gzip", "lz4", "none" (for data which is already compressed, or
+// when sending blocks as they're compressed on disk) and "zstd", optionally
+// with a level, e.g. "zstd:6". zstd is done by the zstd binary, so is only
+// supported if it's installed.
+
+const CODEC_HEADER = "Dotmesh-Codec"
+const ACCEPT_CODECS_HEADER = "Dotmesh-Accept-Codecs"
+
+// Set on GET requests by receivers whose storage can receive a compressed
+// stream (see StorageBackend.CompressedStreams), and on the response if the
+// sender is sending one.
+const COMPRESSED_STREAM_HEADER = "Dotmesh-Compressed-Stream"
+
+const LEGACY_CODEC = "gzip"
+const DEFAULT_CODEC_PREFERENCES = "zstd:3,lz4,gzip"
+
+var zstdAvailable bool
+var zstdOnce sync.Once
+
+func haveZstd() bool {
+	zstdOnce.Do(func() {
+		_, err := exec.LookPath("zstd")
+		zstdAvailable = err == nil
+	})
+	return zstdAvailable
+}
+
+// "zstd:6" => "zstd", "6"
+func splitCodec(codec string) (string, string) {
+	shrapnel := strings.SplitN(codec, ":", 2)
+	if len(shrapnel) == 1 {
+		return shrapnel[0], ""
+	}
+	return shrapnel[0], shrapnel[1]
+}
+
+func validateCodec(codec string) error {
+	name, level := splitCodec(codec)
+	switch name {
+	case "gzip", "lz4", "none":
+		if level != "" {
+			return fmt.Errorf("Codec %s doesn't take a level", name)
+		}
+		return nil
+	case "zstd":
+		if level != "" {
+			l, err := strconv.Atoi(level)
+			if err != nil || l < 1 || l > 19 {
+				return fmt.Errorf("zstd level must be between 1 and 19, not %s", level)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf(
+			"Unknown codec '%s', choose one of 'zstd[:level]', 'lz4', 'gzip' or 'none'",
+			codec,
+		)
+	}
+}
+
+// names of the codecs we can compress and decompress
+func localCodecs() []string {
+	codecs := []string{}
+	if haveZstd() {
+		codecs = append(codecs, "zstd")
+	}
+	return append(codecs, "lz4", "gzip", "none")
+}
+
+// which codecs we'd like to use, best first. a transfer can ask for a
+// particular codec, otherwise it's up to REPLICATION_CODECS.
+func codecPreferences(requested string) []string {
+	if requested != "" {
+		return []string{requested}
+	}
+	preferences := os.Getenv("REPLICATION_CODECS")
+	if preferences == "" {
+		preferences = DEFAULT_CODEC_PREFERENCES
+	}
+	return strings.Split(preferences, ",")
+}
+
+// the first of preferences which is valid and both we and the peer (which
+// supports supported) can do. falls back to gzip, which everyone can do.
+func chooseCodec(preferences, supported []string) string {
+	for _, codec := range preferences {
+		codec = strings.TrimSpace(codec)
+		if validateCodec(codec) != nil {
+			log.Printf("[chooseCodec] ignoring invalid codec %s", codec)
+			continue
+		}
+		name, _ := splitCodec(codec)
+		if containsString(localCodecs(), name) && containsString(supported, name) {
+			return codec
+		}
+	}
+	return LEGACY_CODEC
+}
+
+// parse a list of codecs from a header, "" meaning a peer which predates
+// codec negotiation
+func codecsFromHeader(header string) []string {
+	if header == "" {
+		return []string{LEGACY_CODEC}
+	}
+	codecs := []string{}
+	for _, codec := range strings.Split(header, ",") {
+		codecs = append(codecs, strings.TrimSpace(codec))
+	}
+	return codecs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func compressingWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	name, level := splitCodec(codec)
+	switch name {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "lz4":
+		return lz4.NewWriter(w), nil
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "zstd":
+		if level == "" {
+			level = "3"
+		}
+		return newZstdWriter(w, "-"+level)
+	}
+	return nil, fmt.Errorf("Unsupported codec %s", codec)
+}
+
+func decompressingReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	name, _ := splitCodec(codec)
+	switch name {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "lz4":
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	case "none":
+		return ioutil.NopCloser(r), nil
+	case "zstd":
+		return newZstdReader(r)
+	}
+	return nil, fmt.Errorf("Unsupported codec %s", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compresses everything written to it with a zstd process, which writes to w.
+// Close must be called to flush it.
+type zstdWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func newZstdWriter(w io.Writer, level string) (*zstdWriter, error) {
+	z := &zstdWriter{}
+	z.cmd = exec.Command("zstd", "-q", "-c", level)
+	z.cmd.Stdout = w
+	z.cmd.Stderr = &z.stderr
+	stdin, err := z.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	z.stdin = stdin
+	err = z.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	return z.stdin.Write(p)
+}
+
+func (z *zstdWriter) Close() error {
+	z.stdin.Close()
+	err := z.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v from zstd: %s", err, z.stderr.String())
+	}
+	return nil
+}
+
+// decompresses r with a zstd process.
+type zstdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+}
+
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	z := &zstdReader{}
+	z.cmd = exec.Command("zstd", "-q", "-d", "-c")
+	z.cmd.Stdin = r
+	z.cmd.Stderr = &z.stderr
+	stdout, err := z.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	z.stdout = stdout
+	err = z.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.stdout.Read(p)
+	if err == io.EOF && !z.waited {
+		// zstd has finished, make sure it thought the stream was ok
+		z.waited = true
+		waitErr := z.cmd.Wait()
+		if waitErr != nil {
+			return n, fmt.Errorf("%v from zstd: %s", waitErr, z.stderr.String())
+		}
+	}
+	return n, err
+}
+
+func (z *zstdReader) Close() error {
+	if z.waited {
+		return nil
+	}
+	// we've given up part way through. zstd may be blocked on reading its
+	// input, so don't wait for it.
+	z.waited = true
+	z.stdout.Close()
+	z.cmd.Process.Kill()
+	go z.cmd.Wait()
+	return nil
+}
+
+// For a receiver making a GET: say which codecs we'd like, and whether we
+// can receive a compressed stream.
+func requestCodecs(storage StorageBackend, requested string, req *http.Request) {
+	accept := []string{}
+	for _, codec := range codecPreferences(requested) {
+		codec = strings.TrimSpace(codec)
+		name, _ := splitCodec(codec)
+		if validateCodec(codec) == nil && containsString(localCodecs(), name) {
+			accept = append(accept, codec)
+		}
+	}
+	if !containsString(accept, LEGACY_CODEC) {
+		accept = append(accept, LEGACY_CODEC)
+	}
+	req.Header.Set(ACCEPT_CODECS_HEADER, strings.Join(accept, ","))
+	if storage.CompressedStreams() {
+		req.Header.Set(COMPRESSED_STREAM_HEADER, "true")
+	}
+}
+
+// the codec a sender chose, from its response to a GET or the request of a
+// POST
+func codecFromHeader(header http.Header) (string, error) {
+	codec := header.Get(CODEC_HEADER)
+	if codec == "" {
+		return LEGACY_CODEC, nil
+	}
+	err := validateCodec(codec)
+	if err != nil {
+		return "", err
+	}
+	name, _ := splitCodec(codec)
+	if !containsString(localCodecs(), name) {
+		return "", fmt.Errorf("Codec %s isn't supported here", codec)
+	}
+	return codec, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChooseCodec(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		preferences []string
+		supported   []string
+		expected    string
+	}{
+		{"first both support", []string{"lz4", "gzip"}, []string{"gzip", "lz4", "none"}, "lz4"},
+		{"peer doesn't support it", []string{"lz4", "gzip"}, []string{"gzip", "none"}, "gzip"},
+		{"whitespace", []string{" none "}, []string{"none"}, "none"},
+		{"invalid", []string{"brotli", "lz4:3", "none"}, []string{"lz4", "none"}, "none"},
+		{"nothing in common", []string{"lz4"}, []string{"none"}, LEGACY_CODEC},
+		{"older peer", []string{"lz4", "none"}, codecsFromHeader(""), LEGACY_CODEC},
+	} {
+		codec := chooseCodec(test.preferences, test.supported)
+		if codec != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, codec)
+		}
+	}
+
+	// zstd (and its level) is only chosen if we have it
+	codec := chooseCodec([]string{"zstd:9", "lz4"}, []string{"zstd", "lz4"})
+	expected := "lz4"
+	if haveZstd() {
+		expected = "zstd:9"
+	}
+	if codec != expected {
+		t.Errorf("Expected %s, got %s", expected, codec)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("a replication stream "), 1000)
+	for _, codec := range localCodecs() {
+		compressed := &bytes.Buffer{}
+		w, err := compressingWriter(codec, compressed)
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		w.Write(data)
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		r, err := decompressingReader(codec, compressed)
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		decompressed, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%s: round trip changed the data", codec)
+		}
+	}
+}
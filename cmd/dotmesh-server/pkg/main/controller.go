@@ -18,7 +18,7 @@ import (
 
 // typically methods on the InMemoryState "god object"
 
-func NewInMemoryState(localPoolId string, config Config) *InMemoryState {
+func NewInMemoryState(localPoolId string, config Config, storage StorageBackend) *InMemoryState {
 	d, err := NewDockerClient()
 	if err != nil {
 		panic(err)
@@ -51,6 +51,8 @@ func NewInMemoryState(localPoolId string, config Config) *InMemoryState {
 		// containers that are running with dotmesh volumes by filesystem id
 		containers:     d,
 		containersLock: &sync.Mutex{},
+		// where the data actually lives
+		storage: storage,
 		// channel to send on to hint that a new container is using a dotmesh
 		// volume
 		fetchRelatedContainersChan: make(chan bool),
@@ -64,6 +66,9 @@ func NewInMemoryState(localPoolId string, config Config) *InMemoryState {
 	// a registry of names of filesystems and branches (clones) mapping to
 	// their ids
 	s.registry = NewRegistry(s)
+	// changes to dots, streamed to clients watching them
+	s.events = newEventStream(s)
+	s.audit = newAuditLog(localPoolId)
 	return s
 }
 
@@ -103,8 +108,8 @@ func (s *InMemoryState) deleteFilesystem(filesystemId string) error {
 		errors = append(errors, err)
 	}
 
-	// Actually remove from ZFS
-	err = deleteFilesystemInZFS(filesystemId)
+	// Actually remove from the storage backend
+	err = s.storage.Destroy(filesystemId)
 	if err != nil {
 		errors = append(errors, err)
 	}
@@ -186,7 +191,7 @@ func (s *InMemoryState) getOne(ctx context.Context, fs string) (DotmeshVolume, e
 	log.Printf("[getOne] starting for %v", fs)
 
 	if tlf, clone, err := s.registry.LookupFilesystemById(fs); err == nil {
-		authorized, err := tlf.Authorize(ctx)
+		authorized, err := tlf.AuthorizeRead(ctx)
 		if err != nil {
 			return DotmeshVolume{}, err
 		}
@@ -289,6 +294,9 @@ func (s *InMemoryState) notifyNewSnapshotsAfterPush(filesystemId string) {
 	log.Printf("[notifyNewSnapshotsAfterPush:%s] about to notify chan", filesystemId)
 	f.externalSnapshotsChanged <- true
 	log.Printf("[notifyNewSnapshotsAfterPush:%s] done notify chan", filesystemId)
+	s.notifyWebhooks(WebhookPayload{
+		Event: "push-received", FilesystemId: filesystemId, Commit: s.latestCommitOnDisk(filesystemId),
+	})
 }
 
 func (s *InMemoryState) getCurrentState(filesystemId string) (string, error) {
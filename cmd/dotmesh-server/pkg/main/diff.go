@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Diffs between two commits (or a commit and the working state) are worked
+// out by walking the two trees the storage backend gives us, so they work the
+// same way on every backend. The walk happens on the master of the filesystem
+// being diffed, which is the only node that has it mounted, but outside its
+// state machine, so a big diff doesn't hold up anything else done to the dot.
+
+// One file which differs between two trees.
+type FileChange struct {
+	// "added", "removed", "modified" or "renamed"
+	Change string
+	// where it is in the newer tree (or was, if it was removed)
+	Path string
+	// where it was in the older tree, if it was renamed
+	OldPath string `json:",omitempty"`
+	// bytes in the newer and older trees, 0 where it isn't in one of them
+	Size    int64
+	OldSize int64
+}
+
+type DiffResult struct {
+	Changes []FileChange
+	// set if there were more than MAX_DIFF_CHANGES changes, in which case only
+	// the first (by path) are in Changes
+	Truncated bool
+}
+
+// only this many changes are returned, so that a diff doesn't make for a huge
+// response
+const MAX_DIFF_CHANGES = 5000
+
+type treeEntry struct {
+	info os.FileInfo
+	ino  uint64
+}
+
+// everything but directories under root, by path relative to it. a missing
+// root is an empty tree.
+func walkTree(root string) (map[string]treeEntry, error) {
+	entries := map[string]treeEntry{}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return entries, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// zfs's snapshot directory, if it isn't hidden
+			if rel == ".zfs" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := treeEntry{info: info}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.ino = stat.Ino
+		}
+		entries[rel] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// What changed between the tree at from and the one at to, sorted by path.
+// Files are modified if their type, size or mtime differ (like rsync, the
+// contents aren't compared). A file which is removed from one path and added
+// at another with the same inode number, type and mtime was renamed, which
+// zfs preserves between a filesystem and its snapshots. Hardlinks share an
+// inode, so each removed path is only matched with one added one.
+func diffTrees(from, to string) ([]FileChange, error) {
+	before, err := walkTree(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := walkTree(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []FileChange{}
+	// removed paths, and (so that renames can be matched up with them) the
+	// removed paths of each inode. several paths can share an inode, when
+	// they're hardlinks to it.
+	removed := map[string]bool{}
+	removedByIno := map[uint64][]string{}
+	for path, old := range before {
+		if _, ok := after[path]; !ok {
+			removed[path] = true
+			if old.ino != 0 {
+				removedByIno[old.ino] = append(removedByIno[old.ino], path)
+			}
+		}
+	}
+	// match each added path up with the first (by path) removed one of its
+	// inode, so it's the same whatever order the maps are walked in
+	for _, paths := range removedByIno {
+		sort.Strings(paths)
+	}
+	added := []string{}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			added = append(added, path)
+		}
+	}
+	sort.Strings(added)
+	for _, path := range added {
+		now := after[path]
+		change := FileChange{Change: "added", Path: path, Size: now.info.Size()}
+		candidates := removedByIno[now.ino]
+		for i, oldPath := range candidates {
+			previous := before[oldPath].info
+			if previous.Mode() == now.info.Mode() && previous.ModTime().Equal(now.info.ModTime()) {
+				removedByIno[now.ino] = append(candidates[:i:i], candidates[i+1:]...)
+				delete(removed, oldPath)
+				change.Change = "renamed"
+				change.OldPath = oldPath
+				change.OldSize = previous.Size()
+				break
+			}
+		}
+		changes = append(changes, change)
+	}
+	for path, now := range after {
+		old, ok := before[path]
+		if !ok {
+			continue
+		}
+		if old.info.Mode() != now.info.Mode() ||
+			old.info.Size() != now.info.Size() ||
+			!old.info.ModTime().Equal(now.info.ModTime()) {
+			changes = append(changes, FileChange{
+				Change: "modified", Path: path,
+				Size: now.info.Size(), OldSize: old.info.Size(),
+			})
+		}
+	}
+	for path := range removed {
+		changes = append(changes, FileChange{
+			Change: "removed", Path: path, OldSize: before[path].info.Size(),
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// Compare commit from of branchName of name (nothing at all, if from is "")
+// with commit to (its working state, if to is ""), optionally only under the
+// directory for subdot. Like listing files, this reads the snapshots directly,
+// so it only works on the master of the branch.
+func (s *InMemoryState) diff(name VolumeName, branchName, from, to, subdot string) (DiffResult, error) {
+	if subdot != "" && (filepath.Base(subdot) != subdot || subdot == "." || subdot == "..") {
+		return DiffResult{}, fmt.Errorf("Invalid subdot name '%s'", subdot)
+	}
+	fromRoot := ""
+	if from != "" {
+		root, err := s.commitRoot(name, branchName, from)
+		if err != nil {
+			return DiffResult{}, err
+		}
+		fromRoot = root
+	}
+	toRoot, err := s.commitRoot(name, branchName, to)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	if subdot != "" {
+		if fromRoot != "" {
+			fromRoot = filepath.Join(fromRoot, subdot)
+		}
+		toRoot = filepath.Join(toRoot, subdot)
+	}
+
+	changes, err := diffTrees(fromRoot, toRoot)
+	if err != nil {
+		log.Printf("[diff] %s: %v", name, err)
+		return DiffResult{}, err
+	}
+	result := DiffResult{Changes: changes}
+	if len(changes) > MAX_DIFF_CHANGES {
+		result.Changes = changes[:MAX_DIFF_CHANGES]
+		result.Truncated = true
+	}
+	return result, nil
+}
+
+// Which filesystem has snapshotId in the history of filesystemId: either
+// filesystemId itself, or (for branches) one of its origins, up to and
+// including the snapshot it was branched from.
+func (s *InMemoryState) snapshotInHistory(filesystemId, snapshotId string) (string, error) {
+	fsId := filesystemId
+	upTo := ""
+	for {
+		snaps, err := s.snapshotsForCurrentMaster(fsId)
+		if err != nil {
+			return "", err
+		}
+		for _, snap := range snaps {
+			if snap.Id == snapshotId {
+				return fsId, nil
+			}
+			if snap.Id == upTo {
+				break
+			}
+		}
+		clone, err := s.registry.LookupCloneById(fsId)
+		if err != nil {
+			// reached the master branch without finding it
+			return "", fmt.Errorf("Commit %s isn't in the history of this branch", snapshotId)
+		}
+		fsId = clone.Origin.FilesystemId
+		upTo = clone.Origin.SnapshotId
+	}
+}
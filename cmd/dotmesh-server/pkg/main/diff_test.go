@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	root, err := ioutil.TempDir("", "dotmesh-diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// hardlinks between the trees stand in for the inodes a snapshot shares
+	// with its filesystem
+	from := filepath.Join(root, "from")
+	to := filepath.Join(root, "to")
+	for _, dir := range []string{from, to} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path, content string) {
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(oldPath, newPath string) {
+		err := os.Link(oldPath, newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(from, "kept"), "kept")
+	link(filepath.Join(from, "kept"), filepath.Join(to, "kept"))
+	write(filepath.Join(from, "modified"), "before")
+	write(filepath.Join(to, "modified"), "after it changed")
+	write(filepath.Join(to, "added"), "added")
+	// two links to one file, which are both removed
+	write(filepath.Join(from, "gone"), "gone")
+	link(filepath.Join(from, "gone"), filepath.Join(from, "gone-too"))
+	// two links to another, one of which is renamed
+	write(filepath.Join(from, "linked"), "linked")
+	link(filepath.Join(from, "linked"), filepath.Join(from, "linked-too"))
+	link(filepath.Join(from, "linked"), filepath.Join(to, "renamed"))
+
+	changes, err := diffTrees(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileChange{
+		{Change: "added", Path: "added", Size: 5},
+		{Change: "removed", Path: "gone", OldSize: 4},
+		{Change: "removed", Path: "gone-too", OldSize: 4},
+		{Change: "removed", Path: "linked-too", OldSize: 6},
+		{Change: "modified", Path: "modified", Size: 16, OldSize: 6},
+		{Change: "renamed", Path: "renamed", OldPath: "linked", Size: 6, OldSize: 6},
+	}
+	if fmt.Sprintf("%+v", changes) != fmt.Sprintf("%+v", expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+
+	// from "" is an empty tree
+	changes, err = diffTrees("", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("Expected everything to be added, got %+v", changes)
+	}
+}
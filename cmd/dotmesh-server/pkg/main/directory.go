@@ -0,0 +1,1321 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A storage backend which doesn't need any kernel support, for CI runners and
+// laptops which can't load ZFS. Each filesystem is a plain directory:
+//
+//     <root>/<POOL>/dmfs/<filesystemId>/data                live data, bind-mounted at mnt(fs)
+//     <root>/<POOL>/dmfs/<filesystemId>/snapshots/<id>      one tree per commit
+//     <root>/<POOL>/dmfs/<filesystemId>/dotmesh.json        sidecar: origin, snapshots, metadata
+//
+// Commits are copies of the data directory. Files which haven't changed since
+// the previous commit are hardlinked to it (commits are immutable, so that's
+// safe), and everything else is reflinked where the underlying filesystem
+// supports it, falling back to a plain copy. Unlike zfs snapshots, that means
+// a commit isn't atomic with respect to containers writing to the dot while it
+// happens. Replication streams are tar archives, with unchanged files sent as
+// hardlinks to the previous commit.
+
+const DIRECTORY_SIDECAR = "dotmesh.json"
+const DIRECTORY_STREAM_HEADER = "dotmesh-stream.json"
+
+// FICLONE from linux/fs.h
+const FICLONE = 0x40049409
+
+type DirectoryBackend struct {
+	root string
+	// serializes read-modify-write of sidecar files
+	sidecarLock sync.Mutex
+	// SizeInfo is called every second for every filesystem, so what it can
+	// work out from the (immutable) snapshots is kept, by filesystem id
+	sizeCacheLock sync.Mutex
+	sizeCache     map[string]*directorySizeCache
+}
+
+type directorySizeCache struct {
+	// the snapshot ids the total was worked out for
+	snapshotIds   string
+	snapshotsSize int64
+	// the regular files in the latest snapshot, by path
+	latestId    string
+	latestFiles map[string]os.FileInfo
+}
+
+// the sidecar, which stores what zfs would otherwise keep in dataset
+// properties
+type directorySidecar struct {
+	Origin    Origin
+	Snapshots []directorySnapshot
+}
+
+type directorySnapshot struct {
+	Id string
+	// keyed on META_KEY_PREFIX + key, same as the zfs user properties
+	Properties map[string]string
+}
+
+// first entry in every replication stream
+type directoryStreamHeader struct {
+	// if set, the stream is incremental from this snapshot, which the
+	// receiver must already have
+	BaseFilesystemId string
+	BaseSnapshotId   string
+	Snapshots        []directorySnapshot
+}
+
+func NewDirectoryBackend(root string) *DirectoryBackend {
+	return &DirectoryBackend{root: root, sizeCache: map[string]*directorySizeCache{}}
+}
+
+func (d *DirectoryBackend) Name() string {
+	return "directory"
+}
+
+func (d *DirectoryBackend) poolDir() string {
+	return filepath.Join(d.root, POOL)
+}
+
+func (d *DirectoryBackend) fsDir(filesystemId string) string {
+	return filepath.Join(d.poolDir(), ROOT_FS, filesystemId)
+}
+
+func (d *DirectoryBackend) dataDir(filesystemId string) string {
+	return filepath.Join(d.fsDir(filesystemId), "data")
+}
+
+func (d *DirectoryBackend) snapshotDir(filesystemId, snapshotId string) string {
+	return filepath.Join(d.fsDir(filesystemId), "snapshots", snapshotId)
+}
+
+func (d *DirectoryBackend) sidecarPath(filesystemId string) string {
+	return filepath.Join(d.fsDir(filesystemId), DIRECTORY_SIDECAR)
+}
+
+func (d *DirectoryBackend) readSidecar(filesystemId string) (*directorySidecar, error) {
+	return readSidecarFile(d.sidecarPath(filesystemId))
+}
+
+func (d *DirectoryBackend) updateSidecar(filesystemId string, f func(*directorySidecar) error) error {
+	d.sidecarLock.Lock()
+	defer d.sidecarLock.Unlock()
+	sidecar, err := d.readSidecar(filesystemId)
+	if err != nil {
+		return err
+	}
+	err = f(sidecar)
+	if err != nil {
+		return err
+	}
+	return writeSidecarFile(d.sidecarPath(filesystemId), sidecar)
+}
+
+func readSidecarFile(path string) (*directorySidecar, error) {
+	serialized, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sidecar := &directorySidecar{}
+	err = json.Unmarshal(serialized, sidecar)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", path, err)
+	}
+	return sidecar, nil
+}
+
+func writeSidecarFile(path string, sidecar *directorySidecar) error {
+	serialized, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	// write-then-rename so that a crash never leaves a half-written sidecar
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, serialized, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *directorySidecar) indexOf(snapshotId string) int {
+	for i, snap := range s.Snapshots {
+		if snap.Id == snapshotId {
+			return i
+		}
+	}
+	return -1
+}
+
+func propertiesFromMetadata(meta metadata) map[string]string {
+	properties := map[string]string{}
+	for k, v := range meta {
+		properties[META_KEY_PREFIX+k] = v
+	}
+	return properties
+}
+
+func metadataFromProperties(properties map[string]string) metadata {
+	meta := metadata{}
+	for k, v := range properties {
+		if strings.HasPrefix(k, META_KEY_PREFIX) {
+			meta[k[len(META_KEY_PREFIX):]] = v
+		}
+	}
+	return meta
+}
+
+func (d *DirectoryBackend) PoolId() (string, error) {
+	// there's no pool guid to ask for, so make one up the first time we run
+	// and remember it.
+	err := os.MkdirAll(d.poolDir(), 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(d.poolDir(), "pool-id")
+	id, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(id)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	newId := fmt.Sprintf("%x", b)
+	err = ioutil.WriteFile(path, []byte(newId), 0600)
+	if err != nil {
+		return "", err
+	}
+	return newId, nil
+}
+
+func (d *DirectoryBackend) ListFilesystems() ([]string, error) {
+	log.Print("Finding filesystem ids...")
+	root := filepath.Join(d.poolDir(), ROOT_FS)
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	filesystemIds := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// half-created or half-destroyed filesystems don't have a sidecar
+		if _, err := os.Stat(d.sidecarPath(entry.Name())); err == nil {
+			filesystemIds = append(filesystemIds, entry.Name())
+		}
+	}
+	return filesystemIds, nil
+}
+
+func (d *DirectoryBackend) Discover(filesystemId string) (*filesystem, error) {
+	sidecar, err := d.readSidecar(filesystemId)
+	if os.IsNotExist(err) {
+		return &filesystem{
+			id:     filesystemId,
+			exists: false,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	code, err := returnCode("mountpoint", mnt(filesystemId))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []*snapshot{}
+	for _, snap := range sidecar.Snapshots {
+		meta := metadataFromProperties(snap.Properties)
+		snapshots = append(snapshots, &snapshot{Id: snap.Id, Metadata: &meta})
+	}
+	return &filesystem{
+		id:        filesystemId,
+		exists:    true,
+		mounted:   code == 0,
+		snapshots: snapshots,
+		origin:    sidecar.Origin,
+	}, nil
+}
+
+func (d *DirectoryBackend) Create(filesystemId string) error {
+	return d.create(filesystemId, Origin{})
+}
+
+func (d *DirectoryBackend) create(filesystemId string, origin Origin) error {
+	if _, err := os.Stat(d.sidecarPath(filesystemId)); err == nil {
+		return fmt.Errorf("Filesystem %s already exists", filesystemId)
+	}
+	for _, dir := range []string{
+		d.dataDir(filesystemId),
+		filepath.Join(d.fsDir(filesystemId), "snapshots"),
+	} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	// the sidecar is written last, it's what makes the filesystem exist
+	return writeSidecarFile(
+		d.sidecarPath(filesystemId), &directorySidecar{Origin: origin},
+	)
+}
+
+func (d *DirectoryBackend) Destroy(filesystemId string) error {
+	// zfs destroy unmounts for us, so do the same
+	if code, err := returnCode("mountpoint", mnt(filesystemId)); err == nil && code == 0 {
+		err := d.Unmount(filesystemId)
+		if err != nil {
+			return err
+		}
+	}
+	d.sizeCacheLock.Lock()
+	delete(d.sizeCache, filesystemId)
+	d.sizeCacheLock.Unlock()
+	// remove the sidecar first, so a partial delete doesn't look like a
+	// filesystem any more
+	err := os.Remove(d.sidecarPath(filesystemId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(d.fsDir(filesystemId))
+}
+
+func (d *DirectoryBackend) Mount(filesystemId string) error {
+	out, err := exec.Command(
+		"mkdir", "-p", mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to mkdir mountpoint %s: %s", err, mnt(filesystemId), out)
+	}
+	out, err = exec.Command("mount", "--bind",
+		d.dataDir(filesystemId), mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to bind mount %s: %s", err, d.dataDir(filesystemId), out)
+	}
+	return nil
+}
+
+func (d *DirectoryBackend) Unmount(filesystemId string) error {
+	out, err := exec.Command("umount", mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to unmount %s: %s", err, mnt(filesystemId), out)
+	}
+	return nil
+}
+
+func (d *DirectoryBackend) Snapshot(filesystemId, snapshotId string, meta metadata) error {
+	sidecar, err := d.readSidecar(filesystemId)
+	if err != nil {
+		return err
+	}
+	if sidecar.indexOf(snapshotId) != -1 {
+		return fmt.Errorf("Snapshot %s@%s already exists", filesystemId, snapshotId)
+	}
+	previous := ""
+	if len(sidecar.Snapshots) > 0 {
+		previous = d.snapshotDir(
+			filesystemId, sidecar.Snapshots[len(sidecar.Snapshots)-1].Id,
+		)
+	} else if sidecar.Origin.SnapshotId != "" {
+		// a clone's first commit can share files with its origin
+		previous = d.snapshotDir(sidecar.Origin.FilesystemId, sidecar.Origin.SnapshotId)
+	}
+	tmp := d.snapshotDir(filesystemId, ".tmp-"+snapshotId)
+	err = copyTree(d.dataDir(filesystemId), tmp, previous)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("Unable to snapshot %s: %s", filesystemId, err)
+	}
+	err = os.Rename(tmp, d.snapshotDir(filesystemId, snapshotId))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return d.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		s.Snapshots = append(s.Snapshots, directorySnapshot{
+			Id: snapshotId, Properties: propertiesFromMetadata(meta),
+		})
+		return nil
+	})
+}
+
+func (d *DirectoryBackend) SetSnapshotMetadata(filesystemId, snapshotId string, meta metadata) error {
+	return d.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		i := s.indexOf(snapshotId)
+		if i == -1 {
+			return fmt.Errorf("No such snapshot %s@%s", filesystemId, snapshotId)
+		}
+		if s.Snapshots[i].Properties == nil {
+			s.Snapshots[i].Properties = map[string]string{}
+		}
+		for k, v := range propertiesFromMetadata(meta) {
+			s.Snapshots[i].Properties[k] = v
+		}
+		return nil
+	})
+}
+
+func (d *DirectoryBackend) Rollback(filesystemId, snapshotId string) error {
+	var discard []directorySnapshot
+	err := d.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		i := s.indexOf(snapshotId)
+		if i == -1 {
+			return fmt.Errorf("No such snapshot %s@%s", filesystemId, snapshotId)
+		}
+		discard = s.Snapshots[i+1:]
+		s.Snapshots = s.Snapshots[:i+1]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, snap := range discard {
+		err := os.RemoveAll(d.snapshotDir(filesystemId, snap.Id))
+		if err != nil {
+			return err
+		}
+	}
+	return resetTree(d.snapshotDir(filesystemId, snapshotId), d.dataDir(filesystemId))
+}
+
+func (d *DirectoryBackend) DestroySnapshot(filesystemId, snapshotId string) error {
+	err := d.updateSidecar(filesystemId, func(s *directorySidecar) error {
+		i := s.indexOf(snapshotId)
+		if i == -1 {
+			return fmt.Errorf("No such snapshot %s@%s", filesystemId, snapshotId)
+		}
+		s.Snapshots = append(s.Snapshots[:i], s.Snapshots[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(d.snapshotDir(filesystemId, snapshotId))
+}
+
+func (d *DirectoryBackend) Clone(filesystemId, snapshotId, newFilesystemId string) error {
+	source := d.snapshotDir(filesystemId, snapshotId)
+	if _, err := os.Stat(source); err != nil {
+		return fmt.Errorf("Unable to clone %s@%s: %s", filesystemId, snapshotId, err)
+	}
+	err := os.MkdirAll(d.fsDir(newFilesystemId), 0755)
+	if err != nil {
+		return err
+	}
+	err = copyTree(source, d.dataDir(newFilesystemId), "")
+	if err != nil {
+		os.RemoveAll(d.fsDir(newFilesystemId))
+		return fmt.Errorf("Unable to clone %s@%s: %s", filesystemId, snapshotId, err)
+	}
+	return d.create(newFilesystemId, Origin{
+		FilesystemId: filesystemId, SnapshotId: snapshotId,
+	})
+}
+
+func (d *DirectoryBackend) SnapshotPath(filesystemId, snapshotId string) (string, error) {
+	if snapshotId == "" {
+		return d.dataDir(filesystemId), nil
+	}
+	path := d.snapshotDir(filesystemId, snapshotId)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("No such snapshot %s@%s: %s", filesystemId, snapshotId, err)
+	}
+	return path, nil
+}
+
+// Only the working state is walked each time, what's needed from the
+// snapshots is cached until they change.
+func (d *DirectoryBackend) SizeInfo(filesystemId, latestSnap string) (int64, int64, error) {
+	sidecar, err := d.readSidecar(filesystemId)
+	if err != nil {
+		return 0, 0, err
+	}
+	ids := []string{}
+	for _, snap := range sidecar.Snapshots {
+		ids = append(ids, snap.Id)
+	}
+	snapshotIds := strings.Join(ids, ",")
+
+	d.sizeCacheLock.Lock()
+	cache, ok := d.sizeCache[filesystemId]
+	d.sizeCacheLock.Unlock()
+	if !ok {
+		cache = &directorySizeCache{}
+	} else {
+		// so that concurrent calls don't share one
+		copied := *cache
+		cache = &copied
+	}
+	if !ok || cache.snapshotIds != snapshotIds {
+		cache.snapshotIds = snapshotIds
+		cache.snapshotsSize, err = treeSize(filepath.Join(d.fsDir(filesystemId), "snapshots"))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if latestSnap == "" {
+		cache.latestId = ""
+		cache.latestFiles = map[string]os.FileInfo{}
+	} else if !ok || cache.latestId != latestSnap {
+		cache.latestId = latestSnap
+		cache.latestFiles, err = regularFiles(d.snapshotDir(filesystemId, latestSnap))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	d.sizeCacheLock.Lock()
+	d.sizeCache[filesystemId] = cache
+	d.sizeCacheLock.Unlock()
+
+	dataBytes, dirtyBytes, err := workingStateSize(d.dataDir(filesystemId), cache.latestFiles)
+	if err != nil {
+		return 0, 0, err
+	}
+	return dirtyBytes, dataBytes + cache.snapshotsSize, nil
+}
+
+// work out which snapshots a Send with the given arguments covers, using the
+// same conventions as calculateSendArgs.
+func (d *DirectoryBackend) streamHeader(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+) (*directoryStreamHeader, error) {
+	sidecar, err := d.readSidecar(toFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	end := sidecar.indexOf(toSnapshotId)
+	if end == -1 {
+		return nil, fmt.Errorf("No such snapshot %s@%s", toFilesystemId, toSnapshotId)
+	}
+	header := &directoryStreamHeader{}
+	start := 0
+	if fromSnapshotId != "" && fromSnapshotId != START_SNAPSHOT {
+		if strings.Contains(fromSnapshotId, "@") {
+			// incremental from a clone's origin, so send all of the clone's
+			// own snapshots
+			shrapnel := strings.SplitN(fromSnapshotId, "@", 2)
+			header.BaseFilesystemId = shrapnel[0]
+			header.BaseSnapshotId = shrapnel[1]
+		} else {
+			i := sidecar.indexOf(fromSnapshotId)
+			if i == -1 {
+				return nil, fmt.Errorf("No such snapshot %s@%s", toFilesystemId, fromSnapshotId)
+			}
+			header.BaseFilesystemId = toFilesystemId
+			header.BaseSnapshotId = fromSnapshotId
+			start = i + 1
+		}
+	}
+	header.Snapshots = sidecar.Snapshots[start : end+1]
+	return header, nil
+}
+
+// call f for each entry in the stream (after the header), in order. f is
+// given the tar header to write and, for regular file data, the path to read
+// it from.
+func (d *DirectoryBackend) walkStream(
+	header *directoryStreamHeader, toFilesystemId string,
+	f func(hdr *tar.Header, source string) error,
+) error {
+	previousId := header.BaseSnapshotId
+	previousDir := ""
+	if header.BaseSnapshotId != "" {
+		previousDir = d.snapshotDir(header.BaseFilesystemId, header.BaseSnapshotId)
+	}
+	for _, snap := range header.Snapshots {
+		dir := d.snapshotDir(toFilesystemId, snap.Id)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err = os.Readlink(path)
+				if err != nil {
+					return err
+				}
+			} else if !info.Mode().IsRegular() && !info.IsDir() {
+				log.Printf("[DirectoryBackend:Send] skipping special file %s", path)
+				return nil
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(filepath.Join(snap.Id, rel))
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if info.Mode().IsRegular() && previousDir != "" {
+				if unchangedFile(info, filepath.Join(previousDir, rel)) {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = filepath.ToSlash(filepath.Join(previousId, rel))
+					hdr.Size = 0
+					return f(hdr, "")
+				}
+			}
+			if info.Mode().IsRegular() {
+				return f(hdr, path)
+			}
+			return f(hdr, "")
+		})
+		if err != nil {
+			return err
+		}
+		previousId = snap.Id
+		previousDir = dir
+	}
+	return nil
+}
+
+func (d *DirectoryBackend) PredictSize(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+) (int64, error) {
+	header, err := d.streamHeader(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return 0, err
+	}
+	serialized, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+	// tar pads everything to 512 byte blocks, and ends with two empty ones.
+	// this ignores any extended headers for long names, so it's an estimate.
+	blocks := func(n int64) int64 { return (n + 511) / 512 * 512 }
+	size := 512 + blocks(int64(len(serialized))) + 1024
+	err = d.walkStream(header, toFilesystemId, func(hdr *tar.Header, source string) error {
+		size += 512 + blocks(hdr.Size)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (d *DirectoryBackend) Send(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+	stream io.Writer,
+) error {
+	header, err := d.streamHeader(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(stream)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     DIRECTORY_STREAM_HEADER,
+		Mode:     0600,
+		Size:     int64(len(serialized)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(serialized)
+	if err != nil {
+		return err
+	}
+	err = d.walkStream(header, toFilesystemId, func(hdr *tar.Header, source string) error {
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if source == "" {
+			return nil
+		}
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tw, file, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error sending %s: %s", toFilesystemId, err)
+	}
+	return tw.Close()
+}
+
+func (d *DirectoryBackend) Receive(filesystemId string, stream io.Reader) error {
+	tr := tar.NewReader(stream)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("Unable to read stream header for %s: %s", filesystemId, err)
+	}
+	if hdr.Name != DIRECTORY_STREAM_HEADER {
+		return fmt.Errorf(
+			"Expected %s at start of stream for %s, got %s",
+			DIRECTORY_STREAM_HEADER, filesystemId, hdr.Name,
+		)
+	}
+	header := &directoryStreamHeader{}
+	err = json.NewDecoder(tr).Decode(header)
+	if err != nil {
+		return fmt.Errorf("Unable to parse stream header for %s: %s", filesystemId, err)
+	}
+
+	// get the destination into the state the stream expects, like zfs recv
+	// does.
+	sidecar, err := d.readSidecar(filesystemId)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = d.checkStreamHeader(filesystemId, sidecar, header)
+	if err != nil {
+		return err
+	}
+	if header.BaseSnapshotId == "" {
+		if exists {
+			return fmt.Errorf(
+				"Destination %s exists, can't receive a full stream into it", filesystemId,
+			)
+		}
+		err = d.Create(filesystemId)
+	} else if header.BaseFilesystemId != filesystemId {
+		if exists {
+			return fmt.Errorf(
+				"Destination %s exists, can't receive a clone of %s@%s into it",
+				filesystemId, header.BaseFilesystemId, header.BaseSnapshotId,
+			)
+		}
+		err = d.Clone(header.BaseFilesystemId, header.BaseSnapshotId, filesystemId)
+	} else {
+		if !exists {
+			return fmt.Errorf(
+				"Destination %s does not exist, can't receive an incremental stream into it",
+				filesystemId,
+			)
+		}
+		if len(sidecar.Snapshots) == 0 ||
+			sidecar.Snapshots[len(sidecar.Snapshots)-1].Id != header.BaseSnapshotId {
+			return fmt.Errorf(
+				"Most recent snapshot of %s does not match incremental source %s",
+				filesystemId, header.BaseSnapshotId,
+			)
+		}
+		// receiving ends by resetting the data to the latest snapshot, so
+		// like zfs recv without -F, refuse to throw away uncommitted changes
+		var changed bool
+		changed, err = treeChanged(
+			d.dataDir(filesystemId), d.snapshotDir(filesystemId, header.BaseSnapshotId),
+		)
+		if err == nil && changed {
+			return fmt.Errorf(
+				"Destination %s has been modified since most recent snapshot %s",
+				filesystemId, header.BaseSnapshotId,
+			)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// like a failed zfs recv, a failed full (or clone) receive leaves nothing
+	// behind, so that it can be tried again
+	created := !exists
+
+	// where the stream's snapshots are received to, and where link targets
+	// can be found locally, which includes the snapshot the stream builds on.
+	// nothing in the stream may be written into that.
+	targets := map[string]string{}
+	dirs := map[string]string{}
+	if header.BaseSnapshotId != "" {
+		dirs[header.BaseSnapshotId] = d.snapshotDir(
+			header.BaseFilesystemId, header.BaseSnapshotId,
+		)
+	}
+	tmpDir := func(snapshotId string) string {
+		return d.snapshotDir(filesystemId, ".recv-"+snapshotId)
+	}
+	for _, snap := range header.Snapshots {
+		targets[snap.Id] = tmpDir(snap.Id)
+		dirs[snap.Id] = tmpDir(snap.Id)
+	}
+	cleanup := func() {
+		for _, snap := range header.Snapshots {
+			os.RemoveAll(tmpDir(snap.Id))
+		}
+		if created {
+			err := d.Destroy(filesystemId)
+			if err != nil {
+				log.Printf("[DirectoryBackend:Receive] Unable to remove %s: %s", filesystemId, err)
+			}
+		}
+	}
+
+	// directory mtimes have to be restored after their contents are written
+	dirTimes := map[string]time.Time{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("Error reading stream for %s: %s", filesystemId, err)
+		}
+		target, err := resolveStreamPath(targets, hdr.Name)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(target, os.FileMode(hdr.Mode).Perm())
+			if os.IsExist(err) {
+				// fine if it's a directory we made for something in it, but
+				// not a symlink the stream made
+				info, lstatErr := os.Lstat(target)
+				if lstatErr == nil && info.IsDir() {
+					err = nil
+				}
+			}
+			if err == nil {
+				err = os.Chmod(target, os.FileMode(hdr.Mode).Perm())
+			}
+			dirTimes[target] = hdr.ModTime
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+			if err == nil {
+				err = os.Lchown(target, hdr.Uid, hdr.Gid)
+			}
+		case tar.TypeLink:
+			var source string
+			source, err = resolveStreamPath(dirs, hdr.Linkname)
+			if err == nil {
+				err = os.Link(source, target)
+			}
+		case tar.TypeReg:
+			err = writeStreamFile(tr, hdr, target)
+		default:
+			log.Printf("[DirectoryBackend:Receive] skipping unsupported entry %s", hdr.Name)
+		}
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("Error receiving %s into %s: %s", hdr.Name, filesystemId, err)
+		}
+	}
+	for dir, mtime := range dirTimes {
+		os.Chtimes(dir, mtime, mtime)
+	}
+
+	for _, snap := range header.Snapshots {
+		// a snapshot with no entries at all can't happen (there's always the
+		// root directory), but be defensive
+		err := os.MkdirAll(tmpDir(snap.Id), 0755)
+		if err == nil {
+			err = os.Rename(tmpDir(snap.Id), d.snapshotDir(filesystemId, snap.Id))
+		}
+		if err != nil {
+			cleanup()
+			return err
+		}
+		snap := snap
+		err = d.updateSidecar(filesystemId, func(s *directorySidecar) error {
+			s.Snapshots = append(s.Snapshots, snap)
+			return nil
+		})
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+	if len(header.Snapshots) == 0 {
+		return nil
+	}
+	// like zfs recv, leave the filesystem looking like the latest snapshot
+	latest := header.Snapshots[len(header.Snapshots)-1].Id
+	err = resetTree(d.snapshotDir(filesystemId, latest), d.dataDir(filesystemId))
+	if err != nil {
+		cleanup()
+	}
+	return err
+}
+
+// the snapshot and filesystem ids dotmesh makes. ids in a stream end up in
+// paths, so nothing else (like "..") is allowed.
+var streamIdRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:-]*$`)
+
+// Check the header of a stream being received into filesystemId (whose
+// sidecar is nil if it doesn't exist yet) before anything is written: its
+// ids have to be plain ids, it can only build on a snapshot we have, and it
+// can't bring snapshots we already have.
+func (d *DirectoryBackend) checkStreamHeader(
+	filesystemId string, sidecar *directorySidecar, header *directoryStreamHeader,
+) error {
+	ids := []string{}
+	if header.BaseFilesystemId != "" || header.BaseSnapshotId != "" {
+		ids = append(ids, header.BaseFilesystemId, header.BaseSnapshotId)
+	}
+	for _, snap := range header.Snapshots {
+		ids = append(ids, snap.Id)
+	}
+	for _, id := range ids {
+		if !streamIdRegex.MatchString(id) || strings.Contains(id, "..") {
+			return fmt.Errorf("Invalid id %q in stream for %s", id, filesystemId)
+		}
+	}
+
+	seen := map[string]bool{}
+	if header.BaseSnapshotId != "" {
+		seen[header.BaseSnapshotId] = true
+	}
+	for _, snap := range header.Snapshots {
+		if seen[snap.Id] || (sidecar != nil && sidecar.indexOf(snap.Id) != -1) {
+			return fmt.Errorf("Stream for %s would receive snapshot %s again", filesystemId, snap.Id)
+		}
+		seen[snap.Id] = true
+	}
+
+	if header.BaseSnapshotId == "" {
+		return nil
+	}
+	base := sidecar
+	if header.BaseFilesystemId != filesystemId {
+		var err error
+		base, err = d.readSidecar(header.BaseFilesystemId)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if base == nil || base.indexOf(header.BaseSnapshotId) == -1 {
+		return fmt.Errorf(
+			"Stream for %s builds on %s@%s, which doesn't exist",
+			filesystemId, header.BaseFilesystemId, header.BaseSnapshotId,
+		)
+	}
+	return nil
+}
+
+// map "<snapshotId>/<path>" in a stream to where it lives on disk. symlinks
+// the stream has already made could point anywhere, so nothing is allowed to
+// be under one.
+func resolveStreamPath(dirs map[string]string, name string) (string, error) {
+	shrapnel := strings.SplitN(strings.TrimSuffix(name, "/"), "/", 2)
+	dir, ok := dirs[shrapnel[0]]
+	if !ok {
+		return "", fmt.Errorf("Unexpected snapshot %s in stream", shrapnel[0])
+	}
+	if len(shrapnel) == 1 {
+		return dir, nil
+	}
+	rel := strings.TrimPrefix(filepath.Clean("/"+shrapnel[1]), "/")
+	parent := dir
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			// MkdirAll will make real directories from here on down
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s in stream is under %s, which isn't a directory", name, parent)
+		}
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+func writeStreamFile(r io.Reader, hdr *tar.Header, target string) error {
+	// each file is only in a stream once, so if there's something there
+	// already (like a symlink) the stream isn't one of ours
+	file, err := os.OpenFile(
+		target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, os.FileMode(hdr.Mode).Perm(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Lchown(target, hdr.Uid, hdr.Gid)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(target, os.FileMode(hdr.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// is the file at path the same as the one described by info? (cheaply, like
+// rsync: same inode, or same size, mode and mtime)
+func unchangedFile(info os.FileInfo, path string) bool {
+	other, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	return sameFileInfo(info, other)
+}
+
+func sameFileInfo(info, other os.FileInfo) bool {
+	if os.SameFile(info, other) {
+		return true
+	}
+	return other.Mode() == info.Mode() &&
+		other.Size() == info.Size() &&
+		other.ModTime().Equal(info.ModTime())
+}
+
+// copy the tree at src to dst, which must not exist. regular files which are
+// unchanged from the same path under previous (if given) are hardlinked to it,
+// everything else is reflinked or copied.
+func copyTree(src, dst, previous string) error {
+	dirTimes := map[string]time.Time{}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		chown := func() error {
+			if stat == nil {
+				return nil
+			}
+			return os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		}
+		switch {
+		case info.IsDir():
+			err := os.Mkdir(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			dirTimes[target] = info.ModTime()
+			err = os.Chmod(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			return chown()
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+			return chown()
+		case info.Mode().IsRegular():
+			if previous != "" {
+				candidate := filepath.Join(previous, rel)
+				if unchangedFile(info, candidate) {
+					return os.Link(candidate, target)
+				}
+			}
+			err := cloneFile(path, target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			err = chown()
+			if err != nil {
+				return err
+			}
+			// after chown, which can clear setuid bits, and not subject to
+			// the umask like creating it was
+			err = os.Chmod(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		default:
+			log.Printf("[copyTree] skipping special file %s", path)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for dir, mtime := range dirTimes {
+		os.Chtimes(dir, mtime, mtime)
+	}
+	return nil
+}
+
+// make dst (which may be a mountpoint, so must not itself be replaced) look
+// exactly like src.
+func resetTree(src, dst string) error {
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := os.RemoveAll(filepath.Join(dst, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	entries, err = ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// never hardlink into live data, it's mutable
+		err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reflink src to dst if the filesystem supports it, otherwise copy it.
+func cloneFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), FICLONE, in.Fd())
+	if errno == 0 {
+		return nil
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// bytes used by the tree at root, counting hardlinked files once
+func treeSize(root string) (int64, error) {
+	var size int64
+	seen := map[uint64]bool{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// the regular files in the tree at root, by their path in it
+func regularFiles(root string) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+// the bytes used by the tree at current (like treeSize), and how many of them
+// differ from previous (like treeDelta, but against files previously found by
+// regularFiles, so only current is walked)
+func workingStateSize(current string, previous map[string]os.FileInfo) (int64, int64, error) {
+	var size, delta int64
+	seen := map[uint64]bool{}
+	found := map[string]bool{}
+	err := filepath.Walk(current, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(current, path)
+			if err != nil {
+				return err
+			}
+			found[rel] = true
+			if old, ok := previous[rel]; !ok || !sameFileInfo(info, old) {
+				delta += info.Size()
+			}
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for rel, info := range previous {
+		if !found[rel] {
+			delta += info.Size()
+		}
+	}
+	return size, delta, nil
+}
+
+// whether anything in the tree at current differs from the one at previous
+func treeChanged(current, previous string) (bool, error) {
+	errChanged := fmt.Errorf("changed")
+	entries := 0
+	err := filepath.Walk(current, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(current, path)
+		if err != nil {
+			return err
+		}
+		entries++
+		other, err := os.Lstat(filepath.Join(previous, rel))
+		if err != nil || info.Mode() != other.Mode() {
+			return errChanged
+		}
+		if info.Mode().IsRegular() && !sameFileInfo(info, other) {
+			return errChanged
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(path)
+			otherLink, _ := os.Readlink(filepath.Join(previous, rel))
+			if link != otherLink {
+				return errChanged
+			}
+		}
+		return nil
+	})
+	if err == errChanged {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// nothing's changed or been added, so only something having been
+	// removed would make previous any bigger
+	previousEntries := 0
+	err = filepath.Walk(previous, func(path string, info os.FileInfo, err error) error {
+		previousEntries++
+		return err
+	})
+	return previousEntries != entries, err
+}
+
+// bytes which differ between the tree at current and the one at previous:
+// files which are new or changed in current, plus files which have gone
+func treeDelta(current, previous string) (int64, error) {
+	var delta int64
+	err := filepath.Walk(current, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(current, path)
+		if err != nil {
+			return err
+		}
+		if !unchangedFile(info, filepath.Join(previous, rel)) {
+			delta += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = filepath.Walk(previous, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(previous, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(current, rel)); os.IsNotExist(err) {
+			delta += info.Size()
+		}
+		return nil
+	})
+	return delta, err
+}
+
+// streams are tar files, so what's on disk is always sent uncompressed.
+func (d *DirectoryBackend) CompressedStreams() bool {
+	return false
+}
+
+// receives aren't resumable, an interrupted one is cleaned up as it fails.
+
+func (d *DirectoryBackend) ResumeToken(filesystemId string) (string, error) {
+	return "", nil
+}
+
+func (d *DirectoryBackend) AbortResume(filesystemId string) error {
+	return nil
+}
+
+func (d *DirectoryBackend) InspectResumeToken(token string) (*ResumeInfo, error) {
+	return nil, fmt.Errorf("Resuming replication isn't supported by this storage backend")
+}
+
+func (d *DirectoryBackend) SendResume(token string, stream io.Writer) error {
+	return fmt.Errorf("Resuming replication isn't supported by this storage backend")
+}
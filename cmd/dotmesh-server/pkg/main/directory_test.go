@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDirectoryBackend(t *testing.T) (*DirectoryBackend, func()) {
+	root, err := ioutil.TempDir("", "dotmesh-directory-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDirectoryBackend(root), func() { os.RemoveAll(root) }
+}
+
+// a stream with the given entries after the header, all in snapshot "snap"
+func testStream(t *testing.T, entries ...*tar.Header) *bytes.Buffer {
+	return testStreamWithHeader(t, directoryStreamHeader{
+		Snapshots: []directorySnapshot{{Id: "snap"}},
+	}, entries...)
+}
+
+func testStreamWithHeader(t *testing.T, streamHeader directoryStreamHeader, entries ...*tar.Header) *bytes.Buffer {
+	header, err := json.Marshal(streamHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &bytes.Buffer{}
+	tw := tar.NewWriter(stream)
+	all := append([]*tar.Header{{
+		Name: DIRECTORY_STREAM_HEADER, Mode: 0600, Size: int64(len(header)), Typeflag: tar.TypeReg,
+	}}, entries...)
+	for i, hdr := range all {
+		hdr.ModTime = time.Now()
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			tw.Write(header)
+		} else if hdr.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, hdr.Size))
+		}
+	}
+	tw.Close()
+	return stream
+}
+
+func TestDirectoryRoundTrip(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	// where it's replicated to
+	peer, cleanupPeer := newTestDirectoryBackend(t)
+	defer cleanupPeer()
+
+	err := d.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(d.dataDir("fs"), "first"), []byte("1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Snapshot("fs", "one", metadata{"message": "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(d.dataDir("fs"), "second"), []byte("2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Snapshot("fs", "two", metadata{"message": "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := &bytes.Buffer{}
+	err = d.Send("", "", "fs", "one", false, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = peer.Receive("fs", full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incremental := &bytes.Buffer{}
+	err = d.Send("fs", "one", "fs", "two", false, incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = peer.Receive("fs", incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar, err := peer.readSidecar("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecar.Snapshots) != 2 || sidecar.Snapshots[1].Id != "two" {
+		t.Errorf("Expected snapshots one and two, got %+v", sidecar.Snapshots)
+	}
+	for _, name := range []string{"first", "second"} {
+		_, err := os.Stat(filepath.Join(peer.dataDir("fs"), name))
+		if err != nil {
+			t.Errorf("%s wasn't received: %s", name, err)
+		}
+	}
+}
+
+func TestDirectoryReceiveRefusesPathsUnderSymlinks(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	outside, err := ioutil.TempDir("", "dotmesh-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	err = d.Receive("fs", testStream(t,
+		&tar.Header{Name: "snap/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "snap/x", Linkname: outside, Mode: 0777, Typeflag: tar.TypeSymlink},
+		&tar.Header{Name: "snap/x/evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+	))
+	if err == nil {
+		t.Error("Expected a stream writing under a symlink to be refused")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "evil")); err == nil {
+		t.Error("A stream wrote through a symlink")
+	}
+}
+
+func TestDirectoryReceiveRefusesWritingThroughSymlinks(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	outside, err := ioutil.TempDir("", "dotmesh-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	victim := filepath.Join(outside, "victim")
+	err = ioutil.WriteFile(victim, []byte("precious"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Receive("fs", testStream(t,
+		&tar.Header{Name: "snap/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "snap/x", Linkname: victim, Mode: 0777, Typeflag: tar.TypeSymlink},
+		&tar.Header{Name: "snap/x", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+	))
+	if err == nil {
+		t.Error("Expected a stream writing to a symlink to be refused")
+	}
+	content, _ := ioutil.ReadFile(victim)
+	if string(content) != "precious" {
+		t.Errorf("A stream wrote through a symlink: %q", content)
+	}
+}
+
+func TestDirectoryReceiveRefusesInvalidIds(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	err := d.Create("fs")
+	if err == nil {
+		err = d.Snapshot("fs", "one", metadata{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []directoryStreamHeader{
+		{Snapshots: []directorySnapshot{{Id: ".recv-x/../../.."}}},
+		{Snapshots: []directorySnapshot{{Id: ".."}}},
+		{Snapshots: []directorySnapshot{{Id: "a/b"}}},
+		{Snapshots: []directorySnapshot{{Id: ""}}},
+		{Snapshots: []directorySnapshot{{Id: "two"}, {Id: "two"}}},
+		{BaseFilesystemId: "../fs", BaseSnapshotId: "one", Snapshots: []directorySnapshot{{Id: "two"}}},
+		{BaseFilesystemId: "fs", BaseSnapshotId: "../../..", Snapshots: []directorySnapshot{{Id: "two"}}},
+	} {
+		err := d.Receive("new", testStreamWithHeader(t, header))
+		if err == nil {
+			t.Errorf("Expected a stream with header %+v to be refused", header)
+		}
+	}
+	// the snapshot already there is untouched
+	if _, err := os.Stat(d.snapshotDir("fs", "one")); err != nil {
+		t.Errorf("A stream with invalid ids removed a snapshot: %s", err)
+	}
+	if _, err := os.Stat(d.sidecarPath("new")); err == nil {
+		t.Errorf("A refused stream left a filesystem behind")
+	}
+}
+
+func TestDirectoryReceiveRefusesUnknownBases(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	err := d.Create("fs")
+	if err == nil {
+		err = d.Snapshot("fs", "one", metadata{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// something which isn't a snapshot, but is a directory under the pool
+	err = os.MkdirAll(d.snapshotDir("fs", "not-a-snapshot"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []directoryStreamHeader{
+		// a clone of a snapshot which doesn't exist
+		{BaseFilesystemId: "fs", BaseSnapshotId: "not-a-snapshot", Snapshots: []directorySnapshot{{Id: "two"}}},
+		{BaseFilesystemId: "other", BaseSnapshotId: "one", Snapshots: []directorySnapshot{{Id: "two"}}},
+	} {
+		err := d.Receive("clone", testStreamWithHeader(t, header,
+			&tar.Header{Name: "two/", Mode: 0755, Typeflag: tar.TypeDir},
+		))
+		if err == nil {
+			t.Errorf("Expected a stream building on %s@%s to be refused", header.BaseFilesystemId, header.BaseSnapshotId)
+		}
+	}
+	if _, err := os.Stat(d.sidecarPath("clone")); err == nil {
+		t.Errorf("A refused stream made a clone")
+	}
+}
+
+func TestDirectoryReceiveRefusesWritingIntoBase(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	err := d.Create("fs")
+	if err == nil {
+		err = d.Snapshot("fs", "one", metadata{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Receive("fs", testStreamWithHeader(t, directoryStreamHeader{
+		BaseFilesystemId: "fs", BaseSnapshotId: "one", Snapshots: []directorySnapshot{{Id: "two"}},
+	},
+		&tar.Header{Name: "two/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "one/evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+	))
+	if err == nil {
+		t.Error("Expected a stream writing into the snapshot it builds on to be refused")
+	}
+	if _, err := os.Lstat(filepath.Join(d.snapshotDir("fs", "one"), "evil")); err == nil {
+		t.Error("A stream wrote into an existing snapshot")
+	}
+}
+
+func TestDirectoryFailedFullReceiveCanBeRetried(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+
+	err := d.Receive("fs", testStream(t,
+		&tar.Header{Name: "snap/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "elsewhere/x", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+	))
+	if err == nil {
+		t.Fatal("Expected a stream with an unexpected snapshot to fail")
+	}
+	err = d.Receive("fs", testStream(t,
+		&tar.Header{Name: "snap/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "snap/x", Mode: 0644, Size: 1, Typeflag: tar.TypeReg},
+	))
+	if err != nil {
+		t.Fatalf("Receiving again after a failed receive failed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.dataDir("fs"), "x")); err != nil {
+		t.Errorf("x wasn't received: %s", err)
+	}
+}
+
+func TestDirectorySizeInfo(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	write := func(name string, size int) {
+		err := ioutil.WriteFile(filepath.Join(d.dataDir("fs"), name), make([]byte, size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectDirty := func(latestSnap string, expected int64) {
+		dirty, _, err := d.SizeInfo("fs", latestSnap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dirty != expected {
+			t.Errorf("Expected %d dirty bytes, got %d", expected, dirty)
+		}
+	}
+
+	err := d.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("a", 100)
+	write("b", 10)
+	expectDirty("", 110)
+	err = d.Snapshot("fs", "one", metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDirty("one", 0)
+
+	// changed, new and removed files all count
+	write("a", 50)
+	write("c", 7)
+	err = os.Remove(filepath.Join(d.dataDir("fs"), "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDirty("one", 67)
+
+	err = d.Snapshot("fs", "two", metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDirty("two", 0)
+	_, size, err := d.SizeInfo("fs", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the working state, one's a and b, and two's a and c
+	if size < 50+7+110+57 {
+		t.Errorf("Expected at least %d bytes used, got %d", 50+7+110+57, size)
+	}
+}
+
+func TestDirectoryReceiveRefusesUncommittedChanges(t *testing.T) {
+	d, cleanup := newTestDirectoryBackend(t)
+	defer cleanup()
+	peer, cleanupPeer := newTestDirectoryBackend(t)
+	defer cleanupPeer()
+
+	err := d.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// group writable, which the umask would take away from a plain copy
+	err = ioutil.WriteFile(filepath.Join(d.dataDir("fs"), "shared"), []byte("1"), 0666)
+	if err == nil {
+		err = os.Chmod(filepath.Join(d.dataDir("fs"), "shared"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snap := range []string{"one", "two", "three"} {
+		err = d.Snapshot("fs", snap, metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(from, to string) *bytes.Buffer {
+		stream := &bytes.Buffer{}
+		fromFilesystemId := "fs"
+		if from == "" {
+			fromFilesystemId = ""
+		}
+		err := d.Send(fromFilesystemId, from, "fs", to, false, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+
+	err = peer.Receive("fs", send("", "one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the last receive left is no change
+	err = peer.Receive("fs", send("one", "two"))
+	if err != nil {
+		t.Fatalf("Receiving into an unchanged filesystem failed: %s", err)
+	}
+
+	uncommitted := filepath.Join(peer.dataDir("fs"), "uncommitted")
+	err = ioutil.WriteFile(uncommitted, []byte("precious"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = peer.Receive("fs", send("two", "three"))
+	if err == nil {
+		t.Error("Expected receiving over uncommitted changes to be refused")
+	}
+	if _, err := os.Stat(uncommitted); err != nil {
+		t.Errorf("Uncommitted changes were thrown away: %s", err)
+	}
+}
@@ -179,6 +179,20 @@ func (state *InMemoryState) runPlugin() {
 			writeResponseErr(err, w)
 			return
 		}
+		pin, err := parsePinnedVolume(request.Name, request.Opts)
+		if err != nil {
+			writeResponseErr(err, w)
+			return
+		}
+		if pin != nil {
+			err = state.createPinnedVolume(request.Name, pin, request.Opts["commit"] != "")
+			if err != nil {
+				writeResponseErr(err, w)
+				return
+			}
+			writeResponseOK(w)
+			return
+		}
 		namespace, localName, _, err := parseNamespacedVolumeWithSubvolumes(request.Name)
 		if err != nil {
 			writeResponseErr(err, w)
@@ -207,8 +221,26 @@ func (state *InMemoryState) runPlugin() {
 			We do not actually want to remove the dm volume when Docker
 			references to them are removed.
 
-			This is a no-op.
+			This is a no-op, except for volumes pinned to a commit, which
+			are unmounted.
 		*/
+		log.Print("<= /VolumeDriver.Remove")
+		request := new(RequestRemove)
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			writeResponseErr(err, w)
+			return
+		}
+		pin, err := state.lookupPinnedVolume(request.Name)
+		if err != nil {
+			writeResponseErr(err, w)
+			return
+		}
+		if pin != nil {
+			if err := state.removePinnedVolume(request.Name); err != nil {
+				writeResponseErr(err, w)
+				return
+			}
+		}
 		writeResponseOK(w)
 		// asynchronously notify dotmesh that the containers running on a
 		// volume may have changed
@@ -228,6 +260,11 @@ func (state *InMemoryState) runPlugin() {
 			writeResponseErr(err, w)
 			return
 		}
+		pin, err := state.lookupPinnedVolume(request.Name)
+		if err != nil {
+			writeResponseErr(err, w)
+			return
+		}
 		namespace, localName, subvolume, err := parseNamespacedVolumeWithSubvolumes(request.Name)
 		if err != nil {
 			writeResponseErr(err, w)
@@ -236,6 +273,9 @@ func (state *InMemoryState) runPlugin() {
 
 		name := VolumeName{namespace, localName}
 		mountPoint := containerMntSubvolume(name, subvolume)
+		if pin != nil {
+			mountPoint = pinnedMountpoint(request.Name)
+		}
 
 		log.Printf("Mountpoint for %s: %s", name, mountPoint)
 		responseJSON, _ := json.Marshal(&ResponseMount{
@@ -263,23 +303,39 @@ func (state *InMemoryState) runPlugin() {
 			return
 		}
 
-		namespace, localName, subvolume, err := parseNamespacedVolumeWithSubvolumes(request.Name)
+		pin, err := state.lookupPinnedVolume(request.Name)
 		if err != nil {
 			writeResponseErr(err, w)
 			return
 		}
+		var name VolumeName
+		var mountpoint string
+		if pin != nil {
+			name = VolumeName{pin.Namespace, pin.Dot}
+			mountpoint, err = state.mountPinnedVolume(ctx, request.Name, pin)
+			if err != nil {
+				writeResponseErr(err, w)
+				return
+			}
+		} else {
+			namespace, localName, subvolume, err := parseNamespacedVolumeWithSubvolumes(request.Name)
+			if err != nil {
+				writeResponseErr(err, w)
+				return
+			}
 
-		name := VolumeName{namespace, localName}
+			name = VolumeName{namespace, localName}
 
-		filesystemId, err := state.procureFilesystem(ctx, name)
-		if err != nil {
-			writeResponseErr(err, w)
-			return
-		}
-		mountpoint, err := newContainerMountSymlink(name, filesystemId, subvolume)
-		if err != nil {
-			writeResponseErr(err, w)
-			return
+			filesystemId, err := state.procureFilesystem(ctx, name)
+			if err != nil {
+				writeResponseErr(err, w)
+				return
+			}
+			mountpoint, err = newContainerMountSymlink(name, filesystemId, subvolume)
+			if err != nil {
+				writeResponseErr(err, w)
+				return
+			}
 		}
 		// Allow things that don't want containers to start during their
 		// operations to delay the start of a container. Commented out because
@@ -356,6 +412,11 @@ func (state *InMemoryState) runPlugin() {
 			writeResponseErr(err, w)
 			return
 		}
+		pin, err := state.lookupPinnedVolume(request.Name)
+		if err != nil {
+			writeResponseErr(err, w)
+			return
+		}
 		namespace, localName, subvolume, err := parseNamespacedVolumeWithSubvolumes(request.Name)
 		if err != nil {
 			writeResponseErr(err, w)
@@ -363,6 +424,9 @@ func (state *InMemoryState) runPlugin() {
 		}
 
 		name := VolumeName{namespace, localName}
+		if pin != nil {
+			name = VolumeName{pin.Namespace, pin.Dot}
+		}
 
 		var response = ResponseGet{
 			Err: "",
@@ -379,6 +443,9 @@ func (state *InMemoryState) runPlugin() {
 		}
 
 		mountpoint := containerMntSubvolume(fs.MasterBranch.Name, subvolume)
+		if pin != nil {
+			mountpoint = pinnedMountpoint(request.Name)
+		}
 		log.Printf("Mountpoint for %s (%+v): %s", request.Name, fs, mountpoint)
 		response.Volume = ResponseListVolume{
 			Name:       request.Name,
@@ -398,7 +465,7 @@ func (state *InMemoryState) runPlugin() {
 		log.Fatalf("Could not listen on %s: %v", DM_SOCKET, err)
 	}
 
-	http.Serve(listener, nil)
+	http.Serve(listener, countDockerRequests(http.DefaultServeMux))
 }
 
 func (state *InMemoryState) runErrorPlugin() {
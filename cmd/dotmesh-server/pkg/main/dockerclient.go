@@ -4,10 +4,13 @@ package main
 // stopping and starting containers.
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -189,6 +192,108 @@ func (d *DockerClient) Related(volumeName string) ([]DockerContainer, error) {
 	return related, nil
 }
 
+// The subdot a dm mount name ("dot.subdot@branch", "dot@branch.subdot",
+// "dot" ...) refers to, "__default__" if it doesn't name one.
+func mountSubdot(mountName string) string {
+	for _, part := range strings.Split(mountName, "@") {
+		if i := strings.Index(part, "."); i != -1 {
+			return part[i+1:]
+		}
+	}
+	return "__default__"
+}
+
+// RelatedToSubdot is like Related, but only finds the containers using subdot
+// of volumeName.
+func (d *DockerClient) RelatedToSubdot(volumeName, subdot string) ([]DockerContainer, error) {
+	related := []DockerContainer{}
+	cs, err := d.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return related, err
+	}
+	for _, c := range cs {
+		container, err := d.client.InspectContainer(c.ID)
+		if err != nil {
+			return related, err
+		}
+		if !container.State.Running {
+			continue
+		}
+		for _, m := range container.Mounts {
+			if m.Driver == "dm" && baseDotName(m.Name) == volumeName && mountSubdot(m.Name) == subdot {
+				related = append(related, DockerContainer{Id: container.ID, Name: container.Name})
+				break
+			}
+		}
+	}
+	return related, nil
+}
+
+// Run command with sh -c in a running container, returning what it wrote to
+// stdout and stderr. Gives up waiting for it after timeout, but can't stop
+// it.
+func (d *DockerClient) Exec(containerId, command string, timeout time.Duration) (string, error) {
+	exec, err := d.client.CreateExec(docker.CreateExecOptions{
+		Container:    containerId,
+		Cmd:          []string{"sh", "-c", command},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	output := &synchronizedBuffer{}
+	cw, err := d.client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		OutputStream: output,
+		ErrorStream:  output,
+	})
+	if err != nil {
+		return "", err
+	}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cw.Wait()
+	}()
+	select {
+	case err = <-finished:
+	case <-time.After(timeout):
+		cw.Close()
+		return output.String(), fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return output.String(), err
+	}
+	inspect, err := d.client.InspectExec(exec.ID)
+	if err != nil {
+		return output.String(), err
+	}
+	if inspect.ExitCode != 0 {
+		return output.String(), fmt.Errorf("exited with status %d", inspect.ExitCode)
+	}
+	return output.String(), nil
+}
+
+func (d *DockerClient) Signal(containerId string, signal docker.Signal) error {
+	return d.client.KillContainer(docker.KillContainerOptions{ID: containerId, Signal: signal})
+}
+
+type synchronizedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *synchronizedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *synchronizedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
 func (d *DockerClient) SwitchSymlinks(volumeName, toFilesystemIdPath string) error {
 	// iterate over all the containers, finding mounts where the name of the
 	// mount is volumeName. assuming the container is stopped, unlink the
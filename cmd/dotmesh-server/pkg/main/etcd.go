@@ -284,6 +284,16 @@ func (state *InMemoryState) cleanupDeletedFilesystems() error {
 		del(fmt.Sprintf("%s/filesystems/containers/%s", ETCD_PREFIX, fsId))
 		del(fmt.Sprintf("%s/filesystems/dirty/%s", ETCD_PREFIX, fsId))
 		del(fmt.Sprintf("%s/filesystems/masters/%s", ETCD_PREFIX, fsId))
+		del(policyKey(fsId))
+		del(commitHooksKey(fsId))
+		_, err = kapi.Delete(
+			context.Background(),
+			tagsKey(fsId),
+			&client.DeleteOptions{Recursive: true, Dir: true},
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			errors = append(errors, err)
+		}
 
 		if names.Name.Namespace != "" && names.Name.Name != "" {
 			// The name might be blank in the audit trail - this is used
@@ -480,6 +490,7 @@ func (s *InMemoryState) handleOneFilesystemMaster(node *client.Node) error {
 		pieces := strings.Split(node.Key, "/")
 		fs := pieces[len(pieces)-1]
 		s.initFilesystemMachine(fs)
+		s.events.publish(StreamEvent{Type: "master", FilesystemId: fs, Server: node.Value})
 		var responseChan chan *Event
 		var err error
 		requestId := pieces[len(pieces)-1]
@@ -511,6 +522,7 @@ func (s *InMemoryState) handleOneFilesystemDeletion(node *client.Node) error {
 	pieces := strings.Split(node.Key, "/")
 	fs := pieces[len(pieces)-1]
 	s.initFilesystemMachine(fs)
+	s.events.publish(StreamEvent{Type: "delete", FilesystemId: fs})
 	var responseChan chan *Event
 	var err error
 	requestId := pieces[len(pieces)-1]
@@ -530,7 +542,11 @@ func (s *InMemoryState) globalFsRequestId(fs string, e *Event) (chan *Event, str
 	if err != nil {
 		return nil, "", err
 	}
-	requestId := id.String()
+	return s.globalFsRequestWithId(fs, id.String(), e)
+}
+
+// make a global request with an id we've already chosen
+func (s *InMemoryState) globalFsRequestWithId(fs, requestId string, e *Event) (chan *Event, string, error) {
 	kapi, err := getEtcdKeysApi()
 	if err != nil {
 		return nil, "", err
@@ -606,7 +622,7 @@ func (s *InMemoryState) globalFsRequestId(fs string, e *Event) (chan *Event, str
 		*/
 
 	}()
-	return responseChan, id.String(), nil
+	return responseChan, requestId, nil
 }
 
 // attempt to register an event in etcd upon which the current master for that
@@ -959,6 +975,7 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 				return err
 			}
 			s.registry.UpdateCloneFromEtcd(name, topLevelFilesystemId, *clone)
+			s.events.publish(StreamEvent{Type: "branch", FilesystemId: clone.FilesystemId})
 		}
 		return nil
 	}
@@ -1022,6 +1039,7 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			s.interclusterTransfersLock.Lock()
 			defer s.interclusterTransfersLock.Unlock()
 			(*s.interclusterTransfers)[transferId] = *transferInfo
+			s.events.publishTransfer(transferId, *transferInfo)
 		}
 		return nil
 	}
@@ -1233,6 +1251,7 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			return err
 		}
 		variant := getVariant(node.Node)
+		observeEtcdWatch(variant, node.Index, node.Node.ModifiedIndex)
 		if variant == "filesystems/masters" {
 			updateMine(node.Node)
 			if err = s.handleOneFilesystemMaster(node.Node); err != nil {
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A stream of things happening to dots, served as server-sent events at
+// /events so that clients can wait for changes instead of polling. It's fed
+// by the observers the state machines already use, plus the etcd watch for
+// changes made on other nodes, so each node streams the whole cluster's
+// commits, branches, master moves, transfers and deletions, but only its own
+// state machines' transitions and receive progress.
+type StreamEvent struct {
+	// one of "commit", "branch", "transition", "master", "transfer",
+	// "receive-progress" or "delete"
+	Type         string
+	Time         time.Time
+	FilesystemId string `json:",omitempty"`
+	Namespace    string `json:",omitempty"`
+	Name         string `json:",omitempty"`
+	Branch       string `json:",omitempty"`
+	// the state transitioned to
+	State string `json:",omitempty"`
+	// the new master
+	Server string `json:",omitempty"`
+	// the new latest commit
+	Commit *snapshot `json:",omitempty"`
+	// bytes received so far
+	Bytes      int64               `json:",omitempty"`
+	TransferId string              `json:",omitempty"`
+	Transfer   *TransferPollResult `json:",omitempty"`
+
+	// the dot, as it was when the event happened, for deciding who can see it
+	topLevelFilesystem *TopLevelFilesystem
+}
+
+// a dot and branch a filesystem id has been seen to belong to, remembered so
+// that its deletion can be described after it's gone from the registry
+type knownFilesystem struct {
+	name               VolumeName
+	branch             string
+	topLevelFilesystem TopLevelFilesystem
+}
+
+type eventStream struct {
+	state    *InMemoryState
+	incoming chan StreamEvent
+
+	lock        sync.Mutex
+	subscribers map[chan StreamEvent]bool
+
+	// only touched by run()
+	known         map[string]knownFilesystem
+	latestCommits map[string]string
+	lastProgress  map[string]time.Time
+}
+
+func newEventStream(state *InMemoryState) *eventStream {
+	s := &eventStream{
+		state:         state,
+		incoming:      make(chan StreamEvent, 1000),
+		subscribers:   map[chan StreamEvent]bool{},
+		known:         map[string]knownFilesystem{},
+		latestCommits: map[string]string{},
+		lastProgress:  map[string]time.Time{},
+	}
+	state.newSnapsOnMaster.Tap(func(filesystemId string, data interface{}) {
+		latest, ok := data.(snapshot)
+		if ok && latest.Id != "" {
+			s.publish(StreamEvent{Type: "commit", FilesystemId: filesystemId, Commit: &latest})
+		}
+	})
+	state.localReceiveProgress.Tap(func(filesystemId string, data interface{}) {
+		bytes, ok := data.(int64)
+		if ok {
+			s.publish(StreamEvent{Type: "receive-progress", FilesystemId: filesystemId, Bytes: bytes})
+		}
+	})
+	go s.run()
+	return s
+}
+
+// Stream a state machine's transitions.
+func (s *eventStream) tapTransitions(f *fsMachine) {
+	f.transitionObserver.Tap(func(_ string, data interface{}) {
+		state, ok := data.(string)
+		if ok {
+			s.publish(StreamEvent{Type: "transition", FilesystemId: f.filesystemId, State: state})
+		}
+	})
+}
+
+// Queue an event to be streamed. This never blocks, since it's called from
+// the etcd watch and while publishing to observers; if the stream has fallen
+// that far behind, the event is dropped.
+func (s *eventStream) publish(e StreamEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case s.incoming <- e:
+	default:
+		log.Printf("[eventStream] Dropping %s event for %s, too many queued", e.Type, e.FilesystemId)
+	}
+}
+
+func (s *eventStream) run() {
+	for e := range s.incoming {
+		if !s.interesting(e) {
+			continue
+		}
+		s.describe(&e)
+		s.lock.Lock()
+		for subscriber := range s.subscribers {
+			select {
+			case subscriber <- e:
+			default:
+				// a slow client misses events rather than holding up others
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Commits are published whenever the master's snapshots are updated, so only
+// pass on ones with a new latest commit, and receive progress is published
+// for every block, so only pass on one a second.
+func (s *eventStream) interesting(e StreamEvent) bool {
+	switch e.Type {
+	case "commit":
+		if s.latestCommits[e.FilesystemId] == e.Commit.Id {
+			return false
+		}
+		s.latestCommits[e.FilesystemId] = e.Commit.Id
+	case "receive-progress":
+		if e.Time.Sub(s.lastProgress[e.FilesystemId]) < time.Second {
+			return false
+		}
+		s.lastProgress[e.FilesystemId] = e.Time
+	case "delete":
+		delete(s.latestCommits, e.FilesystemId)
+		delete(s.lastProgress, e.FilesystemId)
+	}
+	return true
+}
+
+// Fill in the dot and branch an event is about.
+func (s *eventStream) describe(e *StreamEvent) {
+	if e.Namespace != "" {
+		tlf, err := s.state.registry.LookupFilesystem(VolumeName{e.Namespace, e.Name})
+		if err == nil {
+			e.topLevelFilesystem = &tlf
+		}
+		return
+	}
+	if e.FilesystemId == "" {
+		return
+	}
+	tlf, branch, err := s.state.registry.LookupFilesystemById(e.FilesystemId)
+	if err == nil {
+		s.known[e.FilesystemId] = knownFilesystem{tlf.MasterBranch.Name, branch, tlf}
+	}
+	known, ok := s.known[e.FilesystemId]
+	if !ok {
+		return
+	}
+	e.Namespace = known.name.Namespace
+	e.Name = known.name.Name
+	e.Branch = branchOrMaster(known.branch)
+	e.topLevelFilesystem = &known.topLevelFilesystem
+	if e.Type == "delete" {
+		delete(s.known, e.FilesystemId)
+	}
+}
+
+func (s *eventStream) subscribe() chan StreamEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subscriber := make(chan StreamEvent, 100)
+	s.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (s *eventStream) unsubscribe(subscriber chan StreamEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers, subscriber)
+}
+
+// Publish a transfer's progress, from the etcd watch.
+func (s *eventStream) publishTransfer(transferId string, pollResult TransferPollResult) {
+	// the stream goes to more people than the transfer's initiator
+	pollResult.ApiKey = ""
+	e := StreamEvent{
+		Type: "transfer", FilesystemId: pollResult.FilesystemId,
+		TransferId: transferId, Transfer: &pollResult,
+	}
+	if _, _, err := s.state.registry.LookupFilesystemById(pollResult.FilesystemId); err != nil {
+		// e.g. the first pull of a dot, which isn't here yet
+		e.FilesystemId = ""
+		e.Namespace = pollResult.LocalNamespace
+		e.Name = pollResult.LocalName
+		e.Branch = branchOrMaster(pollResult.LocalBranchName)
+	}
+	s.publish(e)
+}
+
+type EventStreamServer struct {
+	state *InMemoryState
+}
+
+func (state *InMemoryState) NewEventStreamServer() http.Handler {
+	return EventStreamServer{state: state}
+}
+
+// GET /events streams events about dots the user can see, optionally only
+// about one dot (?namespace=...&name=...) or one transfer (?transfer=<id>).
+func (s EventStreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespace, name, transferId := query.Get("namespace"), query.Get("name"), query.Get("transfer")
+	if namespace != "" || name != "" {
+		err := requireValidVolumeName(VolumeName{namespace, name})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported here", http.StatusInternalServerError)
+		return
+	}
+	admin := ensureAdminUser(r) == nil
+
+	subscriber := s.state.events.subscribe()
+	defer s.state.events.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": watching\n\n")
+	flusher.Flush()
+
+	// keep proxies from giving up on a quiet stream
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e := <-subscriber:
+			if name != "" && (e.Namespace != namespace || e.Name != name) {
+				continue
+			}
+			if transferId != "" && e.TransferId != transferId {
+				continue
+			}
+			if !admin && !s.canSee(r, e, transferId) {
+				continue
+			}
+			serialized, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("[EventStreamServer] Unable to serialize %+v: %s", e, err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, serialized)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Users see events about dots they're authorized for, and transfers they
+// know the id of (as GetTransfer allows).
+func (s EventStreamServer) canSee(r *http.Request, e StreamEvent, transferId string) bool {
+	if transferId != "" && e.TransferId == transferId {
+		return true
+	}
+	if e.topLevelFilesystem == nil {
+		return false
+	}
+	authorized, err := e.topLevelFilesystem.AuthorizeRead(r.Context())
+	return err == nil && authorized
+}
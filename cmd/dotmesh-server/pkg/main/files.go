@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The files in any commit can be listed and read without rolling back to it,
+// straight out of the snapshot the storage backend keeps (.zfs/snapshot/<id>
+// on zfs). Like exports, this only works on the master of the branch, which
+// is the only node that has its snapshots mounted.
+//
+// Paths are relative to the root of the dot, so they start with the subdot
+// they're in ("__default__" for the one used by plain dot names). Symlinks
+// are never followed, they could point anywhere on the host.
+
+// An entry in a directory listing.
+type DotFile struct {
+	Name string
+	// "file", "dir", "symlink" or "other"
+	Type    string
+	Size    int64
+	Mode    string
+	ModTime time.Time
+	// where a symlink points
+	LinkTarget string `json:",omitempty"`
+}
+
+// only this many entries of a huge directory are listed, so that it doesn't
+// make for a huge response
+const MAX_LISTED_FILES = 10000
+
+func dotFileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// The directory holding the files in commit of branchName of name, or its
+// working state if commit is "". The commit can be from before the branch was
+// made.
+func (s *InMemoryState) commitRoot(name VolumeName, branchName, commit string) (string, error) {
+	filesystemId, err := s.registry.MaybeCloneFilesystemId(name, branchName)
+	if err != nil {
+		return "", err
+	}
+	if commit != "" {
+		tlf, err := s.registry.LookupFilesystem(name)
+		if err != nil {
+			return "", err
+		}
+		commit, err = resolveTag(tlf.MasterBranch.Id, commit)
+		if err != nil {
+			return "", err
+		}
+		filesystemId, err = s.snapshotInHistory(filesystemId, commit)
+		if err != nil {
+			return "", err
+		}
+	}
+	if s.masterFor(filesystemId) != s.myNodeId {
+		return "", fmt.Errorf(
+			"Host not master for %s (%s), read it on the node which is", name, filesystemId,
+		)
+	}
+	return s.storage.SnapshotPath(filesystemId, commit)
+}
+
+// Resolve path under root without following symlinks or leaving root.
+// Returns the path on disk and what's there, which may itself be a symlink.
+func resolveDotPath(root, path string) (string, os.FileInfo, error) {
+	current := root
+	info, err := os.Lstat(root)
+	if err != nil {
+		return "", nil, err
+	}
+	parts := strings.Split(strings.Trim(filepath.Clean("/"+path), "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", nil, fmt.Errorf("%s is a symlink", strings.TrimPrefix(current, root+"/"))
+		}
+		if !info.IsDir() {
+			return "", nil, fmt.Errorf("%s isn't a directory", strings.TrimPrefix(current, root+"/"))
+		}
+		current = filepath.Join(current, part)
+		info, err = os.Lstat(current)
+		if err != nil {
+			return "", nil, fmt.Errorf("No such file or directory %s", path)
+		}
+	}
+	return current, info, nil
+}
+
+func listDotFiles(root, path string) ([]DotFile, error) {
+	dir, info, err := resolveDotPath(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		// like ls, list a file as itself
+		return []DotFile{dotFile(dir, info)}, nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := f.Readdir(MAX_LISTED_FILES)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	files := []DotFile{}
+	for _, info := range infos {
+		if dir == root && info.Name() == ".zfs" {
+			continue
+		}
+		files = append(files, dotFile(filepath.Join(dir, info.Name()), info))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func dotFile(path string, info os.FileInfo) DotFile {
+	file := DotFile{
+		Name:    info.Name(),
+		Type:    dotFileType(info.Mode()),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+	}
+	if file.Type == "symlink" {
+		file.LinkTarget, _ = os.Readlink(path)
+	}
+	return file
+}
+
+// GET /files/{namespace}/{name}?branch=<branch>&commit=<commit>&path=<path>
+// => the file at path, or a tar of it if it's a directory (or tar=true).
+// Regular files support range requests.
+type FileServer struct {
+	state *InMemoryState
+}
+
+func (s *InMemoryState) NewFileServer() http.Handler {
+	return FileServer{state: s}
+}
+
+func (fs FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := VolumeName{vars["namespace"], vars["name"]}
+	query := r.URL.Query()
+	branchName := query.Get("branch")
+	if branchName == DEFAULT_BRANCH {
+		branchName = ""
+	}
+	path := query.Get("path")
+
+	fail := func(status int, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("[FileServer] %s", msg)
+		w.WriteHeader(status)
+		w.Write([]byte(msg + "\n"))
+	}
+
+	err := requireValidVolumeName(name)
+	if err != nil {
+		fail(http.StatusBadRequest, "%s", err)
+		return
+	}
+	tlf, err := fs.state.registry.LookupFilesystem(name)
+	if err != nil {
+		fail(http.StatusNotFound, "Can't find %s: %s", name, err)
+		return
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		fail(http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if !authorized {
+		fail(http.StatusForbidden, "You don't have access to %s", name)
+		return
+	}
+	root, err := fs.state.commitRoot(name, branchName, query.Get("commit"))
+	if err != nil {
+		fail(http.StatusNotFound, "%s", err)
+		return
+	}
+	target, info, err := resolveDotPath(root, path)
+	if err != nil {
+		fail(http.StatusNotFound, "%s", err)
+		return
+	}
+
+	if info.IsDir() || query.Get("tar") == "true" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = writeTar(w, target, info.IsDir())
+		if err != nil {
+			// too late to tell the client, but the tar won't have its end
+			// marker so it'll know it's truncated
+			log.Printf("[FileServer] Error writing tar of %s %s: %s", name, path, err)
+		}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		fail(http.StatusBadRequest, "%s isn't a regular file", path)
+		return
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		fail(http.StatusInternalServerError, "%s", err)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// Write a tar of what's at path to w: the contents of a directory, or a file
+// on its own.
+func writeTar(w io.Writer, path string, isDir bool) error {
+	tw := tar.NewWriter(w)
+	base := filepath.Dir(path)
+	if isDir {
+		base = path
+	}
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			// sockets and the like
+			return nil
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
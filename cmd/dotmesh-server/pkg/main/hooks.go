@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fsouza/go-dockerclient"
+	"golang.org/x/net/context"
+)
+
+// Commits snapshot a live filesystem, so a database using a dot is only
+// crash-consistent unless it's told to get its files in order first. Hooks
+// run before ("pre") and after ("post") the snapshot a commit takes, and can:
+//
+//  * run a command in the containers using the dot (or one of its subdots),
+//  * send those containers a signal, or
+//  * POST to a webhook.
+//
+// Hooks are kept in etcd against the dot's top level filesystem id. What
+// they did is recorded in the commit's metadata, under "hooks".
+
+type CommitHook struct {
+	// "pre" or "post"
+	When string
+	// only the containers using this subdot ("__default__" for the one used
+	// by plain dot names), or all of the dot's containers if it's ""
+	Subdot string
+	// one of these
+	Exec    string // run with sh -c
+	Signal  string // e.g. "SIGUSR1" or "10"
+	Webhook string // URL
+	// how long to wait for it, e.g. "30s". DEFAULT_HOOK_TIMEOUT if "".
+	Timeout string
+	// "abort" to fail the commit if the hook fails (after the snapshot, it's
+	// destroyed again) or "proceed" to carry on. "" means abort for pre
+	// hooks and proceed for post ones.
+	OnFailure string
+}
+
+const DEFAULT_HOOK_TIMEOUT = 60 * time.Second
+
+// metadata values are limited to 1024 bytes once they're base64 encoded
+const MAX_HOOK_OUTPUT = 700
+
+// What webhooks are sent.
+type CommitHookNotification struct {
+	Event        string // "pre-commit" or "post-commit"
+	Namespace    string
+	Name         string
+	Branch       string
+	Subdot       string
+	FilesystemId string
+	// set for post-commit, if the snapshot was taken
+	SnapshotId string
+}
+
+var hookSignals = map[string]docker.Signal{
+	"HUP": docker.SIGHUP, "INT": docker.SIGINT, "QUIT": docker.SIGQUIT,
+	"KILL": docker.SIGKILL, "USR1": docker.SIGUSR1, "USR2": docker.SIGUSR2,
+	"TERM": docker.SIGTERM, "CONT": docker.SIGCONT, "STOP": docker.SIGSTOP,
+}
+
+func parseHookSignal(s string) (docker.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if signal, ok := hookSignals[name]; ok {
+		return signal, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Unknown signal '%s'", s)
+	}
+	return docker.Signal(n), nil
+}
+
+func (h CommitHook) validate() error {
+	if h.When != "pre" && h.When != "post" {
+		return fmt.Errorf("Hooks run 'pre' or 'post' commit, not '%s'", h.When)
+	}
+	actions := 0
+	for _, action := range []string{h.Exec, h.Signal, h.Webhook} {
+		if action != "" {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("A hook must have exactly one of a command, a signal or a webhook")
+	}
+	if h.Signal != "" {
+		_, err := parseHookSignal(h.Signal)
+		if err != nil {
+			return err
+		}
+	}
+	if h.Webhook != "" && !strings.HasPrefix(h.Webhook, "http://") && !strings.HasPrefix(h.Webhook, "https://") {
+		return fmt.Errorf("Webhook '%s' isn't an http(s) URL", h.Webhook)
+	}
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid hook timeout '%s', try something like '30s'", h.Timeout)
+		}
+	}
+	if h.OnFailure != "" && h.OnFailure != "abort" && h.OnFailure != "proceed" {
+		return fmt.Errorf("On failure, hooks can 'abort' or 'proceed', not '%s'", h.OnFailure)
+	}
+	return nil
+}
+
+func (h CommitHook) timeout() time.Duration {
+	timeout, err := time.ParseDuration(h.Timeout)
+	if err != nil || timeout <= 0 {
+		return DEFAULT_HOOK_TIMEOUT
+	}
+	return timeout
+}
+
+func (h CommitHook) aborts() bool {
+	if h.OnFailure == "" {
+		return h.When == "pre"
+	}
+	return h.OnFailure == "abort"
+}
+
+func (h CommitHook) String() string {
+	var action string
+	switch {
+	case h.Exec != "":
+		action = fmt.Sprintf("exec %q", h.Exec)
+	case h.Signal != "":
+		action = "signal " + h.Signal
+	default:
+		action = "webhook " + h.Webhook
+	}
+	if h.Subdot != "" {
+		action += " (subdot " + h.Subdot + ")"
+	}
+	return h.When + " " + action
+}
+
+func commitHooksKey(topLevelFilesystemId string) string {
+	return fmt.Sprintf("%s/filesystems/hooks/%s", ETCD_PREFIX, topLevelFilesystemId)
+}
+
+func getCommitHooks(topLevelFilesystemId string) ([]CommitHook, error) {
+	hooks := []CommitHook{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return hooks, err
+	}
+	resp, err := kapi.Get(context.Background(), commitHooksKey(topLevelFilesystemId), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return hooks, nil
+		}
+		return hooks, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &hooks)
+	return hooks, err
+}
+
+func setCommitHooks(topLevelFilesystemId string, hooks []CommitHook) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		_, err = kapi.Delete(context.Background(), commitHooksKey(topLevelFilesystemId), nil)
+		if err != nil && client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	serialized, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(context.Background(), commitHooksKey(topLevelFilesystemId), string(serialized), nil)
+	return err
+}
+
+// The hooks which apply to commits of this filesystem.
+func (f *fsMachine) commitHooks() ([]CommitHook, error) {
+	tlf, _, err := f.state.registry.LookupFilesystemById(f.filesystemId)
+	if err != nil {
+		// not registered (yet), so nobody can have set any
+		return []CommitHook{}, nil
+	}
+	return getCommitHooks(tlf.MasterBranch.Id)
+}
+
+// Run the hooks which run when, appending what happened to hookLog. Returns an
+// error if one which aborts the commit failed, having run the rest anyway
+// so that e.g. everything that was frozen is thawed.
+func (f *fsMachine) runCommitHooks(
+	hooks []CommitHook, when, snapshotId string, hookLog *[]string,
+) error {
+	var abort error
+	for _, hook := range hooks {
+		if hook.When != when {
+			continue
+		}
+		output, err := f.runCommitHook(hook, snapshotId)
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+			if hook.aborts() && abort == nil {
+				abort = fmt.Errorf("%s hook failed: %s", hook, err)
+			}
+		}
+		line := fmt.Sprintf("%s: %s", hook, result)
+		if output = strings.TrimSpace(output); output != "" {
+			line += ": " + output
+		}
+		*hookLog = append(*hookLog, line)
+	}
+	return abort
+}
+
+func (f *fsMachine) runCommitHook(hook CommitHook, snapshotId string) (string, error) {
+	log.Printf("[runCommitHook] Running %s for %s", hook, f.filesystemId)
+	tlf, branch, err := f.state.registry.LookupFilesystemById(f.filesystemId)
+	if err != nil {
+		return "", err
+	}
+	name := tlf.MasterBranch.Name
+
+	if hook.Webhook != "" {
+		notification := CommitHookNotification{
+			Event:        hook.When + "-commit",
+			Namespace:    name.Namespace,
+			Name:         name.Name,
+			Branch:       branch,
+			Subdot:       hook.Subdot,
+			FilesystemId: f.filesystemId,
+			SnapshotId:   snapshotId,
+		}
+		return postCommitHook(hook.Webhook, notification, hook.timeout())
+	}
+
+	containers, err := func() ([]DockerContainer, error) {
+		f.state.containersLock.Lock()
+		defer f.state.containersLock.Unlock()
+		if hook.Subdot == "" {
+			return f.state.containers.Related(name.StringWithoutAdmin())
+		}
+		return f.state.containers.RelatedToSubdot(name.StringWithoutAdmin(), hook.Subdot)
+	}()
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "no containers", nil
+	}
+	outputs := []string{}
+	for _, container := range containers {
+		if hook.Signal != "" {
+			signal, err := parseHookSignal(hook.Signal)
+			if err == nil {
+				err = f.state.containers.Signal(container.Id, signal)
+			}
+			if err != nil {
+				return strings.Join(outputs, "\n"), fmt.Errorf("%s: %s", container.Name, err)
+			}
+			continue
+		}
+		output, err := f.state.containers.Exec(container.Id, hook.Exec, hook.timeout())
+		if output != "" {
+			outputs = append(outputs, output)
+		}
+		if err != nil {
+			return strings.Join(outputs, "\n"), fmt.Errorf("%s: %s", container.Name, err)
+		}
+	}
+	return strings.Join(outputs, "\n"), nil
+}
+
+// Anything but a 2xx response is a failure.
+func postCommitHook(url string, notification CommitHookNotification, timeout time.Duration) (string, error) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	output, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_HOOK_OUTPUT))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(output), fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return string(output), nil
+}
+
+// Sum up what hooks did for the commit's metadata, cutting it short if it
+// won't fit.
+func hookLogMetadata(hookLog []string) string {
+	summary := strings.Join(hookLog, "\n")
+	if len(summary) > MAX_HOOK_OUTPUT {
+		summary = summary[:MAX_HOOK_OUTPUT-3] + "..."
+	}
+	return summary
+}
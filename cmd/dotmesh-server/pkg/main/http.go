@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -49,31 +50,85 @@ func (state *InMemoryState) runServer() {
 
 	router := mux.NewRouter()
 	router.Handle("/rpc",
-		middleware.FromHTTPRequest(tracer, "rpc")(NewAuthHandler(r)),
+		middleware.FromHTTPRequest(tracer, "rpc")(NewAuthHandler(state.audit.auditRPCs(r, tokenScopedRPCs(r, timeRPCs(r))))),
 	)
 
+	router.Handle("/events",
+		middleware.FromHTTPRequest(tracer, "event-stream")(NewAuthHandler(state.NewEventStreamServer())),
+	).Methods("GET")
+
+	router.Handle("/metrics",
+		middleware.FromHTTPRequest(tracer, "metrics")(NewAuthHandler(state.NewMetricsHandler())),
+	).Methods("GET")
+
 	router.HandleFunc("/status",
 		func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "OK")
 		},
 	)
 
+	// not authenticated, they're how people get their API key
+	router.HandleFunc("/oidc", oidcConfigHandler).Methods("GET")
+	router.HandleFunc("/oidc/login", oidcLoginHandler).Methods("POST")
+
 	router.Handle(
 		"/filesystems/{filesystem}/{fromSnap}/{toSnap}",
 		middleware.FromHTTPRequest(tracer, "zfs-sender")(
-			NewAuthHandler(state.NewZFSSendingServer()),
+			NewAuthHandler(state.audit.auditHTTP(
+				"zfs-sender", state.tokenScopedHTTP("zfs-sender", state.NewZFSSendingServer()),
+			)),
 		),
 	).Methods("GET")
 
 	router.Handle(
 		"/filesystems/{filesystem}/{fromSnap}/{toSnap}",
 		middleware.FromHTTPRequest(tracer, "zfs-receiver")(
-			NewAuthHandler(state.NewZFSReceivingServer()),
+			NewAuthHandler(state.audit.auditHTTP(
+				"zfs-receiver", state.tokenScopedHTTP("zfs-receiver", state.NewZFSReceivingServer()),
+			)),
 		),
 	).Methods("POST")
 
-	loggedRouter := handlers.LoggingHandler(getLogfile("requests"), router)
-	err = http.ListenAndServe(":6969", loggedRouter)
+	router.Handle(
+		"/export/{namespace}/{name}",
+		middleware.FromHTTPRequest(tracer, "archive-exporter")(
+			NewAuthHandler(state.audit.auditHTTP(
+				"archive-exporter", state.tokenScopedHTTP("archive-exporter", state.NewArchiveExporter()),
+			)),
+		),
+	).Methods("GET")
+
+	router.Handle(
+		"/files/{namespace}/{name}",
+		middleware.FromHTTPRequest(tracer, "file-server")(
+			NewAuthHandler(state.tokenScopedHTTP("file-server", state.NewFileServer())),
+		),
+	).Methods("GET")
+
+	router.Handle(
+		"/import",
+		middleware.FromHTTPRequest(tracer, "archive-importer")(
+			NewAuthHandler(state.audit.auditHTTP(
+				"archive-importer", state.tokenScopedHTTP("archive-importer", state.NewArchiveImporter()),
+			)),
+		),
+	).Methods("POST")
+
+	settings := getTLSSettings()
+	var handler http.Handler = router
+	if settings.mode == TLS_ON {
+		handler = requireTLS(router)
+	}
+	loggedRouter := handlers.LoggingHandler(getLogfile("requests"), handler)
+	if settings.mode == TLS_OFF {
+		err = http.ListenAndServe(":6969", loggedRouter)
+	} else {
+		var listener net.Listener
+		listener, err = listenTLSAndPlain(":6969", settings.config)
+		if err == nil {
+			err = http.Serve(listener, loggedRouter)
+		}
+	}
 	if err != nil {
 		out(fmt.Sprintf("Unable to listen on port 6969: '%s'\n", err))
 		log.Fatalf("Unable to listen on port 6969: '%s'", err)
@@ -94,8 +149,18 @@ func auth(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
 		notAuth(w)
 		return r, fmt.Errorf("Permission denied.")
 	}
-	// ok, user has provided u/p, try to log them in
-	authorized, passworded, err := CheckPassword(user, pass)
+	// ok, user has provided u/p, try to log them in, either with an API
+	// token or their password or API key
+	var token *ApiToken
+	var authorized, passworded bool
+	var err error
+	if isApiToken(pass) {
+		token, err = checkApiToken(user, pass)
+		authorized = token != nil
+	}
+	if token == nil && err == nil {
+		authorized, passworded, err = CheckPassword(user, pass)
+	}
 	if err != nil {
 		log.Printf(
 			"[AuthHandler] Error running check on %s: %s:",
@@ -116,10 +181,9 @@ func auth(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
 		notAuth(w)
 		return r, fmt.Errorf("Permission denied.")
 	}
-	r = r.WithContext(
-		context.WithValue(context.WithValue(r.Context(), "authenticated-user-id", u.Id),
-			"password-authenticated", passworded),
-	)
+	ctx := context.WithValue(r.Context(), "authenticated-user-id", u.Id)
+	ctx = context.WithValue(ctx, "password-authenticated", passworded)
+	r = r.WithContext(context.WithValue(ctx, "api-token", token))
 	return r, nil
 }
 
@@ -62,6 +62,11 @@ func main() {
 	if POOL == "" {
 		POOL = "pool"
 	}
+	storage, err := NewStorageBackend(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	traceAddr := os.Getenv("TRACE_ADDR")
 	if traceAddr != "" {
 		collector, err := zipkin.NewHTTPCollector(
@@ -93,7 +98,7 @@ func main() {
 		return
 	}
 	if len(os.Args) > 1 && os.Args[1] == "--temporary-error-plugin" {
-		s := NewInMemoryState("<unknown>", config)
+		s := NewInMemoryState("<unknown>", config, storage)
 		s.runErrorPlugin()
 		return
 	}
@@ -104,24 +109,30 @@ func main() {
 	}
 	setupLogging()
 
-	localPoolId, err := findLocalPoolId()
+	localPoolId, err := storage.PoolId()
 	if err != nil {
-		out("Unable to determine pool ID. Make sure to run me as root.\n" +
-			"Please create a ZFS pool called '" + POOL + "'.\n" +
-			"The following commands will create a toy pool-in-a-file:\n\n" +
-			"    sudo truncate -s 10G /pool-datafile\n" +
-			"    sudo zpool create pool /pool-datafile\n\n" +
-			"Otherwise, see 'man zpool' for how to create a real pool.\n" +
-			"If you don't have the 'zpool' tool installed, on Ubuntu 16.04, run:\n\n" +
-			"    sudo apt-get install zfsutils-linux\n\n" +
-			"On other distributions, follow the instructions at http://zfsonlinux.org/\n")
+		if storage.Name() == "zfs" {
+			out("Unable to determine pool ID. Make sure to run me as root.\n" +
+				"Please create a ZFS pool called '" + POOL + "'.\n" +
+				"The following commands will create a toy pool-in-a-file:\n\n" +
+				"    sudo truncate -s 10G /pool-datafile\n" +
+				"    sudo zpool create pool /pool-datafile\n\n" +
+				"Otherwise, see 'man zpool' for how to create a real pool.\n" +
+				"If you don't have the 'zpool' tool installed, on Ubuntu 16.04, run:\n\n" +
+				"    sudo apt-get install zfsutils-linux\n\n" +
+				"On other distributions, follow the instructions at http://zfsonlinux.org/\n")
+		}
 		log.Fatalf("Unable to find pool ID, I don't know who I am :( %s %s", err, localPoolId)
 	}
 	ips, _ := guessIPv4Addresses()
 	log.Printf("Detected my node ID as %s (%s)", localPoolId, ips)
-	s := NewInMemoryState(localPoolId, config)
+	s := NewInMemoryState(localPoolId, config, storage)
 
-	for _, filesystemId := range findFilesystemIdsOnSystem() {
+	filesystemIds, err := storage.ListFilesystems()
+	if err != nil {
+		log.Fatalf("Unable to list filesystems using %s: %s", storage.Name(), err)
+	}
+	for _, filesystemId := range filesystemIds {
 		log.Printf("Initializing fsMachine for %s", filesystemId)
 		go func() {
 			s.initFilesystemMachine(filesystemId)
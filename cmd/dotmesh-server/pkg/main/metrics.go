@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rpc "github.com/gorilla/rpc/v2"
+)
+
+// Metrics for Prometheus, served at /metrics (to the admin user) in its text
+// format. Counters and histograms are kept as things happen; the state of the
+// filesystems and caches is read when they're scraped. Each node reports
+// what it knows, so scrape all of them.
+//
+// This is deliberately a small subset of what the Prometheus client library
+// does, to avoid its dependencies.
+
+var (
+	stateTransitionsMetric = newCounterVec(
+		"dotmesh_filesystem_transitions_total",
+		"State machine transitions, by filesystem and the state transitioned to.",
+		"filesystem", "state",
+	)
+	transferBytesMetric = newCounterVec(
+		"dotmesh_transfer_bytes_total",
+		"Bytes sent by finished transfer segments initiated on this node.",
+		"direction",
+	)
+	transfersMetric = newCounterVec(
+		"dotmesh_transfer_segments_total",
+		"Transfer segments initiated on this node, by how they ended.",
+		"direction", "status",
+	)
+	transferDurationMetric = newHistogramVec(
+		"dotmesh_transfer_segment_duration_seconds",
+		"How long finished transfer segments took.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		"direction",
+	)
+	rpcDurationMetric = newHistogramVec(
+		"dotmesh_rpc_duration_seconds",
+		"How long RPC requests took, by method.",
+		[]float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60},
+		"method",
+	)
+	dockerRequestsMetric = newCounterVec(
+		"dotmesh_docker_plugin_requests_total",
+		"Requests to the docker volume plugin, by endpoint.",
+		"endpoint",
+	)
+	etcdWatchEventsMetric = newCounterVec(
+		"dotmesh_etcd_watch_events_total",
+		"Changes seen by the etcd watch, by the kind of key changed.",
+		"variant",
+	)
+)
+
+// when the etcd watch last saw a change, and how many etcd indexes it was
+// behind the cluster by at the time
+var etcdWatchLag struct {
+	sync.Mutex
+	lastEvent time.Time
+	indexLag  uint64
+}
+
+func observeEtcdWatch(variant string, clusterIndex, modifiedIndex uint64) {
+	etcdWatchEventsMetric.Inc(variant)
+	etcdWatchLag.Lock()
+	defer etcdWatchLag.Unlock()
+	etcdWatchLag.lastEvent = time.Now()
+	etcdWatchLag.indexLag = 0
+	if clusterIndex > modifiedIndex {
+		etcdWatchLag.indexLag = clusterIndex - modifiedIndex
+	}
+}
+
+// Poll results are updated many times per transfer, so each segment is only
+// counted the first time it's seen to have ended.
+var countedTransferSegments = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+func observeTransfer(transferRequestId string, pollResult TransferPollResult) {
+	if pollResult.Status != "finished" && pollResult.Status != "error" {
+		return
+	}
+	key := fmt.Sprintf("%s/%d", transferRequestId, pollResult.Index)
+	countedTransferSegments.Lock()
+	counted := countedTransferSegments.seen[key]
+	if !counted {
+		if len(countedTransferSegments.seen) > 10000 {
+			countedTransferSegments.seen = map[string]bool{}
+		}
+		countedTransferSegments.seen[key] = true
+	}
+	countedTransferSegments.Unlock()
+	if counted {
+		return
+	}
+	transfersMetric.Inc(pollResult.Direction, pollResult.Status)
+	if pollResult.Status == "finished" {
+		transferBytesMetric.Add(float64(pollResult.Sent), pollResult.Direction)
+		transferDurationMetric.Observe(
+			float64(pollResult.NanosecondsElapsed)/float64(time.Second), pollResult.Direction,
+		)
+	}
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	lock       sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(labelValues, "\x00")] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, c.labels, strings.Split(key, "\x00"), c.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	lock       sync.Mutex
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name: name, help: help, labels: labels, buckets: buckets,
+		values: map[string]*histogram{},
+	}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		labelValues := strings.Split(key, "\x00")
+		bucketLabels := append(append([]string{}, h.labels...), "le")
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", bucketLabels,
+				append(append([]string{}, labelValues...), formatFloat(bound)), float64(hist.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabels,
+			append(append([]string{}, labelValues...), "+Inf"), float64(hist.count))
+		writeSample(w, h.name+"_sum", h.labels, labelValues, hist.sum)
+		writeSample(w, h.name+"_count", h.labels, labelValues, float64(hist.count))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeSample(w io.Writer, name string, labels, labelValues []string, v float64) {
+	pairs := []string{}
+	for i, label := range labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueEscaper.Replace(value)))
+	}
+	if len(pairs) > 0 {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(v))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// The user-facing name of each filesystem this node knows about, e.g.
+// "admin/apples@branch".
+func (state *InMemoryState) filesystemNames() map[string]string {
+	names := map[string]string{}
+	state.registry.TopLevelFilesystemsLock.Lock()
+	for name, tlf := range state.registry.TopLevelFilesystems {
+		names[tlf.MasterBranch.Id] = name.String()
+	}
+	state.registry.TopLevelFilesystemsLock.Unlock()
+	state.registry.ClonesLock.Lock()
+	for topLevelFilesystemId, clones := range state.registry.Clones {
+		for cloneName, clone := range clones {
+			names[clone.FilesystemId] = names[topLevelFilesystemId] + "@" + cloneName
+		}
+	}
+	state.registry.ClonesLock.Unlock()
+	return names
+}
+
+// Write this node's view of the filesystems as gauges.
+func (state *InMemoryState) writeFilesystemMetrics(w io.Writer) {
+	names := state.filesystemNames()
+
+	type machineState struct {
+		id, state string
+		snapshots int
+	}
+	fsMachines := map[string]*fsMachine{}
+	state.filesystemsLock.Lock()
+	for id, fs := range *state.filesystems {
+		fsMachines[id] = fs
+	}
+	state.filesystemsLock.Unlock()
+	machines := []machineState{}
+	for id, fs := range fsMachines {
+		fs.snapshotsLock.Lock()
+		snapshots := 0
+		if fs.filesystem != nil {
+			snapshots = len(fs.filesystem.snapshots)
+		}
+		machines = append(machines, machineState{id, fs.currentState, snapshots})
+		fs.snapshotsLock.Unlock()
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].id < machines[j].id })
+
+	writeMetricHeader(w, "dotmesh_filesystem_state",
+		"The state each filesystem's state machine is in on this node (always 1).", "gauge")
+	for _, m := range machines {
+		writeSample(w, "dotmesh_filesystem_state", []string{"filesystem", "name", "state"},
+			[]string{m.id, names[m.id], m.state}, 1)
+	}
+	writeMetricHeader(w, "dotmesh_filesystem_snapshots",
+		"How many snapshots each filesystem has on this node.", "gauge")
+	for _, m := range machines {
+		writeSample(w, "dotmesh_filesystem_snapshots", []string{"filesystem", "name"},
+			[]string{m.id, names[m.id]}, float64(m.snapshots))
+	}
+
+	state.globalDirtyCacheLock.Lock()
+	dirty := map[string]dirtyInfo{}
+	for id, info := range *state.globalDirtyCache {
+		dirty[id] = info
+	}
+	state.globalDirtyCacheLock.Unlock()
+	ids := []string{}
+	for id := range dirty {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	writeMetricHeader(w, "dotmesh_filesystem_dirty_bytes",
+		"Bytes written to each filesystem since its latest snapshot, on its master.", "gauge")
+	for _, id := range ids {
+		writeSample(w, "dotmesh_filesystem_dirty_bytes", []string{"filesystem", "name", "server"},
+			[]string{id, names[id], dirty[id].Server}, float64(dirty[id].DirtyBytes))
+	}
+	writeMetricHeader(w, "dotmesh_filesystem_size_bytes",
+		"Total size of each filesystem, on its master.", "gauge")
+	for _, id := range ids {
+		writeSample(w, "dotmesh_filesystem_size_bytes", []string{"filesystem", "name", "server"},
+			[]string{id, names[id], dirty[id].Server}, float64(dirty[id].SizeBytes))
+	}
+
+	etcdWatchLag.Lock()
+	lastEvent, indexLag := etcdWatchLag.lastEvent, etcdWatchLag.indexLag
+	etcdWatchLag.Unlock()
+	writeMetricHeader(w, "dotmesh_etcd_watch_index_lag",
+		"How many etcd indexes the watch was behind the cluster by when it last saw a change.", "gauge")
+	writeSample(w, "dotmesh_etcd_watch_index_lag", nil, nil, float64(indexLag))
+	if !lastEvent.IsZero() {
+		writeMetricHeader(w, "dotmesh_etcd_watch_last_event_timestamp_seconds",
+			"When the etcd watch last saw a change.", "gauge")
+		writeSample(w, "dotmesh_etcd_watch_last_event_timestamp_seconds", nil, nil,
+			float64(lastEvent.UnixNano())/float64(time.Second))
+	}
+}
+
+type MetricsHandler struct {
+	state *InMemoryState
+}
+
+func (state *InMemoryState) NewMetricsHandler() http.Handler {
+	return MetricsHandler{state: state}
+}
+
+func (m MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the metrics name every dot, so they're only for the admin user
+	err := ensureAdminUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.state.writeFilesystemMetrics(w)
+	for _, c := range []*counterVec{
+		stateTransitionsMetric, transfersMetric, transferBytesMetric,
+		dockerRequestsMetric, etcdWatchEventsMetric,
+	} {
+		c.write(w)
+	}
+	for _, h := range []*histogramVec{transferDurationMetric, rpcDurationMetric} {
+		h.write(w)
+	}
+}
+
+// Time each RPC request by its method, which means peeking in the body.
+func timeRPCs(handler *rpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readAndRestoreBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := struct{ Method string }{}
+		json.Unmarshal(body, &request)
+		// only real methods, so that junk can't make up new labels
+		if !handler.HasMethod(request.Method) {
+			request.Method = "unknown"
+		}
+		started := time.Now()
+		handler.ServeHTTP(w, r)
+		rpcDurationMetric.Observe(time.Since(started).Seconds(), request.Method)
+	})
+}
+
+// Read a request's body, leaving it to be read again.
+func readAndRestoreBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Count requests to the docker plugin by endpoint.
+func countDockerRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dockerRequestsMetric.Inc(strings.TrimPrefix(r.URL.Path, "/"))
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -13,6 +13,9 @@ import (
 type Observer struct {
 	events  map[string][]chan interface{}
 	rwMutex sync.RWMutex
+	// called with everything published, whatever the event, in the order it
+	// was published
+	taps []func(event string, data interface{})
 }
 
 func NewObserver() *Observer {
@@ -28,6 +31,14 @@ func (o *Observer) Subscribe(event string, outputChan chan interface{}) {
 	o.rwMutex.Unlock()
 }
 
+// Be told about everything published. f is called while publishing, so it
+// mustn't block.
+func (o *Observer) Tap(f func(event string, data interface{})) {
+	o.rwMutex.Lock()
+	o.taps = append(o.taps, f)
+	o.rwMutex.Unlock()
+}
+
 func (o *Observer) String() string {
 	o.rwMutex.RLock()
 	defer o.rwMutex.RUnlock()
@@ -108,6 +119,10 @@ func (o *Observer) Publish(event string, data interface{}) error {
 		o.events[event] = outChans
 	}
 
+	for _, tap := range o.taps {
+		tap(event, data)
+	}
+
 	// notify all through chan
 	for _, outputChan := range outChans {
 		go func(outputChan chan interface{}) {
@@ -138,6 +153,10 @@ func (o *Observer) PublishTimeout(event string, data interface{}, timeout time.D
 		o.events[event] = outChans
 	}
 
+	for _, tap := range o.taps {
+		tap(event, data)
+	}
+
 	for _, outputChan := range outChans {
 		select {
 		case outputChan <- data:
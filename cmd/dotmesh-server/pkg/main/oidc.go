@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional login with an external OpenID Connect identity provider (e.g.
+// Dex), configured with:
+//
+//	DOTMESH_OIDC_ISSUER     the provider's issuer URL
+//	DOTMESH_OIDC_CLIENT_ID  the client id dm uses with it, which must be
+//	                        allowed to use the device code flow
+//	DOTMESH_OIDC_GROUPS     which of the provider's groups give their members
+//	                        a role in which organization, e.g.
+//	                        "eng=acme:writer,ops=acme:admin" (role defaults
+//	                        to writer)
+//
+// 'dm remote add --oidc' logs in with the provider, and swaps the ID token it
+// gets for the user's API key at /oidc/login. Users are made the first time
+// they log in, and are found by issuer and subject after that. The provider
+// is in charge of the organizations in DOTMESH_OIDC_GROUPS: its users are
+// added, moved and removed according to their groups each time they log in.
+
+type OidcConfig struct {
+	Issuer   string
+	ClientId string
+}
+
+func oidcConfig() (OidcConfig, bool) {
+	config := OidcConfig{
+		Issuer:   strings.TrimSuffix(os.Getenv("DOTMESH_OIDC_ISSUER"), "/"),
+		ClientId: os.Getenv("DOTMESH_OIDC_CLIENT_ID"),
+	}
+	return config, config.Issuer != "" && config.ClientId != ""
+}
+
+// What an ID token says about who it's for.
+type oidcClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	Expiry            int64       `json:"exp"`
+	Email             string      `json:"email"`
+	PreferredUsername string      `json:"preferred_username"`
+	Name              string      `json:"name"`
+	Groups            []string    `json:"groups"`
+}
+
+func (c oidcClaims) hasAudience(clientId string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the provider's signing keys by id, fetched from its jwks_uri
+var oidcKeys = map[string]*rsa.PublicKey{}
+var oidcKeysFetched time.Time
+var oidcKeysLock sync.Mutex
+
+// Providers rotate their keys, so look them up again when a token is signed
+// with one we don't know, but not more than once a minute.
+func oidcKey(issuer, kid string) (*rsa.PublicKey, error) {
+	oidcKeysLock.Lock()
+	defer oidcKeysLock.Unlock()
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(oidcKeysFetched) > time.Minute {
+		keys, err := fetchOidcKeys(issuer)
+		if err != nil {
+			return nil, err
+		}
+		oidcKeys = keys
+		oidcKeysFetched = time.Now()
+	}
+	key, ok := oidcKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("ID token is signed with an unknown key %s", kid)
+	}
+	return key, nil
+}
+
+func fetchOidcKeys(issuer string) (map[string]*rsa.PublicKey, error) {
+	discovery := struct {
+		JwksUri string `json:"jwks_uri"`
+	}{}
+	err := getJson(issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err = getJson(discovery.JwksUri, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s from %s: %s", jwk.Kid, discovery.JwksUri, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s from %s: %s", jwk.Kid, discovery.JwksUri, err)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func getJson(url string, result interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Check an ID token was signed by the provider, for dm, and hasn't expired,
+// and return what it says.
+func verifyIdToken(config OidcConfig, idToken string) (oidcClaims, error) {
+	claims := oidcClaims{}
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("Malformed ID token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeJwtPart(parts[0], &header)
+	if err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("Unsupported ID token algorithm %s, only RS256 is supported", header.Alg)
+	}
+	key, err := oidcKey(config.Issuer, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("Malformed ID token signature: %s", err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return claims, fmt.Errorf("Invalid ID token signature")
+	}
+	err = decodeJwtPart(parts[1], &claims)
+	if err != nil {
+		return claims, err
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != config.Issuer {
+		return claims, fmt.Errorf("ID token is from %s, not %s", claims.Issuer, config.Issuer)
+	}
+	if !claims.hasAudience(config.ClientId) {
+		return claims, fmt.Errorf("ID token isn't for %s", config.ClientId)
+	}
+	// allow for a little clock skew
+	if time.Now().After(time.Unix(claims.Expiry, 0).Add(time.Minute)) {
+		return claims, fmt.Errorf("ID token has expired")
+	}
+	if claims.Subject == "" {
+		return claims, fmt.Errorf("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJwtPart(part string, result interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("Malformed ID token: %s", err)
+	}
+	err = json.Unmarshal(decoded, result)
+	if err != nil {
+		return fmt.Errorf("Malformed ID token: %s", err)
+	}
+	return nil
+}
+
+// The user an ID token is for, making them if they haven't logged in before.
+func oidcUser(claims oidcClaims) (User, error) {
+	users, err := AllUsers()
+	if err != nil {
+		return User{}, err
+	}
+	for _, u := range users {
+		if u.OidcIssuer == claims.Issuer && u.OidcSubject == claims.Subject {
+			return u, nil
+		}
+	}
+	// nobody will ever know the password, they log in with the provider
+	password := make([]byte, API_KEY_BYTES)
+	_, err = rand.Read(password)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := newUserWithFreeName(oidcUsername(claims), func(name string) (User, error) {
+		return NewUser(name, claims.Email, base64.StdEncoding.EncodeToString(password))
+	})
+	if err != nil {
+		return User{}, err
+	}
+	user.OidcIssuer = claims.Issuer
+	user.OidcSubject = claims.Subject
+	log.Printf("[oidcUser] Adding user %s for %s from %s", user.Name, claims.Subject, claims.Issuer)
+	return user, user.Save()
+}
+
+// What to call a new user from the provider, if the name isn't taken.
+func oidcUsername(claims oidcClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+	return strings.NewReplacer("/", "-", ":", "-").Replace(name)
+}
+
+// Make a user with newUser, called name or, if that's taken (by a local user,
+// or someone with the same name in a different part of the provider), name-2,
+// name-3 and so on.
+func newUserWithFreeName(name string, newUser func(name string) (User, error)) (User, error) {
+	candidate := name
+	for i := 2; ; i++ {
+		user, err := newUser(candidate)
+		if err == nil {
+			return user, nil
+		}
+		if !strings.HasPrefix(err.Error(), "Username already exists") || i > 100 {
+			return User{}, err
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// Which roles in which organizations the provider's groups give their
+// members, from DOTMESH_OIDC_GROUPS.
+func oidcGroupRoles() (map[string]map[string]string, error) {
+	// group -> organization -> role
+	roles := map[string]map[string]string{}
+	setting := strings.TrimSpace(os.Getenv("DOTMESH_OIDC_GROUPS"))
+	if setting == "" {
+		return roles, nil
+	}
+	for _, mapping := range strings.Split(setting, ",") {
+		shrapnel := strings.SplitN(strings.TrimSpace(mapping), "=", 2)
+		if len(shrapnel) != 2 || shrapnel[0] == "" || shrapnel[1] == "" {
+			return nil, fmt.Errorf("Invalid DOTMESH_OIDC_GROUPS entry '%s', try 'group=organization:role'", mapping)
+		}
+		group := shrapnel[0]
+		org, role := shrapnel[1], "writer"
+		if i := strings.Index(shrapnel[1], ":"); i >= 0 {
+			org, role = shrapnel[1][:i], shrapnel[1][i+1:]
+		}
+		err := validateOrganizationRole(role)
+		if err != nil {
+			return nil, err
+		}
+		if roles[group] == nil {
+			roles[group] = map[string]string{}
+		}
+		roles[group][org] = role
+	}
+	return roles, nil
+}
+
+// Give a user the roles their groups call for in the organizations in
+// DOTMESH_OIDC_GROUPS, taking away any they shouldn't have any more.
+// Organizations which don't exist yet are made, owned by the admin user.
+func syncOidcGroups(user User, groups []string) error {
+	groupRoles, err := oidcGroupRoles()
+	if err != nil {
+		return err
+	}
+	// organization -> best role the user's groups give them, "" for none
+	wanted := map[string]string{}
+	for _, orgRoles := range groupRoles {
+		for org := range orgRoles {
+			wanted[org] = ""
+		}
+	}
+	for _, group := range groups {
+		for org, role := range groupRoles[group] {
+			if organizationRoleRank(role) > organizationRoleRank(wanted[org]) {
+				wanted[org] = role
+			}
+		}
+	}
+	for name, role := range wanted {
+		org, _, err := getOrganization(name)
+		if err != nil {
+			if role == "" {
+				continue
+			}
+			org, err = createOrganization(name, ADMIN_USER_UUID)
+			if err != nil {
+				return fmt.Errorf("Can't make organization %s for DOTMESH_OIDC_GROUPS: %s", name, err)
+			}
+			log.Printf("[syncOidcGroups] Made organization %s", name)
+		}
+		current := org.Role(user.Id)
+		if current == role {
+			continue
+		}
+		if role == "" {
+			_, err = removeOrganizationMember(name, ADMIN_USER_UUID, user.Id)
+		} else {
+			_, err = setOrganizationMember(name, ADMIN_USER_UUID, user.Id, role)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("[syncOidcGroups] %s's role in %s is now '%s' (was '%s')", user.Name, name, role, current)
+	}
+	return nil
+}
+
+// Tells dm which provider to log in with, 404 if there isn't one.
+func oidcConfigHandler(w http.ResponseWriter, r *http.Request) {
+	config, ok := oidcConfig()
+	if !ok {
+		http.Error(w, "OpenID Connect login isn't configured on this cluster.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// Swaps an ID token from the provider for the user's name and API key.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	config, ok := oidcConfig()
+	if !ok {
+		http.Error(w, "OpenID Connect login isn't configured on this cluster.", http.StatusNotFound)
+		return
+	}
+	request := struct{ IdToken string }{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't decode request: %s", err), http.StatusBadRequest)
+		return
+	}
+	claims, err := verifyIdToken(config, request.IdToken)
+	if err != nil {
+		log.Printf("[oidcLoginHandler] Refusing ID token: %s", err)
+		http.Error(w, fmt.Sprintf("%s.", err), http.StatusUnauthorized)
+		return
+	}
+	user, err := oidcUser(claims)
+	if err == nil {
+		err = syncOidcGroups(user, claims.Groups)
+	}
+	if err != nil {
+		log.Printf("[oidcLoginHandler] Can't log in %s from %s: %s", claims.Subject, claims.Issuer, err)
+		http.Error(w, fmt.Sprintf("Can't log you in: %s.", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{ User, ApiKey string }{user.Name, user.ApiKey})
+}
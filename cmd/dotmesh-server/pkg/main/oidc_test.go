@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a provider serving discovery and the public half of key, as "key-1"
+func testOidcProvider(key *rsa.PrivateKey) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "key-1",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	// forget the keys of any other provider
+	oidcKeysLock.Lock()
+	oidcKeys = map[string]*rsa.PublicKey{}
+	oidcKeysFetched = time.Time{}
+	oidcKeysLock.Unlock()
+	return server
+}
+
+func testIdToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	encode := func(part map[string]interface{}) string {
+		j, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(j)
+	}
+	signed := encode(header) + "." + encode(claims)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := testOidcProvider(key)
+	defer provider.Close()
+	config := OidcConfig{Issuer: provider.URL, ClientId: "dm"}
+
+	header := func(alg, kid string) map[string]interface{} {
+		return map[string]interface{}{"alg": alg, "kid": kid}
+	}
+	// valid claims, with changes
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": provider.URL,
+			"sub": "alice-id",
+			"aud": "dm",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", testIdToken(t, key, header("RS256", "key-1"), claims(nil)), ""},
+		{
+			"one of several audiences",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"aud": []string{"other", "dm"}})),
+			"",
+		},
+		{
+			"issuer with a trailing slash",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"iss": provider.URL + "/"})),
+			"",
+		},
+		{
+			"expired within the allowed skew",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()})),
+			"",
+		},
+		{"malformed", "not.a-token", "Malformed"},
+		{
+			"signed by another key",
+			testIdToken(t, otherKey, header("RS256", "key-1"), claims(nil)),
+			"Invalid ID token signature",
+		},
+		{
+			"unknown key",
+			testIdToken(t, key, header("RS256", "key-2"), claims(nil)),
+			"unknown key key-2",
+		},
+		{
+			"another algorithm",
+			testIdToken(t, key, header("HS256", "key-1"), claims(nil)),
+			"Unsupported ID token algorithm HS256",
+		},
+		{
+			"no algorithm",
+			testIdToken(t, key, header("none", "key-1"), claims(nil)),
+			"Unsupported ID token algorithm none",
+		},
+		{
+			"wrong audience",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"aud": "other"})),
+			"isn't for dm",
+		},
+		{
+			"wrong issuer",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			"ID token is from https://evil.example.com",
+		},
+		{
+			"expired",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+			"expired",
+		},
+		{
+			"no subject",
+			testIdToken(t, key, header("RS256", "key-1"), claims(map[string]interface{}{"sub": ""})),
+			"no subject",
+		},
+	} {
+		verified, err := verifyIdToken(config, test.token)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			} else if verified.Subject != "alice-id" {
+				t.Errorf("%s: expected alice-id, got %+v", test.name, verified)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestOidcUsername(t *testing.T) {
+	for _, test := range []struct {
+		claims   oidcClaims
+		expected string
+	}{
+		{oidcClaims{PreferredUsername: "alice", Email: "a@example.com", Subject: "1"}, "alice"},
+		{oidcClaims{Email: "alice.smith@example.com", Subject: "1"}, "alice.smith"},
+		{oidcClaims{Subject: "CgVhbGljZQ"}, "CgVhbGljZQ"},
+		{oidcClaims{PreferredUsername: "eng/alice:admin"}, "eng-alice-admin"},
+	} {
+		name := oidcUsername(test.claims)
+		if name != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.claims, test.expected, name)
+		}
+	}
+}
+
+func TestNewUserWithFreeName(t *testing.T) {
+	taken := map[string]bool{"alice": true, "alice-2": true}
+	tried := []string{}
+	newUser := func(name string) (User, error) {
+		tried = append(tried, name)
+		if taken[name] {
+			return User{}, fmt.Errorf("Username already exists - contact help@dotmesh.io")
+		}
+		return User{Name: name}, nil
+	}
+
+	user, err := newUserWithFreeName("alice", newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice-3" {
+		t.Errorf("Expected alice-3, got %s (after trying %v)", user.Name, tried)
+	}
+
+	// other errors aren't retried
+	tried = []string{}
+	_, err = newUserWithFreeName("bob", func(name string) (User, error) {
+		tried = append(tried, name)
+		return User{}, fmt.Errorf("Email already exists - contact help@dotmesh.io")
+	})
+	if err == nil || len(tried) != 1 {
+		t.Errorf("Expected to give up after one try, got %v after %v", err, tried)
+	}
+
+	// and it doesn't go on forever
+	tried = []string{}
+	_, err = newUserWithFreeName("carol", func(name string) (User, error) {
+		tried = append(tried, name)
+		return User{}, fmt.Errorf("Username already exists - contact help@dotmesh.io")
+	})
+	if err == nil || len(tried) > 101 {
+		t.Errorf("Expected to give up, got %v after %d tries", err, len(tried))
+	}
+}
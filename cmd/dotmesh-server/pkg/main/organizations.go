@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// An organization is a namespace which belongs to a team rather than a user.
+// Its members each have a role, which applies to all of its dots:
+//
+//	reader  can see and pull them
+//	writer  can also change them, e.g. push, tag and set policies
+//	admin   can also administer them and the namespace, e.g. create dots,
+//	        delete them and manage webhooks
+//	owner   can also manage the organization's members
+//
+// Organizations are kept in etcd under organizations/<name>, and share the
+// user namespace: there can't be a user and an organization with the same
+// name.
+type Organization struct {
+	Name    string
+	Members []OrganizationMember
+	Created time.Time
+}
+
+type OrganizationMember struct {
+	UserId string
+	// filled in when shown to people
+	User string `json:",omitempty"`
+	Role string
+}
+
+// least powerful first
+var organizationRoles = []string{"reader", "writer", "admin", "owner"}
+
+func organizationRoleRank(role string) int {
+	for i, known := range organizationRoles {
+		if role == known {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateOrganizationRole(role string) error {
+	if organizationRoleRank(role) < 0 {
+		return fmt.Errorf(
+			"Unknown role '%s', try one of %s", role, strings.Join(organizationRoles, ", "),
+		)
+	}
+	return nil
+}
+
+func organizationKey(name string) string {
+	return fmt.Sprintf("%s/organizations/%s", ETCD_PREFIX, name)
+}
+
+// The role of a user in an organization, "" if they aren't a member.
+func (o Organization) Role(userId string) string {
+	for _, member := range o.Members {
+		if member.UserId == userId {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// An organization, and its etcd index for updating it, or a key not found
+// error if there's no such organization.
+func getOrganization(name string) (Organization, uint64, error) {
+	org := Organization{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return org, 0, err
+	}
+	resp, err := kapi.Get(context.Background(), organizationKey(name), nil)
+	if err != nil {
+		return org, 0, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &org)
+	return org, resp.Node.ModifiedIndex, err
+}
+
+// Save an organization, as long as it hasn't changed since index (or doesn't
+// exist yet, if index is 0).
+func saveOrganization(org Organization, index uint64) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	options := &client.SetOptions{PrevIndex: index}
+	if index == 0 {
+		options.PrevExist = client.PrevNoExist
+	}
+	_, err = kapi.Set(context.Background(), organizationKey(org.Name), string(serialized), options)
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok &&
+			(etcdErr.Code == client.ErrorCodeTestFailed || etcdErr.Code == client.ErrorCodeNodeExist) {
+			return fmt.Errorf("%s was changed by someone else at the same time, please try again", org.Name)
+		}
+	}
+	return err
+}
+
+// Make an organization, owned by the user who made it.
+func createOrganization(name, ownerId string) (Organization, error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return Organization{}, fmt.Errorf("Invalid organization name '%s' - it must not contain : or /", name)
+	}
+	// TODO make email in error messages below configurable.
+	if _, err := GetUserByName(name); err == nil || name == "admin" {
+		return Organization{}, fmt.Errorf("Name already exists - contact help@dotmesh.io")
+	}
+	if _, _, err := getOrganization(name); err == nil {
+		return Organization{}, fmt.Errorf("Organization %s already exists", name)
+	}
+	org := Organization{
+		Name:    name,
+		Members: []OrganizationMember{{UserId: ownerId, Role: "owner"}},
+		Created: time.Now().UTC(),
+	}
+	return org, saveOrganization(org, 0)
+}
+
+// Give a user a role in an organization, or change their role. Only
+// organization admins can do this, and only owners can make or unmake other
+// owners.
+func setOrganizationMember(name, byUserId, userId, role string) (Organization, error) {
+	err := validateOrganizationRole(role)
+	if err != nil {
+		return Organization{}, err
+	}
+	org, index, err := getOrganization(name)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return org, fmt.Errorf("No such organization %s", name)
+		}
+		return org, err
+	}
+	err = org.requireCanManage(byUserId, userId, role)
+	if err != nil {
+		return org, err
+	}
+	found := false
+	for i, member := range org.Members {
+		if member.UserId == userId {
+			org.Members[i].Role = role
+			found = true
+		}
+	}
+	if !found {
+		org.Members = append(org.Members, OrganizationMember{UserId: userId, Role: role})
+	}
+	if org.owners() == 0 {
+		return org, fmt.Errorf("%s needs at least one owner", name)
+	}
+	return org, saveOrganization(org, index)
+}
+
+func removeOrganizationMember(name, byUserId, userId string) (Organization, error) {
+	org, index, err := getOrganization(name)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return org, fmt.Errorf("No such organization %s", name)
+		}
+		return org, err
+	}
+	err = org.requireCanManage(byUserId, userId, "")
+	if err != nil {
+		return org, err
+	}
+	members := []OrganizationMember{}
+	for _, member := range org.Members {
+		if member.UserId != userId {
+			members = append(members, member)
+		}
+	}
+	if len(members) == len(org.Members) {
+		return org, fmt.Errorf("User isn't a member of %s", name)
+	}
+	org.Members = members
+	if org.owners() == 0 {
+		return org, fmt.Errorf("%s needs at least one owner", name)
+	}
+	return org, saveOrganization(org, index)
+}
+
+func (o Organization) owners() int {
+	owners := 0
+	for _, member := range o.Members {
+		if member.Role == "owner" {
+			owners++
+		}
+	}
+	return owners
+}
+
+// Whether byUserId can change userId's membership to role ("" meaning
+// removing them).
+func (o Organization) requireCanManage(byUserId, userId, role string) error {
+	if byUserId == ADMIN_USER_UUID {
+		return nil
+	}
+	byRole := o.Role(byUserId)
+	if organizationRoleRank(byRole) < organizationRoleRank("admin") {
+		return fmt.Errorf("Only the owners and admins of %s can manage its members", o.Name)
+	}
+	if byRole != "owner" && (role == "owner" || o.Role(userId) == "owner") {
+		return fmt.Errorf("Only the owners of %s can manage its owners", o.Name)
+	}
+	return nil
+}
+
+// The organizations a user is a member of, or all of them for the admin
+// user, by name.
+func userOrganizations(userId string) ([]Organization, error) {
+	orgs := []Organization{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return orgs, err
+	}
+	resp, err := kapi.Get(
+		context.Background(), fmt.Sprintf("%s/organizations", ETCD_PREFIX), &client.GetOptions{Recursive: true},
+	)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return orgs, nil
+		}
+		return orgs, err
+	}
+	for _, node := range resp.Node.Nodes {
+		org := Organization{}
+		err = json.Unmarshal([]byte(node.Value), &org)
+		if err != nil {
+			return orgs, err
+		}
+		if userId == ADMIN_USER_UUID || org.Role(userId) != "" {
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs, nil
+}
+
+// The role a user has in a namespace by being a member of the organization
+// it belongs to, "" if it's not an organization's or they aren't a member.
+func organizationRole(userId, namespace string) (string, error) {
+	org, _, err := getOrganization(namespace)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return org.Role(userId), nil
+}
+
+// With the members' names filled in, for showing to people.
+func (o Organization) withUserNames() Organization {
+	users, err := AllUsers()
+	if err != nil {
+		return o
+	}
+	names := map[string]string{}
+	for _, user := range users {
+		names[user.Id] = user.Name
+	}
+	members := []OrganizationMember{}
+	for _, member := range o.Members {
+		member.User = names[member.UserId]
+		members = append(members, member)
+	}
+	o.Members = members
+	return o
+}
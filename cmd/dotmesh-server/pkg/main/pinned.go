@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/client"
+)
+
+// Docker volumes can be pinned to a commit, e.g.
+//
+//   docker run -v mydot@branch#<commit>.subdot:/data --volume-driver=dm ...
+//
+// or, with any volume name:
+//
+//   docker volume create -d dm -o dot=mydot@branch.subdot -o commit=<commit> pinned
+//
+// A pinned volume is a read-only bind mount of the commit's snapshot, so it
+// can be used alongside the live branch (and other pinned volumes). The commit
+// can be from before the branch was made. The bind mount is made on the first
+// VolumeDriver.Mount and undone by VolumeDriver.Remove.
+//
+// Volumes pinned with options are recorded in etcd, against this node, so
+// that later requests (which only have the volume's name) can find them.
+
+type pinnedVolume struct {
+	Namespace string
+	Dot       string
+	// "" for master
+	Branch string
+	Commit string
+	// "" for the root of the dot
+	Subdot string
+}
+
+var pinnedVolumesLock sync.Mutex
+
+// Parse a volume name and (on create) its options into what it's pinned to,
+// or nil if it isn't pinned.
+func parsePinnedVolume(dockerName string, opts map[string]string) (*pinnedVolume, error) {
+	spec, commit := dockerName, ""
+	if opts["commit"] != "" {
+		commit = opts["commit"]
+		if opts["dot"] != "" {
+			spec = opts["dot"]
+		}
+	} else if i := strings.Index(dockerName, "#"); i != -1 {
+		// the commit runs up to the subdot, if there is one
+		end := strings.Index(dockerName[i:], ".")
+		if end == -1 {
+			end = len(dockerName)
+		} else {
+			end += i
+		}
+		commit = dockerName[i+1 : end]
+		spec = dockerName[:i] + dockerName[end:]
+	} else {
+		return nil, nil
+	}
+	if commit == "" || strings.ContainsAny(commit, "@#/") {
+		return nil, fmt.Errorf("Invalid commit '%s' in volume %s", commit, dockerName)
+	}
+	namespace, localName, subdot, err := parseNamespacedVolumeWithSubvolumes(spec)
+	if err != nil {
+		return nil, err
+	}
+	pin := &pinnedVolume{Namespace: namespace, Dot: localName, Commit: commit, Subdot: subdot}
+	if i := strings.Index(localName, "@"); i != -1 {
+		pin.Dot, pin.Branch = localName[:i], localName[i+1:]
+		if pin.Branch == DEFAULT_BRANCH {
+			pin.Branch = ""
+		}
+	}
+	return pin, nil
+}
+
+func pinnedVolumeId(dockerName string) string {
+	sum := sha1.Sum([]byte(dockerName))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Where a pinned volume is mounted, beside the filesystems so that the mount
+// propagates out to docker the same way theirs do.
+func pinnedMountpoint(dockerName string) string {
+	return mnt("pinned-" + pinnedVolumeId(dockerName))
+}
+
+func (state *InMemoryState) pinnedVolumeKey(dockerName string) string {
+	return fmt.Sprintf(
+		"%s/docker-pins/%s/%s", ETCD_PREFIX, state.myNodeId, pinnedVolumeId(dockerName),
+	)
+}
+
+// What dockerName is pinned to, from its name or what was recorded when it
+// was created, or nil if it isn't pinned.
+func (state *InMemoryState) lookupPinnedVolume(dockerName string) (*pinnedVolume, error) {
+	pin, err := parsePinnedVolume(dockerName, nil)
+	if pin != nil || err != nil {
+		return pin, err
+	}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(context.Background(), state.pinnedVolumeKey(dockerName), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pin = &pinnedVolume{}
+	err = json.Unmarshal([]byte(resp.Node.Value), pin)
+	return pin, err
+}
+
+// Check that the commit exists, and record pins which only options describe.
+func (state *InMemoryState) createPinnedVolume(dockerName string, pin *pinnedVolume, fromOpts bool) error {
+	_, _, err := state.pinnedSnapshot(pin)
+	if err != nil {
+		return err
+	}
+	if !fromOpts {
+		return nil
+	}
+	serialized, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(context.Background(), state.pinnedVolumeKey(dockerName), string(serialized), nil)
+	return err
+}
+
+// The filesystem which has the pinned commit, and its name. Resolves the
+// commit if it's a tag.
+func (state *InMemoryState) pinnedSnapshot(pin *pinnedVolume) (string, VolumeName, error) {
+	name := VolumeName{pin.Namespace, pin.Dot}
+	filesystemId, err := state.registry.MaybeCloneFilesystemId(name, pin.Branch)
+	if err != nil {
+		return "", name, err
+	}
+	tlf, err := state.registry.LookupFilesystem(name)
+	if err != nil {
+		return "", name, err
+	}
+	// tags never move, so it's safe to pin the commit they're on
+	pin.Commit, err = resolveTag(tlf.MasterBranch.Id, pin.Commit)
+	if err != nil {
+		return "", name, err
+	}
+	filesystemId, err = state.snapshotInHistory(filesystemId, pin.Commit)
+	if err != nil {
+		return "", name, err
+	}
+	_, cloneName, err := state.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return "", name, err
+	}
+	if cloneName != "" {
+		name.Name += "@" + cloneName
+	}
+	return filesystemId, name, nil
+}
+
+func (state *InMemoryState) mountPinnedVolume(ctx context.Context, dockerName string, pin *pinnedVolume) (string, error) {
+	filesystemId, name, err := state.pinnedSnapshot(pin)
+	if err != nil {
+		return "", err
+	}
+	// only the master has the snapshots mounted
+	_, err = state.procureFilesystem(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	pinnedVolumesLock.Lock()
+	defer pinnedVolumesLock.Unlock()
+	mountpoint := pinnedMountpoint(dockerName)
+	if code, err := returnCode("mountpoint", "-q", mountpoint); err == nil && code == 0 {
+		return mountpoint, nil
+	}
+	snapshotPath, err := state.storage.SnapshotPath(filesystemId, pin.Commit)
+	if err != nil {
+		return "", err
+	}
+	// mount follows symlinks, which could point anywhere on the host, so
+	// refuse them anywhere along the subdot's path
+	source, info, err := resolveDotPath(snapshotPath, pin.Subdot)
+	if err != nil {
+		return "", fmt.Errorf("Subdot %s isn't in commit %s of %s: %s", pin.Subdot, pin.Commit, name, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("Subdot %s in commit %s of %s is a symlink", pin.Subdot, pin.Commit, name)
+	}
+	err = os.MkdirAll(mountpoint, 0755)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[mountPinnedVolume] Mounting %s read-only at %s for %s", source, mountpoint, dockerName)
+	out, err := exec.Command("mount", "--bind", source, mountpoint).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v while trying to bind mount %s: %s", err, source, out)
+	}
+	// a bind mount only becomes read-only when it's remounted
+	out, err = exec.Command("mount", "-o", "remount,bind,ro", mountpoint).CombinedOutput()
+	if err != nil {
+		exec.Command("umount", mountpoint).Run()
+		return "", fmt.Errorf("%v while trying to make %s read-only: %s", err, mountpoint, out)
+	}
+	return mountpoint, nil
+}
+
+func (state *InMemoryState) removePinnedVolume(dockerName string) error {
+	pinnedVolumesLock.Lock()
+	defer pinnedVolumesLock.Unlock()
+	mountpoint := pinnedMountpoint(dockerName)
+	if code, err := returnCode("mountpoint", "-q", mountpoint); err == nil && code == 0 {
+		log.Printf("[removePinnedVolume] Unmounting %s for %s", mountpoint, dockerName)
+		out, err := exec.Command("umount", mountpoint).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v while trying to unmount %s: %s", err, mountpoint, out)
+		}
+	}
+	err := os.Remove(mountpoint)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(context.Background(), state.pinnedVolumeKey(dockerName), nil)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
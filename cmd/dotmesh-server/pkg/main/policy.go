@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// A dot can have a policy of committing automatically every so often, and of
+// how many of those automatic commits to keep, e.g. "commit every 15 minutes,
+// keep 24 hourly, 7 daily and 4 weekly". Policies are kept in etcd against
+// the dot's top level filesystem id and apply to all of its branches.
+//
+// The master of each filesystem checks its policy every minute, commits via
+// the usual "snapshot" event when one is due and then destroys automatic
+// commits which have expired. Commits made by people are never destroyed.
+type SnapshotPolicy struct {
+	// how often to commit, e.g. "15m" or "1h". "" means never.
+	CommitEvery string
+	// keep the latest automatic commit from each of this many of the most
+	// recent hours, days and weeks which have one. if they're all 0, all
+	// automatic commits are kept.
+	KeepHourly int
+	KeepDaily  int
+	KeepWeekly int
+}
+
+// set in the metadata of commits made by a policy
+const AUTO_COMMIT_KEY = "auto-commit"
+
+const POLICY_CHECK_INTERVAL = time.Minute
+
+// commits any more frequent than this would mostly be churn
+const MIN_COMMIT_INTERVAL = time.Minute
+
+func (p SnapshotPolicy) validate() error {
+	if p.CommitEvery != "" {
+		interval, err := time.ParseDuration(p.CommitEvery)
+		if err != nil {
+			return fmt.Errorf("Invalid commit interval '%s', try something like '15m' or '1h'", p.CommitEvery)
+		}
+		if interval < MIN_COMMIT_INTERVAL {
+			return fmt.Errorf("Commit interval %s is too short, the minimum is %s", interval, MIN_COMMIT_INTERVAL)
+		}
+	}
+	if p.KeepHourly < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 {
+		return fmt.Errorf("Can't keep a negative number of commits")
+	}
+	return nil
+}
+
+func (p SnapshotPolicy) empty() bool {
+	return p == SnapshotPolicy{}
+}
+
+func snapshotTime(snap *snapshot) (time.Time, bool) {
+	if snap.Metadata == nil {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt((*snap.Metadata)["timestamp"], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
+
+func isAutoCommit(snap *snapshot) bool {
+	return snap.Metadata != nil && (*snap.Metadata)[AUTO_COMMIT_KEY] != ""
+}
+
+// Is a commit due at now, given the existing snapshots (oldest first)?
+func (p SnapshotPolicy) commitDue(snaps []*snapshot, now time.Time) bool {
+	if p.CommitEvery == "" {
+		return false
+	}
+	interval, err := time.ParseDuration(p.CommitEvery)
+	if err != nil {
+		return false
+	}
+	if len(snaps) == 0 {
+		return true
+	}
+	latest, ok := snapshotTime(snaps[len(snaps)-1])
+	return !ok || now.Sub(latest) >= interval
+}
+
+// The ids of the automatic commits in snaps (oldest first) which the policy
+// doesn't keep. The latest commit, and any in protected, are always kept.
+func (p SnapshotPolicy) expired(snaps []*snapshot, protected map[string]bool) []string {
+	if p.KeepHourly == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 {
+		return []string{}
+	}
+	type rule struct {
+		keep   int
+		bucket func(time.Time) string
+		last   string
+	}
+	rules := []*rule{
+		{keep: p.KeepHourly, bucket: func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{keep: p.KeepDaily, bucket: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{keep: p.KeepWeekly, bucket: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+	}
+	expired := []string{}
+	// newest first, so that each rule keeps the newest commit in a bucket
+	for i := len(snaps) - 1; i >= 0; i-- {
+		snap := snaps[i]
+		t, ok := snapshotTime(snap)
+		if !isAutoCommit(snap) || !ok {
+			continue
+		}
+		keep := i == len(snaps)-1 || protected[snap.Id]
+		for _, r := range rules {
+			if b := r.bucket(t); r.keep > 0 && b != r.last {
+				r.keep--
+				r.last = b
+				keep = true
+			}
+		}
+		if !keep {
+			expired = append(expired, snap.Id)
+		}
+	}
+	return expired
+}
+
+func policyKey(topLevelFilesystemId string) string {
+	return fmt.Sprintf("%s/filesystems/policies/%s", ETCD_PREFIX, topLevelFilesystemId)
+}
+
+func getSnapshotPolicy(topLevelFilesystemId string) (SnapshotPolicy, error) {
+	policy := SnapshotPolicy{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return policy, err
+	}
+	resp, err := kapi.Get(context.Background(), policyKey(topLevelFilesystemId), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return policy, nil
+		}
+		return policy, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &policy)
+	return policy, err
+}
+
+func setSnapshotPolicy(topLevelFilesystemId string, policy SnapshotPolicy) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	if policy.empty() {
+		_, err = kapi.Delete(context.Background(), policyKey(topLevelFilesystemId), nil)
+		if err != nil && client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	serialized, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(context.Background(), policyKey(topLevelFilesystemId), string(serialized), nil)
+	return err
+}
+
+// Run by every fsMachine every POLICY_CHECK_INTERVAL, but only does anything
+// on the master.
+func (f *fsMachine) applySnapshotPolicy() error {
+	if f.state.masterFor(f.filesystemId) != f.state.myNodeId {
+		return nil
+	}
+	tlf, cloneName, err := f.state.registry.LookupFilesystemById(f.filesystemId)
+	if err != nil {
+		// not registered (yet)
+		return nil
+	}
+	policy, err := getSnapshotPolicy(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	if policy.empty() {
+		return nil
+	}
+
+	f.snapshotsLock.Lock()
+	snaps := append([]*snapshot{}, f.filesystem.snapshots...)
+	f.snapshotsLock.Unlock()
+	// no point committing if nothing's changed
+	if policy.commitDue(snaps, time.Now()) && (len(snaps) == 0 || f.dirtyDelta > 0) {
+		log.Printf("[applySnapshotPolicy] Committing %s", f.filesystemId)
+		e, err := f.policyRequest(&Event{
+			Name: "snapshot",
+			Args: &EventArgs{"metadata": metadata{
+				"message":       "Automatic commit",
+				"author":        "dotmesh",
+				AUTO_COMMIT_KEY: "true",
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		if e.Name != "snapshotted" {
+			return fmt.Errorf("Automatic commit of %s failed: %s", f.filesystemId, e)
+		}
+	}
+
+	// protected branches' commits can't be destroyed at all
+	if tlf.BranchProtection(cloneName).NoRollback {
+		return nil
+	}
+	// the origins of branches, and tagged commits, can't be destroyed
+	protected, err := taggedCommits(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	for _, clone := range f.state.registry.ClonesFor(tlf.MasterBranch.Id) {
+		if clone.Origin.FilesystemId == f.filesystemId {
+			protected[clone.Origin.SnapshotId] = true
+		}
+	}
+	f.snapshotsLock.Lock()
+	snaps = append([]*snapshot{}, f.filesystem.snapshots...)
+	f.snapshotsLock.Unlock()
+	expired := policy.expired(snaps, protected)
+	if len(expired) == 0 {
+		return nil
+	}
+	log.Printf("[applySnapshotPolicy] Destroying %d expired commits of %s", len(expired), f.filesystemId)
+	e, err := f.policyRequest(&Event{
+		Name: "destroy-snapshots",
+		Args: &EventArgs{"snapshotIds": expired},
+	})
+	if err != nil {
+		return err
+	}
+	if e.Name != "destroyed-snapshots" {
+		return fmt.Errorf("Destroying expired commits of %s failed: %s", f.filesystemId, e)
+	}
+	return nil
+}
+
+// Send ourselves an event, the same way requests from the rest of the
+// cluster arrive, and wait for the response.
+func (f *fsMachine) policyRequest(e *Event) (*Event, error) {
+	responseChan, err := f.state.dispatchEvent(f.filesystemId, e, "")
+	if err != nil {
+		return nil, err
+	}
+	return <-responseChan, nil
+}
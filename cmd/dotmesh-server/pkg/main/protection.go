@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A branch can be protected from changes which lose commits or skip review,
+// e.g. to stop anyone resetting master. Protections are kept in the dot's
+// registry entry, against branch names ("master" for the master branch), and
+// only the dot's owner can change them.
+type BranchProtection struct {
+	// commits on the branch can't be destroyed: no 'dm reset', and policies
+	// don't expire its automatic commits
+	NoRollback bool
+	// pushes and pulls into the branch must fast-forward it, rather than
+	// replacing commits it has that the sender doesn't
+	NoDivergedPush bool
+	// the dot can't be deleted
+	NoDelete bool
+	// only the owner of the dot can commit to the branch
+	OwnerOnlyCommit bool
+}
+
+func (p BranchProtection) empty() bool {
+	return p == BranchProtection{}
+}
+
+func (p BranchProtection) String() string {
+	rules := []string{}
+	if p.NoRollback {
+		rules = append(rules, "no-rollback")
+	}
+	if p.NoDivergedPush {
+		rules = append(rules, "no-diverged-push")
+	}
+	if p.NoDelete {
+		rules = append(rules, "no-delete")
+	}
+	if p.OwnerOnlyCommit {
+		rules = append(rules, "owner-only-commit")
+	}
+	return strings.Join(rules, ",")
+}
+
+// How branchName ("" for master) is protected.
+func (t TopLevelFilesystem) BranchProtection(branchName string) BranchProtection {
+	return t.ProtectedBranches[branchOrMaster(branchName)]
+}
+
+// "" means the master branch in most places
+func branchOrMaster(branchName string) string {
+	if branchName == "" {
+		return DEFAULT_BRANCH
+	}
+	return branchName
+}
+
+func (r *Registry) SetBranchProtection(
+	tlf TopLevelFilesystem, branchName string, protection BranchProtection,
+) error {
+	branchName = branchOrMaster(branchName)
+	protected := map[string]BranchProtection{}
+	for branch, p := range tlf.ProtectedBranches {
+		protected[branch] = p
+	}
+	if protection.empty() {
+		delete(protected, branchName)
+	} else {
+		protected[branchName] = protection
+	}
+	rf := registryFilesystemFor(tlf)
+	rf.ProtectedBranches = protected
+	return r.updateRegistryFilesystem(tlf.MasterBranch.Name, rf)
+}
+
+// Refuse to replace toSnaps with fromSnaps unless it's a fast-forward, for
+// branches protected with NoDivergedPush.
+func refuseDivergedTransfer(branch string, fromSnaps, toSnaps []*snapshot) error {
+	_, err := canApply(fromSnaps, toSnaps)
+	switch err.(type) {
+	case *ToSnapsDiverged, *NoCommonSnapshots:
+		return fmt.Errorf(
+			"Branch %s is protected, and has commits which the transfer would discard (%s)", branch, err,
+		)
+	}
+	return nil
+}
@@ -203,9 +203,26 @@ func (r *Registry) CanPullClone(c Clone) bool {
 // the type as stored in the json in etcd (intermediate representation wrt
 // DotmeshVolume)
 type registryFilesystem struct {
-	Id              string
-	OwnerId         string
-	CollaboratorIds []string
+	Id                string
+	OwnerId           string
+	CollaboratorIds   []string
+	CollaboratorRoles map[string]string           `json:",omitempty"`
+	ProtectedBranches map[string]BranchProtection `json:",omitempty"`
+}
+
+// the registry entry for an existing filesystem, for updating it
+func registryFilesystemFor(tlf TopLevelFilesystem) registryFilesystem {
+	collaboratorIds := []string{}
+	for _, u := range tlf.Collaborators {
+		collaboratorIds = append(collaboratorIds, u.Id)
+	}
+	return registryFilesystem{
+		Id:                tlf.MasterBranch.Id,
+		OwnerId:           tlf.Owner.Id,
+		CollaboratorIds:   collaboratorIds,
+		CollaboratorRoles: tlf.CollaboratorRoles,
+		ProtectedBranches: tlf.ProtectedBranches,
+	}
 }
 
 // update a filesystem, including updating etcd and our local state
@@ -266,19 +283,14 @@ func (r *Registry) UnregisterFilesystem(name VolumeName) error {
 }
 
 func (r *Registry) UpdateCollaborators(
-	ctx context.Context, tlf TopLevelFilesystem, newCollaborators []SafeUser,
+	ctx context.Context, tlf TopLevelFilesystem, newCollaborators []SafeUser, roles map[string]string,
 ) error {
-	collaboratorIds := []string{}
-	for _, u := range newCollaborators {
-		collaboratorIds = append(collaboratorIds, u.Id)
-	}
-	rf := registryFilesystem{
-		Id: tlf.MasterBranch.Id,
-		// Owner is, for now, always the authenticated user at the time of
-		// creation
-		OwnerId:         tlf.Owner.Id,
-		CollaboratorIds: collaboratorIds,
-	}
+	tlf.Collaborators = newCollaborators
+	tlf.CollaboratorRoles = roles
+	return r.updateRegistryFilesystem(tlf.MasterBranch.Name, registryFilesystemFor(tlf))
+}
+
+func (r *Registry) updateRegistryFilesystem(name VolumeName, rf registryFilesystem) error {
 	serialized, err := json.Marshal(rf)
 	if err != nil {
 		return err
@@ -291,7 +303,7 @@ func (r *Registry) UpdateCollaborators(
 		context.Background(),
 		// (0)/(1)dotmesh.io/(2)registry/(3)filesystems/(4)<namespace>/(5)<name> =>
 		//     {"Uuid": "<fs-uuid>"}
-		fmt.Sprintf("%s/registry/filesystems/%s/%s", ETCD_PREFIX, tlf.MasterBranch.Name.Namespace, tlf.MasterBranch.Name.Name),
+		fmt.Sprintf("%s/registry/filesystems/%s/%s", ETCD_PREFIX, name.Namespace, name.Name),
 		string(serialized),
 		// allow (and require) update over existing.
 		&client.SetOptions{PrevExist: client.PrevExist},
@@ -301,7 +313,7 @@ func (r *Registry) UpdateCollaborators(
 	}
 	// Only update our local belief system once the write to etcd has been
 	// successful!
-	return r.UpdateFilesystemFromEtcd(tlf.MasterBranch.Name, rf)
+	return r.UpdateFilesystemFromEtcd(name, rf)
 }
 
 // update a clone, including updating our local record and etcd
@@ -382,9 +394,11 @@ func (r *Registry) UpdateFilesystemFromEtcd(
 			// if that's even the right level of abstraction. At time of writing,
 			// the only thing that seems to reasonably construct a
 			// TopLevelFilesystem is rpc's AllVolumesAndClones.
-			MasterBranch:  DotmeshVolume{Id: rf.Id, Name: name},
-			Owner:         safeUser(owner),
-			Collaborators: collaborators,
+			MasterBranch:      DotmeshVolume{Id: rf.Id, Name: name},
+			Owner:             safeUser(owner),
+			Collaborators:     collaborators,
+			CollaboratorRoles: rf.CollaboratorRoles,
+			ProtectedBranches: rf.ProtectedBranches,
 		}
 	}
 	return nil
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os/exec"
-	"strings"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -18,6 +15,109 @@ import (
 const BUF_LEN = 131072         // 128kb of replication data sent per update (of etcd)
 const START_SNAPSHOT = "START" // meaning "the start of the filesystem"
 
+// Replication requests from a receiver which has part of a stream left over
+// from an interrupted transfer carry its resume token. If the sender can use
+// it, it says so in the response, along with what it's actually sending.
+const RESUME_TOKEN_HEADER = "Dotmesh-Resume-Token"
+const RESUMED_SNAPSHOT_HEADER = "Dotmesh-Resumed-Snapshot"
+const RESUMED_SKIPPED_HEADER = "Dotmesh-Resumed-Skipped-Bytes"
+const RESUMED_SIZE_HEADER = "Dotmesh-Resumed-Size"
+
+// If the sender can resume the stream described by token into filesystemId,
+// return what it would send. Otherwise return nil, and a full stream should be
+// sent.
+func resumableStream(storage StorageBackend, filesystemId, token string) *ResumeInfo {
+	if token == "" {
+		return nil
+	}
+	info, err := storage.InspectResumeToken(token)
+	if err != nil {
+		log.Printf("[resumableStream] Can't resume %s, sending from scratch: %s", filesystemId, err)
+		return nil
+	}
+	if info.FilesystemId != filesystemId {
+		log.Printf(
+			"[resumableStream] Resume token is for %s, not %s, sending from scratch",
+			info.FilesystemId, filesystemId,
+		)
+		return nil
+	}
+	return info
+}
+
+// For a receiver making a GET: ask the sender to resume any partial receive
+// of filesystemId. Returns the token sent, if any.
+func requestResume(storage StorageBackend, filesystemId string, req *http.Request) (string, error) {
+	token, err := storage.ResumeToken(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set(RESUME_TOKEN_HEADER, token)
+	}
+	return token, nil
+}
+
+// Receive a stream which can't be resumed if it's interrupted (from S3 or an
+// archive), so it mustn't find or leave behind a partial receive which would
+// get in the way of the next one.
+func receiveWithoutResume(storage StorageBackend, filesystemId string, stream io.Reader) error {
+	err := abortPartialReceive(storage, filesystemId)
+	if err != nil {
+		return err
+	}
+	err = storage.Receive(filesystemId, stream)
+	if err != nil {
+		abortErr := abortPartialReceive(storage, filesystemId)
+		if abortErr != nil {
+			log.Printf("[receiveWithoutResume] %s", abortErr)
+		}
+	}
+	return err
+}
+
+func abortPartialReceive(storage StorageBackend, filesystemId string) error {
+	token, err := storage.ResumeToken(filesystemId)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return nil
+	}
+	log.Printf("[abortPartialReceive] Aborting partial receive of %s", filesystemId)
+	return storage.AbortResume(filesystemId)
+}
+
+// Once the response to a GET with the given token has arrived, find out
+// whether the sender resumed. If it didn't, what's left of the interrupted
+// receive is no use and is thrown away so the new stream can be received.
+func resumedResponse(
+	storage StorageBackend, filesystemId, token string, resp *http.Response,
+) (*ResumeInfo, error) {
+	snapshotId := resp.Header.Get(RESUMED_SNAPSHOT_HEADER)
+	if snapshotId == "" {
+		if token != "" {
+			log.Printf("[resumedResponse] Sender didn't resume %s, aborting partial receive", filesystemId)
+			return nil, storage.AbortResume(filesystemId)
+		}
+		return nil, nil
+	}
+	skipped, err := strconv.ParseInt(resp.Header.Get(RESUMED_SKIPPED_HEADER), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s header: %s", RESUMED_SKIPPED_HEADER, err)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get(RESUMED_SIZE_HEADER), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s header: %s", RESUMED_SIZE_HEADER, err)
+	}
+	return &ResumeInfo{
+		FilesystemId: filesystemId,
+		SnapshotId:   snapshotId,
+		SkippedBytes: skipped,
+		Size:         size,
+	}, nil
+}
+
 func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// respond to GET requests with a ZFS data stream
 	vars := mux.Vars(r)
@@ -25,6 +125,10 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	z.toSnap = vars["toSnap"]
 	z.filesystem = vars["filesystem"]
 
+	if !z.state.authorizeReplication(w, r, z.filesystem, false) {
+		return
+	}
+
 	// TODO: add a coarse grained lock to start with: stop other readers from
 	// this filesystem, and also stop us moving this filesystem to another node
 	// while it's being read from (although maybe avoid cancelling
@@ -52,8 +156,31 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		z.filesystem, z.fromSnap, z.toSnap,
 	)
 
-	// command writes into pipe
-	var cmd *exec.Cmd
+	resume := resumableStream(
+		z.state.storage, z.filesystem, r.Header.Get(RESUME_TOKEN_HEADER),
+	)
+	if resume != nil {
+		// the prelude has to match what's actually sent
+		z.toSnap = resume.SnapshotId
+		w.Header().Set(RESUMED_SNAPSHOT_HEADER, resume.SnapshotId)
+		w.Header().Set(RESUMED_SKIPPED_HEADER, fmt.Sprintf("%d", resume.SkippedBytes))
+		w.Header().Set(RESUMED_SIZE_HEADER, fmt.Sprintf("%d", resume.Size))
+		log.Printf(
+			"[ZFSSender:ServeHTTP] Resuming send of %s@%s, skipping %d bytes",
+			z.filesystem, z.toSnap, resume.SkippedBytes,
+		)
+	}
+
+	// the receiver told us which codecs it would like, and whether it can
+	// receive a compressed stream
+	codec := chooseCodec(codecsFromHeader(r.Header.Get(ACCEPT_CODECS_HEADER)), localCodecs())
+	compressed := resume == nil &&
+		r.Header.Get(COMPRESSED_STREAM_HEADER) == "true" &&
+		z.state.storage.CompressedStreams()
+	w.Header().Set(CODEC_HEADER, codec)
+	if compressed {
+		w.Header().Set(COMPRESSED_STREAM_HEADER, "true")
+	}
 
 	prelude, err := z.state.calculatePrelude(z.filesystem, z.toSnap)
 	if err != nil {
@@ -66,27 +193,6 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if z.fromSnap == "START" {
-		cmd = exec.Command(
-			// -R sends interim snapshots as well
-			"zfs", "send", "-p", "-R", fq(z.filesystem)+"@"+z.toSnap,
-		)
-	} else {
-		var fromSnap string
-		// in clone case, z.fromSnap must be fully qualified
-		if strings.Contains(z.fromSnap, "@") {
-			// send a clone, so make it fully qualified
-			fromSnap = fq(z.fromSnap)
-		} else {
-			// presume it refers to a snapshot
-			fromSnap = z.fromSnap
-		}
-		cmd = exec.Command(
-			"zfs", "send", "-p",
-			"-I", fromSnap, fq(z.filesystem)+"@"+z.toSnap,
-		)
-	}
-
 	// How to set HTTP response code based on return code of process?
 	// (we can't - it's too late by the time we know the return code)
 	pipeReader, pipeWriter := io.Pipe()
@@ -101,18 +207,19 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd.Stdout = pipeWriter
-	cmd.Stderr = getLogfile("zfs-send-errors")
+	// the checksum of what we sent follows the stream
+	w.Header().Set("Trailer", CHECKSUM_TRAILER)
+	checksum := newStreamChecksum()
 
 	finished := make(chan bool)
 	go pipe(
-		pipeReader, fmt.Sprintf("stdout of zfs send for %s", z.filesystem),
+		pipeReader, fmt.Sprintf("send stream for %s", z.filesystem),
 		w, "http response body",
 		finished,
 		make(chan *Event),
 		func(e *Event, c chan *Event) {},
 		func(bytes int64, t int64) {},
-		"compress",
+		"compress", codec, z.state.servingBandwidthLimit(r), checksum,
 	)
 
 	log.Printf(
@@ -125,14 +232,20 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"[ZFSSender:ServeHTTP] About to Run() for %s %s => %s",
 		z.filesystem, z.fromSnap, z.toSnap,
 	)
-	err = cmd.Run()
+	// z.fromSnap is START_SNAPSHOT, a snapshot id, or a fully qualified
+	// origin snapshot in the clone case, all of which Send understands.
+	if resume != nil {
+		err = z.state.storage.SendResume(r.Header.Get(RESUME_TOKEN_HEADER), pipeWriter)
+	} else {
+		err = z.state.storage.Send("", z.fromSnap, z.filesystem, z.toSnap, compressed, pipeWriter)
+	}
 	log.Printf(
 		"[ZFSSender:ServeHTTP] Finished Run() for %s %s => %s: %s",
 		z.filesystem, z.fromSnap, z.toSnap, err,
 	)
 	if err != nil {
 		log.Printf(
-			"[ZFSSender:ServeHTTP] Error from zfs send of %s from %s => %s: %s, check zfs-send-errors.log",
+			"[ZFSSender:ServeHTTP] Error from send of %s from %s => %s: %s",
 			z.filesystem, z.fromSnap, z.toSnap, err,
 		)
 	}
@@ -144,6 +257,13 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[ZFSSender:ServeHTTP] Waiting for finish signal...")
 	_ = <-finished
+	if err != nil {
+		// what got through is a perfectly good stream of what was sent, so
+		// don't let it look like the whole thing
+		w.Header().Set(CHECKSUM_TRAILER, CHECKSUM_FAILED)
+	} else {
+		w.Header().Set(CHECKSUM_TRAILER, checksumString(checksum))
+	}
 	log.Printf("[ZFSSender:ServeHTTP] Done!")
 
 }
@@ -157,6 +277,10 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	z.filesystem = vars["filesystem"]
 	_ = make([]byte, BUF_LEN)
 
+	if !z.state.authorizeReplication(w, r, z.filesystem, true) {
+		return
+	}
+
 	// TODO: add a coarse grained lock to start with: stop other writers from
 	// writing to this filesystem (unlike readers, this is strictly
 	// one-at-a-time), and also stop us moving this filesystem to another node
@@ -182,21 +306,53 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := exec.Command("zfs", "recv", fq(z.filesystem))
+	codec, err := codecFromHeader(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(fmt.Sprintf("Can't receive %s: %s\n", z.filesystem, err)))
+		return
+	}
+
+	// the pusher asks us for our resume token before it starts. if it isn't
+	// resuming with it, throw away the partial receive it refers to, and if
+	// it's resuming with a token we don't have, the stream is no use to us.
+	token := r.Header.Get(RESUME_TOKEN_HEADER)
+	localToken, err := z.state.storage.ResumeToken(z.filesystem)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Can't get resume token for %s: %s\n", z.filesystem, err)))
+		return
+	}
+	if token != localToken {
+		if token != "" {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf(
+				"Can't resume receiving %s, no partial receive matches that token.\n",
+				z.filesystem,
+			)))
+			return
+		}
+		log.Printf("[ZFSReceiver] Not resuming, aborting partial receive of %s", z.filesystem)
+		err = z.state.storage.AbortResume(z.filesystem)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(
+				"Can't abort partial receive of %s: %s\n", z.filesystem, err,
+			)))
+			return
+		}
+	}
+
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
-	cmd.Stdin = pipeReader
-	cmd.Stdout = w
-
-	errBuffer := bytes.Buffer{}
 
-	cmd.Stderr = &errBuffer
 	finished := make(chan bool)
+	checksum := newStreamChecksum()
 
 	go pipe(
 		r.Body, fmt.Sprintf("http request body for %s", z.filesystem),
-		pipeWriter, "zfs recv stdin", finished,
+		pipeWriter, "receive stream", finished,
 		make(chan *Event),
 		func(e *Event, c chan *Event) {},
 		func(bytes int64, t int64) {
@@ -212,7 +368,7 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 			}()
 		},
-		"decompress",
+		"decompress", codec, z.state.servingBandwidthLimit(r), checksum,
 	)
 
 	log.Printf("[ZFSReceiver] about to start consuming prelude on %v", pipeReader)
@@ -224,26 +380,19 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[ZFSReceiver] Got prelude %v", prelude)
 
-	err = cmd.Run()
+	err = z.state.storage.Receive(z.filesystem, pipeReader)
 	if err != nil {
 		log.Printf(
-			"Got error %s when running zfs recv for %s, check zfs-recv-stderr.log",
+			"Got error %s when receiving %s",
 			err, z.filesystem,
 		)
 		pipeReader.Close()
 		pipeWriter.Close()
 		_ = <-finished
-		readErr, err := ioutil.ReadAll(&errBuffer)
-		if err != nil {
-			// an error with your error. this is a bad day.
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Unable to read error: %s\n", err)))
-			return
-		}
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf(
-			"Unable to receive %s: %s, stderr: %s\n",
-			z.filesystem, err, readErr,
+			"Unable to receive %s: %s\n",
+			z.filesystem, err,
 		)))
 		return
 	}
@@ -252,7 +401,21 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pipeWriter.Close()
 	_ = <-finished
 
-	err = applyPrelude(prelude, fq(z.filesystem))
+	// the request body has been read, so its trailer has arrived
+	err = verifyChecksum(r.Trailer, checksum)
+	if err != nil {
+		log.Printf("[ZFSReceiver] Receiving %s: %s", z.filesystem, err)
+		rollbackErr := rollbackReceive(z.state.storage, z.filesystem, z.fromSnap)
+		if rollbackErr != nil {
+			log.Printf("[ZFSReceiver] Error rolling back %s: %s", z.filesystem, rollbackErr)
+			err = fmt.Errorf("%s, and rolling back failed: %s", err, rollbackErr)
+		}
+		w.WriteHeader(CHECKSUM_MISMATCH_STATUS)
+		w.Write([]byte(fmt.Sprintf("Received %s doesn't match what was sent: %s\n", z.filesystem, err)))
+		return
+	}
+
+	err = applyPrelude(z.state.storage, prelude, z.filesystem)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("Unable to apply prelude for %s: %s\n", z.filesystem, err)))
@@ -279,6 +442,36 @@ type ZFSReceiver struct {
 	toSnap     string
 }
 
+// Check the authenticated user can pull (or, if push, push to) the dot a
+// filesystem belongs to, responding with why not if they can't. Filesystems
+// which aren't in the registry are only for the admin user.
+func (s *InMemoryState) authorizeReplication(
+	w http.ResponseWriter, r *http.Request, filesystemId string, push bool,
+) bool {
+	var authorized bool
+	var err error
+	tlf, _, lookupErr := s.registry.LookupFilesystemById(filesystemId)
+	if lookupErr != nil {
+		authorized = r.Context().Value("authenticated-user-id").(string) == ADMIN_USER_UUID
+	} else if push {
+		authorized, err = tlf.Authorize(r.Context())
+	} else {
+		authorized, err = tlf.AuthorizeRead(r.Context())
+	}
+	if err != nil {
+		log.Printf("[authorizeReplication] Can't authorize %s: %s", filesystemId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Can't authorize %s: %s\n", filesystemId, err)))
+		return false
+	}
+	if !authorized {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("You don't have permission to replicate %s.\n", filesystemId)))
+		return false
+	}
+	return true
+}
+
 func (s *InMemoryState) NewZFSSendingServer() http.Handler {
 	return ZFSSender{
 		state: s,
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// a StorageBackend with a partial receive in the way, which records what's
+// done about it
+type partialReceiveStorage struct {
+	StorageBackend
+	token       string
+	receiveErr  error
+	calls       []string
+	leavesToken string
+}
+
+func (s *partialReceiveStorage) ResumeToken(filesystemId string) (string, error) {
+	return s.token, nil
+}
+
+func (s *partialReceiveStorage) AbortResume(filesystemId string) error {
+	s.calls = append(s.calls, "abort")
+	s.token = ""
+	return nil
+}
+
+// tokens are "<filesystemId>@<snapshotId>"
+func (s *partialReceiveStorage) InspectResumeToken(token string) (*ResumeInfo, error) {
+	shrapnel := strings.Split(token, "@")
+	if len(shrapnel) != 2 {
+		return nil, fmt.Errorf("Invalid token %s", token)
+	}
+	return &ResumeInfo{FilesystemId: shrapnel[0], SnapshotId: shrapnel[1], SkippedBytes: 100, Size: 50}, nil
+}
+
+func (s *partialReceiveStorage) Receive(filesystemId string, stream io.Reader) error {
+	s.calls = append(s.calls, "receive")
+	if s.token != "" {
+		return fmt.Errorf("destination contains partially-complete state")
+	}
+	s.token = s.leavesToken
+	return s.receiveErr
+}
+
+func TestReceiveWithoutResume(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		storage *partialReceiveStorage
+		calls   string
+		ok      bool
+	}{
+		{"clean", &partialReceiveStorage{}, "[receive]", true},
+		{"partial receive in the way", &partialReceiveStorage{token: "1-abc"}, "[abort receive]", true},
+		{
+			"interrupted",
+			&partialReceiveStorage{receiveErr: fmt.Errorf("interrupted"), leavesToken: "1-def"},
+			"[receive abort]", false,
+		},
+	} {
+		err := receiveWithoutResume(test.storage, "fs", &bytes.Buffer{})
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if calls := fmt.Sprintf("%v", test.storage.calls); calls != test.calls {
+			t.Errorf("%s: expected %s, got %s", test.name, test.calls, calls)
+		}
+		if test.storage.token != "" {
+			t.Errorf("%s: partial receive left behind", test.name)
+		}
+	}
+}
+
+func TestResumableStream(t *testing.T) {
+	storage := &partialReceiveStorage{}
+	for _, test := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"no token", "", false},
+		{"resumable", "fs@snap", true},
+		{"invalid token", "rubbish", false},
+		{"another filesystem's token", "other@snap", false},
+	} {
+		info := resumableStream(storage, "fs", test.token)
+		if test.ok && (info == nil || info.SnapshotId != "snap") {
+			t.Errorf("%s: expected to resume snap, got %+v", test.name, info)
+		}
+		if !test.ok && info != nil {
+			t.Errorf("%s: expected not to resume, got %+v", test.name, info)
+		}
+	}
+}
+
+func TestResumedResponse(t *testing.T) {
+	resumed := &http.Response{Header: http.Header{}}
+	resumed.Header.Set(RESUMED_SNAPSHOT_HEADER, "snap")
+	resumed.Header.Set(RESUMED_SKIPPED_HEADER, "100")
+	resumed.Header.Set(RESUMED_SIZE_HEADER, "50")
+	notResumed := &http.Response{Header: http.Header{}}
+
+	// the sender resumed
+	storage := &partialReceiveStorage{token: "fs@snap"}
+	info, err := resumedResponse(storage, "fs", storage.token, resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.SnapshotId != "snap" || info.SkippedBytes != 100 || info.Size != 50 {
+		t.Errorf("Expected snap to be resumed, got %+v", info)
+	}
+	if storage.token == "" {
+		t.Errorf("The partial receive was aborted even though it was resumed")
+	}
+
+	// the sender couldn't, so the partial receive would be in the way
+	info, err = resumedResponse(storage, "fs", storage.token, notResumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Errorf("Expected not to be resumed, got %+v", info)
+	}
+	if storage.token != "" {
+		t.Errorf("The partial receive wasn't aborted")
+	}
+
+	// nothing to resume
+	storage = &partialReceiveStorage{}
+	info, err = resumedResponse(storage, "fs", "", notResumed)
+	if err != nil || info != nil || len(storage.calls) != 0 {
+		t.Errorf("Expected nothing to happen, got %+v, %v, %v", info, err, storage.calls)
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/coreos/etcd/client"
+	"github.com/nu7hatch/gouuid"
 )
 
 // TODO ensure contexts are threaded through in all RPC calls for correct
@@ -198,6 +200,10 @@ func (d *DotmeshRPC) ResetApiKey(
 func (d *DotmeshRPC) GetApiKey(
 	r *http.Request, args *struct{}, result *struct{ ApiKey string },
 ) error {
+	err := refuseApiTokens(r)
+	if err != nil {
+		return err
+	}
 	user, err := GetUserById(r.Context().Value("authenticated-user-id").(string))
 	if err != nil {
 		return err
@@ -212,6 +218,10 @@ func (d *DotmeshRPC) GetApiKey(
 func (d *DotmeshRPC) UpdatePassword(
 	r *http.Request, args *struct{ NewPassword string }, result *SafeUser,
 ) error {
+	err := refuseApiTokens(r)
+	if err != nil {
+		return err
+	}
 	user, err := GetUserById(r.Context().Value("authenticated-user-id").(string))
 	if err != nil {
 		return err
@@ -225,6 +235,75 @@ func (d *DotmeshRPC) UpdatePassword(
 	return nil
 }
 
+// The authenticated user's API tokens.
+func (d *DotmeshRPC) ApiTokens(
+	r *http.Request, args *struct{}, result *[]ApiToken,
+) error {
+	tokens, err := userApiTokens(r.Context().Value("authenticated-user-id").(string))
+	if err != nil {
+		return err
+	}
+	*result = []ApiToken{}
+	for _, token := range tokens {
+		*result = append(*result, token.safe())
+	}
+	return nil
+}
+
+// Make an API token for the authenticated user. Its secret is only ever
+// returned here.
+func (d *DotmeshRPC) CreateApiToken(
+	r *http.Request,
+	args *struct {
+		Name, Scope      string
+		Dots, Namespaces []string
+		Expires          time.Time
+	},
+	result *struct {
+		Token  ApiToken
+		Secret string
+	},
+) error {
+	err := refuseApiTokens(r)
+	if err != nil {
+		return err
+	}
+	if !args.Expires.IsZero() && args.Expires.Before(time.Now()) {
+		return fmt.Errorf("Token would have expired already, at %s", args.Expires)
+	}
+	token, secret, err := createApiToken(ApiToken{
+		UserId:     r.Context().Value("authenticated-user-id").(string),
+		Name:       args.Name,
+		Scope:      args.Scope,
+		Dots:       args.Dots,
+		Namespaces: args.Namespaces,
+		Expires:    args.Expires.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	result.Token = token.safe()
+	result.Secret = secret
+	return nil
+}
+
+// Revoke one of the authenticated user's API tokens, by id or name.
+func (d *DotmeshRPC) RevokeApiToken(
+	r *http.Request, args *struct{ Id string }, result *bool,
+) error {
+	err := refuseApiTokens(r)
+	if err != nil {
+		return err
+	}
+	token, err := revokeApiToken(r.Context().Value("authenticated-user-id").(string), args.Id)
+	if err != nil {
+		return err
+	}
+	log.Printf("[RevokeApiToken] Revoked %s (%s)", token.Name, token.Id)
+	*result = true
+	return nil
+}
+
 // ADMIN BILLING FUNCTIONS
 
 func (d *DotmeshRPC) RegisterNewUser(
@@ -608,6 +687,26 @@ func (d *DotmeshRPC) Commit(
 	if err != nil {
 		return err
 	}
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.Name})
+	if err != nil {
+		return err
+	}
+	err = requireAuthorized(tlf.Authorize, r, tlf, "commit to")
+	if err != nil {
+		return err
+	}
+	if tlf.BranchProtection(args.Branch).OwnerOnlyCommit {
+		authorized, err := tlf.AuthorizeOwner(r.Context())
+		if err != nil {
+			return err
+		}
+		if !authorized {
+			return fmt.Errorf(
+				"Branch %s of %s is protected, only its owner can commit to it.",
+				branchOrMaster(args.Branch), VolumeName{args.Namespace, args.Name},
+			)
+		}
+	}
 	// NB: metadata keys must always start lowercase, because zfs
 	user, _, _ := r.BasicAuth()
 	meta := metadata{"message": args.Message, "author": user}
@@ -640,12 +739,6 @@ func (d *DotmeshRPC) Rollback(
 	args *struct{ Namespace, Name, Branch, SnapshotId string },
 	result *bool,
 ) error {
-	err := ensureAdminUser(r)
-
-	if err != nil {
-		return err
-	}
-
 	// Insert a command into etcd for the current master to respond to, and
 	// wait for a response to be inserted into etcd as well, before firing with
 	// that.
@@ -656,10 +749,32 @@ func (d *DotmeshRPC) Rollback(
 	if err != nil {
 		return err
 	}
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.Name})
+	if err != nil {
+		return err
+	}
+	err = requireAuthorized(tlf.AuthorizeMaintainer, r, tlf, "reset")
+	if err != nil {
+		return err
+	}
+	snapshotId, err := resolveTag(tlf.MasterBranch.Id, args.SnapshotId)
+	if err != nil {
+		return err
+	}
+	if tlf.BranchProtection(args.Branch).NoRollback {
+		return fmt.Errorf(
+			"Branch %s of %s is protected, so it can't be reset. The owner can unprotect it with 'dm branch unprotect'.",
+			branchOrMaster(args.Branch), VolumeName{args.Namespace, args.Name},
+		)
+	}
+	err = d.state.refuseRollbackPastTags(tlf.MasterBranch.Id, filesystemId, snapshotId)
+	if err != nil {
+		return err
+	}
 	responseChan, err := d.state.globalFsRequest(
 		filesystemId,
 		&Event{Name: "rollback",
-			Args: &EventArgs{"rollbackTo": args.SnapshotId}},
+			Args: &EventArgs{"rollbackTo": snapshotId}},
 	)
 	if err != nil {
 		return err
@@ -674,7 +789,7 @@ func (d *DotmeshRPC) Rollback(
 			args.Namespace,
 			args.Name,
 			args.Branch,
-			args.SnapshotId,
+			snapshotId,
 		)
 		*result = true
 	} else {
@@ -729,6 +844,10 @@ func (d *DotmeshRPC) Branch(
 	if err != nil {
 		return err
 	}
+	err = requireAuthorized(tlf.Authorize, r, tlf, "branch")
+	if err != nil {
+		return err
+	}
 	var originFilesystemId string
 
 	// find whether branch refers to top-level fs or a clone, by guessing based
@@ -771,6 +890,13 @@ func (d *DotmeshRPC) Branch(
 			"Cloned %s:%s@%s (%s) to %s", args.Name,
 			args.SourceBranch, args.SourceCommitId, originFilesystemId,
 		)
+		payload := WebhookPayload{
+			Event: "branch-created", Namespace: args.Namespace, Name: args.Name, Branch: args.NewBranchName,
+		}
+		if user, err := GetUserById(r.Context().Value("authenticated-user-id").(string)); err == nil {
+			payload.User = user.Name
+		}
+		d.state.notifyWebhooks(payload)
 		*result = true
 	} else {
 		return maybeError(e)
@@ -889,14 +1015,24 @@ func (d *DotmeshRPC) RegisterFilesystem(
 		return err
 	}
 
-	isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), args.Namespace)
-	if err != nil {
-		return err
-	}
+	// pushing a new branch of an existing dot only needs permission to
+	// change it, but creating one needs the namespace
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.TopLevelFilesystemName})
+	if err == nil {
+		err = requireAuthorized(tlf.Authorize, r, tlf, "push to")
+		if err != nil {
+			return err
+		}
+	} else {
+		isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), args.Namespace)
+		if err != nil {
+			return err
+		}
 
-	if !isAdmin {
-		return fmt.Errorf("User is not an administrator for namespace %s, so cannot create volumes",
-			args.Namespace)
+		if !isAdmin {
+			return fmt.Errorf("User is not an administrator for namespace %s, so cannot create volumes",
+				args.Namespace)
+		}
 	}
 
 	if !args.BecomeMasterIfNotExists {
@@ -982,6 +1118,20 @@ func (d *DotmeshRPC) RegisterTransfer(
 	return nil
 }
 
+// Pushing needs to be able to see the local dot, pulling into it to be able to
+// change it, wherever the other end is.
+func (d *DotmeshRPC) authorizeTransfer(r *http.Request, args *TransferRequest) error {
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.LocalNamespace, args.LocalName})
+	if err != nil {
+		// it doesn't exist yet, so pulling will create it
+		return nil
+	}
+	if args.Direction == "push" {
+		return requireAuthorized(tlf.AuthorizeRead, r, tlf, "push")
+	}
+	return requireAuthorized(tlf.Authorize, r, tlf, "pull into")
+}
+
 // Need both push and pull because one cluster will often be behind NAT.
 // Transfer will immediately return a transferId which can be queried until
 // completion
@@ -990,7 +1140,7 @@ func (d *DotmeshRPC) Transfer(
 	args *TransferRequest,
 	result *string,
 ) error {
-	client := NewJsonRpcClient(args.User, args.Peer, args.ApiKey)
+	client := args.peerClient()
 
 	log.Printf("[Transfer] starting with %+v", safeArgs(*args))
 
@@ -1006,9 +1156,25 @@ func (d *DotmeshRPC) Transfer(
 			return err
 		}
 	}
+	if args.Codec != "" {
+		err := validateCodec(args.Codec)
+		if err != nil {
+			return err
+		}
+	}
+	if args.BandwidthLimit < 0 {
+		return fmt.Errorf("Bandwidth limit can't be negative")
+	}
+	err := d.authorizeTransfer(r, args)
+	if err != nil {
+		return err
+	}
+	if args.S3 != nil {
+		return d.s3Transfer(r, args, result)
+	}
 
 	var remoteFilesystemId string
-	err := client.CallRemote(r.Context(),
+	err = client.CallRemote(r.Context(),
 		"DotmeshRPC.Exists", map[string]string{
 			"Namespace": args.RemoteNamespace,
 			"Name":      args.RemoteName,
@@ -1034,7 +1200,6 @@ func (d *DotmeshRPC) Transfer(
 	if args.Direction == "pull" && !remoteExists {
 		return fmt.Errorf("Can't pull when remote doesn't exist")
 	}
-
 	var localPath, remotePath PathToTopLevelFilesystem
 	if args.Direction == "push" {
 		localPath, err = d.state.registry.deducePathToTopLevelFilesystem(
@@ -1072,6 +1237,13 @@ func (d *DotmeshRPC) Transfer(
 
 	log.Printf("[Transfer] got paths: local=%+v remote=%+v", localPath, remotePath)
 
+	if args.TargetCommit != "" {
+		args.TargetCommit, err = d.resolveTargetCommit(r.Context(), client, args, localFilesystemId)
+		if err != nil {
+			return err
+		}
+	}
+
 	var filesystemId string
 	if args.Direction == "push" && !remoteExists {
 		// pre-create the remote registry entry and pick a master for it to
@@ -1145,37 +1317,20 @@ func (d *DotmeshRPC) Transfer(
 
 		} else if args.Direction == "pull" {
 			// Consult ourselves
-			v, err := d.state.getOne(r.Context(), filesystemId)
+			dirtyBytes, cs, err = d.localDirtyBytesAndContainers(r.Context(), filesystemId)
 			if err != nil {
 				return err
 			}
-			dirtyBytes = v.DirtyBytes
-			log.Printf("[TransferIt] got %d dirty bytes for %s from local", dirtyBytes, filesystemId)
-
-			d.state.globalContainerCacheLock.Lock()
-			defer d.state.globalContainerCacheLock.Unlock()
-			c, _ := (*d.state.globalContainerCache)[filesystemId]
-			cs = c.Containers
 		}
 
-		if dirtyBytes > 0 {
-			return fmt.Errorf(
-				"Aborting because there are %.2f MiB of uncommitted changes on volume "+
-					"where data would be written. Use 'dm reset' to roll back.",
-				float64(dirtyBytes)/(1024*1024),
-			)
+		err = refuseBusyTransferTarget(dirtyBytes, cs)
+		if err != nil {
+			return err
 		}
 
-		if len(cs) > 0 {
-			containersRunning := []string{}
-			for _, c := range cs {
-				containersRunning = append(containersRunning, string(c.Name))
-			}
-			return fmt.Errorf(
-				"Aborting because there are active containers running on "+
-					"volume where data would be written: %s. Stop the containers.",
-				strings.Join(containersRunning, ", "),
-			)
+		err = d.refuseProtectedTransferTarget(r.Context(), client, args, filesystemId)
+		if err != nil {
+			return err
 		}
 
 	} else {
@@ -1187,35 +1342,219 @@ func (d *DotmeshRPC) Transfer(
 		)
 	}
 
-	// Now run globalFsRequest, returning the request id, to make the master of
-	// a (possibly nonexisting) filesystem start pulling or pushing it, and
-	// make it update status as it goes in a new pollable "transfers" object in
-	// etcd.
+	return d.startTransfer(filesystemId, args, result)
+}
 
-	responseChan, requestId, err := d.state.globalFsRequestId(
-		filesystemId,
-		&Event{Name: "transfer",
-			Args: &EventArgs{
-				"Transfer": args,
-			},
-		},
+// Pushes and pulls into a branch protected with NoDivergedPush have to
+// fast-forward it. The receiving side has the say on how it's protected.
+func (d *DotmeshRPC) refuseProtectedTransferTarget(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest, filesystemId string,
+) error {
+	var protection BranchProtection
+	var branch string
+	if args.Direction == "push" {
+		var protected map[string]BranchProtection
+		err := client.CallRemote(ctx,
+			"DotmeshRPC.GetBranchProtections", VolumeName{args.RemoteNamespace, args.RemoteName}, &protected,
+		)
+		if err != nil {
+			return err
+		}
+		branch = branchOrMaster(args.RemoteBranchName)
+		protection = protected[branch]
+	} else {
+		tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.LocalNamespace, args.LocalName})
+		if err != nil {
+			return err
+		}
+		branch = branchOrMaster(args.LocalBranchName)
+		protection = tlf.BranchProtection(branch)
+	}
+	if !protection.NoDivergedPush {
+		return nil
+	}
+
+	localSnaps, err := d.state.snapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return err
+	}
+	var remoteSnaps []snapshot
+	err = client.CallRemote(ctx, "DotmeshRPC.CommitsById", filesystemId, &remoteSnaps)
+	if err != nil {
+		return err
+	}
+	fromSnaps, toSnaps := pointers(localSnaps), pointers(remoteSnaps)
+	if args.Direction == "pull" {
+		fromSnaps, toSnaps = toSnaps, fromSnaps
+	}
+	// only what's being sent matters
+	fromSnaps, err = restrictSnapshots(fromSnaps, args.TargetCommit)
+	if err != nil {
+		return err
+	}
+	return refuseDivergedTransfer(branch, fromSnaps, toSnaps)
+}
+
+// Resolve a transfer's TargetCommit, which may be a tag of the sending dot,
+// and check that it's on the branch being sent, as only that branch's commits
+// can be the last to go.
+func (d *DotmeshRPC) resolveTargetCommit(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest, localFilesystemId string,
+) (string, error) {
+	if args.Direction == "push" {
+		tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.LocalNamespace, args.LocalName})
+		if err != nil {
+			return "", err
+		}
+		commit, err := resolveTag(tlf.MasterBranch.Id, args.TargetCommit)
+		if err != nil {
+			return "", err
+		}
+		snaps, err := d.state.snapshotsForCurrentMaster(localFilesystemId)
+		if err != nil {
+			return "", err
+		}
+		for _, snap := range snaps {
+			if snap.Id == commit {
+				return commit, nil
+			}
+		}
+		return "", fmt.Errorf(
+			"Commit %s isn't on %s/%s,%s", args.TargetCommit,
+			args.LocalNamespace, args.LocalName, args.LocalBranchName,
+		)
+	}
+	// pulls can only check the tags, the commit gets checked when the remote
+	// comes to send it
+	var tags []Tag
+	err := client.CallRemote(ctx,
+		"DotmeshRPC.Tags", VolumeName{args.RemoteNamespace, args.RemoteName}, &tags,
 	)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag.Name == args.TargetCommit {
+			return tag.Commit, nil
+		}
+	}
+	return args.TargetCommit, nil
+}
+
+func (d *DotmeshRPC) localDirtyBytesAndContainers(
+	ctx context.Context, filesystemId string,
+) (int64, []DockerContainer, error) {
+	v, err := d.state.getOne(ctx, filesystemId)
+	if err != nil {
+		return 0, nil, err
+	}
+	log.Printf("[TransferIt] got %d dirty bytes for %s from local", v.DirtyBytes, filesystemId)
+
+	d.state.globalContainerCacheLock.Lock()
+	defer d.state.globalContainerCacheLock.Unlock()
+	c, _ := (*d.state.globalContainerCache)[filesystemId]
+	return v.DirtyBytes, c.Containers, nil
+}
+
+// Refuse to write to a filesystem with uncommitted changes or containers
+// using it.
+func refuseBusyTransferTarget(dirtyBytes int64, cs []DockerContainer) error {
+	if dirtyBytes > 0 {
+		return fmt.Errorf(
+			"Aborting because there are %.2f MiB of uncommitted changes on volume "+
+				"where data would be written. Use 'dm reset' to roll back.",
+			float64(dirtyBytes)/(1024*1024),
+		)
+	}
+
+	if len(cs) > 0 {
+		containersRunning := []string{}
+		for _, c := range cs {
+			containersRunning = append(containersRunning, string(c.Name))
+		}
+		return fmt.Errorf(
+			"Aborting because there are active containers running on "+
+				"volume where data would be written: %s. Stop the containers.",
+			strings.Join(containersRunning, ", "),
+		)
+	}
+	return nil
+}
+
+// Start a transfer, or queue it until the replication schedule allows it,
+// returning its id for polling.
+func (d *DotmeshRPC) startTransfer(filesystemId string, args *TransferRequest, result *string) error {
+	eventArgs := EventArgs{"Transfer": args}
+	if args.Archive != "" {
+		// Archive isn't serialized with the rest of the request
+		eventArgs["Archive"] = args.Archive
+	}
+	event := &Event{Name: "transfer", Args: &eventArgs}
+	id, err := uuid.NewV4()
 	if err != nil {
 		return err
 	}
-	go func() {
-		// asynchronously throw away the response, transfers can be polled via
-		// their own entries in etcd
-		e := <-responseChan
-		log.Printf("finished transfer of %+v, %+v", args, e)
-	}()
+	requestId := id.String()
 
+	// outside the replication schedule, the transfer waits here rather than
+	// in the state machine, which has other things to do in the meantime
+	schedule, err := getReplicationSchedule()
+	if err != nil {
+		return err
+	}
+	if schedule.untilOpen(time.Now()) > 0 {
+		err = d.state.queueTransfer(filesystemId, requestId, *args, event)
+	} else {
+		err = d.state.dispatchTransfer(filesystemId, requestId, *args, event)
+	}
+	if err != nil {
+		return err
+	}
 	*result = requestId
 	return nil
 }
 
+// Cancel a transfer which is queued waiting for the replication schedule.
+func (d *DotmeshRPC) CancelTransfer(
+	r *http.Request,
+	args *string,
+	result *bool,
+) error {
+	d.state.interclusterTransfersLock.Lock()
+	transfer, ok := (*d.state.interclusterTransfers)[*args]
+	d.state.interclusterTransfersLock.Unlock()
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", *args)
+	}
+	if transfer.Status != "queued" {
+		return fmt.Errorf("Transfer %s has started, only queued transfers can be cancelled", *args)
+	}
+	// the same permission it took to start it
+	err := d.authorizeTransfer(r, &TransferRequest{
+		Direction:      transfer.Direction,
+		LocalNamespace: transfer.LocalNamespace,
+		LocalName:      transfer.LocalName,
+	})
+	if err != nil {
+		return err
+	}
+	transfer.Status = "error"
+	transfer.Message = "Cancelled while queued"
+	err = updatePollResult(*args, transfer)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
 func safeArgs(t TransferRequest) TransferRequest {
 	t.ApiKey = "<redacted>"
+	if t.S3 != nil {
+		s3 := *t.S3
+		s3.SecretKey = "<redacted>"
+		t.S3 = &s3
+	}
 	return t
 }
 
@@ -1302,6 +1641,8 @@ func (d *DotmeshRPC) AllDotsAndBranches(
 		}
 		tlf.Owner = crappyTlf.Owner
 		tlf.Collaborators = crappyTlf.Collaborators
+		tlf.CollaboratorRoles = crappyTlf.CollaboratorRoles
+		tlf.ProtectedBranches = crappyTlf.ProtectedBranches
 		vac.Dots = append(vac.Dots, tlf)
 	}
 	*result = vac
@@ -1309,14 +1650,25 @@ func (d *DotmeshRPC) AllDotsAndBranches(
 	return nil
 }
 
+// Share a dot with a user, or change what they can do with it. Role is one of
+// collaboratorRoles, "writer" if it's not given.
 func (d *DotmeshRPC) AddCollaborator(
 	r *http.Request,
 	args *struct {
 		MasterBranchID string
 		Collaborator   string
+		Role           string
 	},
 	result *bool,
 ) error {
+	role := args.Role
+	if role == "" {
+		role = "writer"
+	}
+	err := validateCollaboratorRole(role)
+	if err != nil {
+		return err
+	}
 	// check authenticated user is owner of volume.
 	crappyTlf, clone, err := d.state.registry.LookupFilesystemById(args.MasterBranchID)
 	if err != nil {
@@ -1341,8 +1693,23 @@ func (d *DotmeshRPC) AddCollaborator(
 	if err != nil {
 		return err
 	}
-	newCollaborators := append(crappyTlf.Collaborators, safeUser(potentialCollaborator))
-	err = d.state.registry.UpdateCollaborators(r.Context(), crappyTlf, newCollaborators)
+	if potentialCollaborator.Id == crappyTlf.Owner.Id {
+		return fmt.Errorf("%s owns %s already", args.Collaborator, crappyTlf.MasterBranch.Name)
+	}
+	newCollaborators := crappyTlf.Collaborators
+	if crappyTlf.CollaboratorRole(potentialCollaborator.Id) == "" {
+		newCollaborators = append(newCollaborators, safeUser(potentialCollaborator))
+	}
+	roles := map[string]string{}
+	for id, role := range crappyTlf.CollaboratorRoles {
+		roles[id] = role
+	}
+	if role == "writer" {
+		delete(roles, potentialCollaborator.Id)
+	} else {
+		roles[potentialCollaborator.Id] = role
+	}
+	err = d.state.registry.UpdateCollaborators(r.Context(), crappyTlf, newCollaborators, roles)
 	if err != nil {
 		return err
 	}
@@ -1350,40 +1717,166 @@ func (d *DotmeshRPC) AddCollaborator(
 	return nil
 }
 
-func (d *DotmeshRPC) DeducePathToTopLevelFilesystem(
+// Stop sharing a dot with a user.
+func (d *DotmeshRPC) RemoveCollaborator(
 	r *http.Request,
 	args *struct {
-		RemoteNamespace      string
-		RemoteFilesystemName string
-		RemoteCloneName      string
+		MasterBranchID string
+		Collaborator   string
 	},
-	result *PathToTopLevelFilesystem,
+	result *bool,
 ) error {
-	log.Printf("[DeducePathToTopLevelFilesystem] called with args: %+v", args)
-	res, err := d.state.registry.deducePathToTopLevelFilesystem(
-		VolumeName{args.RemoteNamespace, args.RemoteFilesystemName}, args.RemoteCloneName,
-	)
+	tlf, clone, err := d.state.registry.LookupFilesystemById(args.MasterBranchID)
 	if err != nil {
 		return err
 	}
-	*result = res
-	log.Printf("[DeducePathToTopLevelFilesystem] succeeded: args %+v -> result %+v", args, res)
-	return nil
-}
-
-func (d *DotmeshRPC) PredictSize(
-	r *http.Request,
-	args *struct {
-		FromFilesystemId string
-		FromSnapshotId   string
-		ToFilesystemId   string
-		ToSnapshotId     string
-	},
+	if clone != "" {
+		return fmt.Errorf(
+			"Please remove collaborators from the master branch of the dot",
+		)
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"Not owner. Please ask the owner to remove the collaborator.",
+		)
+	}
+	collaborator, err := GetUserByName(args.Collaborator)
+	if err != nil {
+		return err
+	}
+	if tlf.CollaboratorRole(collaborator.Id) == "" {
+		return fmt.Errorf("%s isn't a collaborator on %s", args.Collaborator, tlf.MasterBranch.Name)
+	}
+	newCollaborators := []SafeUser{}
+	for _, other := range tlf.Collaborators {
+		if other.Id != collaborator.Id {
+			newCollaborators = append(newCollaborators, other)
+		}
+	}
+	roles := map[string]string{}
+	for id, role := range tlf.CollaboratorRoles {
+		if id != collaborator.Id {
+			roles[id] = role
+		}
+	}
+	err = d.state.registry.UpdateCollaborators(r.Context(), tlf, newCollaborators, roles)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Make an organization, owned by the authenticated user.
+func (d *DotmeshRPC) CreateOrganization(
+	r *http.Request, args *struct{ Name string }, result *Organization,
+) error {
+	// an organization's owners own the dots in its namespace, so it can't
+	// take over a namespace which already has some
+	for _, name := range d.state.registry.Filesystems() {
+		if name.Namespace == args.Name {
+			return fmt.Errorf("Name already exists - contact help@dotmesh.io")
+		}
+	}
+	org, err := createOrganization(args.Name, r.Context().Value("authenticated-user-id").(string))
+	if err != nil {
+		return err
+	}
+	*result = org.withUserNames()
+	return nil
+}
+
+// The organizations the authenticated user is a member of.
+func (d *DotmeshRPC) Organizations(
+	r *http.Request, args *struct{}, result *[]Organization,
+) error {
+	orgs, err := userOrganizations(r.Context().Value("authenticated-user-id").(string))
+	if err != nil {
+		return err
+	}
+	*result = []Organization{}
+	for _, org := range orgs {
+		*result = append(*result, org.withUserNames())
+	}
+	return nil
+}
+
+// Add a user to an organization with a role, or change their role.
+func (d *DotmeshRPC) AddOrganizationMember(
+	r *http.Request, args *struct{ Organization, User, Role string }, result *Organization,
+) error {
+	user, err := GetUserByName(args.User)
+	if err != nil {
+		return err
+	}
+	org, err := setOrganizationMember(
+		args.Organization, r.Context().Value("authenticated-user-id").(string), user.Id, args.Role,
+	)
+	if err != nil {
+		return err
+	}
+	*result = org.withUserNames()
+	return nil
+}
+
+func (d *DotmeshRPC) RemoveOrganizationMember(
+	r *http.Request, args *struct{ Organization, User string }, result *Organization,
+) error {
+	user, err := GetUserByName(args.User)
+	if err != nil {
+		return err
+	}
+	org, err := removeOrganizationMember(
+		args.Organization, r.Context().Value("authenticated-user-id").(string), user.Id,
+	)
+	if err != nil {
+		return err
+	}
+	*result = org.withUserNames()
+	return nil
+}
+
+func (d *DotmeshRPC) DeducePathToTopLevelFilesystem(
+	r *http.Request,
+	args *struct {
+		RemoteNamespace      string
+		RemoteFilesystemName string
+		RemoteCloneName      string
+	},
+	result *PathToTopLevelFilesystem,
+) error {
+	log.Printf("[DeducePathToTopLevelFilesystem] called with args: %+v", args)
+	res, err := d.state.registry.deducePathToTopLevelFilesystem(
+		VolumeName{args.RemoteNamespace, args.RemoteFilesystemName}, args.RemoteCloneName,
+	)
+	if err != nil {
+		return err
+	}
+	*result = res
+	log.Printf("[DeducePathToTopLevelFilesystem] succeeded: args %+v -> result %+v", args, res)
+	return nil
+}
+
+func (d *DotmeshRPC) PredictSize(
+	r *http.Request,
+	args *struct {
+		FromFilesystemId string
+		FromSnapshotId   string
+		ToFilesystemId   string
+		ToSnapshotId     string
+		// whether the caller can receive a compressed stream
+		Compressed bool
+	},
 	result *int64,
 ) error {
 	log.Printf("[PredictSize] got args %+v", args)
-	size, err := predictSize(
+	size, err := d.state.storage.PredictSize(
 		args.FromFilesystemId, args.FromSnapshotId, args.ToFilesystemId, args.ToSnapshotId,
+		args.Compressed && d.state.storage.CompressedStreams(),
 	)
 	if err != nil {
 		return err
@@ -1392,6 +1885,556 @@ func (d *DotmeshRPC) PredictSize(
 	return nil
 }
 
+type ReplicationCapabilities struct {
+	// codecs replication streams pushed to us can be compressed with
+	Codecs []string
+	// whether we can receive streams of blocks as they're compressed on disk
+	CompressedStreams bool
+}
+
+// What a pusher can send us.
+func (d *DotmeshRPC) ReplicationCapabilities(
+	r *http.Request, args *struct{}, result *ReplicationCapabilities,
+) error {
+	*result = ReplicationCapabilities{
+		Codecs:            localCodecs(),
+		CompressedStreams: d.state.storage.CompressedStreams(),
+	}
+	return nil
+}
+
+// Get the token describing how much of an interrupted push into filesystemId
+// this node has, so the pusher can resume it. "" if there's nothing to resume.
+func (d *DotmeshRPC) ReceiveResumeToken(
+	r *http.Request,
+	args *struct{ FilesystemId string },
+	result *string,
+) error {
+	token, err := d.state.storage.ResumeToken(args.FilesystemId)
+	if err != nil {
+		return err
+	}
+	*result = token
+	return nil
+}
+
+// The cluster-wide schedule of when transfers may run.
+func (d *DotmeshRPC) GetReplicationSchedule(
+	r *http.Request, args *struct{}, result *ReplicationSchedule,
+) error {
+	schedule, err := getReplicationSchedule()
+	if err != nil {
+		return err
+	}
+	*result = schedule
+	return nil
+}
+
+// Set the cluster-wide replication schedule. No windows means transfers can
+// run at any time.
+func (d *DotmeshRPC) SetReplicationSchedule(
+	r *http.Request, args *ReplicationSchedule, result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	err = args.validate()
+	if err != nil {
+		return err
+	}
+	err = setReplicationSchedule(*args)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// A dot's policy of automatic commits and how long to keep them.
+func (d *DotmeshRPC) GetPolicy(
+	r *http.Request, args *VolumeName, result *SnapshotPolicy,
+) error {
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", args)
+	}
+	policy, err := getSnapshotPolicy(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	*result = policy
+	return nil
+}
+
+// Set a dot's policy. An empty one stops automatic commits, and leaves the
+// ones which have already been made alone.
+func (d *DotmeshRPC) SetPolicy(
+	r *http.Request,
+	args *struct {
+		Namespace, Name string
+		Policy          SnapshotPolicy
+	},
+	result *bool,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	// policies destroy commits, so only the owner gets to set them
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of %s. Only the owner can set its policy.", name,
+		)
+	}
+	err = args.Policy.validate()
+	if err != nil {
+		return err
+	}
+	err = setSnapshotPolicy(tlf.MasterBranch.Id, args.Policy)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// The hooks run before and after a dot is committed.
+func (d *DotmeshRPC) GetCommitHooks(
+	r *http.Request, args *VolumeName, result *[]CommitHook,
+) error {
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", args)
+	}
+	hooks, err := getCommitHooks(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	*result = hooks
+	return nil
+}
+
+// Replace a dot's commit hooks. Hooks run commands in containers, so only
+// the admin user can set them.
+func (d *DotmeshRPC) SetCommitHooks(
+	r *http.Request,
+	args *struct {
+		Namespace, Name string
+		Hooks           []CommitHook
+	},
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.Name})
+	if err != nil {
+		return err
+	}
+	for _, hook := range args.Hooks {
+		err = hook.validate()
+		if err != nil {
+			return err
+		}
+	}
+	err = setCommitHooks(tlf.MasterBranch.Id, args.Hooks)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// The latest entries in the audit log, newest first.
+func (d *DotmeshRPC) AuditLog(
+	r *http.Request, args *AuditFilter, result *[]AuditEntry,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	entries, err := d.state.audit.query(*args)
+	if err != nil {
+		return err
+	}
+	*result = entries
+	return nil
+}
+
+func requireNamespaceAdministrator(r *http.Request, namespace string) error {
+	if namespace == "" || strings.ContainsAny(namespace, ":/") {
+		return fmt.Errorf("Invalid namespace name '%s'", namespace)
+	}
+	administrator, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), namespace)
+	if err != nil {
+		return err
+	}
+	if !administrator {
+		return fmt.Errorf("You don't administer namespace %s", namespace)
+	}
+	return nil
+}
+
+// A namespace's webhooks, without their secrets.
+func (d *DotmeshRPC) Webhooks(
+	r *http.Request, args *string, result *[]Webhook,
+) error {
+	err := requireNamespaceAdministrator(r, *args)
+	if err != nil {
+		return err
+	}
+	webhooks, err := getWebhooks(*args)
+	if err != nil {
+		return err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	*result = webhooks
+	return nil
+}
+
+// Subscribe a URL to events in a namespace. The result includes the secret
+// deliveries are signed with, which is made up if one isn't given, and can't
+// be seen again.
+func (d *DotmeshRPC) AddWebhook(
+	r *http.Request, args *Webhook, result *Webhook,
+) error {
+	err := requireNamespaceAdministrator(r, args.Namespace)
+	if err != nil {
+		return err
+	}
+	err = args.validate()
+	if err != nil {
+		return err
+	}
+	webhook, err := addWebhook(*args)
+	if err != nil {
+		return err
+	}
+	*result = webhook
+	return nil
+}
+
+func (d *DotmeshRPC) RemoveWebhook(
+	r *http.Request, args *struct{ Namespace, Id string }, result *bool,
+) error {
+	err := requireNamespaceAdministrator(r, args.Namespace)
+	if err != nil {
+		return err
+	}
+	err = removeWebhook(args.Namespace, args.Id)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Recent deliveries to a namespace's webhooks (or to one of them, if
+// WebhookId is given), newest first.
+func (d *DotmeshRPC) WebhookDeliveries(
+	r *http.Request, args *struct{ Namespace, WebhookId string }, result *[]WebhookDelivery,
+) error {
+	err := requireNamespaceAdministrator(r, args.Namespace)
+	if err != nil {
+		return err
+	}
+	deliveries, err := getWebhookDeliveries(args.Namespace, args.WebhookId)
+	if err != nil {
+		return err
+	}
+	*result = deliveries
+	return nil
+}
+
+// A dot's tags, sorted by name.
+func (d *DotmeshRPC) Tags(
+	r *http.Request, args *VolumeName, result *[]Tag,
+) error {
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", args)
+	}
+	tags, err := getTags(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	*result = tags
+	return nil
+}
+
+// Tag a commit in the history of a branch, or the latest one if Commit is "".
+// Commit can itself be a tag.
+func (d *DotmeshRPC) Tag(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch, Tag, Commit string },
+	result *Tag,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.Authorize(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", name)
+	}
+	err = validateTagName(args.Tag)
+	if err != nil {
+		return err
+	}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(name, args.Branch)
+	if err != nil {
+		return err
+	}
+	commit := args.Commit
+	if commit == "" {
+		snaps, err := d.state.snapshotsForCurrentMaster(filesystemId)
+		if err != nil {
+			return err
+		}
+		if len(snaps) == 0 {
+			return fmt.Errorf("There are no commits to tag")
+		}
+		commit = snaps[len(snaps)-1].Id
+	} else {
+		commit, err = resolveTag(tlf.MasterBranch.Id, commit)
+		if err != nil {
+			return err
+		}
+		_, err = d.state.snapshotInHistory(filesystemId, commit)
+		if err != nil {
+			return err
+		}
+	}
+	user, _, _ := r.BasicAuth()
+	tag := Tag{Name: args.Tag, Commit: commit, Author: user, Created: time.Now().UTC()}
+	err = createTag(tlf.MasterBranch.Id, tag)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Tag] Tagged %s of %s as %s", commit, name, args.Tag)
+	*result = tag
+	return nil
+}
+
+// Delete a tag. Tags keep commits from being destroyed, so only the owner of
+// the dot can.
+func (d *DotmeshRPC) DeleteTag(
+	r *http.Request,
+	args *struct{ Namespace, Name, Tag string },
+	result *bool,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of %s. Only the owner can delete its tags.", name,
+		)
+	}
+	err = deleteTag(tlf.MasterBranch.Id, args.Tag)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Store the tags of a dot which has just been pushed here, where the commits
+// they name arrived. Returns how many were new.
+func (d *DotmeshRPC) ReplicateTags(
+	r *http.Request,
+	args *struct {
+		Namespace, Name string
+		Tags            []Tag
+	},
+	result *int,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.Authorize(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", name)
+	}
+	stored, err := d.state.replicateTags(tlf.MasterBranch.Id, args.Tags)
+	if err != nil {
+		return err
+	}
+	*result = stored
+	return nil
+}
+
+// How a dot's branches are protected, by branch name ("master" for the
+// master branch). Unprotected branches are left out.
+func (d *DotmeshRPC) GetBranchProtections(
+	r *http.Request, args *VolumeName, result *map[string]BranchProtection,
+) error {
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", args)
+	}
+	protected := map[string]BranchProtection{}
+	for branch, protection := range tlf.ProtectedBranches {
+		protected[branch] = protection
+	}
+	*result = protected
+	return nil
+}
+
+// Replace how a branch is protected. An empty protection unprotects it. Only
+// the owner of the dot can.
+func (d *DotmeshRPC) SetBranchProtection(
+	r *http.Request,
+	args *struct {
+		Namespace, Name, Branch string
+		Protection              BranchProtection
+	},
+	result *bool,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of %s. Only the owner can protect its branches.", name,
+		)
+	}
+	if args.Branch != "" && args.Branch != DEFAULT_BRANCH {
+		_, err = d.state.registry.LookupClone(tlf.MasterBranch.Id, args.Branch)
+		if err != nil {
+			return err
+		}
+	}
+	err = d.state.registry.SetBranchProtection(tlf, args.Branch, args.Protection)
+	if err != nil {
+		return err
+	}
+	log.Printf("[SetBranchProtection] Protected %s of %s with %q", branchOrMaster(args.Branch), name, args.Protection)
+	*result = true
+	return nil
+}
+
+// What changed between two commits of a branch (or its origins), or between
+// a commit and the branch's working state if ToSnapshotId is "". Subdot
+// limits it to the files in one subdot. Only works on the branch's master.
+func (d *DotmeshRPC) Diff(
+	r *http.Request,
+	args *struct {
+		Namespace, Name, Branch      string
+		FromSnapshotId, ToSnapshotId string
+		Subdot                       string
+	},
+	result *DiffResult,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", name)
+	}
+	diff, err := d.state.diff(name, args.Branch, args.FromSnapshotId, args.ToSnapshotId, args.Subdot)
+	if err != nil {
+		return fmt.Errorf("Unable to diff %s: %s", name, err)
+	}
+	*result = diff
+	return nil
+}
+
+// List the files at Path in commit SnapshotId of a branch (or in its working
+// state, if SnapshotId is ""). Only works on the branch's master.
+func (d *DotmeshRPC) ListFiles(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch, SnapshotId, Path string },
+	result *[]DotFile,
+) error {
+	name := VolumeName{args.Namespace, args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(name)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeRead(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have access to %s", name)
+	}
+	root, err := d.state.commitRoot(name, args.Branch, args.SnapshotId)
+	if err != nil {
+		return err
+	}
+	files, err := listDotFiles(root, args.Path)
+	if err != nil {
+		return err
+	}
+	*result = files
+	return nil
+}
+
 func checkNotInUse(d *DotmeshRPC, fsid string, origins map[string]string) error {
 	containersInUse := func() int {
 		d.state.globalContainerCacheLock.Lock()
@@ -1455,6 +2498,14 @@ func (d *DotmeshRPC) Delete(
 		)
 
 	}
+	for branch, protection := range filesystem.ProtectedBranches {
+		if protection.NoDelete {
+			return fmt.Errorf(
+				"Branch %s of %s/%s is protected, so it can't be deleted. Unprotect it with 'dm branch unprotect' first.",
+				branch, args.Namespace, args.Name,
+			)
+		}
+	}
 
 	// Find the list of all clones of the filesystem, as we need to delete each independently.
 	filesystems := d.state.registry.ClonesFor(filesystem.MasterBranch.Id)
@@ -1551,6 +2602,10 @@ func (d *DotmeshRPC) Delete(
 		}
 	}
 
+	d.state.notifyWebhooks(WebhookPayload{
+		Event: "deleted", Namespace: args.Namespace, Name: args.Name,
+		FilesystemId: filesystem.MasterBranch.Id, User: user.Name,
+	})
 	*result = true
 	return nil
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A minimal client for S3 and things which speak its API (MinIO, Ceph, ...),
+// just enough to store replication streams and an index of them in a bucket.
+// Requests are signed with AWS Signature Version 4 and use path-style URLs
+// (http://endpoint/bucket/key), which everything supports.
+
+// Where a dot is kept, as given to a Transfer.
+type S3Target struct {
+	Endpoint  string // e.g. "https://s3.amazonaws.com" or "http://minio:9000"
+	Region    string
+	Bucket    string
+	Prefix    string // optional, keys are put under it
+	AccessKey string
+	SecretKey string
+}
+
+func s3Targetify(in map[string]interface{}) *S3Target {
+	str := func(k string) string {
+		s, _ := in[k].(string)
+		return s
+	}
+	return &S3Target{
+		Endpoint:  str("Endpoint"),
+		Region:    str("Region"),
+		Bucket:    str("Bucket"),
+		Prefix:    str("Prefix"),
+		AccessKey: str("AccessKey"),
+		SecretKey: str("SecretKey"),
+	}
+}
+
+const S3_DEFAULT_REGION = "us-east-1"
+
+// Streams bigger than this are uploaded in parts of this size, which are
+// buffered in memory. S3 allows 10,000 parts, so this caps a single stream
+// (one commit) at ~160GiB.
+const S3_PART_SIZE = 16 * 1024 * 1024
+
+type S3NotFound struct {
+	Key string
+}
+
+func (e *S3NotFound) Error() string {
+	return fmt.Sprintf("%s not found in S3 bucket", e.Key)
+}
+
+type s3Client struct {
+	target S3Target
+	http   *http.Client
+}
+
+func newS3Client(target S3Target) *s3Client {
+	if target.Region == "" {
+		target.Region = S3_DEFAULT_REGION
+	}
+	if !strings.Contains(target.Endpoint, "://") {
+		target.Endpoint = "https://" + target.Endpoint
+	}
+	target.Endpoint = strings.TrimSuffix(target.Endpoint, "/")
+	target.Prefix = strings.Trim(target.Prefix, "/")
+	return &s3Client{target: target, http: new(http.Client)}
+}
+
+// the key for parts, under the target's prefix
+func (c *s3Client) key(parts ...string) string {
+	if c.target.Prefix != "" {
+		parts = append([]string{c.target.Prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Percent-encode everything but RFC 3986 unreserved characters, as SigV4
+// wants. Slashes are left alone in paths.
+func s3Escape(s string, path bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign req, whose body hashes to payloadHash, as of now.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, c.target.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+c.target.SecretKey), day)
+	key = hmacSha256(key, c.target.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.target.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// Make a signed request for key ("" for the bucket itself). Responses other
+// than 2xx are turned into errors, 404s into S3NotFound.
+func (c *s3Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + c.target.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(c.target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, sha256Hex(body), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &S3NotFound{Key: path}
+	}
+	errorBody, _ := ioutil.ReadAll(resp.Body)
+	s3Err := s3Error{}
+	if xml.Unmarshal(errorBody, &s3Err) != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("S3 %s %s: %s", method, path, resp.Status)
+	}
+	return nil, fmt.Errorf("S3 %s %s: %s (%s)", method, path, s3Err.Message, s3Err.Code)
+}
+
+// Check the bucket exists and we're allowed to use it.
+func (c *s3Client) headBucket() error {
+	resp, err := c.do("HEAD", "", nil, nil)
+	if err != nil {
+		if _, ok := err.(*S3NotFound); ok {
+			return fmt.Errorf("S3 bucket %s doesn't exist at %s", c.target.Bucket, c.target.Endpoint)
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// The caller must close the object.
+func (c *s3Client) getObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) putSmallObject(key string, body []byte) error {
+	resp, err := c.do("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Upload everything read from r to key, in parts if it's big. Returns how many
+// bytes were uploaded.
+func (c *s3Client) putObject(key string, r io.Reader) (int64, error) {
+	part := make([]byte, S3_PART_SIZE)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), c.putSmallObject(key, part[:n])
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	uploadId, err := c.createMultipartUpload(key)
+	if err != nil {
+		return 0, err
+	}
+	completed := s3CompleteMultipartUpload{}
+	var size int64
+	for n > 0 {
+		partNumber := len(completed.Parts) + 1
+		etag, err := c.uploadPart(key, uploadId, partNumber, part[:n])
+		if err != nil {
+			c.abortMultipartUpload(key, uploadId)
+			return size, err
+		}
+		completed.Parts = append(completed.Parts, s3Part{PartNumber: partNumber, ETag: etag})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.abortMultipartUpload(key, uploadId)
+			return size, err
+		}
+	}
+	err = c.completeMultipartUpload(key, uploadId, completed)
+	if err != nil {
+		c.abortMultipartUpload(key, uploadId)
+		return size, err
+	}
+	return size, nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+func (c *s3Client) createMultipartUpload(key string) (string, error) {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	result := s3InitiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (c *s3Client) uploadPart(key, uploadId string, partNumber int, body []byte) (string, error) {
+	resp, err := c.do("PUT", key, url.Values{
+		"partNumber": {fmt.Sprintf("%d", partNumber)},
+		"uploadId":   {uploadId},
+	}, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) completeMultipartUpload(
+	key, uploadId string, completed s3CompleteMultipartUpload,
+) error {
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", key, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can report errors in the body of a 200 once it's started responding
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	s3Err := s3Error{}
+	if xml.Unmarshal(result, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("S3 completing upload of %s: %s (%s)", key, s3Err.Message, s3Err.Code)
+	}
+	return nil
+}
+
+func (c *s3Client) abortMultipartUpload(key, uploadId string) {
+	resp, err := c.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil)
+	if err != nil {
+		log.Printf("[abortMultipartUpload] Couldn't abort upload of %s: %s", key, err)
+		return
+	}
+	resp.Body.Close()
+}
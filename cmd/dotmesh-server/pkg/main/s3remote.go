@@ -0,0 +1,689 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Dots can be pushed to and pulled from an S3 bucket as well as another
+// cluster. There's nothing on the other end to ask for its snapshots, so a
+// dot in a bucket is an index:
+//
+//   <prefix>/<namespace>/<name>/index.json
+//
+// which lists each filesystem (branch) and its commits, along with the
+// replication stream which gets you to each commit from the one before it
+// (or from nothing, or from a clone's origin):
+//
+//   <prefix>/<namespace>/<name>/streams/<filesystem id>/<commit id>
+//
+// so a push uploads one stream per new commit and then updates the index, and
+// a pull downloads the streams for the commits it doesn't have, in order.
+//
+// S3 has no locking, so two clusters pushing to the same dot at once may
+// clobber each other's index updates.
+
+type S3Index struct {
+	Namespace            string
+	Name                 string
+	TopLevelFilesystemId string
+	// the storage backend which wrote the streams, they can only be
+	// received by the same kind
+	Backend     string
+	Filesystems map[string]*S3Filesystem
+}
+
+type S3Filesystem struct {
+	BranchName string // "" for master
+	Origin     Origin
+	Commits    []*S3Commit
+}
+
+type S3Commit struct {
+	Id       string
+	Metadata *metadata
+	// the stream from From (START_SNAPSHOT, the previous commit or a clone's
+	// fully qualified origin snapshot) to this commit
+	From   string
+	Key    string
+	Codec  string
+	Size   int64  // bytes stored, after compression
+	Sha256 string // of the stream before compression
+}
+
+func s3IndexKey(c *s3Client, namespace, name string) string {
+	return c.key(namespace, name, "index.json")
+}
+
+func s3StreamKey(c *s3Client, namespace, name, filesystemId, snapshotId string) string {
+	return c.key(namespace, name, "streams", filesystemId, snapshotId)
+}
+
+// Returns nil if the dot isn't in the bucket.
+func loadS3Index(c *s3Client, namespace, name string) (*S3Index, error) {
+	body, err := c.getObject(s3IndexKey(c, namespace, name))
+	if err != nil {
+		if _, ok := err.(*S3NotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+	index := &S3Index{}
+	err = json.NewDecoder(body).Decode(index)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read index of %s/%s from S3: %s", namespace, name, err)
+	}
+	return index, nil
+}
+
+func saveS3Index(c *s3Client, index *S3Index) error {
+	serialized, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return c.putSmallObject(s3IndexKey(c, index.Namespace, index.Name), serialized)
+}
+
+func (fs *S3Filesystem) snapshots() []*snapshot {
+	snaps := []*snapshot{}
+	for _, commit := range fs.Commits {
+		snaps = append(snaps, &snapshot{Id: commit.Id, Metadata: commit.Metadata})
+	}
+	return snaps
+}
+
+// The path from the top level filesystem to branchName, as
+// deducePathToTopLevelFilesystem does for the registry, and the id of
+// branchName's filesystem.
+func (index *S3Index) pathTo(branchName string) (PathToTopLevelFilesystem, string, error) {
+	path := PathToTopLevelFilesystem{
+		TopLevelFilesystemId:   index.TopLevelFilesystemId,
+		TopLevelFilesystemName: VolumeName{index.Namespace, index.Name},
+		Clones:                 ClonesList{},
+	}
+	filesystemId := index.TopLevelFilesystemId
+	if branchName != "" && branchName != DEFAULT_BRANCH {
+		filesystemId = ""
+		for id, fs := range index.Filesystems {
+			if fs.BranchName == branchName {
+				filesystemId = id
+			}
+		}
+		if filesystemId == "" {
+			return path, "", fmt.Errorf(
+				"No branch %s of %s/%s in S3", branchName, index.Namespace, index.Name,
+			)
+		}
+	}
+	for id := filesystemId; id != index.TopLevelFilesystemId; {
+		fs, ok := index.Filesystems[id]
+		if !ok {
+			return path, "", fmt.Errorf(
+				"S3 index of %s/%s is missing filesystem %s", index.Namespace, index.Name, id,
+			)
+		}
+		path.Clones = append(ClonesList{{
+			Name:  fs.BranchName,
+			Clone: Clone{FilesystemId: id, Origin: fs.Origin},
+		}}, path.Clones...)
+		id = fs.Origin.FilesystemId
+	}
+	return path, filesystemId, nil
+}
+
+// The Transfer RPC, for S3 remotes.
+func (d *DotmeshRPC) s3Transfer(
+	r *http.Request,
+	args *TransferRequest,
+	result *string,
+) error {
+	s3 := newS3Client(*args.S3)
+	err := s3.headBucket()
+	if err != nil {
+		return err
+	}
+	index, err := loadS3Index(s3, args.RemoteNamespace, args.RemoteName)
+	if err != nil {
+		return err
+	}
+	if index != nil && index.Backend != d.state.storage.Name() {
+		return fmt.Errorf(
+			"%s/%s was pushed to S3 from %s storage, it can't be used with %s storage",
+			args.RemoteNamespace, args.RemoteName, index.Backend, d.state.storage.Name(),
+		)
+	}
+
+	localFilesystemId := d.state.registry.Exists(
+		VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+	)
+
+	var filesystemId string
+	switch args.Direction {
+	case "push":
+		if localFilesystemId == "" {
+			return fmt.Errorf("Can't push when local doesn't exist")
+		}
+		if index != nil {
+			localPath, err := d.state.registry.deducePathToTopLevelFilesystem(
+				VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+			)
+			if err != nil {
+				return err
+			}
+			if localPath.TopLevelFilesystemId != index.TopLevelFilesystemId {
+				return fmt.Errorf(
+					"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
+					index.TopLevelFilesystemId, localPath.TopLevelFilesystemId, safeArgs(*args),
+				)
+			}
+		}
+		filesystemId = localFilesystemId
+	case "pull":
+		if index == nil {
+			return fmt.Errorf("Can't pull when remote doesn't exist")
+		}
+		remotePath, remoteFilesystemId, err := index.pathTo(args.RemoteBranchName)
+		if err != nil {
+			return err
+		}
+		if localFilesystemId == "" {
+			localPath := remotePath
+			localPath.TopLevelFilesystemName = VolumeName{args.LocalNamespace, args.LocalName}
+			err = d.registerFilesystemBecomeMaster(
+				r.Context(),
+				args.LocalNamespace,
+				args.LocalName,
+				args.LocalBranchName,
+				remoteFilesystemId,
+				localPath,
+			)
+			if err != nil {
+				return err
+			}
+		} else if localFilesystemId != remoteFilesystemId {
+			return fmt.Errorf(
+				"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
+				remoteFilesystemId, localFilesystemId, safeArgs(*args),
+			)
+		} else {
+			dirtyBytes, cs, err := d.localDirtyBytesAndContainers(r.Context(), localFilesystemId)
+			if err != nil {
+				return err
+			}
+			err = refuseBusyTransferTarget(dirtyBytes, cs)
+			if err != nil {
+				return err
+			}
+		}
+		filesystemId = remoteFilesystemId
+	}
+	return d.startTransfer(filesystemId, args, result)
+}
+
+// The path to the S3 dot a pull is from.
+func s3PathToTopLevelFilesystem(transferRequest TransferRequest) (PathToTopLevelFilesystem, error) {
+	s3 := newS3Client(*transferRequest.S3)
+	index, err := loadS3Index(s3, transferRequest.RemoteNamespace, transferRequest.RemoteName)
+	if err != nil {
+		return PathToTopLevelFilesystem{}, err
+	}
+	if index == nil {
+		return PathToTopLevelFilesystem{}, fmt.Errorf(
+			"%s/%s isn't in S3", transferRequest.RemoteNamespace, transferRequest.RemoteName,
+		)
+	}
+	path, _, err := index.pathTo(transferRequest.RemoteBranchName)
+	return path, err
+}
+
+// Like retryPush and retryPull. Progress is recorded in the index after
+// each commit, so a retry carries on from the last one which made it.
+func (f *fsMachine) retryS3(
+	direction string, attempt func() (*Event, stateFn),
+) (*Event, stateFn) {
+	var retry int
+	var responseEvent *Event
+	var nextState stateFn
+	for retry < 5 {
+		responseEvent, nextState = attempt()
+		if responseEvent.Name == "finished-"+direction || responseEvent.Name == "peer-up-to-date" {
+			return responseEvent, nextState
+		}
+		retry++
+		f.updateTransfer(
+			fmt.Sprintf("retry %d", retry),
+			fmt.Sprintf("Attempting to %s %s to S3 got %s", direction, f.filesystemId, responseEvent),
+		)
+		log.Printf(
+			"[retryS3] attempt %d to %s got %s, retrying in %ds",
+			retry, direction, responseEvent, retry,
+		)
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+	return responseEvent, nextState
+}
+
+// A transferFn which pushes the commits of toFilesystemId (up to
+// toSnapshotId, or all of them) which aren't in the bucket yet.
+func (f *fsMachine) s3Push(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	transferRequestId string, pollResult *TransferPollResult,
+	client *JsonRpcClient, transferRequest *TransferRequest,
+) (*Event, stateFn) {
+	return f.retryS3("push", func() (*Event, stateFn) {
+		s3 := newS3Client(*transferRequest.S3)
+		namespace, name := transferRequest.RemoteNamespace, transferRequest.RemoteName
+		index, err := loadS3Index(s3, namespace, name)
+		if err != nil {
+			return &Event{
+				Name: "failed-loading-s3-index", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		if index == nil {
+			index = &S3Index{
+				Namespace:   namespace,
+				Name:        name,
+				Backend:     f.state.storage.Name(),
+				Filesystems: map[string]*S3Filesystem{},
+			}
+		}
+		fs, ok := index.Filesystems[toFilesystemId]
+		if !ok {
+			fs = &S3Filesystem{Commits: []*S3Commit{}}
+			if fromFilesystemId == "" {
+				index.TopLevelFilesystemId = toFilesystemId
+			} else {
+				_, branchName, err := f.state.registry.LookupCloneByIdWithName(toFilesystemId)
+				if err != nil {
+					return &Event{
+						Name: "failed-looking-up-clone", Args: &EventArgs{"err": err},
+					}, backoffState
+				}
+				fs.BranchName = branchName
+				fs.Origin = Origin{FilesystemId: fromFilesystemId, SnapshotId: fromSnapshotId}
+			}
+			index.Filesystems[toFilesystemId] = fs
+		}
+
+		fsMachine, err := f.state.maybeFilesystem(toFilesystemId)
+		if err != nil {
+			return &Event{
+				Name: "s3-push-cant-find-filesystem-id",
+				Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+			}, backoffState
+		}
+		fsMachine.snapshotsLock.Lock()
+		snaps := fsMachine.filesystem.snapshots
+		fsMachine.snapshotsLock.Unlock()
+		localSnaps, err := restrictSnapshots(snaps, toSnapshotId)
+		if err != nil {
+			return &Event{
+				Name: "restrict-snapshots-error",
+				Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+			}, backoffState
+		}
+		snapRange, err := canApply(localSnaps, fs.snapshots())
+		if err != nil {
+			switch err.(type) {
+			case *ToSnapsUpToDate:
+				pollResult.Status = "finished"
+				pollResult.Message = "remote already up-to-date, nothing to do"
+				e := updatePollResult(transferRequestId, *pollResult)
+				if e != nil {
+					return &Event{
+						Name: "push-initiator-cant-write-to-etcd", Args: &EventArgs{"err": e},
+					}, backoffState
+				}
+				return &Event{Name: "peer-up-to-date"}, backoffState
+			}
+			return &Event{
+				Name: "error-in-canapply-when-pushing", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+
+		// the commits to upload, and where the first one's stream starts
+		var from string
+		toUpload := []*snapshot{}
+		if snapRange.fromSnap == nil {
+			from = START_SNAPSHOT
+			if fromFilesystemId != "" {
+				from = fmt.Sprintf("%s@%s", fromFilesystemId, fromSnapshotId)
+			}
+			toUpload = localSnaps
+		} else {
+			from = snapRange.fromSnap.Id
+			for i, snap := range localSnaps {
+				if snap.Id == from {
+					toUpload = localSnaps[i+1:]
+				}
+			}
+		}
+
+		pollResult.FilesystemId = toFilesystemId
+		pollResult.StartingCommit = from
+		pollResult.TargetCommit = snapRange.toSnap.Id
+		pollResult.Codec = chooseCodec(codecPreferences(transferRequest.Codec), localCodecs())
+		pollResult.BandwidthLimit = transferBandwidthLimit(transferRequest)
+		pollResult.Status = "calculating size"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "push-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		size, err := f.state.storage.PredictSize("", from, toFilesystemId, snapRange.toSnap.Id, false)
+		if err != nil {
+			return &Event{
+				Name: "error-predicting-size", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		pollResult.Size = size
+		pollResult.Sent = 0
+		pollResult.Status = "pushing"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "push-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+
+		startTime := time.Now().UnixNano()
+		for _, snap := range toUpload {
+			commit, err := f.s3PushCommit(
+				s3, index, toFilesystemId, from, snap, transferRequestId, pollResult, startTime,
+			)
+			if err != nil {
+				return &Event{
+					Name: "failed-pushing-to-s3",
+					Args: &EventArgs{"err": err, "filesystemId": toFilesystemId, "snapshotId": snap.Id},
+				}, backoffState
+			}
+			fs.Commits = append(fs.Commits, commit)
+			err = saveS3Index(s3, index)
+			if err != nil {
+				return &Event{
+					Name: "failed-saving-s3-index", Args: &EventArgs{"err": err},
+				}, backoffState
+			}
+			from = snap.Id
+		}
+
+		pollResult.Status = "finished"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "error-updating-poll-result", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		return &Event{Name: "finished-push"}, backoffState
+	})
+}
+
+// Upload the stream from from to snap. pollResult.Sent carries on counting
+// from where the last commit left it.
+func (f *fsMachine) s3PushCommit(
+	s3 *s3Client, index *S3Index, filesystemId, from string, snap *snapshot,
+	transferRequestId string, pollResult *TransferPollResult, startTime int64,
+) (*S3Commit, error) {
+	key := s3StreamKey(s3, index.Namespace, index.Name, filesystemId, snap.Id)
+	log.Printf("[s3PushCommit] Uploading %s@%s from %s to %s", filesystemId, snap.Id, from, key)
+
+	sendReader, sendWriter := io.Pipe()
+	uploadReader, uploadWriter := io.Pipe()
+	finished := make(chan bool)
+	checksum := newStreamChecksum()
+	sentBefore := pollResult.Sent
+
+	go pipe(
+		sendReader, fmt.Sprintf("send stream for %s@%s", filesystemId, snap.Id),
+		uploadWriter, "s3 upload",
+		finished,
+		f.innerRequests,
+		func(e *Event, c chan *Event) { c <- e },
+		func(bytes int64, t int64) {
+			pollResult.Sent = sentBefore + bytes
+			pollResult.NanosecondsElapsed = time.Now().UnixNano() - startTime
+			err := updatePollResult(transferRequestId, *pollResult)
+			if err != nil {
+				log.Printf("Error updating poll result: %s", err)
+			}
+		},
+		"compress", pollResult.Codec, pollResult.BandwidthLimit, checksum,
+	)
+
+	type uploadResult struct {
+		size int64
+		err  error
+	}
+	uploaded := make(chan uploadResult)
+	go func() {
+		size, err := s3.putObject(key, uploadReader)
+		// if the upload failed, stop the pipe and the send
+		uploadReader.CloseWithError(fmt.Errorf("upload to S3 stopped"))
+		uploaded <- uploadResult{size, err}
+	}()
+
+	sendErr := f.state.storage.Send("", from, filesystemId, snap.Id, false, sendWriter)
+	sendWriter.Close()
+	<-finished
+	upload := <-uploaded
+
+	if sendErr != nil {
+		// whatever got uploaded isn't in the index, so will be overwritten
+		// next time
+		return nil, sendErr
+	}
+	if upload.err != nil {
+		return nil, upload.err
+	}
+	return &S3Commit{
+		Id:       snap.Id,
+		Metadata: snap.Metadata,
+		From:     from,
+		Key:      key,
+		Codec:    pollResult.Codec,
+		Size:     upload.size,
+		Sha256:   checksumString(checksum),
+	}, nil
+}
+
+// A transferFn which pulls the commits of toFilesystemId (up to toSnapshotId,
+// or all of them) which we don't have yet.
+func (f *fsMachine) s3Pull(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	transferRequestId string, pollResult *TransferPollResult,
+	client *JsonRpcClient, transferRequest *TransferRequest,
+) (*Event, stateFn) {
+	return f.retryS3("pull", func() (*Event, stateFn) {
+		s3 := newS3Client(*transferRequest.S3)
+		namespace, name := transferRequest.RemoteNamespace, transferRequest.RemoteName
+		index, err := loadS3Index(s3, namespace, name)
+		if err == nil && index == nil {
+			err = fmt.Errorf("%s/%s isn't in S3", namespace, name)
+		}
+		if err != nil {
+			return &Event{
+				Name: "failed-loading-s3-index", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		fs, ok := index.Filesystems[toFilesystemId]
+		if !ok {
+			return &Event{
+				Name: "no-such-filesystem-in-s3",
+				Args: &EventArgs{"filesystemId": toFilesystemId},
+			}, backoffState
+		}
+		remoteSnaps, err := restrictSnapshots(fs.snapshots(), toSnapshotId)
+		if err != nil {
+			return &Event{
+				Name: "restrict-snapshots-error",
+				Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+			}, backoffState
+		}
+
+		fsMachine, err := f.state.maybeFilesystem(toFilesystemId)
+		if err != nil {
+			return &Event{
+				Name: "s3-pull-cant-find-filesystem-id",
+				Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+			}, backoffState
+		}
+		fsMachine.snapshotsLock.Lock()
+		localSnaps := fsMachine.filesystem.snapshots
+		fsMachine.snapshotsLock.Unlock()
+		snapRange, err := canApply(remoteSnaps, localSnaps)
+		if err != nil {
+			switch err.(type) {
+			case *ToSnapsUpToDate:
+				pollResult.Status = "finished"
+				pollResult.Message = "remote already up-to-date, nothing to do"
+				e := updatePollResult(transferRequestId, *pollResult)
+				if e != nil {
+					return &Event{
+						Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": e},
+					}, backoffState
+				}
+				return &Event{Name: "peer-up-to-date"}, backoffState
+			}
+			return &Event{
+				Name: "error-in-canapply-when-pulling", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+
+		toDownload := fs.Commits[:len(remoteSnaps)]
+		from := START_SNAPSHOT
+		if fromFilesystemId != "" {
+			from = fmt.Sprintf("%s@%s", fromFilesystemId, fromSnapshotId)
+		}
+		if snapRange.fromSnap != nil {
+			from = snapRange.fromSnap.Id
+			for i, commit := range toDownload {
+				if commit.Id == from {
+					toDownload = toDownload[i+1:]
+					break
+				}
+			}
+		}
+
+		pollResult.FilesystemId = toFilesystemId
+		pollResult.StartingCommit = from
+		pollResult.TargetCommit = snapRange.toSnap.Id
+		pollResult.BandwidthLimit = transferBandwidthLimit(transferRequest)
+		pollResult.Size = 0
+		for _, commit := range toDownload {
+			pollResult.Size += commit.Size
+		}
+		pollResult.Sent = 0
+		pollResult.Status = "pulling"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+
+		startTime := time.Now().UnixNano()
+		for _, commit := range toDownload {
+			if commit.From != from {
+				return &Event{
+					Name: "broken-chain-in-s3",
+					Args: &EventArgs{
+						"err": fmt.Errorf(
+							"the stream for %s is from %s, but we have %s",
+							commit.Id, commit.From, from,
+						),
+						"filesystemId": toFilesystemId,
+					},
+				}, backoffState
+			}
+			err = f.s3PullCommit(s3, toFilesystemId, commit, transferRequestId, pollResult, startTime)
+			if err != nil {
+				return &Event{
+					Name: "failed-pulling-from-s3",
+					Args: &EventArgs{"err": err, "filesystemId": toFilesystemId, "snapshotId": commit.Id},
+				}, backoffState
+			}
+			from = commit.Id
+		}
+
+		pollResult.Status = "finished"
+		err = updatePollResult(transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "error-updating-poll-result", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		return &Event{Name: "finished-pull"}, discoveringState
+	})
+}
+
+// Download and receive the stream for commit, checking it against its
+// checksum in the index.
+func (f *fsMachine) s3PullCommit(
+	s3 *s3Client, filesystemId string, commit *S3Commit,
+	transferRequestId string, pollResult *TransferPollResult, startTime int64,
+) error {
+	log.Printf("[s3PullCommit] Downloading %s@%s from %s", filesystemId, commit.Id, commit.Key)
+	err := validateCodec(commit.Codec)
+	if err != nil {
+		return err
+	}
+	codecName, _ := splitCodec(commit.Codec)
+	if !containsString(localCodecs(), codecName) {
+		return fmt.Errorf("Codec %s isn't supported here", commit.Codec)
+	}
+	pollResult.Codec = commit.Codec
+
+	body, err := s3.getObject(commit.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	finished := make(chan bool)
+	checksum := newStreamChecksum()
+	sentBefore := pollResult.Sent
+
+	go pipe(
+		body, fmt.Sprintf("s3 object %s", commit.Key),
+		pipeWriter, "receive stream",
+		finished,
+		f.innerRequests,
+		func(e *Event, c chan *Event) { c <- e },
+		func(bytes int64, t int64) {
+			pollResult.Sent = sentBefore + bytes
+			pollResult.NanosecondsElapsed = time.Now().UnixNano() - startTime
+			err := updatePollResult(transferRequestId, *pollResult)
+			if err != nil {
+				log.Printf("Error updating poll result: %s", err)
+			}
+		},
+		"decompress", commit.Codec, pollResult.BandwidthLimit, checksum,
+	)
+
+	err = receiveWithoutResume(f.state.storage, filesystemId, pipeReader)
+	pipeReader.Close()
+	<-finished
+	if err != nil {
+		return err
+	}
+	// pipe only sees the end of the body if it got all of it
+	if actual := checksumString(checksum); actual != commit.Sha256 {
+		mismatch := &ChecksumMismatch{Expected: commit.Sha256, Actual: actual}
+		rollbackErr := rollbackReceive(f.state.storage, filesystemId, commit.From)
+		if rollbackErr != nil {
+			log.Printf("[s3PullCommit] Couldn't roll back %s: %s", filesystemId, rollbackErr)
+		}
+		return mismatch
+	}
+	return applyPrelude(f.state.storage, Prelude{
+		SnapshotProperties: []*snapshot{{Id: commit.Id, Metadata: commit.Metadata}},
+	}, filesystemId)
+}
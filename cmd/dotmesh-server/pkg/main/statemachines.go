@@ -7,9 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os/exec"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -21,7 +18,7 @@ import (
 func newFilesystemMachine(filesystemId string, s *InMemoryState) *fsMachine {
 	// initialize the fsMachine with a filesystem struct that has bare minimum
 	// information (just the filesystem id) required to get started
-	return &fsMachine{
+	f := &fsMachine{
 		filesystem: &filesystem{
 			id: filesystemId,
 		},
@@ -52,6 +49,8 @@ func newFilesystemMachine(filesystemId string, s *InMemoryState) *fsMachine {
 		dirtyDelta:               0,
 		sizeBytes:                0,
 	}
+	s.events.tapTransitions(f)
+	return f
 }
 
 func (f *fsMachine) run() {
@@ -82,6 +81,13 @@ func (f *fsMachine) run() {
 		1*time.Second,
 		1*time.Second,
 	)
+	go runWhileFilesystemLives(
+		f.applySnapshotPolicy,
+		"applySnapshotPolicy",
+		f.filesystemId,
+		POLICY_CHECK_INTERVAL,
+		POLICY_CHECK_INTERVAL,
+	)
 	go func() {
 		for state := discoveringState; state != nil; {
 			state = state(f)
@@ -142,7 +148,7 @@ func (f *fsMachine) pollDirty() error {
 		return err
 	}
 	if f.filesystem.mounted {
-		dirtyDelta, sizeBytes, err := getDirtyDelta(
+		dirtyDelta, sizeBytes, err := f.state.storage.SizeInfo(
 			f.filesystemId, f.latestSnapshot(),
 		)
 		if err != nil {
@@ -275,6 +281,7 @@ func (f *fsMachine) transitionedTo(state string, status string) {
 	)
 	f.currentState = state
 	f.status = status
+	stateTransitionsMetric.Inc(f.filesystemId, state)
 	f.lastTransitionTimestamp = now
 	f.transitionObserver.Publish("transitions", state)
 	// update etcd
@@ -467,12 +474,12 @@ waitingForSlaveSnapshot:
 }
 
 func (f *fsMachine) unmount() (responseEvent *Event, nextState stateFn) {
-	out, err := exec.Command("umount", mnt(f.filesystemId)).CombinedOutput()
+	err := f.state.storage.Unmount(f.filesystemId)
 	if err != nil {
-		log.Printf("%v while trying to unmount %s", err, fq(f.filesystemId))
+		log.Printf("[unmount] %v", err)
 		return &Event{
 			Name: "failed-unmount",
-			Args: &EventArgs{"err": err, "combined-output": string(out)},
+			Args: &EventArgs{"err": err},
 		}, backoffState
 	}
 	f.filesystem.mounted = false
@@ -486,13 +493,6 @@ func (f *fsMachine) snapshot(e *Event) (responseEvent *Event, nextState stateFn)
 	} else {
 		meta = metadata{}
 	}
-	meta["timestamp"] = fmt.Sprintf("%d", time.Now().UnixNano())
-	metadataEncoded, err := encodeMetadata(meta)
-	if err != nil {
-		return &Event{
-			Name: "failed-metadata-encode", Args: &EventArgs{"err": err},
-		}, backoffState
-	}
 	id, err := uuid.NewV4()
 	if err != nil {
 		return &Event{
@@ -500,37 +500,113 @@ func (f *fsMachine) snapshot(e *Event) (responseEvent *Event, nextState stateFn)
 		}, backoffState
 	}
 	snapshotId := id.String()
-	args := []string{"snapshot"}
-	args = append(args, metadataEncoded...)
-	args = append(args, fq(f.filesystemId)+"@"+snapshotId)
-	out, err := exec.Command(ZFS, args...).CombinedOutput()
-	log.Printf("[snapshot] Attempting: zfs %s", args)
+
+	hooks, err := f.commitHooks()
 	if err != nil {
-		log.Printf("[snapshot] %v while trying to snapshot %s (%s)", err, fq(f.filesystemId), args)
 		return &Event{
-			Name: "failed-snapshot",
-			Args: &EventArgs{"err": err, "combined-output": string(out)},
+			Name: "failed-getting-commit-hooks", Args: &EventArgs{"err": err},
 		}, backoffState
 	}
-	list, err := exec.Command(ZFS, "list", fq(f.filesystemId)+"@"+snapshotId).CombinedOutput()
+	hookLog := []string{}
+	err = f.runCommitHooks(hooks, "pre", "", &hookLog)
+	if err != nil {
+		// thaw whatever the other pre hooks froze
+		f.runCommitHooks(hooks, "post", "", &hookLog)
+		log.Printf("[snapshot] %v", err)
+		return &Event{
+			Name: "failed-pre-commit-hook",
+			Args: &EventArgs{"err": err, "hooks": hookLog},
+		}, activeState
+	}
+
+	meta["timestamp"] = fmt.Sprintf("%d", time.Now().UnixNano())
+	err = f.state.storage.Snapshot(f.filesystemId, snapshotId, meta)
 	if err != nil {
-		log.Printf("[snapshot] %v while trying to list snapshot %s (%s)", err, fq(f.filesystemId), args)
+		f.runCommitHooks(hooks, "post", "", &hookLog)
+		log.Printf("[snapshot] %v", err)
 		return &Event{
 			Name: "failed-snapshot",
-			Args: &EventArgs{"err": err, "combined-output": string(out)},
+			Args: &EventArgs{"err": err},
 		}, backoffState
+	}
 
+	if len(hooks) > 0 {
+		err = f.runCommitHooks(hooks, "post", snapshotId, &hookLog)
+		if err != nil {
+			log.Printf("[snapshot] %v, destroying %s", err, snapshotId)
+			args := EventArgs{"err": err, "hooks": hookLog}
+			destroyErr := f.state.storage.DestroySnapshot(f.filesystemId, snapshotId)
+			if destroyErr != nil {
+				args["destroyErr"] = destroyErr
+			}
+			return &Event{Name: "failed-post-commit-hook", Args: &args}, activeState
+		}
+		meta["hooks"] = hookLogMetadata(hookLog)
+		err = f.state.storage.SetSnapshotMetadata(f.filesystemId, snapshotId, meta)
+		if err != nil {
+			log.Printf("[snapshot] Couldn't record hook output on %s: %v", snapshotId, err)
+		}
 	}
-	log.Printf("[snapshot] listed snapshot: '%q'", strconv.Quote(string(list)))
 	f.snapshotsLock.Lock()
-	log.Printf("[snapshot] Succeeded snapshotting (out: '%s'), saving: %s", out, &snapshot{Id: snapshotId, Metadata: &meta})
+	log.Printf("[snapshot] Succeeded snapshotting, saving: %s", &snapshot{Id: snapshotId, Metadata: &meta})
 	f.filesystem.snapshots = append(f.filesystem.snapshots,
 		&snapshot{Id: snapshotId, Metadata: &meta})
 	f.snapshotsLock.Unlock()
 	f.snapshotsModified <- true
+	f.state.notifyWebhooks(WebhookPayload{
+		Event: "commit", FilesystemId: f.filesystemId,
+		Commit: &snapshot{Id: snapshotId, Metadata: &meta},
+	})
 	return &Event{Name: "snapshotted"}, activeState
 }
 
+// destroy the given snapshots (e.g. expired ones, see applySnapshotPolicy),
+// which mustn't include the latest one.
+func (f *fsMachine) destroySnapshots(e *Event) (responseEvent *Event, nextState stateFn) {
+	snapshotIds, ok := (*e.Args)["snapshotIds"].([]string)
+	if !ok {
+		return &Event{
+			Name: "cant-cast-snapshot-ids",
+			Args: &EventArgs{"snapshotIds": (*e.Args)["snapshotIds"]},
+		}, backoffState
+	}
+	if len(snapshotIds) > 0 && containsString(snapshotIds, f.latestSnapshot()) {
+		return &Event{
+			Name: "cant-destroy-latest-snapshot",
+			Args: &EventArgs{"snapshotId": f.latestSnapshot()},
+		}, activeState
+	}
+	destroyed := map[string]bool{}
+	var err error
+	for _, snapshotId := range snapshotIds {
+		err = f.state.storage.DestroySnapshot(f.filesystemId, snapshotId)
+		if err != nil {
+			log.Printf("[destroySnapshots] %v", err)
+			break
+		}
+		destroyed[snapshotId] = true
+	}
+	if len(destroyed) > 0 {
+		f.snapshotsLock.Lock()
+		remaining := []*snapshot{}
+		for _, snap := range f.filesystem.snapshots {
+			if !destroyed[snap.Id] {
+				remaining = append(remaining, snap)
+			}
+		}
+		f.filesystem.snapshots = remaining
+		f.snapshotsLock.Unlock()
+		f.snapshotsModified <- true
+	}
+	if err != nil {
+		return &Event{
+			Name: "failed-destroy-snapshot",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{Name: "destroyed-snapshots"}, activeState
+}
+
 // find the user-facing name of a given filesystem id. if we're a branch
 // (clone), return the name of our parent filesystem.
 func (f *fsMachine) name() (VolumeName, error) {
@@ -597,6 +673,7 @@ func activeState(f *fsMachine) stateFn {
 				}
 				return backoffState
 			}
+			transferRequest.Archive, _ = (*e.Args)["Archive"].(string)
 			f.lastTransferRequest = transferRequest
 			transferRequestId, ok := (*e.Args)["RequestId"].(string)
 			if !ok {
@@ -671,6 +748,10 @@ func activeState(f *fsMachine) stateFn {
 			response, state := f.snapshot(e)
 			f.innerResponses <- response
 			return state
+		} else if e.Name == "destroy-snapshots" {
+			response, state := f.destroySnapshots(e)
+			f.innerResponses <- response
+			return state
 		} else if e.Name == "rollback" {
 			// roll back to given snapshot
 			rollbackTo := (*e.Args)["rollbackTo"].(string)
@@ -705,13 +786,12 @@ func activeState(f *fsMachine) stateFn {
 				}
 				return backoffState
 			}
-			out, err := exec.Command(ZFS, "rollback",
-				"-r", fq(f.filesystemId)+"@"+rollbackTo).CombinedOutput()
+			err = f.state.storage.Rollback(f.filesystemId, rollbackTo)
 			if err != nil {
-				log.Printf("%v while trying to rollback %s", err, fq(f.filesystemId))
+				log.Printf("[activeState] %v", err)
 				f.innerResponses <- &Event{
 					Name: "failed-rollback",
-					Args: &EventArgs{"err": err, "combined-output": string(out)},
+					Args: &EventArgs{"err": err},
 				}
 				return backoffState
 			}
@@ -786,16 +866,14 @@ func activeState(f *fsMachine) stateFn {
 				return backoffState
 			}
 
-			out, err := exec.Command(
-				ZFS, "clone",
-				fq(f.filesystemId)+"@"+originSnapshotId,
-				fq(newCloneFilesystemId),
-			).CombinedOutput()
+			err = f.state.storage.Clone(
+				f.filesystemId, originSnapshotId, newCloneFilesystemId,
+			)
 			if err != nil {
-				log.Printf("%v while trying to clone %s", err, fq(f.filesystemId))
+				log.Printf("[activeState] %v", err)
 				f.innerResponses <- &Event{
 					Name: "failed-clone",
-					Args: &EventArgs{"err": err, "combined-output": string(out)},
+					Args: &EventArgs{"err": err},
 				}
 				return backoffState
 			}
@@ -877,27 +955,16 @@ func pointers(snapshots []snapshot) []*snapshot {
 }
 
 func (f *fsMachine) mount() (responseEvent *Event, nextState stateFn) {
-	out, err := exec.Command(
-		"mkdir", "-p", mnt(f.filesystemId)).CombinedOutput()
+	err := f.state.storage.Mount(f.filesystemId)
 	if err != nil {
-		log.Printf("%v while trying to mkdir mountpoint %s", err, fq(f.filesystemId))
-		return &Event{
-			Name: "failed-mkdir-mountpoint",
-			Args: &EventArgs{"err": err, "combined-output": string(out)},
-		}, backoffState
-	}
-	out, err = exec.Command("mount.zfs", "-o", "noatime",
-		fq(f.filesystemId), mnt(f.filesystemId)).CombinedOutput()
-	if err != nil {
-		log.Printf("%v while trying to mount %s", err, fq(f.filesystemId))
+		log.Printf("[mount] %v", err)
 		return &Event{
 			Name: "failed-mount",
-			Args: &EventArgs{"err": err, "combined-output": string(out)},
+			Args: &EventArgs{"err": err},
 		}, backoffState
 	}
-	// trust that zero exit codes from mkdir && mount.zfs means
-	// that it worked and that the filesystem now exists and is
-	// mounted
+	// trust that a successful mount from the storage backend means that the
+	// filesystem now exists and is mounted
 	f.snapshotsLock.Lock()
 	f.filesystem.exists = true // needed in create case
 	f.filesystem.mounted = true
@@ -1026,6 +1093,13 @@ func transferRequestify(in interface{}) (TransferRequest, error) {
 			"Unable to cast %s to map[string]interface{}", in,
 		)
 	}
+	codec, _ := typed["Codec"].(string)
+	// numbers come out of JSON as float64s
+	bandwidthLimit, _ := typed["BandwidthLimit"].(float64)
+	var s3 *S3Target
+	if target, ok := typed["S3"].(map[string]interface{}); ok {
+		s3 = s3Targetify(target)
+	}
 	return TransferRequest{
 		Peer:             typed["Peer"].(string),
 		User:             typed["User"].(string),
@@ -1038,6 +1112,10 @@ func transferRequestify(in interface{}) (TransferRequest, error) {
 		RemoteName:       typed["RemoteName"].(string),
 		RemoteBranchName: typed["RemoteBranchName"].(string),
 		TargetCommit:     typed["TargetCommit"].(string),
+		// not set by older clients
+		Codec:          codec,
+		BandwidthLimit: int64(bandwidthLimit),
+		S3:             s3,
 	}, nil
 }
 
@@ -1103,6 +1181,7 @@ func missingState(f *fsMachine) stateFn {
 				}
 				return backoffState
 			}
+			transferRequest.Archive, _ = (*e.Args)["Archive"].(string)
 			f.lastTransferRequest = transferRequest
 			transferRequestId, ok := (*e.Args)["RequestId"].(string)
 			if !ok {
@@ -1163,13 +1242,12 @@ func missingState(f *fsMachine) stateFn {
 			f.transitionedTo("missing", "creating")
 			// ah - we are going to be created on this node, rather than
 			// received into from a master...
-			log.Printf("%s %s %s", ZFS, "create", fq(f.filesystemId))
-			out, err := exec.Command(ZFS, "create", fq(f.filesystemId)).CombinedOutput()
+			err := f.state.storage.Create(f.filesystemId)
 			if err != nil {
-				log.Printf("%v while trying to create %s", err, fq(f.filesystemId))
+				log.Printf("[missingState] %v", err)
 				f.innerResponses <- &Event{
 					Name: "failed-create",
-					Args: &EventArgs{"err": err, "combined-output": string(out)},
+					Args: &EventArgs{"err": err},
 				}
 				return backoffState
 			}
@@ -1207,7 +1285,7 @@ func backoffState(f *fsMachine) stateFn {
 
 func (f *fsMachine) discover() error {
 	// discover system state synchronously
-	filesystem, err := discoverSystem(f.filesystemId)
+	filesystem, err := f.state.storage.Discover(f.filesystemId)
 	if err != nil {
 		return err
 	}
@@ -1367,9 +1445,34 @@ func receivingState(f *fsMachine) stateFn {
 		return backoffState
 	}
 	req.SetBasicAuth("admin", apiKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	requestCodecs(f.state.storage, "", req)
+	token, err := requestResume(f.state.storage, f.filesystemId, req)
+	if err != nil {
+		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
+		return backoffState
+	}
+	resp, err := internalHTTPClient().Do(req)
+	if err != nil {
+		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
+		return backoffState
+	}
+	resume, err := resumedResponse(f.state.storage, f.filesystemId, token, resp)
 	if err != nil {
+		resp.Body.Close()
+		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
+		return backoffState
+	}
+	if resume != nil {
+		// if this only gets us part of the way, the next attempt will
+		// fetch the rest
+		log.Printf(
+			"Resumed pulling %s@%s, skipped %d bytes",
+			f.filesystemId, resume.SnapshotId, resume.SkippedBytes,
+		)
+	}
+	codec, err := codecFromHeader(resp.Header)
+	if err != nil {
+		resp.Body.Close()
 		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
 		return backoffState
 	}
@@ -1379,20 +1482,16 @@ func receivingState(f *fsMachine) stateFn {
 	)
 
 	f.transitionedTo("receiving", "starting")
-	cmd := exec.Command("zfs", "recv", fq(f.filesystemId))
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
 
-	cmd.Stdin = pipeReader
-	cmd.Stdout = getLogfile("zfs-recv-stdout")
-	cmd.Stderr = getLogfile("zfs-recv-stderr")
-
 	finished := make(chan bool)
+	checksum := newStreamChecksum()
 
 	go pipe(
 		resp.Body, fmt.Sprintf("http response body for %s", f.filesystemId),
-		pipeWriter, "stdin of zfs recv",
+		pipeWriter, "receive stream",
 		finished,
 		f.innerRequests,
 		// put the event back on the channel in the cancellation case
@@ -1408,7 +1507,7 @@ func receivingState(f *fsMachine) stateFn {
 				),
 			)
 		},
-		"decompress",
+		"decompress", codec, 0, checksum, // within the cluster, so not limited
 	)
 
 	log.Printf("[pull] about to start consuming prelude on %v", pipeReader)
@@ -1418,8 +1517,8 @@ func receivingState(f *fsMachine) stateFn {
 	}
 	log.Printf("[pull] Got prelude %v", prelude)
 
-	err = cmd.Run()
-	f.transitionedTo("receiving", "finished zfs recv")
+	err = f.state.storage.Receive(f.filesystemId, pipeReader)
+	f.transitionedTo("receiving", "finished receive")
 	pipeReader.Close()
 	pipeWriter.Close()
 	_ = <-finished
@@ -1427,15 +1526,24 @@ func receivingState(f *fsMachine) stateFn {
 
 	if err != nil {
 		log.Printf(
-			"Got error %s when running zfs recv for %s, check zfs-recv-stderr.log",
+			"Got error %s when receiving %s",
 			err, f.filesystemId,
 		)
 		return backoffState
 	} else {
 		log.Printf("Successfully received %s => %s for %s", fromSnap, snapRange.toSnap.Id)
 	}
+	err = verifyChecksum(resp.Trailer, checksum)
+	if err != nil {
+		log.Printf("Receiving %s: %s", f.filesystemId, err)
+		rollbackErr := rollbackReceive(f.state.storage, f.filesystemId, fromSnap)
+		if rollbackErr != nil {
+			log.Printf("Error rolling back %s: %s", f.filesystemId, rollbackErr)
+		}
+		return backoffState
+	}
 	log.Printf("[pull] about to start applying prelude on %v", pipeReader)
-	err = applyPrelude(prelude, fq(f.filesystemId))
+	err = applyPrelude(f.state.storage, prelude, f.filesystemId)
 	if err != nil {
 		return backoffState
 	}
@@ -1447,6 +1555,7 @@ func updatePollResult(transferRequestId string, pollResult TransferPollResult) e
 		"[updatePollResult] attempting to update poll result for %s: %+v",
 		transferRequestId, pollResult,
 	)
+	observeTransfer(transferRequestId, pollResult)
 	kapi, err := getEtcdKeysApi()
 	if err != nil {
 		return err
@@ -1551,13 +1660,10 @@ func pushInitiatorState(f *fsMachine) stateFn {
 		}
 		return backoffState
 	}
+
 	// Also RPC to remote cluster to set up a similar record there.
 	// TODO retries
-	client := NewJsonRpcClient(
-		transferRequest.User,
-		transferRequest.Peer,
-		transferRequest.ApiKey,
-	)
+	client := transferRequest.peerClient()
 
 	// TODO should we wait for the remote to ack that it's gone into the right state?
 
@@ -1570,12 +1676,22 @@ func pushInitiatorState(f *fsMachine) stateFn {
 		transferRequestId string, pollResult *TransferPollResult,
 		client *JsonRpcClient, transferRequest *TransferRequest,
 	) (*Event, stateFn) {
+		if transferRequest.S3 != nil {
+			return f.s3Push(
+				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				transferRequestId, pollResult, client, transferRequest,
+			)
+		}
 		return f.retryPush(
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
 			transferRequestId, pollResult, client, transferRequest,
 		)
 	}, transferRequestId, &pollResult, client, &transferRequest)
 
+	if transferRequest.S3 == nil && transferSucceeded(responseEvent) {
+		f.pushTags(client, path.TopLevelFilesystemId, transferRequest)
+	}
+
 	f.innerResponses <- responseEvent
 	if nextState == nil {
 		panic("nextState != nil invariant failed")
@@ -1598,7 +1714,7 @@ func (f *fsMachine) retryPush(
 	client *JsonRpcClient, transferRequest *TransferRequest,
 ) (*Event, stateFn) {
 	// Let's go!
-	var retry int
+	var retry, resumes int
 	var responseEvent *Event
 	var nextState stateFn
 	for retry < 5 {
@@ -1733,6 +1849,13 @@ func (f *fsMachine) retryPush(
 			log.Printf("[actualPush] Successful push!")
 			return responseEvent, nextState
 		}
+		// each resume finishes a snapshot, so carry straight on, but not
+		// forever if the peer keeps interrupting us
+		if responseEvent.Name == "resumed-push" && resumes < 5 {
+			resumes++
+			log.Printf("[actualPush] Resumed push got us to %s, pushing the rest", responseEvent)
+			continue
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -1775,6 +1898,16 @@ func (f *fsMachine) updateTransfer(status, message string) {
 			message, err,
 		)
 	}
+	if status == "error" {
+		transfer := *f.lastPollResult
+		transfer.ApiKey = ""
+		f.state.notifyWebhooks(WebhookPayload{
+			Event:     "transfer-failed",
+			Namespace: transfer.LocalNamespace, Name: transfer.LocalName,
+			Branch: branchOrMaster(transfer.LocalBranchName), FilesystemId: transfer.FilesystemId,
+			Transfer: &transfer,
+		})
+	}
 }
 
 func (f *fsMachine) pull(
@@ -1822,6 +1955,7 @@ func (f *fsMachine) pull(
 			"FromSnapshotId":   fromSnapshotId,
 			"ToFilesystemId":   toFilesystemId,
 			"ToSnapshotId":     toSnapshotId,
+			"Compressed":       f.state.storage.CompressedStreams(),
 		},
 		&size,
 	)
@@ -1833,6 +1967,8 @@ func (f *fsMachine) pull(
 	}
 	log.Printf("[pull] size: %d", size)
 	pollResult.Size = size
+	pollResult.Resumed = false
+	pollResult.BytesSkipped = 0
 	pollResult.Status = "pulling"
 	err = updatePollResult(*transferRequestId, *pollResult)
 	if err != nil {
@@ -1849,7 +1985,7 @@ func (f *fsMachine) pull(
 		"%s/filesystems/%s/%s/%s",
 		// pulls are between clusters, so use external address where
 		// appropriate
-		deduceUrl(transferRequest.Peer, "external"),
+		transferRequest.peerClient().baseUrl(),
 		toFilesystemId,
 		fromSnapshotId,
 		toSnapshotId,
@@ -1862,7 +1998,26 @@ func (f *fsMachine) pull(
 		transferRequest.User,
 		transferRequest.ApiKey,
 	)
-	getClient := new(http.Client)
+	requestCodecs(f.state.storage, transferRequest.Codec, req)
+	bandwidthLimit := transferBandwidthLimit(transferRequest)
+	requestBandwidthLimit(bandwidthLimit, req)
+	pollResult.BandwidthLimit = bandwidthLimit
+	// if a previous attempt was interrupted, ask to carry on from where it
+	// got to
+	token, err := requestResume(f.state.storage, toFilesystemId, req)
+	if err != nil {
+		return &Event{
+			Name: "failed-getting-resume-token",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	getClient, err := transferRequest.peerClient().httpClient()
+	if err != nil {
+		return &Event{
+			Name: "get-failed-pull",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
 	resp, err := getClient.Do(req)
 	if err != nil {
 		log.Printf("Attempting to pull %s got %s", toFilesystemId, err)
@@ -1871,6 +2026,40 @@ func (f *fsMachine) pull(
 			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
+	resume, err := resumedResponse(f.state.storage, toFilesystemId, token, resp)
+	if err != nil {
+		resp.Body.Close()
+		return &Event{
+			Name: "failed-resuming-pull",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	codec, err := codecFromHeader(resp.Header)
+	if err != nil {
+		resp.Body.Close()
+		return &Event{
+			Name: "unsupported-codec-pulling",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	pollResult.Codec = codec
+	pollResult.CompressedStream = resp.Header.Get(COMPRESSED_STREAM_HEADER) == "true"
+	if resume != nil {
+		log.Printf(
+			"[pull] Resuming %s@%s, skipping %d bytes",
+			toFilesystemId, resume.SnapshotId, resume.SkippedBytes,
+		)
+		pollResult.Size = resume.Size
+		pollResult.Resumed = true
+		pollResult.BytesSkipped = resume.SkippedBytes
+		err = updatePollResult(*transferRequestId, *pollResult)
+		if err != nil {
+			return &Event{
+				Name: "push-initiator-cant-write-to-etcd",
+				Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+	}
 	log.Printf(
 		"Debug: curl -u admin:[pw] %s",
 		url,
@@ -1889,22 +2078,17 @@ func (f *fsMachine) pull(
 
 	// 2) Pulling node is trying to mount the master fsid and failing.
 
-	// cmd := exec.Command("zfs", "recv", fq(f.filesystemId))
-	cmd := exec.Command("zfs", "recv", fq(toFilesystemId))
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
 
-	cmd.Stdin = pipeReader
-	cmd.Stdout = getLogfile("zfs-recv-stdout")
-	cmd.Stderr = getLogfile("zfs-recv-stderr")
-
 	finished := make(chan bool)
+	checksum := newStreamChecksum()
 
 	// TODO: make this update the pollResult
 	go pipe(
 		resp.Body, fmt.Sprintf("http response body for %s", toFilesystemId),
-		pipeWriter, "stdin of zfs recv",
+		pipeWriter, "receive stream",
 		finished,
 		f.innerRequests,
 		// put the event back on the channel in the cancellation case
@@ -1926,7 +2110,7 @@ func (f *fsMachine) pull(
 				),
 			)
 		},
-		"decompress",
+		"decompress", codec, bandwidthLimit, checksum,
 	)
 
 	log.Printf("[pull] about to start consuming prelude on %v", pipeReader)
@@ -1939,8 +2123,8 @@ func (f *fsMachine) pull(
 	}
 	log.Printf("[pull] Got prelude %v", prelude)
 
-	err = cmd.Run()
-	f.transitionedTo("receiving", "finished zfs recv")
+	err = f.state.storage.Receive(toFilesystemId, pipeReader)
+	f.transitionedTo("receiving", "finished receive")
 	pipeReader.Close()
 	pipeWriter.Close()
 	_ = <-finished
@@ -1948,7 +2132,7 @@ func (f *fsMachine) pull(
 
 	if err != nil {
 		log.Printf(
-			"Got error %s when running zfs recv for %s, check zfs-recv-stderr.log",
+			"Got error %s when receiving %s",
 			err, toFilesystemId,
 		)
 		return &Event{
@@ -1956,14 +2140,36 @@ func (f *fsMachine) pull(
 			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
+	err = verifyChecksum(resp.Trailer, checksum)
+	if err != nil {
+		log.Printf("[pull] Receiving %s: %s", toFilesystemId, err)
+		args := EventArgs{"err": err, "filesystemId": toFilesystemId}
+		rollbackErr := rollbackReceive(f.state.storage, toFilesystemId, fromSnapshotId)
+		if rollbackErr != nil {
+			args["rollbackErr"] = rollbackErr
+		}
+		return &Event{
+			Name: "checksum-mismatch-pulling",
+			Args: &args,
+		}, backoffState
+	}
 	log.Printf("[pull] about to start applying prelude on %v", pipeReader)
-	err = applyPrelude(prelude, fq(toFilesystemId))
+	err = applyPrelude(f.state.storage, prelude, toFilesystemId)
 	if err != nil {
 		return &Event{
 			Name: "failed-applying-prelude",
 			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
+	if resume != nil && resume.SnapshotId != toSnapshotId {
+		// the resumed stream only finished the snapshot it was interrupted
+		// in, carry on from there
+		pollResult.StartingCommit = resume.SnapshotId
+		return &Event{
+			Name: "resumed-pull",
+			Args: &EventArgs{"snapshotId": resume.SnapshotId},
+		}, discoveringState
+	}
 	pollResult.Status = "finished"
 	err = updatePollResult(*transferRequestId, *pollResult)
 	if err != nil {
@@ -1978,99 +2184,6 @@ func (f *fsMachine) pull(
 	}, discoveringState
 }
 
-func calculateSendArgs(
-	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
-) []string {
-
-	// toFilesystemId
-	// snapRange.toSnap.Id
-	// snapRange.fromSnap == nil?  --> fromSnapshotId == ""?
-	// snapRange.fromSnap.Id
-
-	var sendArgs []string
-	var fromSnap string
-	if fromSnapshotId == "" {
-		fromSnap = "START"
-		if fromFilesystemId != "" { // XXX wtf
-			// This is a clone-origin based send
-			fromSnap = fmt.Sprintf(
-				"%s@%s", fromFilesystemId, fromSnapshotId,
-			)
-		}
-	} else {
-		fromSnap = fromSnapshotId
-	}
-	if fromSnap == "START" {
-		// -R sends interim snapshots as well
-		sendArgs = []string{
-			"-p", "-R", fq(toFilesystemId) + "@" + toSnapshotId,
-		}
-	} else {
-		// in clone case, fromSnap must be fully qualified
-		if strings.Contains(fromSnap, "@") {
-			// send a clone, so make it fully qualified
-			fromSnap = fq(fromSnap)
-		}
-		sendArgs = []string{
-			"-p", "-I", fromSnap, fq(toFilesystemId) + "@" + toSnapshotId,
-		}
-	}
-	return sendArgs
-}
-
-/*
-		Discover total number of bytes in replication stream by asking nicely:
-
-			luke@hostess:/foo$ sudo zfs send -nP pool/foo@now2
-			full    pool/foo@now2   105050056
-			size    105050056
-			luke@hostess:/foo$ sudo zfs send -nP -I pool/foo@now pool/foo@now2
-			incremental     now     pool/foo@now2   105044936
-			size    105044936
-
-	   -n
-
-		   Do a dry-run ("No-op") send.  Do not generate any actual send
-		   data.  This is useful in conjunction with the -v or -P flags to
-		   determine what data will be sent.
-
-	   -P
-
-		   Print machine-parsable verbose information about the stream
-		   package generated.
-*/
-func predictSize(
-	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
-) (int64, error) {
-	sendArgs := calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
-	predictArgs := []string{"send", "-nP"}
-	predictArgs = append(predictArgs, sendArgs...)
-
-	sizeCmd := exec.Command("zfs", predictArgs...)
-
-	log.Printf("[predictSize] predict command: %s", strings.Join(predictArgs, " "))
-
-	out, err := sizeCmd.CombinedOutput()
-	if err != nil {
-		return 0, err
-	}
-	shrap := strings.Split(string(out), "\n")
-	if len(shrap) < 2 {
-		return 0, fmt.Errorf("Not enough lines in output %v", string(out))
-	}
-	sizeLine := shrap[len(shrap)-2]
-	shrap = strings.Fields(sizeLine)
-	if len(shrap) < 2 {
-		return 0, fmt.Errorf("Not enough fields in %v", sizeLine)
-	}
-
-	size, err := strconv.ParseInt(shrap[1], 10, 64)
-	if err != nil {
-		return 0, err
-	}
-	return size, nil
-}
-
 // TODO this method shouldn't really be on a fsMachine, because it is
 // parameterized by filesystemId (implicitly in pollResult, which varies over
 // phases of a multi-filesystem push)
@@ -2098,6 +2211,25 @@ func (f *fsMachine) push(
 		}, backoffState
 	}
 
+	// if a previous attempt was interrupted, the peer may be able to carry on
+	// from where it got to
+	var token string
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.ReceiveResumeToken", map[string]interface{}{
+			"FilesystemId": filesystemId,
+		},
+		&token,
+	)
+	if err != nil {
+		log.Printf("[actualPush] Can't get resume token from peer, not resuming: %s", err)
+		token = ""
+	}
+	resume := resumableStream(f.state.storage, filesystemId, token)
+	targetSnapshotId := snapRange.toSnap.Id
+	if resume != nil {
+		targetSnapshotId = resume.SnapshotId
+	}
+
 	postReader, postWriter := io.Pipe()
 
 	defer postWriter.Close()
@@ -2107,10 +2239,10 @@ func (f *fsMachine) push(
 		// pushes are between clusters, so use external address where
 		// appropriate
 		"%s/filesystems/%s/%s/%s",
-		deduceUrl(transferRequest.Peer, "external"),
+		transferRequest.peerClient().baseUrl(),
 		filesystemId,
 		fromSnapshotId,
-		snapRange.toSnap.Id,
+		targetSnapshotId,
 	)
 	log.Printf("Pushing to %s", url)
 	req, err := http.NewRequest(
@@ -2126,8 +2258,6 @@ func (f *fsMachine) push(
 	}
 
 	// TODO remove duplication (with replication.go)
-	// command writes into pipe
-	var cmd *exec.Cmd
 	// https://github.com/zfsonlinux/zfs/pull/5189
 	//
 	// Due to the above issues, -R doesn't send user properties on
@@ -2137,7 +2267,11 @@ func (f *fsMachine) push(
 	// Workaround this limitation by include the missing information in
 	// JSON format in a "prelude" section of the ZFS send stream.
 	//
-	prelude, err := f.state.calculatePrelude(toFilesystemId, toSnapshotId)
+	preludeSnapshotId := toSnapshotId
+	if resume != nil {
+		preludeSnapshotId = resume.SnapshotId
+	}
+	prelude, err := f.state.calculatePrelude(toFilesystemId, preludeSnapshotId)
 	if err != nil {
 		return &Event{
 			Name: "error-calculating-prelude",
@@ -2147,21 +2281,47 @@ func (f *fsMachine) push(
 
 	// TODO test whether toFilesystemId and toSnapshotId are set correctly,
 	// and consistently with snapRange?
-	sendArgs := calculateSendArgs(
-		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-	)
-	realArgs := []string{"send"}
-	realArgs = append(realArgs, sendArgs...)
 
-	// XXX this doesn't need to happen every push(), just once above.
-	size, err := predictSize(
-		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+	// find out what the peer can receive. peers which predate
+	// ReplicationCapabilities can only do gzip.
+	capabilities := ReplicationCapabilities{Codecs: []string{LEGACY_CODEC}}
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.ReplicationCapabilities", struct{}{}, &capabilities,
 	)
 	if err != nil {
-		return &Event{
-			Name: "error-predicting",
-			Args: &EventArgs{"err": err},
-		}, backoffState
+		log.Printf("[actualPush] Can't get replication capabilities from peer, using gzip: %s", err)
+		capabilities = ReplicationCapabilities{Codecs: []string{LEGACY_CODEC}}
+	}
+	codec := chooseCodec(codecPreferences(transferRequest.Codec), capabilities.Codecs)
+	compressed := resume == nil &&
+		capabilities.CompressedStreams && f.state.storage.CompressedStreams()
+	pollResult.Codec = codec
+	pollResult.CompressedStream = compressed
+	bandwidthLimit := transferBandwidthLimit(transferRequest)
+	pollResult.BandwidthLimit = bandwidthLimit
+
+	var size int64
+	if resume != nil {
+		size = resume.Size
+		log.Printf(
+			"[actualPush] Resuming %s@%s, skipping %d bytes",
+			filesystemId, resume.SnapshotId, resume.SkippedBytes,
+		)
+		pollResult.Resumed = true
+		pollResult.BytesSkipped = resume.SkippedBytes
+	} else {
+		// XXX this doesn't need to happen every push(), just once above.
+		size, err = f.state.storage.PredictSize(
+			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId, compressed,
+		)
+		if err != nil {
+			return &Event{
+				Name: "error-predicting",
+				Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		pollResult.Resumed = false
+		pollResult.BytesSkipped = 0
 	}
 
 	log.Printf("[actualPush] size: %d", size)
@@ -2176,7 +2336,6 @@ func (f *fsMachine) push(
 	}
 
 	// proceed to do real send
-	cmd = exec.Command("zfs", realArgs...)
 	pipeReader, pipeWriter := io.Pipe()
 
 	defer pipeWriter.Close()
@@ -2191,13 +2350,15 @@ func (f *fsMachine) push(
 		}, backoffState
 	}
 
-	cmd.Stdout = pipeWriter
-	cmd.Stderr = getLogfile("zfs-send-errors")
+	// the checksum of what we send goes in a trailer, set when pipe closes
+	// the request body
+	checksum := newStreamChecksum()
+	body := newChecksummedBody(postWriter, checksum, req)
 
 	finished := make(chan bool)
 	go pipe(
-		pipeReader, fmt.Sprintf("stdout of zfs send for %s", filesystemId),
-		postWriter, "http request body",
+		pipeReader, fmt.Sprintf("send stream for %s", filesystemId),
+		body, "http request body",
 		finished,
 		make(chan *Event),
 		func(e *Event, c chan *Event) {},
@@ -2218,7 +2379,7 @@ func (f *fsMachine) push(
 				),
 			)
 		},
-		"compress",
+		"compress", codec, bandwidthLimit, checksum,
 	)
 
 	log.Printf(
@@ -2231,15 +2392,26 @@ func (f *fsMachine) push(
 		transferRequest.User,
 		transferRequest.ApiKey,
 	)
-	postClient := new(http.Client)
+	req.Header.Set(CODEC_HEADER, codec)
+	requestBandwidthLimit(bandwidthLimit, req)
+	if resume != nil {
+		req.Header.Set(RESUME_TOKEN_HEADER, token)
+	}
+	postClient, err := transferRequest.peerClient().httpClient()
+	if err != nil {
+		return &Event{
+			Name: "error-starting-post-when-pushing",
+			Args: &EventArgs{"err": err, "filesystemId": filesystemId},
+		}, backoffState
+	}
 
 	log.Printf("About to postClient.Do with req %s", req)
 
 	// postClient.Do will block trying to read the first byte of the request
 	// body. But, we won't be able to provide the first byte until we start
-	// running the command. So, do what we always do to avoid a deadlock. Run
+	// running the send. So, do what we always do to avoid a deadlock. Run
 	// something in a goroutine. In this case we need 'resp' in scope, so let's
-	// run the command in a goroutine.
+	// run the send in a goroutine.
 
 	errch := make(chan error)
 	go func() {
@@ -2247,13 +2419,25 @@ func (f *fsMachine) push(
 			"[actualPush] About to Run() for %s %s => %s",
 			filesystemId, fromSnapshotId, toSnapshotId,
 		)
-		runErr := cmd.Run()
+		var runErr error
+		if resume != nil {
+			runErr = f.state.storage.SendResume(token, pipeWriter)
+		} else {
+			runErr = f.state.storage.Send(
+				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				compressed, pipeWriter,
+			)
+		}
 
 		log.Printf(
 			"[actualPush] Run() got result %s, about to put it into errch after closing pipeWriter",
 			runErr,
 		)
-		err := pipeWriter.Close()
+		if runErr != nil {
+			body.Fail()
+		}
+		// a nil error closes it normally
+		err := pipeWriter.CloseWithError(runErr)
 		if err != nil {
 			log.Printf("[actualPush] error closing pipeWriter: %s", err)
 		}
@@ -2283,6 +2467,13 @@ func (f *fsMachine) push(
 		}, backoffState
 	}
 
+	if resp.StatusCode == CHECKSUM_MISMATCH_STATUS {
+		// the peer has rolled back what it received
+		return &Event{
+			Name: "checksum-mismatch-pushing",
+			Args: &EventArgs{"err": string(responseBody)},
+		}, backoffState
+	}
 	if resp.StatusCode != 200 {
 		return &Event{
 			Name: "error-pushing-posting",
@@ -2309,11 +2500,11 @@ func (f *fsMachine) push(
 	)
 	if err != nil {
 		log.Printf(
-			"[actualPush] Error from zfs send of %s from %s => %s: %s, check zfs-send-errors.log",
+			"[actualPush] Error from send of %s from %s => %s: %s",
 			filesystemId, fromSnapshotId, toSnapshotId, err,
 		)
 		return &Event{
-			Name: "error-from-zfs-send",
+			Name: "error-from-send",
 			Args: &EventArgs{"err": err},
 		}, backoffState
 	}
@@ -2325,6 +2516,15 @@ func (f *fsMachine) push(
 	pipeWriter.Close()
 	pipeReader.Close()
 
+	if resume != nil && resume.SnapshotId != snapRange.toSnap.Id {
+		// the resumed stream only finished the snapshot it was interrupted
+		// in, carry on from there
+		return &Event{
+			Name: "resumed-push",
+			Args: &EventArgs{"snapshotId": resume.SnapshotId},
+		}, discoveringState
+	}
+
 	pollResult.Status = "finished"
 	err = updatePollResult(*transferRequestId, *pollResult)
 	if err != nil {
@@ -2542,51 +2742,33 @@ func pushPeerState(f *fsMachine) stateFn {
 
 func pullInitiatorState(f *fsMachine) stateFn {
 	f.transitionedTo("pullInitiatorState", "requesting")
-	// this is a write state. refuse to act if containers are running
-
-	// refuse to pull if we have any containers running
-	// TODO stop any containers being started, somehow. (by acquiring a lock?)
-	containers, err := f.containersRunning()
-	if err != nil {
-		log.Printf(
-			"Can't pull into filesystem while we can't list whether containers are using it",
-		)
-		f.innerResponses <- &Event{
-			Name: "error-listing-containers-during-pull",
-			Args: &EventArgs{"err": err},
-		}
-		return backoffState
-	}
-	if len(containers) > 0 {
-		log.Printf("Can't pull into filesystem while containers are using it")
-		f.innerResponses <- &Event{
-			Name: "cannot-pull-while-containers-running",
-			Args: &EventArgs{"containers": containers},
-		}
-		return backoffState
-	}
 
 	transferRequest := f.lastTransferRequest
 	transferRequestId := f.lastTransferRequestId
+	// an imported archive is only used once, however it goes
+	defer removeImportedArchive(transferRequest)
 
 	// TODO dedupe what follows wrt pushInitiatorState!
-	client := NewJsonRpcClient(
-		transferRequest.User,
-		transferRequest.Peer,
-		transferRequest.ApiKey,
-	)
+	client := transferRequest.peerClient()
 
 	var path PathToTopLevelFilesystem
-	// XXX Not propagating context here; not needed for auth, but would be nice
-	// for inter-cluster opentracing.
-	err = client.CallRemote(context.Background(),
-		"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
-			"RemoteNamespace":      transferRequest.RemoteNamespace,
-			"RemoteFilesystemName": transferRequest.RemoteName,
-			"RemoteCloneName":      transferRequest.RemoteBranchName,
-		},
-		&path,
-	)
+	var err error
+	if transferRequest.S3 != nil {
+		path, err = s3PathToTopLevelFilesystem(transferRequest)
+	} else if transferRequest.Archive != "" {
+		path, err = archivePathToTopLevelFilesystem(transferRequest)
+	} else {
+		// XXX Not propagating context here; not needed for auth, but would be nice
+		// for inter-cluster opentracing.
+		err = client.CallRemote(context.Background(),
+			"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
+				"RemoteNamespace":      transferRequest.RemoteNamespace,
+				"RemoteFilesystemName": transferRequest.RemoteName,
+				"RemoteCloneName":      transferRequest.RemoteBranchName,
+			},
+			&path,
+		)
+	}
 	if err != nil {
 		f.innerResponses <- &Event{
 			Name: "cant-rpc-deduce-path",
@@ -2611,18 +2793,58 @@ func pullInitiatorState(f *fsMachine) stateFn {
 		return backoffState
 	}
 
+	// this is a write state. refuse to pull if we have any containers running
+	// TODO stop any containers being started, somehow. (by acquiring a lock?)
+	containers, err := f.containersRunning()
+	if err != nil {
+		log.Printf(
+			"Can't pull into filesystem while we can't list whether containers are using it",
+		)
+		f.updateTransfer("error", fmt.Sprintf("Can't list containers using the dot: %s", err))
+		f.innerResponses <- &Event{
+			Name: "error-listing-containers-during-pull",
+			Args: &EventArgs{"err": err},
+		}
+		return backoffState
+	}
+	if len(containers) > 0 {
+		log.Printf("Can't pull into filesystem while containers are using it")
+		f.updateTransfer("error", "Can't pull into a dot while containers are using it")
+		f.innerResponses <- &Event{
+			Name: "cannot-pull-while-containers-running",
+			Args: &EventArgs{"containers": containers},
+		}
+		return backoffState
+	}
+
 	// iterate over the path, attempting to pull each clone in turn.
 	responseEvent, nextState := f.applyPath(path, func(f *fsMachine,
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 		transferRequestId string, pollResult *TransferPollResult,
 		client *JsonRpcClient, transferRequest *TransferRequest,
 	) (*Event, stateFn) {
+		if transferRequest.Archive != "" {
+			return f.archivePull(
+				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				transferRequestId, pollResult, client, transferRequest,
+			)
+		}
+		if transferRequest.S3 != nil {
+			return f.s3Pull(
+				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				transferRequestId, pollResult, client, transferRequest,
+			)
+		}
 		return f.retryPull(
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
 			transferRequestId, pollResult, client, transferRequest,
 		)
 	}, transferRequestId, &pollResult, client, &transferRequest)
 
+	if transferRequest.S3 == nil && transferRequest.Archive == "" && transferSucceeded(responseEvent) {
+		f.pullTags(client, path.TopLevelFilesystemId, transferRequest)
+	}
+
 	f.innerResponses <- responseEvent
 	return nextState
 }
@@ -2737,7 +2959,7 @@ func (f *fsMachine) retryPull(
 		}, backoffState
 	}
 
-	var retry int
+	var retry, resumes int
 	var responseEvent *Event
 	var nextState stateFn
 	for retry < 5 {
@@ -2750,6 +2972,13 @@ func (f *fsMachine) retryPull(
 			log.Printf("[actualPull] Successful pull!")
 			return responseEvent, nextState
 		}
+		// each resume finishes a snapshot, so carry straight on, but not
+		// forever if the peer keeps interrupting us
+		if responseEvent.Name == "resumed-pull" && resumes < 5 {
+			resumes++
+			log.Printf("[actualPull] Resumed pull got us to %s, pulling the rest", responseEvent)
+			continue
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -2868,11 +3097,17 @@ func (f *fsMachine) applyPath(
 
 	log.Printf("[applyPath] applying path %#v", path)
 
+	// the last leg goes up to the requested commit, or the latest one if
+	// none was
+	targetCommit := ""
+	if transferRequest != nil {
+		targetCommit = transferRequest.TargetCommit
+	}
+
 	if len(path.Clones) == 0 {
-		// just pushing a master branch to its latest snapshot
-		// do a push with empty origin and empty target snapshot
-		// TODO parametrize "push to snapshot" and expose in the UI
-		firstSnapshot = ""
+		// just pushing a master branch, to its latest snapshot unless asked
+		// otherwise
+		firstSnapshot = targetCommit
 	} else {
 		// push the master branch up to the first snapshot
 		firstSnapshot = path.Clones[0].Clone.Origin.SnapshotId
@@ -2921,6 +3156,8 @@ func (f *fsMachine) applyPath(
 			// last item so the guard evaluates to false; if we're on the first
 			// item, 2 > 1 is true, so guard is true.
 			nextOrigin = path.Clones[i+1].Clone.Origin
+		} else {
+			nextOrigin.SnapshotId = targetCommit
 		}
 		log.Printf(
 			"[applyPath,i] calling transferFn with fF=%v, fS=%v, tF=%v, tS=%v",
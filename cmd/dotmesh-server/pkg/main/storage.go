@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// A StorageBackend is the thing that actually stores the data in dots. The
+// state machines, replication handlers and RPC layer talk to it in terms of
+// filesystem ids and snapshot ids, and never need to know what commands (if
+// any) are run underneath.
+//
+// fromSnapshotId in Send and PredictSize follows the same conventions as the
+// replication URLs: "" or START_SNAPSHOT means "from the start of the
+// filesystem", "<filesystemId>@<snapshotId>" means "incrementally from a
+// clone's origin snapshot", and anything else is a snapshot of
+// toFilesystemId.
+type StorageBackend interface {
+	// Name of the backend, e.g. "zfs".
+	Name() string
+
+	// A stable identifier for the local storage pool, used as this node's id.
+	PoolId() (string, error)
+	// Ids of all filesystems which exist locally, creating any root
+	// structures the backend needs if they don't exist yet.
+	ListFilesystems() ([]string, error)
+	// Synchronously inspect a filesystem: does it exist, is it mounted, what
+	// snapshots (and snapshot metadata) does it have.
+	Discover(filesystemId string) (*filesystem, error)
+
+	Create(filesystemId string) error
+	Destroy(filesystemId string) error
+	Mount(filesystemId string) error
+	Unmount(filesystemId string) error
+
+	// Take a snapshot, recording meta against it.
+	Snapshot(filesystemId, snapshotId string, meta metadata) error
+	// Replace the metadata recorded against an existing snapshot (used when
+	// applying a replication prelude).
+	SetSnapshotMetadata(filesystemId, snapshotId string, meta metadata) error
+	// Roll back to snapshotId, discarding any later snapshots.
+	Rollback(filesystemId, snapshotId string) error
+	// Destroy one snapshot, which mustn't be the origin of a clone.
+	DestroySnapshot(filesystemId, snapshotId string) error
+	// Create newFilesystemId as a writable copy of filesystemId@snapshotId.
+	Clone(filesystemId, snapshotId, newFilesystemId string) error
+	// A directory holding the files in filesystemId@snapshotId (or in the
+	// working state of filesystemId, if snapshotId is ""), for reading only.
+	SnapshotPath(filesystemId, snapshotId string) (string, error)
+
+	// How many bytes has the filesystem diverged from latestSnapshotId, and
+	// how many bytes does it take up in total?
+	SizeInfo(filesystemId, latestSnapshotId string) (dirtyBytes int64, sizeBytes int64, err error)
+
+	// Can Send write streams of blocks as they're compressed on disk, rather
+	// than decompressing them first (and can Receive read them)?
+	CompressedStreams() bool
+	// Estimate how many bytes Send will write for the same arguments.
+	PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, compressed bool) (int64, error)
+	// Write a replication stream of toFilesystemId up to toSnapshotId into
+	// stream, blocking until it has all been written. compressed asks for a
+	// compressed stream, and is only set if CompressedStreams is true on both
+	// ends.
+	Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, compressed bool, stream io.Writer) error
+	// Apply a replication stream produced by Send on another node to
+	// filesystemId, blocking until stream is exhausted. If the stream is cut
+	// off part way through, backends which support it keep what they got so
+	// that the transfer can be resumed.
+	Receive(filesystemId string, stream io.Reader) error
+
+	// An opaque token describing how much of an interrupted Receive into
+	// filesystemId made it, or "" if there isn't one (or the backend can't
+	// resume).
+	ResumeToken(filesystemId string) (string, error)
+	// Throw away whatever an interrupted Receive left behind, so that a
+	// fresh stream can be received.
+	AbortResume(filesystemId string) error
+	// On the sending node, work out what a resumed stream for a token from
+	// the receiving node would contain.
+	InspectResumeToken(token string) (*ResumeInfo, error)
+	// Write the rest of the stream described by token into stream.
+	SendResume(token string, stream io.Writer) error
+}
+
+// What a resumed replication stream contains.
+type ResumeInfo struct {
+	// the snapshot being sent when the stream was interrupted. resuming only
+	// finishes that snapshot, any after it need another stream.
+	FilesystemId string
+	SnapshotId   string
+	// bytes the receiver already has, which won't be sent again
+	SkippedBytes int64
+	// bytes left to send
+	Size int64
+}
+
+// Construct the storage backend with the given name. The empty string means
+// the default (zfs).
+func NewStorageBackend(name string) (StorageBackend, error) {
+	switch name {
+	case "", "zfs":
+		return &ZFSBackend{}, nil
+	case "directory":
+		root := os.Getenv("DIRECTORY_BACKEND_ROOT")
+		if root == "" {
+			root = "/var/lib/dotmesh/directory"
+		}
+		return NewDirectoryBackend(root), nil
+	case "btrfs":
+		root := os.Getenv("BTRFS_BACKEND_ROOT")
+		if root == "" {
+			root = "/var/lib/dotmesh/btrfs"
+		}
+		return NewBtrfsBackend(root), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend '%s'", name)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Tags are names for commits, e.g. "v1.2" or "before-migration", which can be
+// used anywhere a commit id can. They're kept in etcd against the dot's top
+// level filesystem id, one key per tag, so a name is unique across all of a
+// dot's branches. Tags are immutable: once made, a tag can only be deleted,
+// never moved. They go along with the commits they name when a dot is pushed
+// or pulled.
+type Tag struct {
+	Name    string
+	Commit  string
+	Author  string
+	Created time.Time
+}
+
+var tagNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// HEAD, HEAD^ and so on already mean something
+var headRefRegex = regexp.MustCompile(`^HEAD\^*$`)
+
+// and so do commit ids, which a tag mustn't be able to stand in for
+var commitIdRegex = regexp.MustCompile(
+	`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`,
+)
+
+func validateTagName(name string) error {
+	if !tagNameRegex.MatchString(name) || len(name) > 100 {
+		return fmt.Errorf(
+			"Invalid tag name '%s', tags must start with a letter or digit and contain only letters, digits, '.', '_' and '-'",
+			name,
+		)
+	}
+	if headRefRegex.MatchString(name) || commitIdRegex.MatchString(name) {
+		return fmt.Errorf("'%s' can't be used as a tag name", name)
+	}
+	return nil
+}
+
+func tagsKey(topLevelFilesystemId string) string {
+	return fmt.Sprintf("%s/filesystems/tags/%s", ETCD_PREFIX, topLevelFilesystemId)
+}
+
+func tagKey(topLevelFilesystemId, name string) string {
+	return fmt.Sprintf("%s/%s", tagsKey(topLevelFilesystemId), name)
+}
+
+// A dot's tags, sorted by name.
+func getTags(topLevelFilesystemId string) ([]Tag, error) {
+	tags := []Tag{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return tags, err
+	}
+	resp, err := kapi.Get(
+		context.Background(), tagsKey(topLevelFilesystemId),
+		&client.GetOptions{Recursive: true, Sort: true},
+	)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return tags, nil
+		}
+		return tags, err
+	}
+	for _, node := range resp.Node.Nodes {
+		tag := Tag{}
+		err = json.Unmarshal([]byte(node.Value), &tag)
+		if err != nil {
+			log.Printf("[getTags] Ignoring unreadable tag %s: %s", node.Key, err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+type tagExistsError struct {
+	existing Tag
+}
+
+func (e tagExistsError) Error() string {
+	return fmt.Sprintf(
+		"Tag %s already exists (on commit %s), tags can't be moved", e.existing.Name, e.existing.Commit,
+	)
+}
+
+// Make a tag, failing with a tagExistsError if there's already one of that
+// name.
+func createTag(topLevelFilesystemId string, tag Tag) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(tag)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(), tagKey(topLevelFilesystemId, tag.Name), string(serialized),
+		&client.SetOptions{PrevExist: client.PrevNoExist},
+	)
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeNodeExist {
+			existing, lookupErr := lookupTag(topLevelFilesystemId, tag.Name)
+			if lookupErr != nil || existing == nil {
+				return fmt.Errorf("Tag %s already exists, tags can't be moved", tag.Name)
+			}
+			return tagExistsError{*existing}
+		}
+		return err
+	}
+	return nil
+}
+
+// The tag called name, or nil if there isn't one.
+func lookupTag(topLevelFilesystemId, name string) (*Tag, error) {
+	if validateTagName(name) != nil {
+		return nil, nil
+	}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(context.Background(), tagKey(topLevelFilesystemId, name), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tag := &Tag{}
+	err = json.Unmarshal([]byte(resp.Node.Value), tag)
+	return tag, err
+}
+
+func deleteTag(topLevelFilesystemId, name string) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(context.Background(), tagKey(topLevelFilesystemId, name), nil)
+	if err != nil && client.IsKeyNotFound(err) {
+		return fmt.Errorf("No such tag %s", name)
+	}
+	return err
+}
+
+// The commit ref names, if it's a tag of the dot, or ref itself otherwise.
+func resolveTag(topLevelFilesystemId, ref string) (string, error) {
+	tag, err := lookupTag(topLevelFilesystemId, ref)
+	if err != nil {
+		return "", err
+	}
+	if tag == nil {
+		return ref, nil
+	}
+	return tag.Commit, nil
+}
+
+// The ids of a dot's tagged commits.
+func taggedCommits(topLevelFilesystemId string) (map[string]bool, error) {
+	tags, err := getTags(topLevelFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	commits := map[string]bool{}
+	for _, tag := range tags {
+		commits[tag.Commit] = true
+	}
+	return commits, nil
+}
+
+// Is commit in one of the dot's filesystems?
+func (state *InMemoryState) commitInDot(topLevelFilesystemId, commit string) bool {
+	filesystemIds := []string{topLevelFilesystemId}
+	for _, clone := range state.registry.ClonesFor(topLevelFilesystemId) {
+		filesystemIds = append(filesystemIds, clone.FilesystemId)
+	}
+	for _, filesystemId := range filesystemIds {
+		snaps, err := state.snapshotsForCurrentMaster(filesystemId)
+		if err != nil {
+			continue
+		}
+		for _, snap := range snaps {
+			if snap.Id == commit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Store tags which came from another cluster along with their commits. Tags
+// of commits which didn't come too are left out, as are tags which clash with
+// ones made here, so that existing tags never change.
+func (state *InMemoryState) replicateTags(topLevelFilesystemId string, tags []Tag) (int, error) {
+	stored := 0
+	for _, tag := range tags {
+		if validateTagName(tag.Name) != nil {
+			log.Printf("[replicateTags] Ignoring tag with invalid name %q", tag.Name)
+			continue
+		}
+		if !state.commitInDot(topLevelFilesystemId, tag.Commit) {
+			continue
+		}
+		err := createTag(topLevelFilesystemId, tag)
+		if err != nil {
+			if existing, ok := err.(tagExistsError); ok {
+				if existing.existing.Commit != tag.Commit {
+					log.Printf(
+						"[replicateTags] Not replicating tag %s of %s onto commit %s, it's already on %s here",
+						tag.Name, topLevelFilesystemId, tag.Commit, existing.existing.Commit,
+					)
+				}
+				continue
+			}
+			return stored, err
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// Rolling a filesystem back destroys the commits after the one it's rolled
+// back to, so refuse to if any of them are tagged.
+func (state *InMemoryState) refuseRollbackPastTags(topLevelFilesystemId, filesystemId, rollbackTo string) error {
+	snaps, err := state.snapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return err
+	}
+	tags, err := getTags(topLevelFilesystemId)
+	if err != nil {
+		return err
+	}
+	after := map[string]bool{}
+	found := false
+	for _, snap := range snaps {
+		if found {
+			after[snap.Id] = true
+		}
+		found = found || snap.Id == rollbackTo
+	}
+	doomed := []string{}
+	for _, tag := range tags {
+		if after[tag.Commit] {
+			doomed = append(doomed, tag.Name)
+		}
+	}
+	if len(doomed) > 0 {
+		return fmt.Errorf(
+			"Can't reset to %s, it would destroy tagged commits (%s). Delete the tags first.",
+			rollbackTo, strings.Join(doomed, ", "),
+		)
+	}
+	return nil
+}
+
+func transferSucceeded(e *Event) bool {
+	return e.Name == "finished-push" || e.Name == "finished-pull" || e.Name == "peer-up-to-date"
+}
+
+// Send a dot's tags along after pushing it. Failing to only loses the tags,
+// which the next push will try again, so it's logged rather than failing the
+// push.
+func (f *fsMachine) pushTags(client *JsonRpcClient, topLevelFilesystemId string, transferRequest TransferRequest) {
+	tags, err := getTags(topLevelFilesystemId)
+	if err != nil {
+		log.Printf("[pushTags] Unable to get tags of %s: %s", topLevelFilesystemId, err)
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	var stored int
+	err = client.CallRemote(context.Background(), "DotmeshRPC.ReplicateTags", map[string]interface{}{
+		"Namespace": transferRequest.RemoteNamespace,
+		"Name":      transferRequest.RemoteName,
+		"Tags":      tags,
+	}, &stored)
+	if err != nil {
+		log.Printf("[pushTags] Unable to push tags of %s: %s", topLevelFilesystemId, err)
+		return
+	}
+	log.Printf("[pushTags] Pushed %d new tags of %s", stored, topLevelFilesystemId)
+}
+
+// Fetch a dot's tags after pulling it, the same way.
+func (f *fsMachine) pullTags(client *JsonRpcClient, topLevelFilesystemId string, transferRequest TransferRequest) {
+	var tags []Tag
+	err := client.CallRemote(context.Background(), "DotmeshRPC.Tags", VolumeName{
+		transferRequest.RemoteNamespace, transferRequest.RemoteName,
+	}, &tags)
+	if err != nil {
+		log.Printf("[pullTags] Unable to get remote tags of %s: %s", topLevelFilesystemId, err)
+		return
+	}
+	stored, err := f.state.replicateTags(topLevelFilesystemId, tags)
+	if err != nil {
+		log.Printf("[pullTags] Unable to store tags of %s: %s", topLevelFilesystemId, err)
+		return
+	}
+	log.Printf("[pullTags] Pulled %d new tags of %s", stored, topLevelFilesystemId)
+}
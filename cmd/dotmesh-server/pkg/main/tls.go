@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How port 6969 is served, from DOTMESH_TLS:
+//
+//	off         plain HTTP, as it always was
+//	transition  HTTPS and plain HTTP on the same port, so that clients and
+//	            peers can move to HTTPS one at a time (the default)
+//	on          HTTPS only, apart from /status for health checks
+//
+// The certificate is DOTMESH_TLS_CERT and DOTMESH_TLS_KEY if they're set, or
+// else the one 'dm cluster init' made in the PKI directory. Nodes in a cluster
+// check each other's certificates against DOTMESH_TLS_CA, or the cluster's CA
+// in the PKI directory, or if neither is set the system's usual CAs, including
+// the hostname. Without a certificate, it's plain HTTP whatever DOTMESH_TLS
+// says.
+const (
+	TLS_OFF        = "off"
+	TLS_TRANSITION = "transition"
+	TLS_ON         = "on"
+)
+
+type tlsSettings struct {
+	mode   string
+	config *tls.Config
+	// the private CA to check our peers' certificates against, nil for the
+	// system's usual CAs
+	clusterCAs *x509.CertPool
+}
+
+var serverTLS tlsSettings
+var serverTLSOnce sync.Once
+
+func getTLSSettings() tlsSettings {
+	serverTLSOnce.Do(func() {
+		var err error
+		serverTLS, err = loadTLSSettings()
+		if err != nil {
+			log.Fatalf("[getTLSSettings] %s", err)
+		}
+		log.Printf("[getTLSSettings] TLS is %s", serverTLS.mode)
+	})
+	return serverTLS
+}
+
+func loadTLSSettings() (tlsSettings, error) {
+	settings := tlsSettings{mode: os.Getenv("DOTMESH_TLS")}
+	if settings.mode == "" {
+		settings.mode = TLS_TRANSITION
+	}
+	if settings.mode != TLS_OFF && settings.mode != TLS_TRANSITION && settings.mode != TLS_ON {
+		return settings, fmt.Errorf("Invalid DOTMESH_TLS '%s', try off, transition or on", settings.mode)
+	}
+	if settings.mode == TLS_OFF {
+		return settings, nil
+	}
+
+	pkiPath := os.Getenv("DOTMESH_PKI_PATH")
+	if pkiPath == "" {
+		pkiPath = "/pki"
+	}
+	certFile, keyFile, caFile := os.Getenv("DOTMESH_TLS_CERT"), os.Getenv("DOTMESH_TLS_KEY"), os.Getenv("DOTMESH_TLS_CA")
+	userSupplied := certFile != "" || keyFile != ""
+	if !userSupplied {
+		certFile = fmt.Sprintf("%s/apiserver.pem", pkiPath)
+		keyFile = fmt.Sprintf("%s/apiserver-key.pem", pkiPath)
+		if caFile == "" {
+			caFile = fmt.Sprintf("%s/ca.pem", pkiPath)
+		}
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if userSupplied {
+			return settings, fmt.Errorf("Can't load DOTMESH_TLS_CERT and DOTMESH_TLS_KEY: %s", err)
+		}
+		log.Printf("[loadTLSSettings] No certificate (%s), serving plain HTTP", err)
+		settings.mode = TLS_OFF
+		return settings, nil
+	}
+
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return settings, fmt.Errorf("Can't read CA certificate: %s", err)
+		}
+		settings.clusterCAs = x509.NewCertPool()
+		if !settings.clusterCAs.AppendCertsFromPEM(caPem) {
+			return settings, fmt.Errorf("No certificates in %s", caFile)
+		}
+		// send the CA along with our certificate, so that dm can pin it when
+		// it's added as a remote
+		block, _ := pem.Decode(caPem)
+		if block != nil && len(certificate.Certificate) == 1 {
+			certificate.Certificate = append(certificate.Certificate, block.Bytes)
+		}
+	}
+	settings.config = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	return settings, nil
+}
+
+// Listen on address, handing out TLS connections for clients which start with
+// a TLS handshake and plain ones for those which don't.
+func listenTLSAndPlain(address string, config *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &sniffingListener{
+		Listener: listener,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+type sniffingListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan net.Conn
+	errs   chan error
+}
+
+func (l *sniffingListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		// a slow client mustn't hold up everyone else
+		go l.sniff(conn)
+	}
+}
+
+func (l *sniffingListener) sniff(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	// 0x16 is the record type of a TLS handshake
+	if first[0] == 0x16 {
+		l.conns <- tls.Server(peeked, l.config)
+	} else {
+		l.conns <- peeked
+	}
+}
+
+func (l *sniffingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Refuse plain HTTP requests, apart from health checks.
+func requireTLS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil && r.URL.Path != "/status" {
+			http.Error(w, "This server only accepts HTTPS.", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Check a certificate was issued by one of roots, but not which host it was
+// issued for. For private CAs which only issue certificates for dotmesh
+// clusters, like the one 'dm cluster init' makes, that's what matters, and the
+// names in the certificate often aren't the ones peers and clients know the
+// cluster by. Never use it with the usual CAs, which will issue a certificate
+// to anyone.
+func verifyIssuer(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if roots == nil {
+			return fmt.Errorf("No CA to check the certificate against")
+		}
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("No certificate presented")
+		}
+		certs := []*x509.Certificate{}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+func httpClientWithTLS(config *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}}
+}
+
+// For talking to other nodes in our cluster.
+func internalHTTPClient() *http.Client {
+	clusterCAs := getTLSSettings().clusterCAs
+	if clusterCAs == nil {
+		// a publicly issued certificate, so it has to be for the right host
+		return httpClientWithTLS(&tls.Config{})
+	}
+	return httpClientWithTLS(&tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyIssuer(clusterCAs),
+	})
+}
+
+type cachedScheme struct {
+	scheme string
+	until  time.Time
+}
+
+var internalSchemes = map[string]cachedScheme{}
+var internalSchemesLock sync.Mutex
+
+// Whether to use "https" or "http" for another node in our cluster. While
+// moving to TLS, that depends on whether it's been upgraded yet.
+func internalScheme(host string) string {
+	switch getTLSSettings().mode {
+	case TLS_OFF:
+		return "http"
+	case TLS_ON:
+		return "https"
+	}
+	internalSchemesLock.Lock()
+	cached, ok := internalSchemes[host]
+	internalSchemesLock.Unlock()
+	if ok && time.Now().Before(cached.until) {
+		return cached.scheme
+	}
+	conn, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: 10 * time.Second}, "tcp", net.JoinHostPort(host, "6969"),
+		&tls.Config{InsecureSkipVerify: true},
+	)
+	scheme := "https"
+	if err == nil {
+		conn.Close()
+	} else if _, ok := err.(tls.RecordHeaderError); ok {
+		scheme = "http"
+	} else {
+		// try again next time, the request will say what's wrong
+		return scheme
+	}
+	internalSchemesLock.Lock()
+	internalSchemes[host] = cachedScheme{scheme: scheme, until: time.Now().Add(5 * time.Minute)}
+	internalSchemesLock.Unlock()
+	return scheme
+}
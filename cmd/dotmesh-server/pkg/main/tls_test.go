@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a CA, and a certificate for a server it's issued
+func testCertificates(t *testing.T) (*x509.Certificate, tls.Certificate) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "apiserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key}
+}
+
+func TestListenTLSAndPlain(t *testing.T) {
+	ca, certificate := testCertificates(t)
+	listener, err := listenTLSAndPlain("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	address := listener.Addr().String()
+
+	resp, err := http.Get("http://" + address + "/")
+	if err != nil {
+		t.Fatalf("Plain HTTP failed: %s", err)
+	}
+	resp.Body.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	pinned := httpClientWithTLS(&tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verifyIssuer(roots)})
+	resp, err = pinned.Get("https://" + address + "/")
+	if err != nil {
+		t.Fatalf("HTTPS with the server's CA pinned failed: %s", err)
+	}
+	resp.Body.Close()
+
+	otherCa, _ := testCertificates(t)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCa)
+	wrong := httpClientWithTLS(&tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verifyIssuer(otherRoots)})
+	_, err = wrong.Get("https://" + address + "/")
+	if err == nil {
+		t.Error("HTTPS with a different CA pinned succeeded")
+	}
+
+	// without a private CA, the hostname has to be checked too
+	unpinned := httpClientWithTLS(&tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verifyIssuer(nil)})
+	_, err = unpinned.Get("https://" + address + "/")
+	if err == nil {
+		t.Error("Checking the issuer without a CA succeeded")
+	}
+}
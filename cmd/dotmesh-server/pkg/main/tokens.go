@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+	rpc "github.com/gorilla/rpc/v2"
+	rpcjson "github.com/gorilla/rpc/v2/json2"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+// API tokens are extra credentials a user can hand out, e.g. to a CI job,
+// instead of their ApiKey. Each one has a name, a scope:
+//
+//	read   anything which doesn't change anything, including pulling
+//	push   as read, except pulling, plus pushing to the given dots and
+//	       namespaces
+//	admin  anything the ApiKey can do
+//
+// and maybe an expiry. They're used in place of the password along with the
+// user's name, and look like "dmt_<id>_<secret>". Only a hash of the secret
+// is kept, in etcd under tokens/<id>. Revoking a token deletes it.
+//
+// No token can do what needs a password, see its user's ApiKey, or manage
+// tokens.
+type ApiToken struct {
+	Id     string
+	UserId string
+	Name   string
+	Scope  string
+	// what a push token can push to, "namespace/name" dots and namespaces
+	Dots       []string `json:",omitempty"`
+	Namespaces []string `json:",omitempty"`
+	Created    time.Time
+	// zero if it doesn't expire, or hasn't been used
+	Expires  time.Time
+	LastUsed time.Time
+	// hex SHA-256 of the secret, never shown
+	SecretHash string `json:",omitempty"`
+}
+
+var apiTokenScopes = []string{"read", "push", "admin"}
+
+const API_TOKEN_PREFIX = "dmt_"
+
+// LastUsed is only updated this often, to save writing to etcd on every
+// request
+const API_TOKEN_LAST_USED_INTERVAL = time.Minute
+
+// how long expired tokens are kept around for 'dm token list' to show
+const API_TOKEN_EXPIRED_TTL = 30 * 24 * time.Hour
+
+func apiTokenKey(id string) string {
+	return fmt.Sprintf("%s/tokens/%s", ETCD_PREFIX, id)
+}
+
+func (t ApiToken) expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// A copy which is safe to show, without the secret's hash.
+func (t ApiToken) safe() ApiToken {
+	t.SecretHash = ""
+	return t
+}
+
+func (t ApiToken) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, " \t\n/") {
+		return fmt.Errorf("Invalid token name '%s'", t.Name)
+	}
+	known := false
+	for _, scope := range apiTokenScopes {
+		known = known || t.Scope == scope
+	}
+	if !known {
+		return fmt.Errorf(
+			"Unknown token scope '%s', try one of %s", t.Scope, strings.Join(apiTokenScopes, ", "),
+		)
+	}
+	if t.Scope != "push" && (len(t.Dots) > 0 || len(t.Namespaces) > 0) {
+		return fmt.Errorf("Only push tokens are limited to dots and namespaces")
+	}
+	if t.Scope == "push" && len(t.Dots) == 0 && len(t.Namespaces) == 0 {
+		return fmt.Errorf("A push token needs at least one dot or namespace to push to")
+	}
+	for _, dot := range t.Dots {
+		shrapnel := strings.SplitN(dot, "/", 2)
+		if len(shrapnel) != 2 {
+			return fmt.Errorf("Please give dots to push to as namespace/name, got '%s'", dot)
+		}
+		err := requireValidVolumeName(VolumeName{shrapnel[0], shrapnel[1]})
+		if err != nil {
+			return err
+		}
+	}
+	for _, namespace := range t.Namespaces {
+		if namespace == "" || strings.ContainsAny(namespace, ":/") {
+			return fmt.Errorf("Invalid namespace name '%s'", namespace)
+		}
+	}
+	return nil
+}
+
+func saveApiToken(token ApiToken) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	options := &client.SetOptions{}
+	if !token.Expires.IsZero() {
+		options.TTL = time.Until(token.Expires) + API_TOKEN_EXPIRED_TTL
+	}
+	_, err = kapi.Set(context.Background(), apiTokenKey(token.Id), string(serialized), options)
+	return err
+}
+
+// Make a token, returning it and the string to authenticate with, which
+// can't be recovered later.
+func createApiToken(token ApiToken) (ApiToken, string, error) {
+	err := token.validate()
+	if err != nil {
+		return token, "", err
+	}
+	existing, err := userApiTokens(token.UserId)
+	if err != nil {
+		return token, "", err
+	}
+	for _, other := range existing {
+		if other.Name == token.Name {
+			return token, "", fmt.Errorf("You already have a token called '%s'", token.Name)
+		}
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return token, "", err
+	}
+	secret := make([]byte, API_KEY_BYTES)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return token, "", err
+	}
+	token.Id = id.String()
+	token.Created = time.Now().UTC()
+	token.LastUsed = time.Time{}
+	token.SecretHash = sha256Hex(secret)
+	err = saveApiToken(token)
+	if err != nil {
+		return token, "", err
+	}
+	return token, API_TOKEN_PREFIX + token.Id + "_" + hex.EncodeToString(secret), nil
+}
+
+func getApiToken(id string) (ApiToken, error) {
+	token := ApiToken{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return token, err
+	}
+	resp, err := kapi.Get(context.Background(), apiTokenKey(id), nil)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &token)
+	return token, err
+}
+
+// A user's tokens, oldest first.
+func userApiTokens(userId string) ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return tokens, err
+	}
+	resp, err := kapi.Get(
+		context.Background(), fmt.Sprintf("%s/tokens", ETCD_PREFIX), &client.GetOptions{Recursive: true},
+	)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return tokens, nil
+		}
+		return tokens, err
+	}
+	for _, node := range resp.Node.Nodes {
+		token := ApiToken{}
+		err = json.Unmarshal([]byte(node.Value), &token)
+		if err != nil {
+			log.Printf("[userApiTokens] Ignoring unreadable token %s: %s", node.Key, err)
+			continue
+		}
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens, nil
+}
+
+// Revoke one of a user's tokens, by id or name.
+func revokeApiToken(userId, idOrName string) (ApiToken, error) {
+	tokens, err := userApiTokens(userId)
+	if err != nil {
+		return ApiToken{}, err
+	}
+	for _, token := range tokens {
+		if token.Id == idOrName || token.Name == idOrName {
+			kapi, err := getEtcdKeysApi()
+			if err != nil {
+				return token, err
+			}
+			_, err = kapi.Delete(context.Background(), apiTokenKey(token.Id), nil)
+			return token, err
+		}
+	}
+	return ApiToken{}, fmt.Errorf("No such token '%s'", idOrName)
+}
+
+func isApiToken(password string) bool {
+	return strings.HasPrefix(password, API_TOKEN_PREFIX)
+}
+
+// The token password authenticates username with, or nil if it doesn't
+// (because it's wrong, revoked, expired or someone else's).
+func checkApiToken(username, password string) (*ApiToken, error) {
+	shrapnel := strings.SplitN(strings.TrimPrefix(password, API_TOKEN_PREFIX), "_", 2)
+	if len(shrapnel) != 2 || strings.Contains(shrapnel[0], "/") {
+		return nil, nil
+	}
+	secret, err := hex.DecodeString(shrapnel[1])
+	if err != nil {
+		return nil, nil
+	}
+	token, err := getApiToken(shrapnel[0])
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(sha256Hex(secret))) != 1 ||
+		token.expired() {
+		return nil, nil
+	}
+	user, err := GetUserByName(username)
+	if err != nil || user.Id != token.UserId {
+		return nil, nil
+	}
+	if time.Since(token.LastUsed) > API_TOKEN_LAST_USED_INTERVAL {
+		token.LastUsed = time.Now().UTC()
+		go func(token ApiToken) {
+			err := saveApiToken(token)
+			if err != nil {
+				log.Printf("[checkApiToken] Unable to update last use of %s: %s", token.Id, err)
+			}
+		}(token)
+	}
+	return &token, nil
+}
+
+// The token a request was authenticated with, if it was.
+func requestApiToken(r *http.Request) *ApiToken {
+	token, _ := r.Context().Value("api-token").(*ApiToken)
+	return token
+}
+
+// Reject the request if it was authenticated with a token, for things only
+// the user themselves should do.
+func refuseApiTokens(r *http.Request) error {
+	if token := requestApiToken(r); token != nil {
+		return fmt.Errorf(
+			"API tokens can't be used for this, but '%s' was. Please use a password or API key.",
+			token.Name,
+		)
+	}
+	return nil
+}
+
+func (t *ApiToken) allowsPushTo(name VolumeName) bool {
+	for _, namespace := range t.Namespaces {
+		if name.Namespace == namespace {
+			return true
+		}
+	}
+	for _, dot := range t.Dots {
+		if dot == name.Namespace+"/"+name.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *ApiToken) refusal(what string) error {
+	return fmt.Errorf("API token '%s' has %s scope, which doesn't allow %s", t.Name, t.Scope, what)
+}
+
+// Whether the token's scope allows calling method with args (as decoded by
+// rpcArgs). auditedRPCs are the ones which change things.
+func (t *ApiToken) allowsRPC(method string, args interface{}) error {
+	if t.Scope == "admin" || !auditedRPCs[method] {
+		return nil
+	}
+	if t.Scope == "push" {
+		fields, _ := args.(map[string]interface{})
+		field := func(name string) string {
+			value, _ := fields[name].(string)
+			return value
+		}
+		var name VolumeName
+		switch method {
+		case "RegisterFilesystem":
+			name = VolumeName{field("Namespace"), field("TopLevelFilesystemName")}
+		case "RegisterTransfer":
+			if field("Direction") == "push" {
+				name = VolumeName{field("RemoteNamespace"), field("RemoteName")}
+			}
+		case "ReplicateTags":
+			name = VolumeName{field("Namespace"), field("Name")}
+		}
+		if name.Name != "" {
+			if t.allowsPushTo(name) {
+				return nil
+			}
+			return t.refusal("pushing to " + name.String())
+		}
+	}
+	return t.refusal(method)
+}
+
+// Refuse RPCs which the scope of the token they're authenticated with doesn't
+// allow, with a JSON-RPC error so that clients show it.
+func tokenScopedRPCs(server *rpc.Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestApiToken(r)
+		if token == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		body, err := readAndRestoreBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := struct {
+			Method string
+			Params json.RawMessage
+			Id     *json.RawMessage
+		}{}
+		json.Unmarshal(body, &request)
+		pieces := strings.SplitN(request.Method, ".", 2)
+		if len(pieces) != 2 || !server.HasMethod(request.Method) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		err = token.allowsRPC(pieces[1], rpcArgs(request.Params))
+		if err != nil {
+			log.Printf("[tokenScopedRPCs] Refusing %s: %s", request.Method, err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(struct {
+				Version string           `json:"jsonrpc"`
+				Error   *rpcjson.Error   `json:"error"`
+				Id      *json.RawMessage `json:"id"`
+			}{"2.0", &rpcjson.Error{Code: rpcjson.E_SERVER, Message: err.Error()}, request.Id})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Refuse requests to an HTTP endpoint (as named in runServer) which the scope
+// of the token they're authenticated with doesn't allow.
+func (state *InMemoryState) tokenScopedHTTP(endpoint string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestApiToken(r)
+		if token == nil || token.Scope == "admin" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		var err error
+		switch endpoint {
+		case "zfs-sender", "archive-exporter", "file-server":
+			if token.Scope != "read" {
+				err = token.refusal("pulling")
+			}
+		case "zfs-receiver":
+			err = token.refusal("pushing")
+			if token.Scope == "push" {
+				tlf, _, lookupErr := state.registry.LookupFilesystemById(mux.Vars(r)["filesystem"])
+				if lookupErr == nil && token.allowsPushTo(tlf.MasterBranch.Name) {
+					err = nil
+				} else if lookupErr == nil {
+					err = token.refusal("pushing to " + tlf.MasterBranch.Name.String())
+				}
+			}
+		default:
+			err = token.refusal(endpoint)
+		}
+		if err != nil {
+			log.Printf("[tokenScopedHTTP] Refusing %s: %s", endpoint, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
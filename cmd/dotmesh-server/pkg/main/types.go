@@ -15,6 +15,9 @@ type User struct {
 	ApiKey      string
 	CustomerId  string
 	CurrentPlan string
+	// who they are to an OpenID Connect provider, if they log in with one
+	OidcIssuer  string `json:",omitempty"`
+	OidcSubject string `json:",omitempty"`
 }
 
 type SafeUser struct {
@@ -79,6 +82,10 @@ type TopLevelFilesystem struct {
 	OtherBranches []DotmeshVolume
 	Owner         SafeUser
 	Collaborators []SafeUser
+	// collaborator user id => role, for collaborators who aren't writers
+	CollaboratorRoles map[string]string `json:",omitempty"`
+	// branch name => how it's protected, for protected branches
+	ProtectedBranches map[string]BranchProtection `json:",omitempty"`
 }
 
 type VolumesAndBranches struct {
@@ -142,6 +149,18 @@ type TransferPollResult struct {
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Set if the current segment picked up where an interrupted transfer
+	// left off, in which case Size and Sent don't include BytesSkipped.
+	Resumed      bool
+	BytesSkipped int64
+
+	// How the current segment's stream is compressed
+	Codec            string
+	CompressedStream bool // blocks sent as they're compressed on disk
+
+	// bytes per second the current segment is limited to, 0 if unlimited
+	BandwidthLimit int64
 }
 
 // A container for some state that is truly global to this process.
@@ -165,11 +184,14 @@ type InMemoryState struct {
 	registry                   *Registry
 	containers                 *DockerClient
 	containersLock             *sync.Mutex
+	storage                    StorageBackend
 	fetchRelatedContainersChan chan bool
 	interclusterTransfers      *map[string]TransferPollResult
 	interclusterTransfersLock  *sync.Mutex
 	globalDirtyCacheLock       *sync.Mutex
 	globalDirtyCache           *map[string]dirtyInfo
+	events                     *eventStream
+	audit                      *auditLog
 
 	debugPartialFailCreateFilesystem bool
 	versionInfo                      *VersionInfo
@@ -245,6 +267,23 @@ type TransferRequest struct {
 	RemoteBranchName string
 	// TODO could also include SourceSnapshot here
 	TargetCommit string // optional, "" means "latest"
+	// optional, codec to compress replication streams with, e.g. "zstd:6",
+	// "" means the server's default
+	Codec string
+	// optional, bytes per second to limit replication streams to, 0 means
+	// the server's default
+	BandwidthLimit int64
+	// whether Peer speaks HTTPS, and the CA its certificate is pinned to
+	// ("" for the usual ones)
+	PeerTLS    bool
+	PeerCACert string
+	// set when the remote is an S3 bucket rather than a dotmesh cluster, in
+	// which case Peer, User and ApiKey aren't used
+	S3 *S3Target
+	// set when importing an archive, the file it's been spooled to. Never
+	// decoded from JSON, so that clients can't point it at other files;
+	// startTransfer passes it alongside the request instead.
+	Archive string `json:"-"`
 }
 
 type EventArgs map[string]interface{}
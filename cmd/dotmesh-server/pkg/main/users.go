@@ -7,6 +7,9 @@ import (
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+
 	"github.com/coreos/etcd/client"
 	"github.com/nu7hatch/gouuid"
 	"golang.org/x/crypto/scrypt"
@@ -68,10 +71,14 @@ func NewUser(name, email, password string) (User, error) {
 		if user.Name == name {
 			return User{}, fmt.Errorf("Username already exists - contact help@dotmesh.io")
 		}
-		if user.Email == email {
+		if email != "" && user.Email == email {
 			return User{}, fmt.Errorf("Email already exists - contact help@dotmesh.io")
 		}
 	}
+	// users and organizations share namespaces
+	if _, _, err := getOrganization(name); err == nil {
+		return User{}, fmt.Errorf("Username already exists - contact help@dotmesh.io")
+	}
 
 	salt, hashedPassword, err := HashPassword(password)
 
@@ -257,15 +264,70 @@ func GetUserByCustomerId(id string) (User, error) {
 	return User{}, fmt.Errorf("User customerId=%v not found", id)
 }
 
+// What a collaborator on a dot can do with it, least powerful first:
+//
+//	reader      see it, clone and pull it
+//	writer      also commit, branch and push to it
+//	maintainer  also reset it
+//
+// Collaborators without a role (from before there were roles) are writers.
+var collaboratorRoles = []string{"reader", "writer", "maintainer"}
+
+func collaboratorRoleRank(role string) int {
+	for i, known := range collaboratorRoles {
+		if role == known {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateCollaboratorRole(role string) error {
+	if collaboratorRoleRank(role) < 0 {
+		return fmt.Errorf(
+			"Unknown role '%s', try one of %s", role, strings.Join(collaboratorRoles, ", "),
+		)
+	}
+	return nil
+}
+
+// The role of a collaborator on the dot, "" if they aren't one.
+func (t TopLevelFilesystem) CollaboratorRole(userId string) string {
+	for _, other := range t.Collaborators {
+		if other.Id == userId {
+			if role, ok := t.CollaboratorRoles[userId]; ok {
+				return role
+			}
+			return "writer"
+		}
+	}
+	return ""
+}
+
+// Whether the authenticated user can administer the dot: its owner, and the
+// admins of the organization it belongs to.
 func (t TopLevelFilesystem) AuthorizeOwner(ctx context.Context) (bool, error) {
-	return t.authorize(ctx, false)
+	return t.authorize(ctx, "", "admin")
 }
 
+// Whether they can reset it: also its maintainers.
+func (t TopLevelFilesystem) AuthorizeMaintainer(ctx context.Context) (bool, error) {
+	return t.authorize(ctx, "maintainer", "admin")
+}
+
+// Whether they can change it: also its writers, and the organization's.
 func (t TopLevelFilesystem) Authorize(ctx context.Context) (bool, error) {
-	return t.authorize(ctx, true)
+	return t.authorize(ctx, "writer", "writer")
+}
+
+// Whether they can see it: also its readers, and the organization's.
+func (t TopLevelFilesystem) AuthorizeRead(ctx context.Context) (bool, error) {
+	return t.authorize(ctx, "reader", "reader")
 }
 
-func (t TopLevelFilesystem) authorize(ctx context.Context, includeCollab bool) (bool, error) {
+// collabRole and orgRole are the least a collaborator or member of the
+// organization the dot belongs to needs, "" if no collaborator will do.
+func (t TopLevelFilesystem) authorize(ctx context.Context, collabRole, orgRole string) (bool, error) {
 	authenticatedUserId := ctx.Value("authenticated-user-id").(string)
 	if authenticatedUserId == "" {
 		return false, fmt.Errorf("No user found in context.")
@@ -283,14 +345,17 @@ func (t TopLevelFilesystem) authorize(ctx context.Context, includeCollab bool) (
 	if user.Id == t.Owner.Id {
 		return true, nil
 	}
-	if includeCollab {
-		for _, other := range t.Collaborators {
-			if user.Id == other.Id {
-				return true, nil
-			}
+	if collabRole != "" {
+		role := t.CollaboratorRole(user.Id)
+		if role != "" && collaboratorRoleRank(role) >= collaboratorRoleRank(collabRole) {
+			return true, nil
 		}
 	}
-	return false, nil
+	role, err := organizationRole(user.Id, t.MasterBranch.Name.Namespace)
+	if err != nil {
+		return false, err
+	}
+	return role != "" && organizationRoleRank(role) >= organizationRoleRank(orgRole), nil
 }
 
 func UserIsNamespaceAdministrator(userId, namespace string) (bool, error) {
@@ -305,13 +370,16 @@ func UserIsNamespaceAdministrator(userId, namespace string) (bool, error) {
 		return false, err
 	}
 
-	// ...and see if their name matches the namespace name. In future,
-	// this can be extended to cover more configurable rules.
+	// ...and see if their name matches the namespace name, or they're an
+	// admin of the organization it belongs to.
 	if user.Name == namespace {
 		return true, nil
-	} else {
-		return false, nil
 	}
+	role, err := organizationRole(user.Id, namespace)
+	if err != nil {
+		return false, err
+	}
+	return organizationRoleRank(role) >= organizationRoleRank("admin"), nil
 }
 
 func AuthenticatedUserIsNamespaceAdministrator(ctx context.Context, namespace string) (bool, error) {
@@ -323,3 +391,18 @@ func AuthenticatedUserIsNamespaceAdministrator(ctx context.Context, namespace st
 	a, err := UserIsNamespaceAdministrator(u, namespace)
 	return a, err
 }
+
+// Reject the request unless authorize, one of a dot's Authorize methods, says
+// the authenticated user can do what they're trying to it.
+func requireAuthorized(
+	authorize func(context.Context) (bool, error), r *http.Request, tlf TopLevelFilesystem, what string,
+) error {
+	authorized, err := authorize(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("You don't have permission to %s %s.", what, tlf.MasterBranch.Name)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
@@ -16,6 +17,8 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/pierrec/lz4"
 )
 
 func deduceUrl(hostname, mode string) string {
@@ -25,6 +28,9 @@ func deduceUrl(hostname, mode string) string {
 	scheme := "http"
 	port := "6969"
 
+	if mode == "internal" {
+		scheme = internalScheme(hostname)
+	}
 	if mode == "external" && (hostname == "saas.dotmesh.io" || hostname == "dothub.com") {
 		scheme = "https"
 		port = "443"
@@ -74,30 +80,16 @@ func consumePrelude(r io.Reader) (Prelude, error) {
 }
 
 // apply the instructions encoded in the prelude to the system
-func applyPrelude(prelude Prelude, fqfs string) error {
-	// iterate over it setting zfs user properties accordingly.
+func applyPrelude(storage StorageBackend, prelude Prelude, filesystemId string) error {
+	// iterate over it setting snapshot metadata accordingly.
 	log.Printf("[applyPrelude] Got prelude: %s", prelude)
 	for _, j := range prelude.SnapshotProperties {
-		metadataEncoded, err := encodeMetadata(*j.Metadata)
+		err := storage.SetSnapshotMetadata(filesystemId, j.Id, *j.Metadata)
 		if err != nil {
+			log.Printf("[applyPrelude] Error applying prelude: %s", err)
 			return err
 		}
-		for _, k := range metadataEncoded {
-			// eh, would be better to refactor encodeMetadata
-			if k != "-o" {
-				args := []string{"set"}
-				args = append(args, k)
-				args = append(args, fqfs+"@"+j.Id)
-				out, err := exec.Command("zfs", args...).CombinedOutput()
-				if err != nil {
-					log.Printf(
-						"[applyPrelude] Error applying prelude: %s, %s, %s", args, err, out,
-					)
-					return fmt.Errorf("Error applying prelude: %s -> %v: %s", args, err, out)
-				}
-				log.Printf("[applyPrelude] Applied snapshot props for: %s", j.Id)
-			}
-		}
+		log.Printf("[applyPrelude] Applied snapshot props for: %s", j.Id)
 	}
 	return nil
 }
@@ -300,7 +292,9 @@ func pipe(
 	finished chan bool, canceller chan *Event,
 	cancelFunc func(*Event, chan *Event),
 	notifyFunc func(int64, int64),
-	compressMode string,
+	compressMode, codec string,
+	bandwidthLimit int64, // bytes per second on the wire, 0 for unlimited
+	checksum hash.Hash, // if not nil, of everything on the uncompressed side
 ) {
 	startTime := time.Now().UnixNano()
 	var totalBytes int64
@@ -330,21 +324,40 @@ func pipe(
 	var reader io.Reader
 	var err error
 
-	log.Printf("[PIPE] reader %s => writer %s, COMPRESSMODE=%s", rDesc, wDesc, compressMode)
+	log.Printf(
+		"[PIPE] reader %s => writer %s, COMPRESSMODE=%s, CODEC=%s, BANDWIDTHLIMIT=%d",
+		rDesc, wDesc, compressMode, codec, bandwidthLimit,
+	)
+
+	// throttle the compressed side, which is what goes over the network
+	var throttledR io.Reader = r
+	var throttledW io.Writer = w
+	if bandwidthLimit > 0 {
+		limiter := newRateLimiter(bandwidthLimit)
+		if compressMode == "compress" {
+			throttledW = throttledWriter{w, limiter}
+		} else {
+			throttledR = throttledReader{r, limiter}
+		}
+	}
 
 	if compressMode == "compress" {
-		writer = gzip.NewWriter(w)
+		writer, err = compressingWriter(codec, throttledW)
+		if err != nil {
+			handleErr(fmt.Sprintf("Unable to create %s writer: %s", codec, err), r, w, r, w)
+			return
+		}
 		reader = r
 	} else if compressMode == "decompress" {
-		reader, err = gzip.NewReader(r)
+		reader, err = decompressingReader(codec, throttledR)
 		if err != nil {
-			handleErr(fmt.Sprintf("Unable to create gzip reader: %s", err), r, w, r, w)
+			handleErr(fmt.Sprintf("Unable to create %s reader: %s", codec, err), r, w, r, w)
 			return
 		}
 		writer = w
 	} else if compressMode == "none" {
 		// no compression
-		reader = r
+		reader = throttledR
 		writer = w
 	} else {
 		handleErr(
@@ -375,6 +388,9 @@ func pipe(
 		nr, err := reader.Read(buffer)
 		if nr > 0 {
 			data := buffer[0:nr]
+			if checksum != nil {
+				checksum.Write(data)
+			}
 			nw, wErr := writer.Write(data)
 			if nw != nr {
 				handleErr(fmt.Sprintf("short write %s (read) != %s (written)", nr, nw), reader, writer, r, w)
@@ -389,6 +405,9 @@ func pipe(
 				// directly to an http.Flusher any more)
 				f.Flush()
 			}
+			if f, ok := writer.(*lz4.Writer); ok {
+				f.Flush()
+			}
 			totalBytes += int64(nr)
 			notifyFunc(totalBytes, time.Now().UnixNano()-startTime)
 			if wErr != nil {
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+// Webhooks tell other systems (e.g. CI) about things happening to the dots in
+// a namespace, by POSTing a WebhookPayload to a URL. Subscriptions are kept in
+// etcd, one key per webhook under the namespace, and are managed by the
+// namespace's administrator. Each delivery is signed with the webhook's
+// secret, retried with backoff if it fails, and recorded in etcd for a while
+// so that people can see what happened.
+//
+// Events are delivered by the node they happen on: commits by the master,
+// pushes by the node which received them, transfer failures by the node
+// which initiated the transfer.
+type Webhook struct {
+	Id        string
+	Namespace string
+	URL       string
+	// used to sign deliveries, never shown once it's set
+	Secret string `json:",omitempty"`
+	// which of webhookEvents to deliver, all of them if empty
+	Events  []string
+	Created time.Time
+}
+
+var webhookEvents = []string{"commit", "push-received", "branch-created", "deleted", "transfer-failed"}
+
+// What's POSTed to a webhook.
+type WebhookPayload struct {
+	Event        string
+	DeliveryId   string
+	Time         time.Time
+	Namespace    string
+	Name         string
+	Branch       string `json:",omitempty"`
+	FilesystemId string `json:",omitempty"`
+	// who did it, if someone did
+	User string `json:",omitempty"`
+	// the new commit (for commit), or latest one (for push-received)
+	Commit *snapshot `json:",omitempty"`
+	// for transfer-failed
+	Transfer *TransferPollResult `json:",omitempty"`
+}
+
+// The record of sending a payload to a webhook.
+type WebhookDelivery struct {
+	Id        string
+	WebhookId string
+	Event     string
+	URL       string
+	// "pending" while it's being tried, then "delivered" or "failed"
+	Status string
+	// how many times it's been tried, the response to the latest try (0 if
+	// there wasn't one) and what went wrong with it
+	Attempts     int
+	ResponseCode int
+	Error        string `json:",omitempty"`
+	Created      time.Time
+	Updated      time.Time
+}
+
+const WEBHOOK_ATTEMPTS = 5
+
+// doubled after each failed attempt
+const WEBHOOK_RETRY_DELAY = 2 * time.Second
+
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// how long deliveries are kept for
+const WEBHOOK_DELIVERY_TTL = 7 * 24 * time.Hour
+
+// the signature is hex encoded HMAC-SHA256 of the body, keyed on the secret,
+// prefixed with "sha256="
+const WEBHOOK_SIGNATURE_HEADER = "X-Dotmesh-Signature"
+
+func (h Webhook) validate() error {
+	if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+		return fmt.Errorf("Webhook '%s' isn't an http(s) URL", h.URL)
+	}
+	for _, event := range h.Events {
+		if !knownWebhookEvent(event) {
+			return fmt.Errorf(
+				"Unknown webhook event '%s', try one of %s", event, strings.Join(webhookEvents, ", "),
+			)
+		}
+	}
+	return nil
+}
+
+func knownWebhookEvent(event string) bool {
+	for _, known := range webhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, wanted := range h.Events {
+		if event == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+func webhooksKey(namespace string) string {
+	return fmt.Sprintf("%s/webhooks/subscriptions/%s", ETCD_PREFIX, namespace)
+}
+
+func webhookDeliveriesKey(namespace string) string {
+	return fmt.Sprintf("%s/webhooks/deliveries/%s", ETCD_PREFIX, namespace)
+}
+
+// A namespace's webhooks, oldest first.
+func getWebhooks(namespace string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return webhooks, err
+	}
+	resp, err := kapi.Get(context.Background(), webhooksKey(namespace), &client.GetOptions{Recursive: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return webhooks, nil
+		}
+		return webhooks, err
+	}
+	for _, node := range resp.Node.Nodes {
+		webhook := Webhook{}
+		err = json.Unmarshal([]byte(node.Value), &webhook)
+		if err != nil {
+			log.Printf("[getWebhooks] Ignoring unreadable webhook %s: %s", node.Key, err)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Created.Before(webhooks[j].Created) })
+	return webhooks, nil
+}
+
+// Add a webhook, making it a secret if it doesn't have one.
+func addWebhook(webhook Webhook) (Webhook, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return webhook, err
+	}
+	webhook.Id = id.String()
+	webhook.Created = time.Now().UTC()
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return webhook, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return webhook, err
+	}
+	serialized, err := json.Marshal(webhook)
+	if err != nil {
+		return webhook, err
+	}
+	_, err = kapi.Set(
+		context.Background(), fmt.Sprintf("%s/%s", webhooksKey(webhook.Namespace), webhook.Id),
+		string(serialized), nil,
+	)
+	return webhook, err
+}
+
+func removeWebhook(namespace, id string) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(context.Background(), fmt.Sprintf("%s/%s", webhooksKey(namespace), id), nil)
+	if err != nil && client.IsKeyNotFound(err) {
+		return fmt.Errorf("No such webhook %s in %s", id, namespace)
+	}
+	return err
+}
+
+func recordWebhookDelivery(namespace string, delivery WebhookDelivery) error {
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(), fmt.Sprintf("%s/%s", webhookDeliveriesKey(namespace), delivery.Id),
+		string(serialized), &client.SetOptions{TTL: WEBHOOK_DELIVERY_TTL},
+	)
+	return err
+}
+
+// A namespace's recent deliveries (of one webhook, unless webhookId is ""),
+// newest first.
+func getWebhookDeliveries(namespace, webhookId string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	kapi, err := getEtcdKeysApi()
+	if err != nil {
+		return deliveries, err
+	}
+	resp, err := kapi.Get(
+		context.Background(), webhookDeliveriesKey(namespace), &client.GetOptions{Recursive: true},
+	)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return deliveries, nil
+		}
+		return deliveries, err
+	}
+	for _, node := range resp.Node.Nodes {
+		delivery := WebhookDelivery{}
+		err = json.Unmarshal([]byte(node.Value), &delivery)
+		if err != nil {
+			continue
+		}
+		if webhookId == "" || delivery.WebhookId == webhookId {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Created.After(deliveries[j].Created) })
+	return deliveries, nil
+}
+
+// Tell the webhooks of payload's namespace (filled in from its filesystem id
+// if it isn't set) about it, in the background.
+func (s *InMemoryState) notifyWebhooks(payload WebhookPayload) {
+	if payload.Namespace == "" {
+		tlf, branch, err := s.registry.LookupFilesystemById(payload.FilesystemId)
+		if err != nil {
+			log.Printf(
+				"[notifyWebhooks] Can't find dot of %s for %s event: %s",
+				payload.FilesystemId, payload.Event, err,
+			)
+			return
+		}
+		payload.Namespace = tlf.MasterBranch.Name.Namespace
+		payload.Name = tlf.MasterBranch.Name.Name
+		payload.Branch = branchOrMaster(branch)
+	}
+	payload.Time = time.Now().UTC()
+	go func() {
+		webhooks, err := getWebhooks(payload.Namespace)
+		if err != nil {
+			log.Printf("[notifyWebhooks] Unable to get webhooks of %s: %s", payload.Namespace, err)
+			return
+		}
+		for _, webhook := range webhooks {
+			if webhook.wants(payload.Event) {
+				go deliverWebhook(webhook, payload)
+			}
+		}
+	}()
+}
+
+func deliverWebhook(webhook Webhook, payload WebhookPayload) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("[deliverWebhook] %s", err)
+		return
+	}
+	payload.DeliveryId = id.String()
+	delivery := WebhookDelivery{
+		Id: payload.DeliveryId, WebhookId: webhook.Id, Event: payload.Event, URL: webhook.URL,
+		Status: "pending", Created: time.Now().UTC(),
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[deliverWebhook] Unable to serialize %+v: %s", payload, err)
+		return
+	}
+	delay := WEBHOOK_RETRY_DELAY
+	for delivery.Attempts < WEBHOOK_ATTEMPTS {
+		if delivery.Attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		delivery.Attempts++
+		delivery.ResponseCode, err = postWebhook(webhook, payload, body)
+		delivery.Updated = time.Now().UTC()
+		if err == nil {
+			delivery.Status = "delivered"
+			delivery.Error = ""
+		} else {
+			delivery.Error = err.Error()
+			if delivery.Attempts == WEBHOOK_ATTEMPTS {
+				delivery.Status = "failed"
+			}
+			log.Printf(
+				"[deliverWebhook] Attempt %d of %s to %s failed: %s",
+				delivery.Attempts, payload.Event, webhook.URL, err,
+			)
+		}
+		recordErr := recordWebhookDelivery(webhook.Namespace, delivery)
+		if recordErr != nil {
+			log.Printf("[deliverWebhook] Unable to record delivery %s: %s", delivery.Id, recordErr)
+		}
+		if err == nil {
+			return
+		}
+	}
+}
+
+// Anything but a 2xx response is a failure.
+func postWebhook(webhook Webhook, payload WebhookPayload, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dotmesh-Event", payload.Event)
+	req.Header.Set("X-Dotmesh-Delivery", payload.DeliveryId)
+	req.Header.Set(
+		WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(hmacSha256([]byte(webhook.Secret), string(body))),
+	)
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// The latest commit of a filesystem which has just been pushed to this node,
+// straight from storage since the state machine may not have caught up.
+func (s *InMemoryState) latestCommitOnDisk(filesystemId string) *snapshot {
+	fs, err := s.storage.Discover(filesystemId)
+	if err != nil || len(fs.snapshots) == 0 {
+		return nil
+	}
+	latest := *fs.snapshots[len(fs.snapshots)-1]
+	latest.filesystem = nil
+	return &latest
+}
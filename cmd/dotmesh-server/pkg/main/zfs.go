@@ -4,21 +4,33 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // functions which relate to interacting directly with zfs
 
+// ZFSBackend is the default StorageBackend: each filesystem is a ZFS dataset
+// under POOL/ROOT_FS, each commit a ZFS snapshot with its metadata stored in
+// user properties, and replication uses zfs send/recv.
+type ZFSBackend struct{}
+
+func (z *ZFSBackend) Name() string {
+	return "zfs"
+}
+
 // how many bytes has a filesystem diverged from its latest snapshot?
 // also how many bytes does the filesystem take up on disk in total?
-// TODO rename getDirtyDelta and dirtyInfo etc to sizeInfo
-func getDirtyDelta(filesystemId, latestSnap string) (int64, int64, error) {
+func (z *ZFSBackend) SizeInfo(filesystemId, latestSnap string) (int64, int64, error) {
 	o, err := exec.Command(
-		"zfs", "get", "-pHr", "referenced,used", fq(filesystemId),
+		ZFS, "get", "-pHr", "referenced,used", fq(filesystemId),
 	).CombinedOutput()
 	if err != nil {
 		return 0, 0, fmt.Errorf(
@@ -80,7 +92,7 @@ func intDiff(a, b int64) int64 {
 	}
 }
 
-func findLocalPoolId() (string, error) {
+func (z *ZFSBackend) PoolId() (string, error) {
 	output, err := exec.Command(ZPOOL, "get", "-H", "guid", POOL).CombinedOutput()
 	if err != nil {
 		return string(output), err
@@ -92,14 +104,14 @@ func findLocalPoolId() (string, error) {
 	return fmt.Sprintf("%x", i), nil
 }
 
-func findFilesystemIdsOnSystem() []string {
+func (z *ZFSBackend) ListFilesystems() ([]string, error) {
 	// synchronously, return slice of filesystem ids that exist.
 	log.Print("Finding filesystem ids...")
 	listArgs := []string{"list", "-H", "-r", "-o", "name", POOL + "/" + ROOT_FS}
 	// look before you leap (check error code of zfs list)
 	code, err := returnCode(ZFS, listArgs...)
 	if err != nil {
-		log.Fatalf("%s, when running zfs list", err)
+		return nil, fmt.Errorf("%s, when running zfs list", err)
 	}
 	// creates pool/dmfs on demand if it doesn't exist.
 	if code != 0 {
@@ -108,13 +120,13 @@ func findFilesystemIdsOnSystem() []string {
 		if err != nil {
 			out("Unable to create", POOL+"/"+ROOT_FS, "- does ZFS pool '"+POOL+"' exist?\n")
 			log.Printf(string(output))
-			log.Fatal(err)
+			return nil, err
 		}
 	}
 	// get output
 	output, err := exec.Command(ZFS, listArgs...).Output()
 	if err != nil {
-		log.Fatalf("%s, while getting output from zfs list", err)
+		return nil, fmt.Errorf("%s, while getting output from zfs list", err)
 	}
 	// output should now contain newline delimited list of fq filesystem names.
 	newLines := []string{}
@@ -125,10 +137,10 @@ func findFilesystemIdsOnSystem() []string {
 	for _, line := range lines {
 		newLines = append(newLines, unfq(line))
 	}
-	return newLines
+	return newLines, nil
 }
 
-func deleteFilesystemInZFS(fs string) error {
+func (z *ZFSBackend) Destroy(fs string) error {
 	cmd := exec.Command(ZFS, "destroy", "-r", fq(fs))
 	errBuffer := bytes.Buffer{}
 	cmd.Stderr = &errBuffer
@@ -144,7 +156,7 @@ func deleteFilesystemInZFS(fs string) error {
 	return nil
 }
 
-func discoverSystem(fs string) (*filesystem, error) {
+func (z *ZFSBackend) Discover(fs string) (*filesystem, error) {
 	// TODO sanitize fs
 	// does filesystem exist? (early exit if not)
 	code, err := returnCode(ZFS, "list", fq(fs))
@@ -239,3 +251,368 @@ func discoverSystem(fs string) (*filesystem, error) {
 	}
 	return filesystem, nil
 }
+
+func (z *ZFSBackend) Create(filesystemId string) error {
+	log.Printf("%s %s %s", ZFS, "create", fq(filesystemId))
+	out, err := exec.Command(ZFS, "create", fq(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to create %s: %s", err, fq(filesystemId), out)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) Mount(filesystemId string) error {
+	out, err := exec.Command(
+		"mkdir", "-p", mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to mkdir mountpoint %s: %s", err, mnt(filesystemId), out)
+	}
+	out, err = exec.Command("mount.zfs", "-o", "noatime",
+		fq(filesystemId), mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to mount %s: %s", err, fq(filesystemId), out)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) Unmount(filesystemId string) error {
+	out, err := exec.Command("umount", mnt(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to unmount %s: %s", err, fq(filesystemId), out)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) Snapshot(filesystemId, snapshotId string, meta metadata) error {
+	metadataEncoded, err := encodeMetadata(meta)
+	if err != nil {
+		return err
+	}
+	args := []string{"snapshot"}
+	args = append(args, metadataEncoded...)
+	args = append(args, fq(filesystemId)+"@"+snapshotId)
+	log.Printf("[snapshot] Attempting: zfs %s", args)
+	out, err := exec.Command(ZFS, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to snapshot %s (%s): %s", err, fq(filesystemId), args, out)
+	}
+	list, err := exec.Command(ZFS, "list", fq(filesystemId)+"@"+snapshotId).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to list snapshot %s (%s): %s", err, fq(filesystemId), args, list)
+	}
+	log.Printf("[snapshot] listed snapshot: '%q'", strconv.Quote(string(list)))
+	return nil
+}
+
+func (z *ZFSBackend) SetSnapshotMetadata(filesystemId, snapshotId string, meta metadata) error {
+	metadataEncoded, err := encodeMetadata(meta)
+	if err != nil {
+		return err
+	}
+	for _, k := range metadataEncoded {
+		// eh, would be better to refactor encodeMetadata
+		if k != "-o" {
+			args := []string{"set"}
+			args = append(args, k)
+			args = append(args, fq(filesystemId)+"@"+snapshotId)
+			out, err := exec.Command(ZFS, args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("Error applying prelude: %s -> %v: %s", args, err, out)
+			}
+		}
+	}
+	return nil
+}
+
+func (z *ZFSBackend) Rollback(filesystemId, snapshotId string) error {
+	out, err := exec.Command(ZFS, "rollback",
+		"-r", fq(filesystemId)+"@"+snapshotId).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to rollback %s: %s", err, fq(filesystemId), out)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) DestroySnapshot(filesystemId, snapshotId string) error {
+	out, err := exec.Command(ZFS, "destroy", fq(filesystemId)+"@"+snapshotId).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to destroy %s@%s: %s", err, fq(filesystemId), snapshotId, out)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) SnapshotPath(filesystemId, snapshotId string) (string, error) {
+	// snapshots are only visible under .zfs while the filesystem is mounted
+	if _, err := os.Stat(filepath.Join(mnt(filesystemId), ".zfs")); err != nil {
+		return "", fmt.Errorf("%s isn't mounted here: %s", filesystemId, err)
+	}
+	if snapshotId == "" {
+		return mnt(filesystemId), nil
+	}
+	path := filepath.Join(mnt(filesystemId), ".zfs", "snapshot", snapshotId)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("No such snapshot %s@%s: %s", filesystemId, snapshotId, err)
+	}
+	return path, nil
+}
+
+func (z *ZFSBackend) Clone(filesystemId, snapshotId, newFilesystemId string) error {
+	out, err := exec.Command(
+		ZFS, "clone",
+		fq(filesystemId)+"@"+snapshotId,
+		fq(newFilesystemId),
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v while trying to clone %s: %s", err, fq(filesystemId), out)
+	}
+	return nil
+}
+
+func calculateSendArgs(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+) []string {
+
+	// toFilesystemId
+	// snapRange.toSnap.Id
+	// snapRange.fromSnap == nil?  --> fromSnapshotId == ""?
+	// snapRange.fromSnap.Id
+
+	var sendArgs []string
+	var fromSnap string
+	if fromSnapshotId == "" {
+		fromSnap = START_SNAPSHOT
+		if fromFilesystemId != "" { // XXX wtf
+			// This is a clone-origin based send
+			fromSnap = fmt.Sprintf(
+				"%s@%s", fromFilesystemId, fromSnapshotId,
+			)
+		}
+	} else {
+		fromSnap = fromSnapshotId
+	}
+	if fromSnap == START_SNAPSHOT {
+		// -R sends interim snapshots as well
+		sendArgs = []string{
+			"-p", "-R", fq(toFilesystemId) + "@" + toSnapshotId,
+		}
+	} else {
+		// in clone case, fromSnap must be fully qualified
+		if strings.Contains(fromSnap, "@") {
+			// send a clone, so make it fully qualified
+			fromSnap = fq(fromSnap)
+		}
+		sendArgs = []string{
+			"-p", "-I", fromSnap, fq(toFilesystemId) + "@" + toSnapshotId,
+		}
+	}
+	return sendArgs
+}
+
+/*
+		Discover total number of bytes in replication stream by asking nicely:
+
+			luke@hostess:/foo$ sudo zfs send -nP pool/foo@now2
+			full    pool/foo@now2   105050056
+			size    105050056
+			luke@hostess:/foo$ sudo zfs send -nP -I pool/foo@now pool/foo@now2
+			incremental     now     pool/foo@now2   105044936
+			size    105044936
+
+	   -n
+
+		   Do a dry-run ("No-op") send.  Do not generate any actual send
+		   data.  This is useful in conjunction with the -v or -P flags to
+		   determine what data will be sent.
+
+	   -P
+
+		   Print machine-parsable verbose information about the stream
+		   package generated.
+*/
+func (z *ZFSBackend) PredictSize(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+) (int64, error) {
+	sendArgs := calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	predictArgs := []string{"send", "-nP"}
+	if compressed {
+		predictArgs = append(predictArgs, "-c")
+	}
+	predictArgs = append(predictArgs, sendArgs...)
+
+	sizeCmd := exec.Command(ZFS, predictArgs...)
+
+	log.Printf("[predictSize] predict command: %s", strings.Join(predictArgs, " "))
+
+	out, err := sizeCmd.CombinedOutput()
+	if err != nil {
+		return 0, err
+	}
+	shrap := strings.Split(string(out), "\n")
+	if len(shrap) < 2 {
+		return 0, fmt.Errorf("Not enough lines in output %v", string(out))
+	}
+	sizeLine := shrap[len(shrap)-2]
+	shrap = strings.Fields(sizeLine)
+	if len(shrap) < 2 {
+		return 0, fmt.Errorf("Not enough fields in %v", sizeLine)
+	}
+
+	size, err := strconv.ParseInt(shrap[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (z *ZFSBackend) Send(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	compressed bool,
+	stream io.Writer,
+) error {
+	args := []string{"send"}
+	if compressed {
+		args = append(args, "-c")
+	}
+	args = append(args, calculateSendArgs(
+		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+	)...)
+	log.Printf("[ZFSBackend:Send] running: zfs %s", strings.Join(args, " "))
+	cmd := exec.Command(ZFS, args...)
+	cmd.Stdout = stream
+	cmd.Stderr = getLogfile("zfs-send-errors")
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v from zfs send of %s, check zfs-send-errors.log", err, toFilesystemId)
+	}
+	return nil
+}
+
+func (z *ZFSBackend) Receive(filesystemId string, stream io.Reader) error {
+	// -s keeps a partially received stream around if we're interrupted, so
+	// that the sender can pick up where it left off (see ResumeToken).
+	cmd := exec.Command(ZFS, "recv", "-s", fq(filesystemId))
+	errBuffer := bytes.Buffer{}
+	cmd.Stdin = stream
+	cmd.Stdout = getLogfile("zfs-recv-stdout")
+	cmd.Stderr = io.MultiWriter(getLogfile("zfs-recv-stderr"), &errBuffer)
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v from zfs recv of %s, stderr: %s", err, filesystemId, errBuffer.String())
+	}
+	return nil
+}
+
+var zfsCompressedStreams bool
+var zfsCompressedStreamsOnce sync.Once
+
+// zfs send -c (and receiving the streams it makes) arrived in ZoL 0.7. Older
+// versions don't list it in their usage message:
+//
+//	usage:
+//		send [-DnPpRvLec] [-[iI] snapshot] <snapshot>
+func (z *ZFSBackend) CompressedStreams() bool {
+	zfsCompressedStreamsOnce.Do(func() {
+		// no arguments means usage, and a non-zero exit code
+		out, _ := exec.Command(ZFS, "send").CombinedOutput()
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[0] == "send" &&
+				strings.HasPrefix(fields[1], "[-") &&
+				strings.Contains(fields[1], "c") {
+				zfsCompressedStreams = true
+			}
+		}
+		log.Printf("[CompressedStreams] zfs send -c supported: %t", zfsCompressedStreams)
+	})
+	return zfsCompressedStreams
+}
+
+func (z *ZFSBackend) ResumeToken(filesystemId string) (string, error) {
+	out, err := exec.Command(
+		ZFS, "get", "-H", "-o", "value", "receive_resume_token", fq(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "does not exist") {
+			return "", nil
+		}
+		return "", fmt.Errorf(
+			"%v while getting receive_resume_token of %s: %s", err, filesystemId, out,
+		)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "-" {
+		return "", nil
+	}
+	return token, nil
+}
+
+func (z *ZFSBackend) AbortResume(filesystemId string) error {
+	out, err := exec.Command(ZFS, "recv", "-A", fq(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"%v while aborting partial receive of %s: %s", err, filesystemId, out,
+		)
+	}
+	return nil
+}
+
+/*
+Dry-run a resumed send to find out what it would contain:
+
+	# zfs send -nvP -t 1-e604ea4bf-e0-789c63a2...
+	resume token contents:
+	nvlist version: 0
+		object = 0x6
+		offset = 0x0
+		bytes = 0x1f0d000
+		toguid = 0x2fe1b2d8e5f4b7a1
+		toname = pool/dmfs/b2c3...@a1b2...
+	full	pool/dmfs/b2c3...@a1b2...	72269832
+	size	72269832
+*/
+func (z *ZFSBackend) InspectResumeToken(token string) (*ResumeInfo, error) {
+	out, err := exec.Command(ZFS, "send", "-nvP", "-t", token).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v while inspecting resume token: %s", err, out)
+	}
+	info := &ResumeInfo{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "bytes" && fields[1] == "=":
+			info.SkippedBytes, err = strconv.ParseInt(fields[2], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse %q: %s", line, err)
+			}
+		case len(fields) == 3 && fields[0] == "toname" && fields[1] == "=":
+			shrapnel := strings.SplitN(fields[2], "@", 2)
+			if len(shrapnel) != 2 || !strings.HasPrefix(shrapnel[0], POOL+"/"+ROOT_FS+"/") {
+				return nil, fmt.Errorf("Resume token is for unexpected snapshot %s", fields[2])
+			}
+			info.FilesystemId = unfq(shrapnel[0])
+			info.SnapshotId = shrapnel[1]
+		case len(fields) == 2 && fields[0] == "size":
+			info.Size, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse %q: %s", line, err)
+			}
+		}
+	}
+	if info.SnapshotId == "" {
+		return nil, fmt.Errorf("No snapshot named in resume token: %s", out)
+	}
+	return info, nil
+}
+
+func (z *ZFSBackend) SendResume(token string, stream io.Writer) error {
+	log.Printf("[ZFSBackend:SendResume] running: zfs send -t %s", token)
+	cmd := exec.Command(ZFS, "send", "-t", token)
+	cmd.Stdout = stream
+	cmd.Stderr = getLogfile("zfs-send-errors")
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v from resumed zfs send, check zfs-send-errors.log", err)
+	}
+	return nil
+}
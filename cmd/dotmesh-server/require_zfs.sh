@@ -42,7 +42,10 @@ FILE=${DIR}/dotmesh_data
 POOL=${USE_POOL_NAME:-pool}
 POOL=$(echo $POOL |sed s/\#HOSTNAME\#/$(hostname)/)
 MOUNTPOINT=${MOUNTPOINT:-$DIR/mnt}
-INHERIT_ENVIRONMENT_NAMES=( "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS")
+# "zfs" (the default), "btrfs" if $DIR is on btrfs, or "directory", for hosts
+# which can't load ZFS
+STORAGE_BACKEND=${STORAGE_BACKEND:-zfs}
+INHERIT_ENVIRONMENT_NAMES=( "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "REPLICATION_CODECS" "REPLICATION_BANDWIDTH_LIMIT" "AUDIT_LOG_PATH" "AUDIT_LOG_ETCD" "DOTMESH_TLS" "DOTMESH_TLS_CERT" "DOTMESH_TLS_KEY" "DOTMESH_TLS_CA" "DOTMESH_OIDC_ISSUER" "DOTMESH_OIDC_CLIENT_ID" "DOTMESH_OIDC_GROUPS")
 
 echo "=== Using mountpoint $MOUNTPOINT"
 
@@ -74,28 +77,32 @@ if [ ! -d $DIR ]; then
     mkdir -p $DIR
 fi
 
-if [ -n "`lsmod|grep zfs`" ]; then
-    echo "ZFS already loaded :)"
-else
-    depmod -b /system-lib || true
-    if ! modprobe -d /system-lib zfs; then
-        fetch_zfs
+if [ "$STORAGE_BACKEND" == "zfs" ]; then
+    if [ -n "`lsmod|grep zfs`" ]; then
+        echo "ZFS already loaded :)"
     else
-        echo "Successfully loaded system ZFS :)"
+        depmod -b /system-lib || true
+        if ! modprobe -d /system-lib zfs; then
+            fetch_zfs
+        else
+            echo "Successfully loaded system ZFS :)"
+        fi
     fi
-fi
 
-if [ ! -e /dev/zfs ]; then
-    mknod -m 660 /dev/zfs c $(cat /sys/class/misc/zfs/dev |sed 's/:/ /g')
-fi
-if ! zpool status $POOL; then
-    if [ ! -f $FILE ]; then
-        truncate -s 10G $FILE
-        echo zpool create -m $MOUNTPOINT $POOL $FILE
-        zpool create -m $MOUNTPOINT $POOL $FILE
-    else
-        zpool import -f -d $DIR $POOL
+    if [ ! -e /dev/zfs ]; then
+        mknod -m 660 /dev/zfs c $(cat /sys/class/misc/zfs/dev |sed 's/:/ /g')
     fi
+    if ! zpool status $POOL; then
+        if [ ! -f $FILE ]; then
+            truncate -s 10G $FILE
+            echo zpool create -m $MOUNTPOINT $POOL $FILE
+            zpool create -m $MOUNTPOINT $POOL $FILE
+        else
+            zpool import -f -d $DIR $POOL
+        fi
+    fi
+else
+    echo "Using the $STORAGE_BACKEND storage backend, not loading ZFS"
 fi
 
 # Clear away stale socket if existing
@@ -145,6 +152,13 @@ if [ "$PKI_PATH" != "" ]; then
     pki_volume_mount="-v $PKI_PATH:/pki"
 fi
 
+# The directory and btrfs storage backends keep its data under $DIR, so make sure it's
+# visible if it's somewhere other than /var/lib/dotmesh.
+pool_dir_volume_mount=""
+if [ "$DIR" != "/var/lib/dotmesh" ]; then
+    pool_dir_volume_mount="-v $DIR:$DIR"
+fi
+
 net="-p 6969:6969"
 link=""
 if [ "$DOTMESH_ETCD_ENDPOINT" == "" ]; then
@@ -191,6 +205,7 @@ done
 
 docker run -i $rm_opt --privileged --name=dotmesh-server-inner \
     -v /var/lib/dotmesh:/var/lib/dotmesh \
+    $pool_dir_volume_mount \
     -v /var/run/docker.sock:/var/run/docker.sock \
     -v /run/docker/plugins:/run/docker/plugins \
     -v $MOUNTPOINT:$MOUNTPOINT:rshared \
@@ -204,6 +219,9 @@ docker run -i $rm_opt --privileged --name=dotmesh-server-inner \
     -e "LD_LIBRARY_PATH=$LD_LIBRARY_PATH" \
     -e "MOUNT_PREFIX=$MOUNTPOINT" \
     -e "POOL=$POOL" \
+    -e "STORAGE_BACKEND=$STORAGE_BACKEND" \
+    -e "DIRECTORY_BACKEND_ROOT=$DIR/directory" \
+    -e "BTRFS_BACKEND_ROOT=$DIR/btrfs" \
     -e "YOUR_IPV4_ADDRS=$YOUR_IPV4_ADDRS" \
     -e "TRACE_ADDR=$TRACE_ADDR" \
     -e "DOTMESH_ETCD_ENDPOINT=$DOTMESH_ETCD_ENDPOINT" $INHERIT_ENVIRONMENT_ARGS \
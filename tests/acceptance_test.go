@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -203,6 +205,420 @@ func TestSingleNode(t *testing.T) {
 		}
 	})
 
+	t.Run("Policy", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm dot policy set --commit-every=1m --keep-hourly=2")
+		resp := citools.OutputFromRunOnNode(t, node1, "dm dot policy show")
+		if !strings.Contains(resp, "every 1m") || !strings.Contains(resp, "2 hourly") {
+			t.Errorf("unexpected policy: %s", resp)
+		}
+
+		// policies are checked every minute
+		committed := false
+		for i := 0; i < 20 && !committed; i++ {
+			time.Sleep(10 * time.Second)
+			resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+			committed = strings.Contains(resp, "Automatic commit")
+		}
+		if !committed {
+			t.Error("dot wasn't committed automatically")
+		}
+
+		citools.RunOnNode(t, node1, "dm dot policy clear")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm dot policy show")
+		if !strings.Contains(resp, "no policy") {
+			t.Errorf("policy wasn't cleared: %s", resp)
+		}
+	})
+
+	t.Run("CommitHooks", func(t *testing.T) {
+		fsname := citools.UniqName()
+		container := fsname + "_db"
+		citools.RunOnNode(t, node1, citools.DockerRunDetached(fsname+".db", "--name "+container)+" sh -c 'sleep 60'")
+		defer citools.RunOnNode(t, node1, "docker rm -f "+container)
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+
+		citools.RunOnNode(t, node1, "dm dot hook add "+fsname+".db --pre --exec 'echo quiesced; touch /foo/QUIESCED'")
+		citools.RunOnNode(t, node1, "dm commit -m 'hooked'")
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "quiesced") {
+			t.Errorf("hook output wasn't recorded in the commit: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "docker exec "+container+" ls /foo/")
+		if !strings.Contains(resp, "QUIESCED") {
+			t.Error("pre commit hook didn't run in the subdot's container")
+		}
+
+		// failing pre hooks abort the commit
+		citools.RunOnNode(t, node1, "dm dot hook add --pre --exec 'exit 3'")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm commit -m 'never' || true")
+		if !strings.Contains(resp, "status 3") {
+			t.Errorf("commit didn't fail with the hook: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.Contains(resp, "never") {
+			t.Error("commit happened despite its pre hook failing")
+		}
+
+		citools.RunOnNode(t, node1, "dm dot hook clear")
+		citools.RunOnNode(t, node1, "dm commit -m 'unhooked'")
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo hello > /foo/A; touch /foo/B'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'first'")
+		first := strings.TrimSpace(citools.OutputFromRunOnNode(t, node1,
+			"dm log | grep ^commit | head -n 1 | cut -d ' ' -f 2"))
+
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'rm /foo/B; mv /foo/A /foo/C; echo hi > /foo/D'")
+		resp := citools.OutputFromRunOnNode(t, node1, "dm diff")
+		if !strings.Contains(resp, "__default__/A -> __default__/C") {
+			t.Errorf("rename missing from diff against the working state: %s", resp)
+		}
+		citools.RunOnNode(t, node1, "dm commit -m 'second'")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm diff HEAD^ HEAD --subdot=__default__ --name-only")
+		if strings.TrimSpace(resp) != "B\nC\nD" {
+			t.Errorf("unexpected names in diff between commits: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm diff HEAD^ HEAD --stat")
+		if !strings.Contains(resp, "3 files changed (1 added, 1 removed, 0 modified, 1 renamed)") {
+			t.Errorf("unexpected summary in diff --stat: %s", resp)
+		}
+
+		// across the origin of a branch
+		citools.RunOnNode(t, node1, "dm checkout -b branch1")
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/E")
+		citools.RunOnNode(t, node1, "dm commit -m 'third'")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm diff "+first+" HEAD --name-only")
+		if !strings.Contains(resp, "__default__/D") || !strings.Contains(resp, "__default__/E") {
+			t.Errorf("diff across the branch's origin is missing changes: %s", resp)
+		}
+		citools.RunOnNode(t, node1, "dm checkout master")
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo old > /foo/A; mkdir /foo/d; echo x > /foo/d/B'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'old'")
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo new > /foo/A'")
+		citools.RunOnNode(t, node1, "dm commit -m 'new'")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm cat __default__/A --commit=HEAD^")
+		if strings.TrimSpace(resp) != "old" {
+			t.Errorf("unexpected contents of A in the old commit: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm cat A --subdot=__default__")
+		if strings.TrimSpace(resp) != "new" {
+			t.Errorf("unexpected contents of A in the latest commit: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm ls --subdot=__default__")
+		if !strings.Contains(resp, "d/") {
+			t.Errorf("directory missing from dm ls: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm cat __default__/d --tar | tar -t")
+		if strings.TrimSpace(resp) != "B" {
+			t.Errorf("unexpected tar of a directory: %s", resp)
+		}
+	})
+
+	t.Run("PinnedCommitVolume", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo old > /foo/A'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'old'")
+		commit := strings.TrimSpace(citools.OutputFromRunOnNode(t, node1,
+			"dm log | grep ^commit | head -n 1 | cut -d ' ' -f 2"))
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo new > /foo/A'")
+
+		pinned := fsname + "#" + commit
+		resp := citools.OutputFromRunOnNode(t, node1, citools.DockerRun(pinned)+" cat /foo/A")
+		if strings.TrimSpace(resp) != "old" {
+			t.Errorf("pinned volume doesn't have the commit's contents: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(pinned)+" sh -c 'touch /foo/B 2>&1 || echo failed'")
+		if !strings.Contains(resp, "failed") {
+			t.Errorf("pinned volume is writable: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/A")
+		if strings.TrimSpace(resp) != "new" {
+			t.Errorf("live volume changed: %s", resp)
+		}
+		citools.RunOnNode(t, node1, "docker volume rm '"+pinned+"'")
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo one > /foo/A'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'one'")
+		citools.RunOnNode(t, node1, "dm tag v1")
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo two > /foo/A'")
+		citools.RunOnNode(t, node1, "dm commit -m 'two'")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "(tag: v1)") {
+			t.Errorf("tag missing from dm log: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm cat __default__/A --commit=v1")
+		if strings.TrimSpace(resp) != "one" {
+			t.Errorf("unexpected contents of A in the tagged commit: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm tag v1 HEAD 2>&1 || true")
+		if !strings.Contains(resp, "already exists") {
+			t.Errorf("tag was moved: %s", resp)
+		}
+
+		// resetting past a tagged commit would destroy it
+		citools.RunOnNode(t, node1, "dm tag v2")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm reset --hard v1 2>&1 || true")
+		if !strings.Contains(resp, "v2") {
+			t.Errorf("reset past a tagged commit wasn't refused: %s", resp)
+		}
+		citools.RunOnNode(t, node1, "dm tag -d v2")
+		citools.RunOnNode(t, node1, "dm reset --hard v1")
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/A")
+		if strings.TrimSpace(resp) != "one" {
+			t.Errorf("reset to a tag didn't roll back: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm tag -l")
+		if !strings.Contains(resp, "v1") || strings.Contains(resp, "v2") {
+			t.Errorf("unexpected tags listed: %s", resp)
+		}
+	})
+
+	t.Run("ProtectedBranch", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'one'")
+		citools.RunOnNode(t, node1, "dm commit -m 'two'")
+		citools.RunOnNode(t, node1, "dm branch protect --no-rollback --no-delete")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm branch")
+		if !strings.Contains(resp, "* master (protected: no-rollback,no-delete)") {
+			t.Errorf("protection missing from dm branch: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm reset --hard HEAD^ 2>&1 || true")
+		if !strings.Contains(resp, "protected") {
+			t.Errorf("protected branch was reset: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm dot delete -f "+fsname+" 2>&1 || true")
+		if !strings.Contains(resp, "protected") {
+			t.Errorf("dot with a protected branch was deleted: %s", resp)
+		}
+
+		citools.RunOnNode(t, node1, "dm branch unprotect")
+		citools.RunOnNode(t, node1, "dm reset --hard HEAD^")
+		citools.RunOnNode(t, node1, "dm dot delete -f "+fsname)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1,
+			"(timeout 20 dm watch "+fsname+" > /tmp/watch-"+fsname+" 2>&1 &)")
+		// give it time to connect
+		time.Sleep(2 * time.Second)
+		citools.RunOnNode(t, node1, "dm commit -m 'watched commit'")
+		citools.RunOnNode(t, node1, "dm checkout -b watched")
+
+		resp := ""
+		for try := 0; try < 10; try++ {
+			time.Sleep(time.Second)
+			resp = citools.OutputFromRunOnNode(t, node1, "cat /tmp/watch-"+fsname)
+			if strings.Contains(resp, "watched commit") && strings.Contains(resp, "@watched created") {
+				break
+			}
+		}
+		if !strings.Contains(resp, "watched commit") {
+			t.Errorf("commit missing from dm watch: %s", resp)
+		}
+		if !strings.Contains(resp, "admin/"+fsname+"@watched created") {
+			t.Errorf("new branch missing from dm watch: %s", resp)
+		}
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		// nothing listens there, so deliveries fail and are retried
+		resp := citools.OutputFromRunOnNode(t, node1,
+			"dm webhook add http://127.0.0.1:1/hook --event=commit --secret=s3cret")
+		if !strings.Contains(resp, "Added webhook") {
+			t.Fatalf("webhook wasn't added: %s", resp)
+		}
+		webhookId := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(resp), "Added webhook"))
+		citools.RunOnNode(t, node1, "dm commit -m 'hooked'")
+
+		resp = ""
+		for try := 0; try < 10; try++ {
+			time.Sleep(time.Second)
+			resp = citools.OutputFromRunOnNode(t, node1, "dm webhook deliveries "+webhookId)
+			if strings.Contains(resp, "commit") {
+				break
+			}
+		}
+		if !strings.Contains(resp, "commit") || !strings.Contains(resp, "http://127.0.0.1:1/hook") {
+			t.Errorf("commit delivery missing from the log: %s", resp)
+		}
+
+		citools.RunOnNode(t, node1, "dm webhook remove "+webhookId)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm webhook list")
+		if strings.Contains(resp, webhookId) {
+			t.Errorf("removed webhook still listed: %s", resp)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'one'")
+		citools.RunOnNode(t, node1, "dm commit -m 'two'")
+		citools.RunOnNode(t, node1, "dm reset --hard HEAD^")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm audit --dot="+fsname+" --method=Rollback")
+		if !strings.Contains(resp, "Rollback") || !strings.Contains(resp, "admin/"+fsname) {
+			t.Errorf("rollback missing from the audit log: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm audit --dot="+fsname+" --method=Commit")
+		if strings.Count(resp, "Commit") != 2 {
+			t.Errorf("expected two commits in the audit log: %s", resp)
+		}
+	})
+
+	t.Run("ApiTokens", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'hello'")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm token create ci-"+fsname+" --scope=read")
+		token := ""
+		for _, word := range strings.Fields(resp) {
+			if strings.HasPrefix(word, "dmt_") {
+				token = word
+			}
+		}
+		if token == "" {
+			t.Fatalf("no token in: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm token list")
+		if !strings.Contains(resp, "ci-"+fsname) {
+			t.Errorf("new token not listed: %s", resp)
+		}
+
+		var commits []interface{}
+		err := citools.DoRPC(f[0].GetNode(0).IP, "admin", token,
+			"DotmeshRPC.Commits", struct{ Namespace, Name, Branch string }{"admin", fsname, ""}, &commits)
+		if err != nil {
+			t.Errorf("read token couldn't list commits: %s", err)
+		}
+		var committed bool
+		err = citools.DoRPC(f[0].GetNode(0).IP, "admin", token,
+			"DotmeshRPC.Commit", struct{ Namespace, Name, Branch, Message string }{"admin", fsname, "", "nope"}, &committed)
+		if err == nil || !strings.Contains(err.Error(), "read scope") {
+			t.Errorf("read token was allowed to commit: %v", err)
+		}
+		var key struct{ ApiKey string }
+		err = citools.DoRPC(f[0].GetNode(0).IP, "admin", token, "DotmeshRPC.GetApiKey", struct{}{}, &key)
+		if err == nil {
+			t.Errorf("token was allowed to see the API key")
+		}
+
+		citools.RunOnNode(t, node1, "dm token revoke ci-"+fsname)
+		err = citools.DoRPC(f[0].GetNode(0).IP, "admin", token,
+			"DotmeshRPC.Commits", struct{ Namespace, Name, Branch string }{"admin", fsname, ""}, &commits)
+		if err == nil {
+			t.Errorf("revoked token still works")
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'hello'")
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:6969/metrics", f[0].GetNode(0).IP), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("admin", f[0].GetNode(0).ApiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := string(body)
+		for _, expected := range []string{
+			`name="admin/` + fsname + `"`,
+			"dotmesh_filesystem_transitions_total",
+			`dotmesh_rpc_duration_seconds_count{method="DotmeshRPC.Commit"}`,
+			"dotmesh_docker_plugin_requests_total",
+		} {
+			if !strings.Contains(metrics, expected) {
+				t.Errorf("%s missing from metrics: %s", expected, metrics)
+			}
+		}
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		host := fmt.Sprintf("%s:6969", f[0].GetNode(0).IP)
+
+		// the server presents the cluster's CA along with its certificate
+		conn, err := tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs := conn.ConnectionState().PeerCertificates
+		conn.Close()
+		ca := certs[len(certs)-1]
+		if !ca.IsCA {
+			t.Fatalf("server didn't present a CA certificate: %+v", ca.Subject)
+		}
+
+		// which its certificate checks out against
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		_, err = certs[0].Verify(x509.VerifyOptions{Roots: roots})
+		if err != nil {
+			t.Error(err)
+		}
+
+		// and, while moving to TLS, plain HTTP still works too
+		for _, scheme := range []string{"https", "http"} {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			resp, err := client.Get(fmt.Sprintf("%s://%s/status", scheme, host))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s /status returned %s", scheme, resp.Status)
+			}
+		}
+
+		// the local remote uses it, pinned to the cluster's CA
+		config := citools.OutputFromRunOnNode(t, node1, "cat /root/.dotmesh/config")
+		if !strings.Contains(config, `"TLS":true`) || !strings.Contains(config, "BEGIN CERTIFICATE") {
+			t.Errorf("local remote doesn't use TLS: %s", config)
+		}
+	})
+
 	t.Run("Branch", func(t *testing.T) {
 		fsname := citools.UniqName()
 		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
@@ -875,6 +1291,78 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 			t.Error("unable to find commit message remote's log output")
 		}
 	})
+	t.Run("ExportImport", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'exported'")
+		citools.RunOnNode(t, node2, "dm export -o /tmp/"+fsname+"-1.dmx")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node2, "dm commit -m 'exported again'")
+		citools.RunOnNode(t, node2, "dm export "+fsname+" --from HEAD^ -o /tmp/"+fsname+"-2.dmx")
+
+		// import them into the other cluster, from here
+		citools.RunOnNode(t, node2, "dm remote switch cluster_0")
+		defer citools.RunOnNode(t, node2, "dm remote switch local")
+		citools.RunOnNode(t, node2, "dm import /tmp/"+fsname+"-1.dmx")
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "exported") {
+			t.Error("unable to find commit message in imported dot's log output")
+		}
+		if strings.Contains(resp, "exported again") {
+			t.Error("found a commit which wasn't in the archive")
+		}
+
+		// the incremental archive applies on top
+		citools.RunOnNode(t, node2, "dm import /tmp/"+fsname+"-2.dmx")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "exported again") {
+			t.Error("unable to find commit message from incremental archive")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" ls /foo/")
+		if !strings.Contains(resp, "Y") {
+			t.Error("imported dot doesn't have the file from the incremental archive")
+		}
+
+	})
+	t.Run("ImportChecksumMismatch", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'intact'")
+		citools.RunOnNode(t, node2, "dm export -o /tmp/"+fsname+"-1.dmx")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node2, "dm commit -m 'tampered'")
+		citools.RunOnNode(t, node2, "dm export "+fsname+" --from HEAD^ -o /tmp/"+fsname+"-2.dmx")
+		// an archive ends with the checksum of its last stream
+		archive := "/tmp/" + fsname + "-2.dmx"
+		citools.RunOnNode(t, node2, "printf '%064d' 0 | dd of="+archive+
+			" bs=1 seek=$(( $(stat -c %s "+archive+") - 64 )) conv=notrunc")
+
+		citools.RunOnNode(t, node2, "dm remote switch cluster_0")
+		defer citools.RunOnNode(t, node2, "dm remote switch local")
+		citools.RunOnNode(t, node2, "dm import /tmp/"+fsname+"-1.dmx")
+		resp := citools.OutputFromRunOnNode(t, node2, "dm import "+archive+" || true")
+		if !strings.Contains(resp, "checksum") {
+			t.Errorf("importing an archive with the wrong checksum didn't fail: %s", resp)
+		}
+
+		// what was received is rolled back
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "intact") {
+			t.Error("unable to find commit message in imported dot's log output")
+		}
+		if strings.Contains(resp, "tampered") {
+			t.Error("found a commit which failed verification")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" ls /foo/")
+		if strings.Contains(resp, "Y") {
+			t.Error("imported dot has a file which failed verification")
+		}
+	})
 	t.Run("PushCommitBranchNoExtantBase", func(t *testing.T) {
 		fsname := citools.UniqName()
 		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
@@ -897,6 +1385,137 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 			t.Error("unable to find commit message remote's log output")
 		}
 	})
+	t.Run("PushCodecs", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'seq 100000 > /foo/X'")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+
+		for _, codec := range []string{"lz4", "none", "gzip"} {
+			citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo "+codec+" >> /foo/X'")
+			citools.RunOnNode(t, node2, "dm commit -m 'sent with "+codec+"'")
+			resp := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --codec "+codec)
+			if !strings.Contains(resp, "Compressing with "+codec) {
+				t.Errorf("push didn't use %s: %s", codec, resp)
+			}
+		}
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "sent with gzip") {
+			t.Error("unable to find commit message remote's log output")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" tail -n 3 /foo/X")
+		if !strings.Contains(resp, "lz4\nnone\ngzip") {
+			t.Errorf("pushed file is wrong: %s", resp)
+		}
+
+		resp = citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --codec brotli 2>&1 || true")
+		if !strings.Contains(resp, "Unknown codec") {
+			t.Errorf("push with an unknown codec didn't fail: %s", resp)
+		}
+	})
+	t.Run("PushBandwidthLimit", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" dd if=/dev/urandom of=/foo/X bs=1M count=5")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'limited'")
+
+		start := time.Now()
+		resp := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --limit 1M")
+		if !strings.Contains(resp, "limited to 1.00MiB/s") {
+			t.Errorf("push didn't report its limit: %s", resp)
+		}
+		if elapsed := time.Since(start); elapsed < 4*time.Second {
+			t.Errorf("5MiB at 1MiB/s only took %s", elapsed)
+		}
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "limited") {
+			t.Error("unable to find commit message remote's log output")
+		}
+
+		resp = citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --limit fast 2>&1 || true")
+		if !strings.Contains(resp, "Invalid bandwidth limit") {
+			t.Errorf("push with an invalid limit didn't fail: %s", resp)
+		}
+	})
+	t.Run("ReplicationSchedule", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'scheduled'")
+
+		// a window which isn't open now
+		now := time.Now().UTC()
+		window := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+		citools.RunOnNode(t, node2, "dm cluster schedule "+window)
+		defer citools.RunOnNode(t, node2, "dm cluster schedule --clear")
+		resp := citools.OutputFromRunOnNode(t, node2, "dm cluster schedule")
+		if !strings.Contains(resp, window) {
+			t.Errorf("schedule wasn't set: %s", resp)
+		}
+
+		// so pushes are queued until it opens, or they're cancelled
+		citools.RunOnNode(t, node2, "(dm push cluster_0 > /tmp/push-"+fsname+" 2>&1 &)")
+		citools.RunOnNode(t, node2, "for i in $(seq 30); do "+
+			"grep -q 'dm cancel' /tmp/push-"+fsname+" && break; sleep 1; done")
+		resp = citools.OutputFromRunOnNode(t, node2, "cat /tmp/push-"+fsname)
+		if !strings.Contains(resp, "Queued") {
+			t.Errorf("push wasn't queued: %s", resp)
+		}
+		citools.RunOnNode(t, node2, "dm cancel $(sed -n \"s/.*'dm cancel \\(.*\\)'.*/\\1/p\" /tmp/push-"+fsname+")")
+		citools.RunOnNode(t, node2, "for i in $(seq 30); do "+
+			"pgrep -f '[d]m push cluster_0' > /dev/null || break; sleep 1; done")
+		resp = citools.OutputFromRunOnNode(t, node2, "cat /tmp/push-"+fsname)
+		if !strings.Contains(resp, "Cancelled while queued") {
+			t.Errorf("queued push wasn't cancelled: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm list")
+		if strings.Contains(resp, fsname) {
+			t.Error("cancelled push reached the remote")
+		}
+
+		// and run straight away once there's no schedule
+		citools.RunOnNode(t, node2, "dm cluster schedule --clear")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "scheduled") {
+			t.Error("unable to find commit message remote's log output")
+		}
+	})
+	t.Run("ResumeInterruptedPush", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" dd if=/dev/urandom of=/foo/big bs=1M count=20")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'big'")
+
+		// push slowly, and kill the receive on node1 part way through
+		citools.RunOnNode(t, node2,
+			"(dm push cluster_0 --limit 1M > /tmp/push-"+fsname+" 2>&1 &)")
+		citools.RunOnNode(t, node1, "for i in $(seq 30); do "+
+			"docker exec dotmesh-server-inner pgrep -f 'zfs recv -s' && break; sleep 1; done")
+		time.Sleep(5 * time.Second)
+		citools.RunOnNode(t, node1, "docker exec dotmesh-server-inner pkill -f 'zfs recv -s'")
+		citools.RunOnNode(t, node2, "for i in $(seq 60); do "+
+			"pgrep -f '[d]m push cluster_0' > /dev/null || break; sleep 1; done")
+
+		// pushing again picks up where it left off (unless it already has)
+		resp := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0")
+		resp += citools.OutputFromRunOnNode(t, node2, "cat /tmp/push-"+fsname)
+		if !strings.Contains(resp, "Resuming interrupted transfer") {
+			t.Errorf("interrupted push wasn't resumed: %s", resp)
+		}
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "big") {
+			t.Error("unable to find commit message remote's log output")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" stat -c %s /foo/big")
+		if !strings.Contains(resp, "20971520") {
+			t.Errorf("resumed push didn't send the whole file: %s", resp)
+		}
+	})
 	t.Run("DirtyDetected", func(t *testing.T) {
 		fsname := citools.UniqName()
 		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
@@ -1133,6 +1752,184 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 	})
 }
 
+func TestDirectoryBackend(t *testing.T) {
+	citools.TeardownFinishedTestRuns()
+
+	// as if on hosts which can't load ZFS
+	f := citools.Federation{
+		citools.NewClusterWithArgs(1, map[string]string{}, " --storage-backend directory"), // cluster_0_node_0
+		citools.NewClusterWithArgs(1, map[string]string{}, " --storage-backend directory"), // cluster_1_node_0
+	}
+	citools.StartTiming()
+	err := f.Start(t)
+	defer citools.TestMarkForCleanup(f)
+	if err != nil {
+		t.Error(err)
+	}
+	node1 := f[0].GetNode(0).Container
+	node2 := f[1].GetNode(0).Container
+
+	t.Run("InitCommitBranchPush", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, "dm init "+fsname)
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo hello > /foo/X'")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "hello") {
+			t.Error("unable to find commit message remote's log output")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/X")
+		if !strings.Contains(resp, "hello") {
+			t.Error("pushed file isn't on the remote")
+		}
+
+		// incremental push
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node2, "dm commit -m 'again'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "again") {
+			t.Error("unable to find commit message remote's log output")
+		}
+
+		// a branch, and rolling back on it
+		citools.RunOnNode(t, node2, "dm checkout -b newbranch")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Z")
+		citools.RunOnNode(t, node2, "dm commit -m 'branchy'")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/uncommitted")
+		citools.RunOnNode(t, node2, "dm reset --hard HEAD")
+		resp = citools.OutputFromRunOnNode(t, node2, citools.DockerRun(fsname)+" ls /foo/")
+		if strings.Contains(resp, "uncommitted") {
+			t.Error("reset didn't throw away uncommitted changes")
+		}
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		citools.RunOnNode(t, node1, "dm checkout newbranch")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "branchy") {
+			t.Error("unable to find commit message remote's log output")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" ls /foo/")
+		if !strings.Contains(resp, "Z") {
+			t.Error("pushed branch doesn't have the file committed on it")
+		}
+		citools.RunOnNode(t, node1, "dm checkout master")
+	})
+
+	t.Run("DirtyImmediate", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		// uncommitted changes on the remote aren't overwritten
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo precious > /foo/Y'")
+		citools.RunOnNode(t, node2, "dm commit -m 'again'")
+		result := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 || true") // an error code is ok
+		if !strings.Contains(result, "has been modified") {
+			t.Error("pushing didn't fail when there were uncommitted changes on the peer")
+		}
+		resp := citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/Y")
+		if !strings.Contains(resp, "precious") {
+			t.Error("uncommitted changes on the peer were thrown away")
+		}
+	})
+}
+
+func TestS3Remote(t *testing.T) {
+	citools.TeardownFinishedTestRuns()
+
+	f := citools.Federation{
+		citools.NewCluster(1), // cluster_0_node_0
+		citools.NewCluster(1), // cluster_1_node_0
+	}
+	citools.StartTiming()
+	err := f.Start(t)
+	defer citools.TestMarkForCleanup(f)
+	if err != nil {
+		t.Error(err)
+	}
+	node1 := f[0].GetNode(0).Container
+	node2 := f[1].GetNode(0).Container
+
+	// a MinIO on node1 stands in for S3, both clusters use it
+	citools.RunOnNode(t, node1, "docker run -d --name minio -p 9000:9000 "+
+		"-e MINIO_ACCESS_KEY=dotmesh -e MINIO_SECRET_KEY=dotmesh-s3-secret "+
+		"--entrypoint sh minio/minio -c 'mkdir -p /data/dots && minio server /data'")
+	citools.RunOnNode(t, node1, "for i in $(seq 30); do "+
+		"curl -s http://localhost:9000/minio/health/live && break; sleep 1; done")
+	addRemote := "AWS_ACCESS_KEY_ID=dotmesh AWS_SECRET_ACCESS_KEY=dotmesh-s3-secret " +
+		"dm remote add bucket s3://dots/backups --endpoint http://" + f[0].GetNode(0).IP + ":9000"
+	citools.RunOnNode(t, node1, addRemote)
+	citools.RunOnNode(t, node2, addRemote)
+
+	t.Run("PushPullIncremental", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node1, "dm push bucket")
+
+		citools.RunOnNode(t, node2, "dm clone bucket "+fsname)
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "hello") {
+			t.Error("unable to find commit message in log output of clone from S3")
+		}
+
+		// only the new commit's stream should be uploaded
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node1, "dm commit -m 'again'")
+		citools.RunOnNode(t, node1, "dm push bucket")
+		resp = citools.OutputFromRunOnNode(t, node1,
+			"docker exec minio find /data/dots/backups/admin/"+fsname+"/streams -type f | wc -l")
+		if strings.TrimSpace(resp) != "2" {
+			t.Errorf("expected one stream per commit in S3, got %s", resp)
+		}
+
+		citools.RunOnNode(t, node2, "dm pull bucket "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "again") {
+			t.Error("unable to find incremental commit in log output after pull from S3")
+		}
+		resp = citools.OutputFromRunOnNode(t, node2, citools.DockerRun(fsname)+" ls /foo/")
+		if !strings.Contains(resp, "Y") {
+			t.Error("pulled dot doesn't have the incremental commit's file")
+		}
+
+		// and pushing it back is a no-op
+		citools.RunOnNode(t, node2, "dm push bucket "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1,
+			"docker exec minio find /data/dots/backups/admin/"+fsname+"/streams -type f | wc -l")
+		if strings.TrimSpace(resp) != "2" {
+			t.Errorf("pushing an up-to-date dot to S3 uploaded something, got %s streams", resp)
+		}
+	})
+
+	t.Run("PushPullBranch", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'master'")
+		citools.RunOnNode(t, node1, "dm checkout -b newbranch")
+		citools.RunOnNode(t, node1, "dm commit -m 'branchy'")
+		citools.RunOnNode(t, node1, "dm push bucket")
+
+		citools.RunOnNode(t, node2, "dm clone bucket "+fsname+" newbranch")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm checkout newbranch")
+		resp := citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "branchy") {
+			t.Error("unable to find branch commit in log output of clone from S3")
+		}
+	})
+}
+
 func TestThreeSingleNodeClusters(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 
@@ -1423,6 +2220,107 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 		}
 	})
 
+	t.Run("Organizations", func(t *testing.T) {
+		fsname := citools.UniqName()
+		org := "org" + fsname
+
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_"+fsname+" alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm org create "+org)
+		citools.RunOnNode(t, aliceNode.Container, "dm org add-member "+org+" bob --role=reader")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+
+		// alice owns the organization, so can create dots in it
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun(fsname)+" touch /foo/alice")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch "+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push common_"+fsname+" --remote-name "+org+"/"+fsname)
+
+		// bob can see it, but not delete it
+		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add common_"+fsname+" bob@"+commonNode.IP)
+		citools.RunOnNode(t, bobNode.Container, "dm remote switch common_"+fsname)
+		resp := citools.OutputFromRunOnNode(t, bobNode.Container, "dm list -H | cut -f 1")
+		if !strings.Contains(resp, org+"/"+fsname) {
+			t.Errorf("bob can't see his organization's dot: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container, "dm org list")
+		if !strings.Contains(resp, "reader") {
+			t.Errorf("bob isn't listed as a reader: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container, "if dm dot delete -f "+org+"/"+fsname+"; then false; else true; fi")
+		if !strings.Contains(resp, "You are not the owner") {
+			t.Error("a reader was able to delete the organization's dot")
+		}
+
+		// ...until he's an admin of the organization
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm org add-member "+org+" bob --role=admin")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+		citools.RunOnNode(t, bobNode.Container, "dm dot delete -f "+org+"/"+fsname)
+		citools.RunOnNode(t, bobNode.Container, "dm remote switch local")
+	})
+
+	t.Run("OrganizationNamedAfterNamespace", func(t *testing.T) {
+		fsname := citools.UniqName()
+		namespace := "unowned" + fsname
+
+		// the admin puts a dot in a namespace nobody owns
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun(fsname)+" touch /foo/admin")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch "+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Admin commits'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push cluster_0 --remote-name "+namespace+"/"+fsname)
+
+		// which alice can't take over by making an organization of that name
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_"+fsname+" alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		resp := citools.OutputFromRunOnNode(t, aliceNode.Container, "if dm org create "+namespace+"; then false; else true; fi")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+		if !strings.Contains(resp, "Name already exists") {
+			t.Errorf("alice made an organization named after a namespace with dots in it: %s", resp)
+		}
+	})
+
+	t.Run("CollaboratorRoles", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_"+fsname+" alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun(fsname)+" touch /foo/alice")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch "+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm dot share "+fsname+" bob --role=reader")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+
+		// bob can pull it, but not push to it
+		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add common_"+fsname+" bob@"+commonNode.IP)
+		citools.RunOnNode(t, bobNode.Container, "dm clone common_"+fsname+" alice/"+fsname+" --local-name="+fsname)
+		citools.RunOnNode(t, bobNode.Container, citools.DockerRun(fsname)+" touch /foo/bob")
+		citools.RunOnNode(t, bobNode.Container, "dm switch "+fsname)
+		citools.RunOnNode(t, bobNode.Container, "dm commit -m'Bob commits'")
+		resp := citools.OutputFromRunOnNode(t, bobNode.Container,
+			"if dm push common_"+fsname+" "+fsname+" --remote-name alice/"+fsname+"; then false; else true; fi")
+		if !strings.Contains(resp, "permission") {
+			t.Errorf("a reader was able to push: %s", resp)
+		}
+
+		// ...until he's a writer
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm dot share "+fsname+" bob --role=writer")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+		citools.RunOnNode(t, bobNode.Container, "dm push common_"+fsname+" "+fsname+" --remote-name alice/"+fsname)
+
+		// and once it's unshared, he can't see it at all
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_"+fsname)
+		citools.RunOnNode(t, aliceNode.Container, "dm dot unshare "+fsname+" bob")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+		citools.RunOnNode(t, bobNode.Container, "dm remote switch common_"+fsname)
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container, "dm list -H | cut -f 1")
+		if strings.Contains(resp, fsname) {
+			t.Errorf("bob can still see a dot which isn't shared with him: %s", resp)
+		}
+		citools.RunOnNode(t, bobNode.Container, "dm remote switch local")
+	})
+
 	// on alice's machine
 	// ------------------
 	// dm init foo